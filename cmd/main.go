@@ -16,11 +16,15 @@ import (
 	bucketcache "animakuro/cdn/pkg/cache/bucket"
 	filecache "animakuro/cdn/pkg/cache/file"
 	"animakuro/cdn/pkg/dealer"
+	"animakuro/cdn/pkg/ffmpeg"
+	"animakuro/cdn/pkg/hls"
 	"animakuro/cdn/pkg/http"
 	"animakuro/cdn/pkg/logging"
 	"animakuro/cdn/pkg/metrics"
 	"animakuro/cdn/pkg/middleware"
 	"animakuro/cdn/pkg/mongodb"
+	"animakuro/cdn/pkg/pool"
+	"animakuro/cdn/pkg/precompress"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
@@ -69,15 +73,39 @@ func main() {
 
 	bucketCache := bucketcache.NewBucketCache()
 	fileCache := filecache.NewFileCache(logger, cfg.FileCacheConfig)
-	middlewares := middleware.NewMiddlewares(logger, bucketCache)
-	moduleController := modules.NewController(logger)
+	middlewares := middleware.NewMiddlewares(logger, bucketCache, cfg.AuthConfig.AdminKey)
 
 	// Worker pool for IO operations
 	jobDealer := dealer.New(logger, cfg.MaxWorkers)
 	jobDealer.WithStrategy(dealer.WorkerPool)
 
+	// Worker pool for CPU-bound operations (resolvers)
+	processingPool := pool.New(cfg.ProcessingConfig.Workers, cfg.ProcessingConfig.QueueSize, cfg.ProcessingConfig.BucketQueueSize)
+	metrics.RegisterProcessingQueue(func() float64 {
+		return float64(processingPool.Queued())
+	})
+
 	repo := cdn.NewRepository(logger, cfg.DBName, mng.Client())
 	service := cdn.NewService(logger, repo, bucketCache, fileCache, cfg.Domain, jobDealer)
+
+	// Service is used by modules to read files stored in CDN (e.g. watermarks)
+	moduleController := modules.NewController(logger, cfg.ModulesConfig, service)
+
+	// Buckets can't package videos into HLS without ffmpeg
+	var packager *hls.Packager
+	if runner, err := ffmpeg.New(cfg.ModulesConfig.FFmpeg.Path); err == nil {
+		packager = hls.New(runner, cfg.ModulesConfig.Video.HLSSegmentDuration)
+	}
+
+	// Worker pool for HLS packaging, long jobs don't take workers of resolvers
+	packagingPool := pool.New(cfg.ModulesConfig.Video.HLSWorkers, cfg.ModulesConfig.Video.HLSQueueSize, cfg.ModulesConfig.Video.HLSQueueSize)
+
+	// Text is precompressed with gzip only without brotli
+	compressor := precompress.New(cfg.ModulesConfig.Text.BrotliPath)
+	if len(compressor.Encodings()) == 1 {
+		logger.Warnf("brotli is not found: %s. Files are precompressed with gzip only", cfg.ModulesConfig.Text.BrotliPath)
+	}
+
 	handler := cdn.NewHandler(&cdn.HandlerDeps{
 		Logger:           logger,
 		Mux:              router,
@@ -87,6 +115,13 @@ func main() {
 		BucketCache:      bucketCache,
 		FileCache:        fileCache,
 		MemConfig:        cfg.MemoryConfig,
+		Dealer:           jobDealer,
+		Processing:       processingPool,
+		ProcessingConfig: cfg.ProcessingConfig,
+		Packager:         packager,
+		Packaging:        packagingPool,
+		VideoConfig:      cfg.ModulesConfig.Video,
+		Compressor:       compressor,
 	})
 
 	err = service.InitBuckets(ctx)
@@ -99,11 +134,17 @@ func main() {
 		logger.Fatalf("could not start fileCache: %s", err.Error())
 	}
 
+	// Applies lifecycle rules of buckets cached by InitBuckets
+	lifecycle := cdn.NewLifecycle(logger, service, bucketCache, cfg.LifecycleConfig)
+
 	handler.InitRoutes()
 	metrics.StartRecordingMetrics(router)
 
 	// Init worker pool and job pool
 	jobDealer.Start()
+	processingPool.Start()
+	packagingPool.Start()
+	lifecycle.Start()
 
 	// Graceful shutdown
 	shutdown := make(chan os.Signal)
@@ -129,6 +170,10 @@ func main() {
 	}
 	logger.Debug("server has shutdown")
 
+	// Lifecycle needs mongo and jobDealer to finish the pass in progress
+	lifecycle.Stop()
+	logger.Debugf("lifecycle has stopped")
+
 	if err := mng.CloseConnection(gctx); err != nil {
 		logger.Errorf("mongo could not close connection. %s", err.Error())
 	}
@@ -137,8 +182,18 @@ func main() {
 	fileCache.Stop()
 	logger.Debugf("fileCache has stopped")
 
+	// Pending renders save files through jobDealer, so stop it first
+	processingPool.Stop()
+	logger.Debugf("processingPool has stopped")
+
+	packagingPool.Stop()
+	logger.Debugf("packagingPool has stopped")
+
 	jobDealer.Stop()
 	logger.Debugf("jobDealer has stopped")
+
+	moduleController.Close()
+	logger.Debugf("plugins have stopped")
 }
 
 func parseFlags() (bool, bool, string, string, string) {
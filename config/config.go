@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"runtime"
+	"time"
 
 	filecache "animakuro/cdn/pkg/cache/file"
 
@@ -18,16 +20,154 @@ type MemoryConfig struct {
 	MaxUploadSize int64 // Represents megabytes 10^6 byte
 }
 
+// Image limits used if config doesn't set them
+const (
+	DefaultMaxInputPixels     = 50_000_000
+	DefaultMaxOutputDimension = 8192
+	DefaultMaxFrames          = 500
+	DefaultImageRenderTimeout = time.Second * 30
+)
+
+type ImageConfig struct {
+	// Bucket which image.watermark overlays are read from.
+	// Empty value disables the resolver
+	WatermarkBucket string
+	// Max width * height of an image being processed or uploaded
+	MaxInputPixels int
+	// Max width or height of a processed image
+	MaxOutputDimension int
+	// Max frames of an animated image being processed or uploaded
+	MaxFrames int
+	// Max time resolvers of a single request may take
+	RenderTimeout time.Duration
+	// Whether tiny base64 placeholder is computed at upload along with BlurHash
+	LQIP bool
+}
+
+type VideoConfig struct {
+	// Max time resolvers of a single request may take
+	RenderTimeout time.Duration
+	// Seconds of a single HLS segment
+	HLSSegmentDuration int
+	// Max time packaging of a single video into HLS may take
+	HLSTimeout time.Duration
+	// Videos packaged at once. Packaging has workers of its own, apart from processing ones
+	HLSWorkers int
+	// Max videos waiting to be packaged
+	HLSQueueSize int
+	// Lifetime of signed URIs of HLS playlists served from buckets with private get
+	HLSURLTTL time.Duration
+}
+
+type AudioConfig struct {
+	// Max time resolvers of a single request may take
+	RenderTimeout time.Duration
+}
+
+type DocumentConfig struct {
+	// Paths to poppler binaries. Module is not registered if they're not found
+	PdftoppmPath string
+	PdfinfoPath  string
+	// Max time resolvers of a single request may take
+	RenderTimeout time.Duration
+}
+
+type TextConfig struct {
+	// Path to brotli binary. Text is precompressed with gzip only if it's not found
+	BrotliPath string
+	// Max time resolvers of a single request may take
+	RenderTimeout time.Duration
+}
+
+// PluginConfig describes module served by external process (see pkg/plugin)
+type PluginConfig struct {
+	// Path to plugin binary and its arguments
+	Path string
+	Args []string
+	// Max time a single render may take
+	RenderTimeout time.Duration
+	// Max time plugin may take to start and describe itself
+	StartTimeout time.Duration
+}
+
+// WasmConfig describes resolvers done by WebAssembly transforms (see pkg/wasm)
+type WasmConfig struct {
+	// Limits of a single run of transform
+	MaxMemory int64 // Represents bytes
+	Timeout   time.Duration
+	Resolvers []*WasmResolverConfig
+}
+
+type WasmResolverConfig struct {
+	// Module resolver is added to and its name
+	Module string
+	Name   string
+	// Path to .wasm file
+	Path string
+	// Type of argument: int, float, bool or string
+	Argument string
+	// Arguments string resolver accepts
+	Arguments []string
+	// Argument meaning the resolver does nothing
+	Default string
+}
+
+type FFmpegConfig struct {
+	// Path to ffmpeg binary. Resolvers depending on it
+	// are not registered if it's not found
+	Path string
+}
+
+// ModulesConfig is passed to modules controller. Every module takes its part
+type ModulesConfig struct {
+	Image    *ImageConfig
+	Video    *VideoConfig
+	Audio    *AudioConfig
+	Document *DocumentConfig
+	Text     *TextConfig
+	FFmpeg   *FFmpegConfig
+	Wasm     *WasmConfig
+	Plugins  []*PluginConfig
+}
+
+type ProcessingConfig struct {
+	// Number of resolvers (CPU-bound work) running at one time
+	Workers int
+	// Max renders waiting for a worker
+	QueueSize int
+	// Max renders of a single bucket waiting for a worker
+	BucketQueueSize int
+	// Seconds client is told to wait (Retry-After) when queue is full
+	RetryAfter int
+}
+
+type LifecycleConfig struct {
+	// How often lifecycle rules of buckets are applied
+	Interval time.Duration
+	// Max files fetched from database at once
+	BatchSize int
+}
+
+type AuthConfig struct {
+	// Key admin tokens are signed with. Admins may delete files of any bucket at once.
+	// Empty value disables admin tokens
+	AdminKey string
+}
+
 type AppConfig struct {
-	MongoURI        string
-	DBName          string
-	AppPort         string
-	AppHost         string
-	Debug           bool
-	Domain          string
-	MaxWorkers      int
-	MemoryConfig    *MemoryConfig
-	FileCacheConfig *filecache.Config
+	MongoURI         string
+	DBName           string
+	AppPort          string
+	AppHost          string
+	Debug            bool
+	Domain           string
+	MaxWorkers       int
+	MemoryConfig     *MemoryConfig
+	ModulesConfig    *ModulesConfig
+	ProcessingConfig *ProcessingConfig
+	LifecycleConfig  *LifecycleConfig
+	AuthConfig       *AuthConfig
+	FileCacheConfig  *filecache.Config
 }
 
 func GetAppConfig(path string, debug bool) (*AppConfig, error) {
@@ -72,6 +212,9 @@ func GetAppConfig(path string, debug bool) (*AppConfig, error) {
 		return nil, fmt.Errorf("missing DOMAIN env")
 	}
 
+	// Optional
+	adminKey := os.Getenv("ADMIN_KEY")
+
 	cacheMaxMem := viper.GetInt64("cache.max_memory")
 	if cacheMaxMem == 0 {
 		return nil, fmt.Errorf("missing cache.max_memory in config")
@@ -112,6 +255,160 @@ func GetAppConfig(path string, debug bool) (*AppConfig, error) {
 		return nil, fmt.Errorf("missing cdn.io_workers in config")
 	}
 
+	// Optional
+	watermarkBucket := viper.GetString("modules.image.watermark_bucket")
+
+	// Optional. Image limits
+	maxInputPixels := viper.GetInt("modules.image.max_input_pixels")
+	if maxInputPixels == 0 {
+		maxInputPixels = DefaultMaxInputPixels
+	}
+
+	maxOutputDimension := viper.GetInt("modules.image.max_output_dimension")
+	if maxOutputDimension == 0 {
+		maxOutputDimension = DefaultMaxOutputDimension
+	}
+
+	maxFrames := viper.GetInt("modules.image.max_frames")
+	if maxFrames == 0 {
+		maxFrames = DefaultMaxFrames
+	}
+
+	renderTimeout := time.Duration(viper.GetInt("modules.image.render_timeout")) * time.Second
+	if renderTimeout == 0 {
+		renderTimeout = DefaultImageRenderTimeout
+	}
+
+	// Optional
+	lqip := viper.GetBool("modules.image.lqip")
+
+	videoRenderTimeout := viper.GetInt("modules.video.render_timeout")
+	if videoRenderTimeout == 0 {
+		videoRenderTimeout = 120
+	}
+
+	hlsSegmentDuration := viper.GetInt("modules.video.hls_segment_duration")
+	if hlsSegmentDuration == 0 {
+		hlsSegmentDuration = 6
+	}
+
+	hlsTimeout := viper.GetInt("modules.video.hls_timeout")
+	if hlsTimeout == 0 {
+		hlsTimeout = 1800
+	}
+
+	hlsWorkers := viper.GetInt("modules.video.hls_workers")
+	if hlsWorkers == 0 {
+		hlsWorkers = 1
+	}
+
+	hlsQueueSize := viper.GetInt("modules.video.hls_queue_size")
+	if hlsQueueSize == 0 {
+		hlsQueueSize = 100
+	}
+
+	hlsURLTTL := viper.GetInt("modules.video.hls_url_ttl")
+	if hlsURLTTL == 0 {
+		hlsURLTTL = 14400
+	}
+
+	audioRenderTimeout := viper.GetInt("modules.audio.render_timeout")
+	if audioRenderTimeout == 0 {
+		audioRenderTimeout = 60
+	}
+
+	// Optional
+	pdftoppmPath := viper.GetString("modules.document.pdftoppm_path")
+	if pdftoppmPath == "" {
+		pdftoppmPath = "pdftoppm"
+	}
+
+	// Optional
+	pdfinfoPath := viper.GetString("modules.document.pdfinfo_path")
+	if pdfinfoPath == "" {
+		pdfinfoPath = "pdfinfo"
+	}
+
+	documentRenderTimeout := viper.GetInt("modules.document.render_timeout")
+	if documentRenderTimeout == 0 {
+		documentRenderTimeout = 60
+	}
+
+	// Optional
+	brotliPath := viper.GetString("modules.text.brotli_path")
+	if brotliPath == "" {
+		brotliPath = "brotli"
+	}
+
+	textRenderTimeout := viper.GetInt("modules.text.render_timeout")
+	if textRenderTimeout == 0 {
+		textRenderTimeout = 10
+	}
+
+	// Optional
+	ffmpegPath := viper.GetString("modules.ffmpeg.path")
+	if ffmpegPath == "" {
+		ffmpegPath = "ffmpeg"
+	}
+
+	wasmMaxMemory := viper.GetInt64("modules.wasm.max_memory")
+	if wasmMaxMemory == 0 {
+		wasmMaxMemory = 64
+	}
+
+	wasmTimeout := viper.GetInt("modules.wasm.timeout")
+	if wasmTimeout == 0 {
+		wasmTimeout = 10
+	}
+
+	// Optional
+	wasmResolvers, err := wasmResolversConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// Optional
+	plugins, err := pluginsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// Optional. Defaults to number of CPUs
+	processingWorkers := viper.GetInt("cdn.processing.workers")
+	if processingWorkers == 0 {
+		processingWorkers = runtime.NumCPU()
+	}
+
+	// Optional
+	processingQueueSize := viper.GetInt("cdn.processing.queue_size")
+	if processingQueueSize == 0 {
+		processingQueueSize = processingWorkers * 16
+	}
+
+	// Optional. Defaults to quarter of the queue
+	processingBucketQueueSize := viper.GetInt("cdn.processing.bucket_queue_size")
+	if processingBucketQueueSize == 0 {
+		processingBucketQueueSize = processingQueueSize/4 + 1
+	}
+
+	// Optional
+	processingRetryAfter := viper.GetInt("cdn.processing.retry_after")
+	if processingRetryAfter == 0 {
+		processingRetryAfter = 1
+	}
+
+	// Optional
+	lifecycleInterval := viper.GetInt("cdn.lifecycle.interval")
+	if lifecycleInterval == 0 {
+		lifecycleInterval = 60
+	}
+
+	// Optional
+	lifecycleBatchSize := viper.GetInt("cdn.lifecycle.batch_size")
+	if lifecycleBatchSize == 0 {
+		lifecycleBatchSize = 500
+	}
+
 	return &AppConfig{
 		MongoURI:   mongoURI,
 		AppPort:    appPort,
@@ -123,6 +420,58 @@ func GetAppConfig(path string, debug bool) (*AppConfig, error) {
 		MemoryConfig: &MemoryConfig{
 			MaxUploadSize: uploadMaxMem,
 		},
+		ModulesConfig: &ModulesConfig{
+			Image: &ImageConfig{
+				WatermarkBucket:    watermarkBucket,
+				MaxInputPixels:     maxInputPixels,
+				MaxOutputDimension: maxOutputDimension,
+				MaxFrames:          maxFrames,
+				RenderTimeout:      renderTimeout,
+				LQIP:               lqip,
+			},
+			Video: &VideoConfig{
+				RenderTimeout:      time.Duration(videoRenderTimeout) * time.Second,
+				HLSSegmentDuration: hlsSegmentDuration,
+				HLSTimeout:         time.Duration(hlsTimeout) * time.Second,
+				HLSWorkers:         hlsWorkers,
+				HLSQueueSize:       hlsQueueSize,
+				HLSURLTTL:          time.Duration(hlsURLTTL) * time.Second,
+			},
+			Audio: &AudioConfig{
+				RenderTimeout: time.Duration(audioRenderTimeout) * time.Second,
+			},
+			Document: &DocumentConfig{
+				PdftoppmPath:  pdftoppmPath,
+				PdfinfoPath:   pdfinfoPath,
+				RenderTimeout: time.Duration(documentRenderTimeout) * time.Second,
+			},
+			Text: &TextConfig{
+				BrotliPath:    brotliPath,
+				RenderTimeout: time.Duration(textRenderTimeout) * time.Second,
+			},
+			FFmpeg: &FFmpegConfig{
+				Path: ffmpegPath,
+			},
+			Wasm: &WasmConfig{
+				MaxMemory: wasmMaxMemory * 1_000_000,
+				Timeout:   time.Duration(wasmTimeout) * time.Second,
+				Resolvers: wasmResolvers,
+			},
+			Plugins: plugins,
+		},
+		ProcessingConfig: &ProcessingConfig{
+			Workers:         processingWorkers,
+			QueueSize:       processingQueueSize,
+			BucketQueueSize: processingBucketQueueSize,
+			RetryAfter:      processingRetryAfter,
+		},
+		LifecycleConfig: &LifecycleConfig{
+			Interval:  time.Duration(lifecycleInterval) * time.Minute,
+			BatchSize: lifecycleBatchSize,
+		},
+		AuthConfig: &AuthConfig{
+			AdminKey: adminKey,
+		},
 		FileCacheConfig: &filecache.Config{
 			MaxCacheSize:   cacheMaxMem,
 			MaxCacheItems:  cacheMaxItems,
@@ -134,3 +483,73 @@ func GetAppConfig(path string, debug bool) (*AppConfig, error) {
 	}, nil
 
 }
+
+// pluginsConfig reads modules.plugins list
+func pluginsConfig() ([]*PluginConfig, error) {
+	var raw []struct {
+		Path          string   `mapstructure:"path"`
+		Args          []string `mapstructure:"args"`
+		RenderTimeout int      `mapstructure:"render_timeout"`
+		StartTimeout  int      `mapstructure:"start_timeout"`
+	}
+	if err := viper.UnmarshalKey("modules.plugins", &raw); err != nil {
+		return nil, fmt.Errorf("invalid modules.plugins in config: %w", err)
+	}
+
+	plugins := make([]*PluginConfig, 0, len(raw))
+	for i, p := range raw {
+		if p.Path == "" {
+			return nil, fmt.Errorf("missing modules.plugins[%d].path in config", i)
+		}
+
+		if p.RenderTimeout == 0 {
+			p.RenderTimeout = 30
+		}
+
+		if p.StartTimeout == 0 {
+			p.StartTimeout = 5
+		}
+
+		plugins = append(plugins, &PluginConfig{
+			Path:          p.Path,
+			Args:          p.Args,
+			RenderTimeout: time.Duration(p.RenderTimeout) * time.Second,
+			StartTimeout:  time.Duration(p.StartTimeout) * time.Second,
+		})
+	}
+
+	return plugins, nil
+}
+
+// wasmResolversConfig reads modules.wasm.resolvers list
+func wasmResolversConfig() ([]*WasmResolverConfig, error) {
+	var raw []struct {
+		Module    string   `mapstructure:"module"`
+		Name      string   `mapstructure:"name"`
+		Path      string   `mapstructure:"path"`
+		Argument  string   `mapstructure:"argument"`
+		Arguments []string `mapstructure:"arguments"`
+		Default   string   `mapstructure:"default"`
+	}
+	if err := viper.UnmarshalKey("modules.wasm.resolvers", &raw); err != nil {
+		return nil, fmt.Errorf("invalid modules.wasm.resolvers in config: %w", err)
+	}
+
+	resolvers := make([]*WasmResolverConfig, 0, len(raw))
+	for i, r := range raw {
+		if r.Module == "" || r.Name == "" || r.Path == "" {
+			return nil, fmt.Errorf("missing module, name or path of modules.wasm.resolvers[%d] in config", i)
+		}
+
+		resolvers = append(resolvers, &WasmResolverConfig{
+			Module:    r.Module,
+			Name:      r.Name,
+			Path:      r.Path,
+			Argument:  r.Argument,
+			Arguments: r.Arguments,
+			Default:   r.Default,
+		})
+	}
+
+	return resolvers, nil
+}
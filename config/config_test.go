@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -15,6 +16,7 @@ func TestGetAppConfig(t *testing.T) {
 	os.Setenv("APP_HOST", "localhost")
 	os.Setenv("MONGO_DB_NAME", "dbname")
 	os.Setenv("DOMAIN", "mock_domain")
+	os.Setenv("ADMIN_KEY", "mock_admin_key")
 
 	cfg, err := GetAppConfig("./testdata/config.yaml", true)
 	require.NoError(t, err)
@@ -26,6 +28,7 @@ func TestGetAppConfig(t *testing.T) {
 	require.Equal(t, "dbname", cfg.DBName)
 	require.Equal(t, true, cfg.Debug)
 	require.Equal(t, "mock_domain", cfg.Domain)
+	require.Equal(t, "mock_admin_key", cfg.AuthConfig.AdminKey)
 
 	//cfg file
 	require.Equal(t, int64(128), cfg.MemoryConfig.MaxUploadSize)
@@ -36,5 +39,49 @@ func TestGetAppConfig(t *testing.T) {
 	require.Equal(t, int64(512), cfg.FileCacheConfig.MaxCacheSize)
 	require.Equal(t, 128, cfg.FileCacheConfig.MaxCacheItems)
 	require.Equal(t, 120, cfg.FileCacheConfig.FlushEvery)
+	require.Equal(t, "watermarks", cfg.ModulesConfig.Image.WatermarkBucket)
+	require.Equal(t, 1000000, cfg.ModulesConfig.Image.MaxInputPixels)
+	require.Equal(t, 4096, cfg.ModulesConfig.Image.MaxOutputDimension)
+	// Default
+	require.Equal(t, 500, cfg.ModulesConfig.Image.MaxFrames)
+	require.Equal(t, time.Second*10, cfg.ModulesConfig.Image.RenderTimeout)
+	require.True(t, cfg.ModulesConfig.Image.LQIP)
+	require.Equal(t, "/usr/bin/ffmpeg", cfg.ModulesConfig.FFmpeg.Path)
+	require.Equal(t, time.Minute, cfg.ModulesConfig.Video.RenderTimeout)
+	require.Equal(t, 4, cfg.ModulesConfig.Video.HLSSegmentDuration)
+	require.Equal(t, time.Minute*10, cfg.ModulesConfig.Video.HLSTimeout)
+	require.Equal(t, 2, cfg.ModulesConfig.Video.HLSWorkers)
+	require.Equal(t, 100, cfg.ModulesConfig.Video.HLSQueueSize)
+	require.Equal(t, time.Hour, cfg.ModulesConfig.Video.HLSURLTTL)
+	require.Equal(t, time.Second*30, cfg.ModulesConfig.Audio.RenderTimeout)
+	require.Equal(t, "/usr/bin/pdftoppm", cfg.ModulesConfig.Document.PdftoppmPath)
+	require.Equal(t, "pdfinfo", cfg.ModulesConfig.Document.PdfinfoPath)
+	require.Equal(t, time.Second*45, cfg.ModulesConfig.Document.RenderTimeout)
+	require.Equal(t, "/usr/bin/brotli", cfg.ModulesConfig.Text.BrotliPath)
+	// Default
+	require.Equal(t, time.Second*10, cfg.ModulesConfig.Text.RenderTimeout)
+	require.Equal(t, int64(16_000_000), cfg.ModulesConfig.Wasm.MaxMemory)
+	require.Equal(t, time.Second*2, cfg.ModulesConfig.Wasm.Timeout)
+	require.Equal(t, []*WasmResolverConfig{{
+		Module:   "image",
+		Name:     "palette",
+		Path:     "/usr/lib/cdn/palette.wasm",
+		Argument: "int",
+		Default:  "0",
+	}}, cfg.ModulesConfig.Wasm.Resolvers)
+	require.Equal(t, []*PluginConfig{{
+		Path:          "/usr/lib/cdn/upscale",
+		Args:          []string{"--model", "x4"},
+		RenderTimeout: time.Minute,
+		// Default
+		StartTimeout: time.Second * 5,
+	}}, cfg.ModulesConfig.Plugins)
+	require.Equal(t, 4, cfg.ProcessingConfig.Workers)
+	require.Equal(t, 64, cfg.ProcessingConfig.QueueSize)
+	require.Equal(t, 16, cfg.ProcessingConfig.BucketQueueSize)
+	require.Equal(t, 2, cfg.ProcessingConfig.RetryAfter)
+	require.Equal(t, time.Minute*15, cfg.LifecycleConfig.Interval)
+	// Default
+	require.Equal(t, 500, cfg.LifecycleConfig.BatchSize)
 
 }
@@ -3,7 +3,17 @@ package cdn_go
 const (
 	BucketKey            = "bucket"
 	FileUUIDKey          = "fileUUID"
+	HLSPathKey           = "hlsPath"
 	URLAuthKey           = "auth"
+	URLPresetKey         = "preset"
+	URLVersionKey        = "version"
+	VersionKey           = "version"
+	URLDestinationKey    = "to"
+	TransferKey          = "transfer"
+	TransferCopy         = "copy"
+	TransferMove         = "move"
+	DestinationAuthKey   = "Destination-Authorization"
+	AliasKey             = "alias"
 	OperationGet         = "get"
 	OperationPost        = "post"
 	OperationDelete      = "delete"
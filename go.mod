@@ -16,6 +16,7 @@ require (
 	github.com/prometheus/client_golang v1.14.0
 	github.com/spf13/viper v1.13.0
 	github.com/stretchr/testify v1.8.1
+	github.com/tetratelabs/wazero v1.0.1
 	go.mongodb.org/mongo-driver v1.10.2
 	go.uber.org/zap v1.23.0
 )
@@ -40,20 +40,24 @@ func ParseToken(operation string, url *url.URL, tokenSource string) ([]byte, err
 
 	} else {
 		// tokenSource could be an authorization header
-		if tokenSource == "" {
-			return nil, ErrMissingAuthHeader
+		return ParseHeader(tokenSource)
+	}
 
-		}
+	return token, nil
+}
 
-		splitBySpace := strings.Split(tokenSource, " ")
-		if len(splitBySpace) == 1 {
-			return nil, ErrInvalidAuthHeader
-		}
+// ParseHeader parses a []byte token from authorization header (Bearer {token})
+func ParseHeader(header string) ([]byte, error) {
+	if header == "" {
+		return nil, ErrMissingAuthHeader
+	}
 
-		token = []byte(splitBySpace[1])
+	splitBySpace := strings.Split(header, " ")
+	if len(splitBySpace) == 1 {
+		return nil, ErrInvalidAuthHeader
 	}
 
-	return token, nil
+	return []byte(splitBySpace[1]), nil
 }
 
 func ValidateToken(token []byte, keys []string, wanted *Claims) (bool, error) {
@@ -0,0 +1,229 @@
+package cdn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+
+	cdn_go "animakuro/cdn"
+	"animakuro/cdn/internal/auth"
+	"animakuro/cdn/internal/cdn/cdnutil"
+	"animakuro/cdn/internal/cdn/dto"
+	cdn_errors "animakuro/cdn/internal/cdn/errors"
+	cdnpath "animakuro/cdn/internal/cdn/path"
+	"animakuro/cdn/internal/entities"
+	"animakuro/cdn/internal/formdata"
+	"animakuro/cdn/pkg/http/response"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const maxAliasLength = 255
+
+// Segment of alias path, e.g. naruto-s1.jpg
+var aliasSegment = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Segments routed to other handlers, alias can't contain them
+var reservedSegments = map[string]bool{
+	"hls":               true,
+	cdnpath.VersionsDir: true,
+	cdn_go.TransferCopy: true,
+	cdn_go.TransferMove: true,
+	cdn_go.AliasKey:     true,
+}
+
+// validateAlias checks that alias is a path of letters, digits, '.', '_' and '-'
+// which is not mistaken for UUID or other routes
+func validateAlias(alias string) error {
+	if alias == "" || len(alias) > maxAliasLength {
+		return entities.ErrInvalidAlias
+	}
+
+	if _, err := uuid.Parse(alias); err == nil {
+		return entities.ErrInvalidAlias
+	}
+
+	for _, segment := range strings.Split(alias, "/") {
+		if !aliasSegment.MatchString(segment) || reservedSegments[segment] {
+			return entities.ErrInvalidAlias
+		}
+	}
+
+	return nil
+}
+
+// resolveAlias replaces alias of file requested by cdn_go.AliasKey or cdn_go.FileUUIDKey with its UUID,
+// so next (auth included) handles the file as if it's requested by UUID.
+// Aliases of bucket with private get are resolved only for requests carrying token, and unknown ones
+// are denied like unauthorized requests are, so that their existence isn't revealed
+func (h *Handler) resolveAlias(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		name, ok := vars[cdn_go.AliasKey]
+		if !ok {
+			name = vars[cdn_go.FileUUIDKey]
+		}
+
+		if _, err := uuid.Parse(name); err == nil {
+			next(w, r)
+			return
+		}
+
+		bucket := vars[cdn_go.BucketKey]
+		b, err := h.bc.Get(bucket)
+		if err != nil {
+			cdn_errors.ToHttp(h.logger, w, err)
+			return
+		}
+
+		notFound := entities.ErrFileNotFound
+		if !isPublic(b, cdn_go.OperationGet) {
+			notFound = auth.ErrAccessDenied
+
+			if _, err := auth.ParseToken(cdn_go.OperationGet, r.URL, ""); err != nil {
+				cdn_errors.ToHttp(h.logger, w, notFound)
+				return
+			}
+		}
+
+		// Never stored, so never found
+		if err := validateAlias(name); err != nil {
+			cdn_errors.ToHttp(h.logger, w, notFound)
+			return
+		}
+
+		id, err := h.service.ResolveAlias(r.Context(), bucket, name)
+		if errors.Is(err, entities.ErrFileNotFound) {
+			err = notFound
+		}
+		if err != nil {
+			cdn_errors.ToHttp(h.logger, w, err)
+			return
+		}
+
+		resolved := make(map[string]string, len(vars))
+		for k, v := range vars {
+			resolved[k] = v
+		}
+		delete(resolved, cdn_go.AliasKey)
+		resolved[cdn_go.FileUUIDKey] = id
+
+		next(w, mux.SetURLVars(r, resolved))
+	}
+}
+
+// isPublic tells whether operation on bucket requires no token
+func isPublic(b *entities.Bucket, operation string) bool {
+	for _, op := range b.Operations {
+		if op.Name == operation && op.Type == cdn_go.OperationTypePublic {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetAlias assigns alias to file replacing its current one. Empty alias removes it
+func (h *Handler) SetAlias(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	bucket := vars[cdn_go.BucketKey]
+	uuid := vars[cdn_go.FileUUIDKey]
+
+	var inp dto.AliasDto
+	if err := json.NewDecoder(r.Body).Decode(&inp); err != nil {
+		err = cdnutil.WrapInternal(err, "Handler.SetAlias.json.Decode")
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	if inp.Alias != "" {
+		if err := validateAlias(inp.Alias); err != nil {
+			cdn_errors.ToHttp(h.logger, w, err)
+			return
+		}
+	}
+
+	if _, err := h.bc.Get(bucket); err != nil {
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	if err := h.service.SetAliasDB(r.Context(), bucket, uuid, inp.Alias); err != nil {
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	response.Json(h.logger, w, http.StatusOK, response.JSON{
+		"id":    uuid,
+		"alias": inp.Alias,
+	})
+}
+
+// aliasUpload assigns alias passed along with uploaded file. Alias is of a single file only
+func (h *Handler) aliasUpload(r *http.Request, files []*formdata.UploadFile) error {
+	alias := r.PostFormValue(cdn_go.AliasKey)
+	if alias == "" {
+		return nil
+	}
+
+	if len(files) != 1 {
+		return entities.ErrSingleFileOnly
+	}
+
+	if err := validateAlias(alias); err != nil {
+		return err
+	}
+
+	files[0].Alias = alias
+	return nil
+}
+
+func (s *cdnService) ResolveAlias(ctx context.Context, bucket string, alias string) (string, error) {
+	if id, ok := s.aliases.Get(bucket, alias); ok {
+		return id, nil
+	}
+
+	f, err := s.repository.GetFileByAlias(ctx, bucket, alias)
+	if err != nil {
+		return "", cdnutil.WrapInternal(err, "cdnService.ResolveAlias.repository.GetFileByAlias")
+	}
+
+	// Deleted files lose their aliases, see repository.MarkAsDeletable
+	if f == nil || f.IsDeletable {
+		return "", entities.ErrFileNotFound
+	}
+
+	s.aliases.Add(bucket, alias, f.UUID)
+	return f.UUID, nil
+}
+
+func (s *cdnService) SetAliasDB(ctx context.Context, bucket string, uuid string, alias string) error {
+	f, err := s.repository.SetAlias(ctx, bucket, uuid, alias)
+	if errors.Is(err, entities.ErrAliasTaken) {
+		return err
+	}
+
+	if err != nil {
+		return cdnutil.WrapInternal(err, "cdnService.SetAliasDB.repository.SetAlias")
+	}
+
+	if f == nil {
+		return entities.ErrFileNotFound
+	}
+
+	// Prior alias resolves to nothing now, the new one could be cached as one of another file
+	if f.Alias != "" {
+		s.aliases.Remove(bucket, f.Alias)
+	}
+	if alias != "" {
+		s.aliases.Remove(bucket, alias)
+	}
+
+	return nil
+}
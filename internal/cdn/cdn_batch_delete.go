@@ -0,0 +1,155 @@
+package cdn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	cdn_go "animakuro/cdn"
+	"animakuro/cdn/internal/cdn/cdnutil"
+	"animakuro/cdn/internal/cdn/dto"
+	cdn_errors "animakuro/cdn/internal/cdn/errors"
+	"animakuro/cdn/internal/entities"
+	"animakuro/cdn/pkg/http/response"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Max files deleted by a single request
+const maxDeleteBatch = 10000
+
+// validateFilter checks that files are selected either by ids or by metadata
+// and metadata keys can't be mistaken for nested fields or operators
+func validateFilter(inp dto.BatchDeleteDto) error {
+	if (len(inp.IDs) == 0) == (len(inp.Metadata) == 0) {
+		return entities.ErrInvalidFilter
+	}
+
+	for k := range inp.Metadata {
+		if k == "" || strings.Contains(k, ".") || strings.HasPrefix(k, "$") {
+			return entities.ErrInvalidFilter
+		}
+	}
+
+	return nil
+}
+
+// BatchDelete marks many files of bucket as deletable at once just like Delete does with a single one.
+// Files are selected by ids or by metadata, result of every file is written.
+// Files selected by metadata are deleted up to maxDeleteBatch per request
+func (h *Handler) BatchDelete(w http.ResponseWriter, r *http.Request) {
+	bucket := mux.Vars(r)[cdn_go.BucketKey]
+
+	var inp dto.BatchDeleteDto
+	if err := json.NewDecoder(r.Body).Decode(&inp); err != nil {
+		err = cdnutil.WrapInternal(err, "Handler.BatchDelete.json.Decode")
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	if err := validateFilter(inp); err != nil {
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	if len(inp.IDs) > maxDeleteBatch {
+		err := fmt.Errorf("%w: %d files exceed limit of %d", entities.ErrBatchTooLarge, len(inp.IDs), maxDeleteBatch)
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	if _, err := h.bc.Get(bucket); err != nil {
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	deleted, err := h.service.MarkManyAsDeletableDB(r.Context(), bucket, inp, maxDeleteBatch)
+	if err != nil {
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	results := make([]response.JSON, 0, len(deleted))
+
+	// Files selected by metadata are the deleted ones
+	if len(inp.IDs) == 0 {
+		for _, id := range deleted {
+			results = append(results, response.JSON{
+				"id":     id,
+				"status": http.StatusOK,
+			})
+		}
+
+		response.Json(h.logger, w, http.StatusOK, response.JSON{
+			"results": results,
+		})
+		return
+	}
+
+	isDeleted := make(map[string]bool, len(deleted))
+	for _, id := range deleted {
+		isDeleted[id] = true
+	}
+
+	// Files not found or already deleted are reported the same way, see Service.GetFileDB
+	for _, id := range inp.IDs {
+		if !isDeleted[id] {
+			message, code := cdn_errors.Describe(h.logger, entities.ErrFileNotFound)
+			results = append(results, response.JSON{
+				"id":     id,
+				"status": code,
+				"error":  message,
+			})
+			continue
+		}
+
+		results = append(results, response.JSON{
+			"id":     id,
+			"status": http.StatusOK,
+		})
+	}
+
+	response.Json(h.logger, w, http.StatusOK, response.JSON{
+		"results": results,
+	})
+}
+
+func (s *cdnService) MarkManyAsDeletableDB(ctx context.Context, bucket string, dto dto.BatchDeleteDto, limit int64) ([]string, error) {
+	files, err := s.repository.GetFiles(ctx, bucket, dto, limit)
+	if err != nil {
+		return nil, cdnutil.WrapInternal(err, "cdnService.MarkManyAsDeletableDB.s.repository.GetFiles")
+	}
+
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(files))
+	aliases := make(map[primitive.ObjectID]string, len(files))
+	for _, f := range files {
+		ids = append(ids, f.ID)
+		aliases[f.ID] = f.Alias
+	}
+
+	// Files marked meanwhile by another request are not reported
+	marked, err := s.repository.MarkManyAsDeletable(ctx, ids)
+	if err != nil {
+		return nil, cdnutil.WrapInternal(err, "cdnService.MarkManyAsDeletableDB.s.repository.MarkManyAsDeletable")
+	}
+
+	uuids := make([]string, 0, len(marked))
+	for _, f := range marked {
+		uuids = append(uuids, f.UUID)
+
+		// Marked files have no alias anymore, the one they had is forgotten
+		if alias := aliases[f.ID]; alias != "" {
+			s.aliases.Remove(bucket, alias)
+		}
+	}
+
+	s.logger.Debugf("marked %d files of bucket: %s as deletable", len(uuids), bucket)
+	return uuids, nil
+}
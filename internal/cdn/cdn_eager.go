@@ -0,0 +1,172 @@
+package cdn
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	cdnpath "animakuro/cdn/internal/cdn/path"
+	"animakuro/cdn/internal/entities"
+	"animakuro/cdn/internal/fs"
+	"animakuro/cdn/internal/modules"
+	"animakuro/cdn/pkg/hash"
+	"animakuro/cdn/pkg/metrics"
+)
+
+const (
+	// Max time to read meta of a single original while rendering eagerly
+	eagerTimeout = time.Second * 30
+
+	eagerStatusOk     = "ok"
+	eagerStatusFailed = "failed"
+)
+
+// derivative is ModuleMap along with module rendering it
+type derivative struct {
+	module string
+	mm     modules.ModuleMap
+}
+
+// renderEager renders bucket's eager derivatives of just uploaded files.
+// Derivatives are saved to the same paths Handler.Get looks them up at.
+// Derivatives of modules not applying to file are skipped.
+// Failures are logged and counted but never affect the upload itself
+func (h *Handler) renderEager(b *entities.Bucket, ids []string) {
+	derivatives, err := h.eagerDerivatives(b.Eager, b.Presets, b.Modules)
+	if err != nil {
+		h.logger.Errorf("could not expand eager of bucket: %s. err: %s", b.Name, err.Error())
+		return
+	}
+
+	// Same derivatives as Handler.Get renders
+	for i, d := range derivatives {
+		if derivatives[i].mm, err = h.withStrip(d.mm, b, d.module); err != nil {
+			h.logger.Errorf("could not expand eager of bucket: %s. err: %s", b.Name, err.Error())
+			return
+		}
+
+		if derivatives[i].mm, err = h.moduleController.Pin(context.Background(), d.module, derivatives[i].mm); err != nil {
+			h.logger.Errorf("could not expand eager of bucket: %s. err: %s", b.Name, err.Error())
+			return
+		}
+	}
+
+	for _, uuid := range ids {
+		f, err := h.eagerFile(b.Name, uuid)
+		if err != nil {
+			h.logger.Errorf("could not render eagerly: %s/%s. err: %s", b.Name, uuid, err.Error())
+			metrics.EagerRenders.WithLabelValues(b.Name, eagerStatusFailed).Add(float64(len(derivatives)))
+			continue
+		}
+
+		applicable := make([]derivative, 0, len(derivatives))
+		for _, d := range derivatives {
+			if h.moduleController.CheckMime(d.module, f.MimeType) == nil {
+				applicable = append(applicable, d)
+			}
+		}
+
+		if len(applicable) == 0 {
+			continue
+		}
+
+		pathToOriginal := cdnpath.ToOriginalFile(&cdnpath.Original{
+			BucketsPath: fs.BucketsPath(),
+			Bucket:      b.Name,
+			UUID:        uuid,
+			DefaultName: fs.DefaultName + f.Extension,
+		})
+
+		bits, err := h.service.ReadFile(pathToOriginal, f.AvailableIn)
+		if err != nil {
+			h.logger.Errorf("could not render eagerly: %s/%s. err: %s", b.Name, uuid, err.Error())
+			metrics.EagerRenders.WithLabelValues(b.Name, eagerStatusFailed).Add(float64(len(applicable)))
+			continue
+		}
+
+		for _, d := range applicable {
+			pathToResolved := cdnpath.ToExistingFile(&cdnpath.Existing{
+				BucketsPath: fs.BucketsPath(),
+				Bucket:      b.Name,
+				UUID:        uuid,
+				SHA1:        hash.SHA1Name(h.moduleController.Raw(d.module, d.mm, uuid)),
+			})
+
+			// Shares the flight with Handler.Get requesting the same derivative meanwhile
+			d := d
+			_, err, _ := h.renders.Do(pathToResolved, func() (any, error) {
+				out, err := h.render(bits, b, d.module, d.mm)
+				if err != nil {
+					return nil, err
+				}
+
+				h.saveDerivative(d.module, out, pathToResolved)
+				return out, nil
+			})
+			if err != nil {
+				h.logger.Errorf("could not render eagerly: %s. err: %s", pathToResolved, err.Error())
+				metrics.EagerRenders.WithLabelValues(b.Name, eagerStatusFailed).Inc()
+				continue
+			}
+
+			metrics.EagerRenders.WithLabelValues(b.Name, eagerStatusOk).Inc()
+		}
+	}
+}
+
+// eagerFile reads meta of uploaded file. Renders of files uploaded along
+// take their own time, so every file is given a time of its own
+func (h *Handler) eagerFile(bucket string, uuid string) (*entities.File, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), eagerTimeout)
+	defer cancel()
+
+	return h.service.GetFileDB(ctx, bucket, uuid)
+}
+
+// eagerDerivatives expands every eager entry which is either
+// preset name or resolvers query (e.g. "image.webp=true&image.resize=200x0")
+func (h *Handler) eagerDerivatives(eager []string, presets map[string]entities.Preset, bucketModules []string) ([]derivative, error) {
+	derivatives := make([]derivative, 0, len(eager))
+
+	for _, entry := range eager {
+		var (
+			d   derivative
+			err error
+		)
+
+		if preset, ok := presets[entry]; ok {
+			d.module, d.mm, err = h.moduleController.ParsePreset(preset, bucketModules)
+		} else {
+			// Neither preset nor query
+			if !strings.Contains(entry, "=") {
+				return nil, entities.ErrInvalidEager
+			}
+
+			q, perr := url.ParseQuery(entry)
+			if perr != nil {
+				return nil, entities.ErrInvalidEager
+			}
+
+			d.module, d.mm, err = h.moduleController.Parse(q, bucketModules)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Entry resolves to the original file
+		if d.mm == nil {
+			continue
+		}
+
+		derivatives = append(derivatives, d)
+	}
+
+	return derivatives, nil
+}
+
+// validateEager checks that every eager entry could be expanded
+func (h *Handler) validateEager(eager []string, presets map[string]entities.Preset, bucketModules []string) error {
+	_, err := h.eagerDerivatives(eager, presets, bucketModules)
+	return err
+}
@@ -5,8 +5,12 @@ import (
 	"encoding/json"
 	_ "image/jpeg"
 	_ "image/png"
+	"io"
 	"net/http"
+	"net/url"
 	"path"
+	"strconv"
+	"time"
 
 	cdn_go "animakuro/cdn"
 	"animakuro/cdn/config"
@@ -21,9 +25,15 @@ import (
 	"animakuro/cdn/internal/modules"
 	bucketcache "animakuro/cdn/pkg/cache/bucket"
 	filecache "animakuro/cdn/pkg/cache/file"
+	"animakuro/cdn/pkg/dealer"
 	"animakuro/cdn/pkg/hash"
+	"animakuro/cdn/pkg/hls"
 	"animakuro/cdn/pkg/http/response"
+	"animakuro/cdn/pkg/metrics"
 	"animakuro/cdn/pkg/middleware"
+	"animakuro/cdn/pkg/pool"
+	"animakuro/cdn/pkg/precompress"
+	"animakuro/cdn/pkg/singleflight"
 
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
@@ -39,6 +49,21 @@ type Handler struct {
 	moduleController modules.Controller
 	bc               *bucketcache.BucketCache
 	fc               filecache.FileCache
+	dealer           *dealer.Dealer
+	// Deduplicates concurrent renders of the same derivative (keyed by its path)
+	renders *singleflight.Group
+	// CPU-bound pool resolvers run in
+	processing       *pool.Pool
+	processingConfig *config.ProcessingConfig
+	// Packages videos into HLS. Nil if ffmpeg is not found
+	packager *hls.Packager
+	// Packaging takes minutes, so it has workers of its own
+	packaging  *pool.Pool
+	hlsTimeout time.Duration
+	// Lifetime of signed URIs of HLS playlists
+	hlsURLTTL time.Duration
+	// Compresses files of modules served precompressed (e.g. text)
+	compressor *precompress.Compressor
 }
 
 type HandlerDeps struct {
@@ -50,9 +75,31 @@ type HandlerDeps struct {
 	BucketCache      *bucketcache.BucketCache
 	FileCache        filecache.FileCache
 	MemConfig        *config.MemoryConfig
+	// Used for background work e.g. eager rendering
+	Dealer *dealer.Dealer
+	// Resolvers run in it instead of request goroutine
+	Processing       *pool.Pool
+	ProcessingConfig *config.ProcessingConfig
+	// Optional. Buckets can't package videos into HLS without it
+	Packager *hls.Packager
+	// Required along with Packager. Videos are packaged in it apart from resolvers
+	Packaging   *pool.Pool
+	VideoConfig *config.VideoConfig
+	// Optional. Files are never served compressed without it
+	Compressor *precompress.Compressor
 }
 
 func NewHandler(deps *HandlerDeps) *Handler {
+	hlsTimeout := defaultHLSTimeout
+	if deps.VideoConfig != nil && deps.VideoConfig.HLSTimeout > 0 {
+		hlsTimeout = deps.VideoConfig.HLSTimeout
+	}
+
+	hlsURLTTL := defaultHLSURLTTL
+	if deps.VideoConfig != nil && deps.VideoConfig.HLSURLTTL > 0 {
+		hlsURLTTL = deps.VideoConfig.HLSURLTTL
+	}
+
 	return &Handler{
 		logger:           deps.Logger,
 		mux:              deps.Mux,
@@ -62,6 +109,15 @@ func NewHandler(deps *HandlerDeps) *Handler {
 		moduleController: deps.ModuleController,
 		bc:               deps.BucketCache,
 		fc:               deps.FileCache,
+		dealer:           deps.Dealer,
+		renders:          singleflight.New(),
+		processing:       deps.Processing,
+		processingConfig: deps.ProcessingConfig,
+		packager:         deps.Packager,
+		packaging:        deps.Packaging,
+		hlsTimeout:       hlsTimeout,
+		hlsURLTTL:        hlsURLTTL,
+		compressor:       deps.Compressor,
 	}
 }
 
@@ -69,18 +125,34 @@ func (h *Handler) InitRoutes() {
 
 	//shorthands for middlewares
 	auth := h.middlewares.JwtMiddleware.Auth
+	transfer := h.middlewares.JwtMiddleware.Transfer
+	batchDelete := h.middlewares.JwtMiddleware.BatchDelete
+	admin := h.middlewares.JwtMiddleware.Admin
+	hlsAuth := h.middlewares.JwtMiddleware.HLS
 
 	api := h.mux.PathPrefix("/api").Subrouter()
 	{
 		api.HandleFunc("/health", h.Healthcheck).Methods(http.MethodGet)
 		//todo: get rid of it
 		api.HandleFunc("/bucket", h.CreateBucket).Methods(http.MethodPost)
+		api.HandleFunc("/bucket/{bucket}", admin(h.UpdateBucket)).Methods(http.MethodPatch)
+		api.HandleFunc("/bucket/{bucket}/usage", admin(h.GetUsage)).Methods(http.MethodGet)
 	}
 
 	//cdn routes
 	h.mux.HandleFunc("/{bucket}", auth(h.Upload)).Methods(http.MethodPost)
-	h.mux.HandleFunc("/{bucket}/{fileUUID}", auth(h.Get)).Methods(http.MethodGet)
+	h.mux.HandleFunc("/{bucket}/{fileUUID}", h.resolveAlias(auth(h.Get))).Methods(http.MethodGet)
+	h.mux.HandleFunc("/{bucket}/{fileUUID}", auth(h.Update)).Methods(http.MethodPut)
+	h.mux.HandleFunc("/{bucket}/{fileUUID}/versions", auth(h.GetVersions)).Methods(http.MethodGet)
+	h.mux.HandleFunc("/{bucket}/{fileUUID}/versions/{version}/rollback", auth(h.Rollback)).Methods(http.MethodPost)
+	h.mux.HandleFunc("/{bucket}/{transfer:copy|move}", transfer(h.Transfer)).Methods(http.MethodPost)
+	h.mux.HandleFunc("/{bucket}/{fileUUID}/{transfer:copy|move}", transfer(h.Transfer)).Methods(http.MethodPost)
+	h.mux.HandleFunc("/{bucket}/{fileUUID}/hls/{hlsPath:.+}", hlsAuth(h.GetHLS)).Methods(http.MethodGet)
 	h.mux.HandleFunc("/{bucket}/{fileUUID}", auth(h.Delete)).Methods(http.MethodDelete)
+	h.mux.HandleFunc("/{bucket}/delete", batchDelete(h.BatchDelete)).Methods(http.MethodPost)
+	h.mux.HandleFunc("/{bucket}/{fileUUID}/alias", auth(h.SetAlias)).Methods(http.MethodPut)
+	// Aliases could contain slashes, so every other file route takes precedence
+	h.mux.HandleFunc("/{bucket}/{alias:.+}", h.resolveAlias(auth(h.Get))).Methods(http.MethodGet)
 }
 
 func (h *Handler) Healthcheck(w http.ResponseWriter, _ *http.Request) {
@@ -95,6 +167,11 @@ func (h *Handler) CreateBucket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Bucket of a single module could be created the old way
+	if len(inp.Modules) == 0 && inp.Module != "" {
+		inp.Modules = []string{inp.Module}
+	}
+
 	// Validations
 	{
 		if err := validate.ValidateRequiredFields(inp); err != nil {
@@ -107,8 +184,15 @@ func (h *Handler) CreateBucket(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if ok := h.moduleController.DoesModuleExist(inp.Module); !ok {
-			cdn_errors.ToHttp(h.logger, w, modules.ErrNotFound)
+		for _, module := range inp.Modules {
+			if ok := h.moduleController.DoesModuleExist(module); !ok {
+				cdn_errors.ToHttp(h.logger, w, modules.ErrNotFound)
+				return
+			}
+		}
+
+		if err := h.validateBucketSettings(&inp.BucketSettings, inp.Modules); err != nil {
+			cdn_errors.ToHttp(h.logger, w, err)
 			return
 		}
 	}
@@ -131,17 +215,50 @@ func (h *Handler) CreateBucket(w http.ResponseWriter, r *http.Request) {
 	response.Created(w)
 }
 
+// UpdateBucket changes settings of existing bucket (see dto.BucketSettings)
+func (h *Handler) UpdateBucket(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bucket := vars[cdn_go.BucketKey]
+
+	var inp dto.UpdateBucketDto
+	if err := json.NewDecoder(r.Body).Decode(&inp); err != nil {
+		err = cdnutil.WrapInternal(err, "Handler.UpdateBucket.json.Decode")
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	b, err := h.bc.Get(bucket)
+	if err != nil {
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	// Only fields present in request are updated, but validated along with the rest
+	inp.Keep(b)
+
+	if err := h.validateBucketSettings(&inp.BucketSettings, b.Modules); err != nil {
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	b, err = h.service.UpdateBucketDB(r.Context(), bucket, inp)
+	if err != nil {
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	// Replace bucket in cache
+	h.bc.Add(b)
+
+	response.Ok(w)
+}
+
 func (h *Handler) Get(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	bucket := vars[cdn_go.BucketKey]
 	uuid := vars[cdn_go.FileUUIDKey]
 
-	var (
-		rawQuery   string
-		isOriginal bool
-	)
-
 	// Get bucket from cache
 	b, err := h.bc.Get(bucket)
 	if err != nil {
@@ -149,40 +266,55 @@ func (h *Handler) Get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Convert URL to moduleMap (see modules.Parse impl)
-	moduleMap, err := h.moduleController.Parse(r.URL.Query(), b.Module)
+	// Prior version could be requested along with resolvers
+	q := r.URL.Query()
+	version, err := requestedVersion(q)
+	if err != nil {
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	// Convert URL or preset to moduleMap of one of bucket's modules (see modules.Parse impl)
+	module, moduleMap, err := h.moduleMap(q, b)
 	if err != nil {
 		cdn_errors.ToHttp(h.logger, w, err)
 		return
 	}
 
-	isOriginal = moduleMap == nil
-	rawQuery = h.moduleController.Raw(moduleMap, uuid)
-	sha1 := hash.SHA1Name(rawQuery)
+	// Derivatives of current version are stored next to it
+	dir := path.Join(fs.BucketsPath(), cdnpath.ToDir(bucket, uuid))
 
-	// Try go get existing processed file.
+	// Try go get existing processed file. Module is known from query,
+	// so there's no need to read file's meta.
 	// TODO: think of what if file is deleted
-	if !isOriginal {
-		// Make path to file and check if already resolved file exists. (isOriginal = false)
-		pathToExisting := cdnpath.ToExistingFile(&cdnpath.Existing{
-			BucketsPath: fs.BucketsPath(),
-			Bucket:      bucket,
-			UUID:        uuid,
-			SHA1:        sha1,
-		})
-
-		bits, isAvailable, err := h.service.ReadExisting(pathToExisting)
+	if moduleMap != nil {
+		// Bucket could strip metadata of every file it serves
+		moduleMap, err = h.withStrip(moduleMap, b, module)
 		if err != nil {
 			cdn_errors.ToHttp(h.logger, w, err)
 			return
 		}
 
-		// Available locally
-		if isAvailable {
-			h.fc.Increment(pathToExisting)
-			response.Binary(w, bits, h.service.ParseMime(bits))
+		// Derivative depends on current state of files besides original, e.g. watermark overlay
+		moduleMap, err = h.moduleController.Pin(r.Context(), module, moduleMap)
+		if err != nil {
+			cdn_errors.ToHttp(h.logger, w, err)
 			return
 		}
+
+		// Dir of requested version is known from file's meta only
+		if version == 0 {
+			served, err := h.serveExisting(w, r, b, module, moduleMap, uuid, dir)
+			if err != nil {
+				cdn_errors.ToHttp(h.logger, w, err)
+				return
+			}
+
+			// Available locally
+			if served {
+				return
+			}
+		}
 	}
 
 	// Get original file meta from DB
@@ -191,20 +323,65 @@ func (h *Handler) Get(w http.ResponseWriter, r *http.Request) {
 		cdn_errors.ToHttp(h.logger, w, err)
 		// If meta is not found in DB - delete file from disk.
 		if errors.Is(err, entities.ErrFileNotFound) {
-			dirPath := cdnpath.ToDir(bucket, uuid)
+			dirPath := path.Join(fs.BucketsPath(), cdnpath.ToDir(bucket, uuid))
 			// TODO: mark for deletion
 			h.service.TryDeleteLocally(dirPath)
 		}
 		return
 	}
 
+	// Original file of requested version
+	v := f.Current()
+	if version != 0 && version != v.Version {
+		var ok bool
+		if v, ok = f.FindVersion(version); !ok {
+			cdn_errors.ToHttp(h.logger, w, entities.ErrVersionNotFound)
+			return
+		}
+
+		dir = cdnpath.ToVersionDir(fs.BucketsPath(), bucket, uuid, version)
+	}
+
+	if moduleMap == nil {
+		// Original file still belongs to module applying to it, e.g. it's stripped on delivery
+		module = h.moduleController.Select(b.Modules, v.MimeType)
+
+		moduleMap, err = h.withStrip(nil, b, module)
+		if err != nil {
+			cdn_errors.ToHttp(h.logger, w, err)
+			return
+		}
+
+		if moduleMap != nil {
+			served, err := h.serveExisting(w, r, b, module, moduleMap, uuid, dir)
+			if err != nil {
+				cdn_errors.ToHttp(h.logger, w, err)
+				return
+			}
+
+			if served {
+				return
+			}
+		}
+	} else if err := h.moduleController.CheckMime(module, v.MimeType); err != nil {
+		// Resolvers are requested from module which doesn't apply to file
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	isOriginal := moduleMap == nil
+
 	// Make path to original file in disk
-	pathToOriginal := cdnpath.ToOriginalFile(&cdnpath.Original{
-		BucketsPath: fs.BucketsPath(),
-		Bucket:      bucket,
-		UUID:        uuid,
-		DefaultName: fs.DefaultName + f.Extension,
-	})
+	pathToOriginal := path.Join(dir, fs.DefaultName+v.Extension)
+
+	// Compressed variant spares reading original
+	if isOriginal && h.serveVariant(w, r, module, pathToOriginal, v.MimeType) {
+		h.logger.Debugf("serving compressed original file: %s", pathToOriginal)
+		return
+	}
+
+	// Original could be replaced by a new version while it's rendered
+	original := fs.Stat(pathToOriginal)
 
 	bits, err := h.service.ReadFile(pathToOriginal, f.AvailableIn)
 	if err != nil {
@@ -214,67 +391,327 @@ func (h *Handler) Get(w http.ResponseWriter, r *http.Request) {
 
 	// Serve original file without module processing (isOriginal = true)
 	if isOriginal {
-		// Can use original file's (f) MimeType
-		response.Binary(w, bits, f.MimeType)
+		// Can use original file's (v) MimeType
+		response.Binary(w, bits, v.MimeType)
 		h.fc.Increment(pathToOriginal)
 		h.logger.Debugf("serving original file: %s", pathToOriginal)
 		return
 	}
 
-	// Magic happens here
-	// UseResolver would modify buff according to moduleMap
-	// TODO: think for resolving queue
-	buff := bytes.NewBuffer(bits)
-	err = h.moduleController.UseResolvers(buff, b.Module, moduleMap)
+	// Make path to resolved file in disk after service.MustSave
+	sha1 := hash.SHA1Name(h.moduleController.Raw(module, moduleMap, uuid))
+	pathToResolved := path.Join(dir, sha1)
+
+	// Concurrent requests of the same derivative wait for a single render.
+	// Saving is done inside the flight, so requests coming after it find the file on disk.
+	// If saving fails somehow the next call to Get with resolvers will
+	// resolve (process) the file again and try to save once more.
+	out, err, _ := h.renders.Do(pathToResolved, func() (any, error) {
+		// Magic happens here
+		// render would apply resolvers according to moduleMap
+		buffBits, err := h.render(bits, b, module, moduleMap)
+		if err != nil {
+			return nil, err
+		}
+
+		// Derivative of replaced original would be served as the one of a new version
+		if fs.Changed(pathToOriginal, original) {
+			return buffBits, nil
+		}
+
+		h.saveDerivative(module, buffBits, pathToResolved)
+		return buffBits, nil
+	})
 	if err != nil {
+		h.setRetryAfter(w, err)
 		cdn_errors.ToHttp(h.logger, w, err)
 		return
 	}
 
-	// Make path to resolved file in disk after service.MustSave
-	pathToResolved := path.Join(fs.BucketsPath(), f.Bucket, uuid, sha1)
+	buffBits := out.([]byte)
+	contentType := h.moduleController.ContentType(module, moduleMap)
+	if contentType == "" {
+		contentType = h.service.ParseMime(buffBits)
+	}
+
+	// Variants are not compressed yet, but next response may be compressed
+	if h.isPrecompressed(module) {
+		w.Header().Set("Vary", "Accept-Encoding")
+	}
+
 	h.fc.Increment(pathToResolved)
+	response.Binary(w, buffBits, contentType)
+}
 
-	buffBits := buff.Bytes()
-	// Important to execute asynchronously (defer), due to
-	// if it fails somehow the next call to Get with resolvers will
-	// resolve (process) the file again and try to save once more.
-	// There's no need to save synchronously. Client will get it's file bits no matter what.
-	response.Binary(w, buffBits, h.service.ParseMime(buffBits))
-	h.service.MustSave(buffBits, pathToResolved)
+// serveExisting serves derivative rendered before (or its compressed variant) in dir of original.
+// False means it's not available locally
+func (h *Handler) serveExisting(w http.ResponseWriter, r *http.Request, b *entities.Bucket, module string, moduleMap modules.ModuleMap, uuid string, dir string) (bool, error) {
+	pathToExisting := path.Join(dir, hash.SHA1Name(h.moduleController.Raw(module, moduleMap, uuid)))
+
+	// Compressed variant if client accepts it
+	contentType := h.moduleController.ContentType(module, moduleMap)
+	if h.serveVariant(w, r, module, pathToExisting, contentType) {
+		return true, nil
+	}
+
+	bits, isAvailable, err := h.service.ReadExisting(pathToExisting)
+	if err != nil || !isAvailable {
+		return false, err
+	}
+
+	if contentType == "" {
+		contentType = h.service.ParseMime(bits)
+	}
+
+	h.fc.Increment(pathToExisting)
+	response.Binary(w, bits, contentType)
+	return true, nil
+}
+
+// render applies resolvers from moduleMap to a copy of bits in processing pool.
+// Original bits could be shared with file cache hence never modified in place
+func (h *Handler) render(bits []byte, b *entities.Bucket, module string, moduleMap modules.ModuleMap) ([]byte, error) {
+	out, err := h.processing.Do(b.Name, func() (any, error) {
+		start := time.Now()
+		defer func() {
+			metrics.RenderDuration.WithLabelValues(b.Name).Observe(time.Since(start).Seconds())
+		}()
+
+		buff := bytes.NewBuffer(append(make([]byte, 0, len(bits)), bits...))
+		if err := h.moduleController.UseResolvers(buff, module, moduleMap); err != nil {
+			return nil, err
+		}
+
+		return buff.Bytes(), nil
+	})
+	if err != nil {
+		if errors.Is(err, pool.ErrQueueFull) {
+			metrics.RendersRejected.WithLabelValues(b.Name).Inc()
+		}
+		return nil, err
+	}
+
+	return out.([]byte), nil
+}
+
+// setRetryAfter tells client when to retry if processing queue is full
+func (h *Handler) setRetryAfter(w http.ResponseWriter, err error) {
+	if errors.Is(err, pool.ErrQueueFull) {
+		w.Header().Set("Retry-After", strconv.Itoa(h.processingConfig.RetryAfter))
+	}
+}
+
+// moduleMap expands preset requested via URL query or
+// parses resolvers from it if there's no preset. Returns module they belong to
+func (h *Handler) moduleMap(q url.Values, b *entities.Bucket) (string, modules.ModuleMap, error) {
+	presetName := q.Get(cdn_go.URLPresetKey)
+
+	if presetName == "" {
+		module, moduleMap, err := h.moduleController.Parse(q, b.Modules)
+		if err != nil {
+			return "", nil, err
+		}
+
+		// Original file is still available for presets only bucket
+		if moduleMap != nil && b.PresetsOnly {
+			return "", nil, entities.ErrPresetsOnly
+		}
+
+		return module, moduleMap, nil
+	}
+
+	preset, ok := b.Presets[presetName]
+	if !ok {
+		return "", nil, entities.ErrPresetNotFound
+	}
+
+	// Preset is the only thing that could be passed along with auth
+	q.Del(cdn_go.URLAuthKey)
+	q.Del(cdn_go.URLPresetKey)
+	if len(q) != 0 {
+		return "", nil, entities.ErrPresetWithResolvers
+	}
+
+	return h.moduleController.ParsePreset(preset, b.Modules)
+}
+
+// validateBucketSettings checks settings of bucket with modules, both new and updated one
+func (h *Handler) validateBucketSettings(settings *dto.BucketSettings, bucketModules []string) error {
+	if err := h.validatePresets(settings.Presets, bucketModules); err != nil {
+		return err
+	}
+
+	if err := h.validateEager(settings.Eager, settings.Presets, bucketModules); err != nil {
+		return err
+	}
+
+	if err := h.validateStrip(settings.Strip, bucketModules); err != nil {
+		return err
+	}
+
+	if err := h.validateHLS(settings.HLS); err != nil {
+		return err
+	}
+
+	if err := h.validateUpload(settings.Upload); err != nil {
+		return err
+	}
+
+	if err := h.validateQuota(settings.Quota); err != nil {
+		return err
+	}
+
+	if err := h.validateLifecycle(settings.Lifecycle); err != nil {
+		return err
+	}
+
+	return h.validateVersioning(settings.Versioning)
+}
+
+// validatePresets checks that every preset could be expanded by one of bucket's modules
+func (h *Handler) validatePresets(presets map[string]entities.Preset, bucketModules []string) error {
+	for _, preset := range presets {
+		if _, _, err := h.moduleController.ParsePreset(preset, bucketModules); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (h *Handler) Upload(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	bucket := vars[cdn_go.BucketKey]
 
-	err := r.ParseMultipartForm(h.memConfig.MaxUploadSize)
+	b, err := h.bc.Get(bucket)
 	if err != nil {
-		err = cdnutil.WrapInternal(err, "Handler.Upload.r.ParseMultipartForm")
 		cdn_errors.ToHttp(h.logger, w, err)
 		return
 	}
 
-	// Get files attached to MultipartForm
-	files, err := formdata.ParseFiles(r.MultipartForm)
+	// Files violating bucket's upload policy are rejected before anything is saved
+	files, err := h.parseUpload(r, b)
 	if err != nil {
 		cdn_errors.ToHttp(h.logger, w, err)
 		return
 	}
 
+	if err := h.aliasUpload(r, files); err != nil {
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	if err := h.prepareUpload(b, files); err != nil {
+		h.setRetryAfter(w, err)
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
 	// Upload files to bucket
 	urls, ids, err := h.service.UploadMany(r.Context(), bucket, files)
 	if err != nil {
+		h.setRetryAfter(w, err)
 		cdn_errors.ToHttp(h.logger, w, err)
 		return
 	}
 
+	h.afterUpload(b, ids)
+
+	// File metadata by id
+	metadata := make(map[string]map[string]string, len(files))
+	for _, file := range files {
+		if len(file.Metadata) != 0 {
+			metadata[file.UUID] = file.Metadata
+		}
+	}
+
 	response.Json(h.logger, w, http.StatusCreated, response.JSON{
-		"ids":  ids,
-		"urls": urls,
+		"ids":      ids,
+		"urls":     urls,
+		"metadata": metadata,
 	})
 }
 
+// prepareUpload rejects files exceeding module limits before anything is saved,
+// computes metadata saved along with files (e.g. placeholders) and strips metadata of originals
+func (h *Handler) prepareUpload(b *entities.Bucket, files []*formdata.UploadFile) error {
+	if err := h.inspectFiles(b, files); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		process, err := h.stripOnUpload(b, h.moduleController.Select(b.Modules, file.MimeType))
+		if err != nil {
+			return err
+		}
+
+		file.Process = process
+	}
+
+	return nil
+}
+
+// afterUpload starts background work on files just saved. Client doesn't wait for it
+func (h *Handler) afterUpload(b *entities.Bucket, ids []string) {
+	// Pre-render derivatives
+	if len(b.Eager) != 0 {
+		go h.renderEager(b, ids)
+	}
+
+	// Packaging takes way longer than rendering, so is done in background as well
+	if b.HLS != nil && h.packager != nil {
+		go h.packageHLS(b, ids)
+	}
+
+	if h.hasPrecompressed(b) {
+		go h.precompressOriginals(b, ids)
+	}
+}
+
+// inspectFiles validates files against limits of module applying to them
+// and fills metadata module computes for them. Files no module applies to are saved as is
+func (h *Handler) inspectFiles(b *entities.Bucket, files []*formdata.UploadFile) error {
+	for _, file := range files {
+		module := h.moduleController.Select(b.Modules, file.MimeType)
+		if module == "" {
+			continue
+		}
+
+		f, err := file.Open()
+		if err != nil {
+			return cdnutil.WrapInternal(err, "Handler.inspectFiles.file.Open")
+		}
+
+		bits, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return cdnutil.WrapInternal(err, "Handler.inspectFiles.io.ReadAll")
+		}
+
+		if err := h.moduleController.Check(module, bits); err != nil {
+			return err
+		}
+
+		// Decoding is CPU-bound, hence goes through the processing pool
+		out, err := h.processing.Do(b.Name, func() (any, error) {
+			return h.moduleController.Describe(module, bits)
+		})
+		if err != nil {
+			if errors.Is(err, pool.ErrQueueFull) {
+				return err
+			}
+
+			// File is still worth saving without metadata
+			h.logger.Errorf("could not describe file: %s/%s. err: %s", b.Name, file.UUID, err.Error())
+			continue
+		}
+
+		file.Metadata = out.(map[string]string)
+	}
+
+	return nil
+}
+
 func (h *Handler) Delete(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
@@ -0,0 +1,196 @@
+package cdn
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	cdn_go "animakuro/cdn"
+	cdn_errors "animakuro/cdn/internal/cdn/errors"
+	cdnpath "animakuro/cdn/internal/cdn/path"
+	"animakuro/cdn/internal/entities"
+	"animakuro/cdn/internal/fs"
+	"animakuro/cdn/pkg/hls"
+	"animakuro/cdn/pkg/http/response"
+	"animakuro/cdn/pkg/metrics"
+	"animakuro/cdn/pkg/pool"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Max time to read original's meta before packaging
+	hlsReadTimeout = time.Second * 30
+	// Attempts to get into full packaging queue
+	hlsAttempts = 10
+	// Used if config doesn't set them
+	defaultHLSTimeout = time.Minute * 30
+	defaultHLSURLTTL  = time.Hour * 4
+
+	hlsStatusOk     = "ok"
+	hlsStatusFailed = "failed"
+)
+
+// validateHLS checks that packaging is available and renditions are known
+func (h *Handler) validateHLS(policy *entities.HLSPolicy) error {
+	if policy == nil {
+		return nil
+	}
+
+	if h.packager == nil {
+		return entities.ErrHLSUnavailable
+	}
+
+	if len(policy.Renditions) == 0 {
+		return entities.ErrInvalidHLS
+	}
+
+	seen := make(map[int]bool, len(policy.Renditions))
+	for _, height := range policy.Renditions {
+		known := false
+		for _, rendition := range entities.HLSRenditions {
+			if height == rendition {
+				known = true
+				break
+			}
+		}
+
+		if !known || seen[height] {
+			return entities.ErrInvalidHLS
+		}
+		seen[height] = true
+	}
+
+	return nil
+}
+
+// packageHLS packages just uploaded videos of bucket into HLS.
+// Files other than videos are skipped. Failures are logged and counted
+// but never affect the upload itself
+func (h *Handler) packageHLS(b *entities.Bucket, ids []string) {
+	for _, uuid := range ids {
+		if err := h.packageVideo(b, uuid); err != nil {
+			h.logger.Errorf("could not package hls: %s/%s. err: %s", b.Name, uuid, err.Error())
+			metrics.HLSPackages.WithLabelValues(b.Name, hlsStatusFailed).Inc()
+		}
+	}
+}
+
+func (h *Handler) packageVideo(b *entities.Bucket, uuid string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hlsReadTimeout)
+	defer cancel()
+
+	f, err := h.service.GetFileDB(ctx, b.Name, uuid)
+	if err != nil {
+		return err
+	}
+
+	pathToOriginal := cdnpath.ToOriginalFile(&cdnpath.Original{
+		BucketsPath: fs.BucketsPath(),
+		Bucket:      b.Name,
+		UUID:        uuid,
+		DefaultName: fs.DefaultName + f.Extension,
+	})
+
+	bits, err := h.service.ReadFile(pathToOriginal, f.AvailableIn)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(h.service.ParseMime(bits), "video/") {
+		return nil
+	}
+
+	dir := cdnpath.ToHLSDir(fs.BucketsPath(), b.Name, uuid)
+	pack := func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), h.hlsTimeout)
+		defer cancel()
+
+		return nil, h.packager.Package(ctx, bits, f.Extension, dir, b.HLS.Renditions)
+	}
+
+	// Packaging is CPU-bound, but runs apart from resolvers, so that a few uploads
+	// can't take every processing worker for minutes. Unlike requests it can wait for the queue to free up
+	for attempt := 1; ; attempt++ {
+		_, err = h.packaging.Do(b.Name, pack)
+		if !errors.Is(err, pool.ErrQueueFull) || attempt == hlsAttempts {
+			break
+		}
+		time.Sleep(time.Duration(h.processingConfig.RetryAfter) * time.Second)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Packager writes files itself
+	h.service.AccountDerivatives(b.Name, dir)
+
+	metrics.HLSPackages.WithLabelValues(b.Name, hlsStatusOk).Inc()
+	return nil
+}
+
+// GetHLS serves files of HLS package: master playlist, rendition playlists and segments.
+// Players request them relatively to the playlist, hence URIs of playlists served from bucket
+// with private get are signed with its first key and expire in hlsURLTTL (see Middleware.HLS).
+// Package is served as long as its file is, deleted files' packages are never served
+func (h *Handler) GetHLS(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	bucket := vars[cdn_go.BucketKey]
+	uuid := vars[cdn_go.FileUUIDKey]
+	hlsPath := vars[cdn_go.HLSPathKey]
+
+	b, err := h.bc.Get(bucket)
+	if err != nil {
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	// Never serve anything but the package (e.g. "../original.mp4")
+	if !hls.IsPath(hlsPath) {
+		cdn_errors.ToHttp(h.logger, w, entities.ErrHLSNotFound)
+		return
+	}
+
+	// Package of deleted file stays on disk until the file is cleaned up
+	if _, err := h.service.GetFileDB(r.Context(), bucket, uuid); err != nil {
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	pathToFile := path.Join(cdnpath.ToHLSDir(fs.BucketsPath(), bucket, uuid), hlsPath)
+	bits, isAvailable, err := h.service.ReadExisting(pathToFile)
+	if err != nil {
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	if !isAvailable {
+		cdn_errors.ToHttp(h.logger, w, entities.ErrHLSNotFound)
+		return
+	}
+
+	h.fc.Increment(pathToFile)
+
+	// Signed copy, cached bits stay intact
+	if keys := privateKeys(b, cdn_go.OperationGet); hls.IsPlaylist(hlsPath) && len(keys) > 0 {
+		expires := time.Now().Add(h.hlsURLTTL).Unix()
+		bits = hls.SignURIs(bits, keys[0], path.Join(bucket, uuid), hlsPath, expires)
+	}
+
+	response.Binary(w, bits, hls.ContentType(hlsPath))
+}
+
+// privateKeys returns keys of operation on bucket requiring token. Nil if operation is public
+func privateKeys(b *entities.Bucket, operation string) []string {
+	for _, op := range b.Operations {
+		if op.Name == operation && op.Type != cdn_go.OperationTypePublic {
+			return op.Keys
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,248 @@
+package cdn
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"animakuro/cdn/config"
+	cdnpath "animakuro/cdn/internal/cdn/path"
+	"animakuro/cdn/internal/entities"
+	"animakuro/cdn/internal/fs"
+	bucketcache "animakuro/cdn/pkg/cache/bucket"
+	"animakuro/cdn/pkg/metrics"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// Last access of derivatives is recorded at most once per accessGranularity
+	accessGranularity = time.Hour
+
+	day = time.Hour * 24
+)
+
+// Lifecycle rules, used as metric labels
+const (
+	ruleExpireOriginals   = "expire_originals"
+	ruleExpireDerivatives = "expire_derivatives"
+	rulePurgeDeleted      = "purge_deleted"
+)
+
+// validateLifecycle checks that lifecycle's days are not negative
+func (h *Handler) validateLifecycle(lifecycle *entities.LifecyclePolicy) error {
+	if lifecycle == nil {
+		return nil
+	}
+
+	if lifecycle.ExpireOriginalsAfter < 0 || lifecycle.ExpireDerivativesAfter < 0 || lifecycle.PurgeDeletedAfter < 0 {
+		return entities.ErrInvalidLifecycle
+	}
+
+	return nil
+}
+
+// Lifecycle periodically applies lifecycle rules of buckets.
+// Files are deleted the same way as by clients: originals are marked as deletable
+// and purged later, derivatives are removed from disk to be rendered again if requested
+type Lifecycle struct {
+	logger  *zap.SugaredLogger
+	service Service
+	bc      *bucketcache.BucketCache
+	cfg     *config.LifecycleConfig
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewLifecycle(logger *zap.SugaredLogger, service Service, bc *bucketcache.BucketCache, cfg *config.LifecycleConfig) *Lifecycle {
+	return &Lifecycle{
+		logger:  logger,
+		service: service,
+		bc:      bc,
+		cfg:     cfg,
+		quit:    make(chan struct{}),
+	}
+}
+
+// Start runs rules every cfg.Interval until Stop
+func (l *Lifecycle) Start() {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+
+		ticker := time.NewTicker(l.cfg.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-l.quit:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), l.cfg.Interval)
+				l.Run(ctx, time.Now())
+				cancel()
+			}
+		}
+	}()
+}
+
+// Stop waits for the pass in progress to finish
+func (l *Lifecycle) Stop() {
+	close(l.quit)
+	l.wg.Wait()
+}
+
+// Run applies rules of every bucket as of now
+func (l *Lifecycle) Run(ctx context.Context, now time.Time) {
+	for _, b := range l.bc.All() {
+		if b.Lifecycle == nil {
+			continue
+		}
+
+		if days := b.Lifecycle.ExpireOriginalsAfter; days > 0 {
+			l.expireOriginals(ctx, b.Name, now.Add(-time.Duration(days)*day))
+		}
+
+		if days := b.Lifecycle.ExpireDerivativesAfter; days > 0 {
+			n, err := l.service.ExpireDerivatives(b.Name, now.Add(-time.Duration(days)*day))
+			if err != nil {
+				l.logger.Errorf("could not expire derivatives of bucket: %s. err: %s", b.Name, err.Error())
+			}
+			metrics.LifecycleDeletions.WithLabelValues(b.Name, ruleExpireDerivatives).Add(float64(n))
+		}
+
+		if days := b.Lifecycle.PurgeDeletedAfter; days > 0 {
+			l.purgeDeleted(ctx, b.Name, now.Add(-time.Duration(days)*day))
+		}
+	}
+}
+
+// expireOriginals marks files uploaded before given time as deletable just like Handler.Delete does
+func (l *Lifecycle) expireOriginals(ctx context.Context, bucket string, uploadedBefore time.Time) {
+	l.inBatches(ctx, bucket, ruleExpireOriginals, func() ([]*entities.File, error) {
+		return l.service.GetExpiredFilesDB(ctx, bucket, uploadedBefore, int64(l.cfg.BatchSize))
+	}, func(f *entities.File) error {
+		return l.service.MarkAsDeletableDB(ctx, bucket, f.ID)
+	})
+}
+
+// purgeDeleted removes files marked before given time from disk and then from database
+func (l *Lifecycle) purgeDeleted(ctx context.Context, bucket string, deletedBefore time.Time) {
+	l.inBatches(ctx, bucket, rulePurgeDeleted, func() ([]*entities.File, error) {
+		return l.service.GetDeletedFilesDB(ctx, bucket, deletedBefore, int64(l.cfg.BatchSize))
+	}, func(f *entities.File) error {
+		// Document is kept until files are gone, so failed purge is retried
+		if err := l.service.DeleteAll(path.Join(fs.BucketsPath(), cdnpath.ToDir(bucket, f.UUID))); err != nil {
+			return err
+		}
+
+		return l.service.DeleteFileDB(ctx, bucket, f.UUID)
+	})
+}
+
+// inBatches applies rule to files returned by next until they're over.
+// Stops if none of a batch could be handled, such files are retried on the next run
+func (l *Lifecycle) inBatches(ctx context.Context, bucket string, rule string, next func() ([]*entities.File, error), apply func(f *entities.File) error) {
+	for ctx.Err() == nil {
+		files, err := next()
+		if err != nil {
+			l.logger.Errorf("lifecycle %s of bucket: %s failed. err: %s", rule, bucket, err.Error())
+			return
+		}
+
+		var applied int
+		for _, f := range files {
+			if err := apply(f); err != nil {
+				l.logger.Errorf("lifecycle %s of: %s/%s failed. err: %s", rule, bucket, f.UUID, err.Error())
+				continue
+			}
+			applied++
+		}
+
+		metrics.LifecycleDeletions.WithLabelValues(bucket, rule).Add(float64(applied))
+
+		if len(files) < l.cfg.BatchSize || applied == 0 {
+			return
+		}
+	}
+}
+
+func (s *cdnService) ExpireDerivatives(bucket string, unusedSince time.Time) (int, error) {
+	bucketPath := path.Join(fs.BucketsPath(), bucket)
+
+	dirs, err := os.ReadDir(bucketPath)
+	if err != nil {
+		return 0, err
+	}
+
+	var removed int
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		// Derivatives of prior versions are stored next to them
+		dirPath := path.Join(bucketPath, dir.Name())
+		versions, _ := os.ReadDir(path.Join(dirPath, cdnpath.VersionsDir))
+
+		dirPaths := []string{dirPath}
+		for _, v := range versions {
+			dirPaths = append(dirPaths, path.Join(dirPath, cdnpath.VersionsDir, v.Name()))
+		}
+
+		for _, p := range dirPaths {
+			n, err := s.expireIn(p, unusedSince)
+			removed += n
+			if err != nil {
+				return removed, err
+			}
+		}
+	}
+
+	return removed, nil
+}
+
+// expireIn removes derivatives in dir of original not requested since given time
+func (s *cdnService) expireIn(dir string, unusedSince time.Time) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		// Deleted meanwhile
+		return 0, nil
+	}
+
+	var removed int
+	for _, e := range entries {
+		if !isExpirable(e) {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil || !info.ModTime().Before(unusedSince) {
+			continue
+		}
+
+		if err := s.DeleteAll(path.Join(dir, e.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// isExpirable tells whether file of original's dir is a rendered derivative.
+// Originals with their compressed variants and HLS packages are never rendered again, so they're kept
+func isExpirable(e os.DirEntry) bool {
+	return !e.IsDir() && !strings.HasPrefix(e.Name(), ".") && !strings.HasPrefix(e.Name(), fs.DefaultName)
+}
+
+// touch records access of derivative at path, see accessGranularity
+func (s *cdnService) touch(path string) {
+	if err := fs.Touch(path, accessGranularity); err != nil {
+		s.logger.Debugf("could not record access of: %s. err: %s", path, err.Error())
+	}
+}
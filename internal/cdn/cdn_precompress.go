@@ -0,0 +1,131 @@
+package cdn
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	cdnpath "animakuro/cdn/internal/cdn/path"
+	"animakuro/cdn/internal/entities"
+	"animakuro/cdn/internal/fs"
+	"animakuro/cdn/pkg/http/response"
+	"animakuro/cdn/pkg/precompress"
+)
+
+const (
+	// Max time to read originals' meta and compress a single file
+	precompressTimeout = time.Second * 30
+)
+
+// isPrecompressed tells whether files of module have compressed variants
+func (h *Handler) isPrecompressed(module string) bool {
+	return h.compressor != nil && h.moduleController.Precompressed(module)
+}
+
+// hasPrecompressed tells whether some of bucket's modules have compressed variants
+func (h *Handler) hasPrecompressed(b *entities.Bucket) bool {
+	for _, module := range b.Modules {
+		if h.isPrecompressed(module) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// precompressOriginals saves compressed variants of just uploaded files next to them.
+// Files of modules not precompressed are skipped.
+// Failures are logged but never affect the upload itself, files are served uncompressed then
+func (h *Handler) precompressOriginals(b *entities.Bucket, ids []string) {
+	for _, uuid := range ids {
+		ctx, cancel := context.WithTimeout(context.Background(), precompressTimeout)
+
+		f, err := h.service.GetFileDB(ctx, b.Name, uuid)
+		if err != nil {
+			cancel()
+			h.logger.Errorf("could not precompress: %s/%s. err: %s", b.Name, uuid, err.Error())
+			continue
+		}
+
+		if !h.isPrecompressed(h.moduleController.Select(b.Modules, f.MimeType)) {
+			cancel()
+			continue
+		}
+
+		pathToOriginal := cdnpath.ToOriginalFile(&cdnpath.Original{
+			BucketsPath: fs.BucketsPath(),
+			Bucket:      b.Name,
+			UUID:        uuid,
+			DefaultName: fs.DefaultName + f.Extension,
+		})
+
+		bits, err := h.service.ReadFile(pathToOriginal, f.AvailableIn)
+		if err != nil {
+			cancel()
+			h.logger.Errorf("could not precompress: %s. err: %s", pathToOriginal, err.Error())
+			continue
+		}
+
+		h.precompress(ctx, bits, pathToOriginal)
+		cancel()
+	}
+}
+
+// saveDerivative saves derivative rendered by module and its compressed variants if module has them.
+// Client doesn't wait for compression
+func (h *Handler) saveDerivative(module string, bits []byte, path string) {
+	h.service.MustSave(bits, path)
+
+	if h.isPrecompressed(module) {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), precompressTimeout)
+			defer cancel()
+
+			h.precompress(ctx, bits, path)
+		}()
+	}
+}
+
+// precompress saves variants of file at path as path + encoding's extension (e.g. ".br")
+func (h *Handler) precompress(ctx context.Context, bits []byte, path string) {
+	variants, err := h.compressor.Compress(ctx, bits)
+	if err != nil {
+		h.logger.Errorf("could not precompress: %s. err: %s", path, err.Error())
+		return
+	}
+
+	for encoding, variant := range variants {
+		h.service.MustSave(variant, path+precompress.Ext(encoding))
+	}
+}
+
+// serveVariant writes variant of file at path client accepts.
+// False means there's none and file itself should be served
+func (h *Handler) serveVariant(w http.ResponseWriter, r *http.Request, module string, path string, mime string) bool {
+	if !h.isPrecompressed(module) {
+		return false
+	}
+
+	// Response depends on the header even if file itself is served
+	w.Header().Set("Vary", "Accept-Encoding")
+
+	// Type of compressed variant can't be sniffed
+	if mime == "" {
+		return false
+	}
+
+	for _, encoding := range precompress.Negotiate(r.Header.Get("Accept-Encoding"), h.compressor.Encodings()) {
+		pathToVariant := path + precompress.Ext(encoding)
+		bits, isAvailable, err := h.service.ReadExisting(pathToVariant)
+		if err != nil || !isAvailable {
+			continue
+		}
+
+		h.fc.Increment(pathToVariant)
+		w.Header().Set("Content-Encoding", encoding)
+		response.Binary(w, bits, mime)
+		return true
+	}
+
+	return false
+}
@@ -2,6 +2,8 @@ package cdn
 
 import (
 	"context"
+	"strings"
+	"time"
 
 	"animakuro/cdn/internal/cdn/dto"
 	"animakuro/cdn/internal/entities"
@@ -10,27 +12,50 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.uber.org/zap"
 )
 
 const (
 	BucketCollection = "bucket"
 	FileCollection   = "file"
+
+	// Unique index of aliases in bucket, see migrations
+	aliasIndex = "file_alias_unique_idx"
 )
 
 type Repository interface {
 	GetBucket(ctx context.Context, name string) (*entities.Bucket, error)
 	GetAllBuckets(ctx context.Context) ([]*entities.Bucket, error)
 	SaveBucket(ctx context.Context, dto dto.CreateBucketDto) (*entities.Bucket, error)
+	// Replaces bucket presets and policies present in dto. Returns nil if bucket does not exist
+	UpdateBucket(ctx context.Context, name string, dto dto.UpdateBucketDto) (*entities.Bucket, error)
 
 	GetFile(ctx context.Context, bucket string, uuid string) (*entities.File, error)
+	// Returns nil if no file has alias
+	GetFileByAlias(ctx context.Context, bucket string, alias string) (*entities.File, error)
+	// Assigns alias to file, empty alias removes it. Returns file as it was before or nil if there's none.
+	// Fails with entities.ErrAliasTaken if another file of bucket has alias
+	SetAlias(ctx context.Context, bucket string, uuid string, alias string) (*entities.File, error)
+	// Returns false if file already exists. Fails with entities.ErrAliasTaken if its alias is taken
 	SaveFile(ctx context.Context, dto dto.SaveFileDto) (bool, error)
+	// Replaces current version of file if it's still the given one. Returns nil otherwise
+	UpdateFile(ctx context.Context, bucket string, uuid string, current int, dto dto.UpdateFileDto) (*entities.File, error)
 
 	// Actually deletes the file from database forever
 	DeleteFile(ctx context.Context, bucket string, uuid string) (bool, error)
-	// Makes file ready to be deleted.
-	// Marked file no longer can be accessed via GetFile
-	MarkAsDeletable(ctx context.Context, bucket string, mongoID primitive.ObjectID) error
+	// Makes file ready to be deleted and returns it as it was before.
+	// Marked file no longer can be accessed via GetFile. Returns nil if file is marked already
+	MarkAsDeletable(ctx context.Context, bucket string, mongoID primitive.ObjectID) (*entities.File, error)
+
+	// Files of bucket uploaded before given time and not marked yet, limit at most
+	GetExpiredFiles(ctx context.Context, bucket string, uploadedBefore time.Time, limit int64) ([]*entities.File, error)
+	// Files of bucket marked as deletable before given time, limit at most
+	GetDeletedFiles(ctx context.Context, bucket string, deletedBefore time.Time, limit int64) ([]*entities.File, error)
+	// Returns files of bucket not marked as deletable selected by dto, up to limit
+	GetFiles(ctx context.Context, bucket string, dto dto.BatchDeleteDto, limit int64) ([]*entities.File, error)
+	// Marks files as deletable with a single write. Returns files marked by this write only
+	MarkManyAsDeletable(ctx context.Context, mongoIDs []primitive.ObjectID) ([]*entities.File, error)
 }
 
 type cdnRepo struct {
@@ -55,13 +80,65 @@ func (r *cdnRepo) SaveBucket(ctx context.Context, dto dto.CreateBucketDto) (*ent
 	}
 
 	return &entities.Bucket{
-		ID:         res.InsertedID.(primitive.ObjectID),
-		Name:       dto.Name,
-		Operations: dto.Operations,
-		Module:     dto.Module,
+		ID:          res.InsertedID.(primitive.ObjectID),
+		Name:        dto.Name,
+		Operations:  dto.Operations,
+		Modules:     dto.Modules,
+		Presets:     dto.Presets,
+		PresetsOnly: dto.PresetsOnly,
+		Eager:       dto.Eager,
+		Strip:       dto.Strip,
+		HLS:         dto.HLS,
+		Upload:      dto.Upload,
+		Quota:       dto.Quota,
+		Lifecycle:   dto.Lifecycle,
+		Versioning:  dto.Versioning,
 	}, nil
 }
 
+func (r *cdnRepo) UpdateBucket(ctx context.Context, name string, dto dto.UpdateBucketDto) (*entities.Bucket, error) {
+
+	var b entities.Bucket
+
+	// Fields missing in request are kept
+	doc, err := bson.Marshal(dto)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields bson.M
+	if err := bson.Unmarshal(doc, &fields); err != nil {
+		return nil, err
+	}
+
+	set := bson.D{}
+	for _, field := range dto.Present() {
+		if v, ok := fields[field]; ok {
+			set = append(set, bson.E{field, v})
+		}
+	}
+
+	if len(set) == 0 {
+		return r.GetBucket(ctx, name)
+	}
+
+	q := bson.D{{"name", name}}
+	update := bson.D{{"$set", set}}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	res := r.db.Collection(BucketCollection).FindOneAndUpdate(ctx, q, update, opts)
+
+	if err := res.Decode(&b); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &b, nil
+}
+
 func (r *cdnRepo) GetBucket(ctx context.Context, name string) (*entities.Bucket, error) {
 
 	var b entities.Bucket
@@ -98,9 +175,59 @@ func (r *cdnRepo) GetFile(ctx context.Context, bucket string, uuid string) (*ent
 	return &f, nil
 }
 
+func (r *cdnRepo) GetFileByAlias(ctx context.Context, bucket string, alias string) (*entities.File, error) {
+
+	var f entities.File
+
+	q := bson.D{{"bucket", bucket}, {"alias", alias}}
+	res := r.db.Collection(FileCollection).FindOne(ctx, q)
+
+	if err := res.Decode(&f); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+func (r *cdnRepo) SetAlias(ctx context.Context, bucket string, uuid string, alias string) (*entities.File, error) {
+
+	var f entities.File
+
+	q := bson.D{{"bucket", bucket}, {"uuid", uuid}, {"is_deletable", false}}
+	update := bson.D{{"$set", bson.D{{"alias", alias}}}}
+	if alias == "" {
+		update = bson.D{{"$unset", bson.D{{"alias", ""}}}}
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+	res := r.db.Collection(FileCollection).FindOneAndUpdate(ctx, q, update, opts)
+
+	if err := res.Decode(&f); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, entities.ErrAliasTaken
+		}
+
+		return nil, err
+	}
+
+	return &f, nil
+}
+
 func (r *cdnRepo) SaveFile(ctx context.Context, dto dto.SaveFileDto) (bool, error) {
 	_, err := r.db.Collection(FileCollection).InsertOne(ctx, dto)
 	if err != nil {
+		if mongo.IsDuplicateKeyError(err) && strings.Contains(err.Error(), aliasIndex) {
+			return false, entities.ErrAliasTaken
+		}
+
 		if mongo.IsDuplicateKeyError(err) {
 			return false, nil
 		}
@@ -110,6 +237,33 @@ func (r *cdnRepo) SaveFile(ctx context.Context, dto dto.SaveFileDto) (bool, erro
 	return true, nil
 }
 
+func (r *cdnRepo) UpdateFile(ctx context.Context, bucket string, uuid string, current int, dto dto.UpdateFileDto) (*entities.File, error) {
+
+	var f entities.File
+
+	// Files never updated have no version
+	version := bson.E{"version", current}
+	if current == 1 {
+		version = bson.E{"version", bson.D{{"$in", bson.A{1, nil}}}}
+	}
+
+	q := bson.D{{"bucket", bucket}, {"uuid", uuid}, {"is_deletable", false}, version}
+	update := bson.D{{"$set", dto}}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	res := r.db.Collection(FileCollection).FindOneAndUpdate(ctx, q, update, opts)
+
+	if err := res.Decode(&f); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &f, nil
+}
+
 func (r *cdnRepo) GetAllBuckets(ctx context.Context) ([]*entities.Bucket, error) {
 
 	c, err := r.db.Collection(BucketCollection).Find(ctx, bson.D{{}})
@@ -150,17 +304,116 @@ func (r *cdnRepo) DeleteFile(ctx context.Context, bucket string, uuid string) (b
 	return true, nil
 }
 
-func (r *cdnRepo) MarkAsDeletable(ctx context.Context, bucket string, mongoID primitive.ObjectID) error {
+func (r *cdnRepo) MarkAsDeletable(ctx context.Context, bucket string, mongoID primitive.ObjectID) (*entities.File, error) {
+
+	var f entities.File
 
 	q := bson.D{{"_id", mongoID}, {"is_deletable", false}}
 
-	// Update
-	update := bson.D{{"$set", bson.D{{"is_deletable", true}}}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+	res := r.db.Collection(FileCollection).FindOneAndUpdate(ctx, q, deletableUpdate(primitive.NewObjectID()), opts)
 
-	_, err := r.db.Collection(FileCollection).UpdateOne(ctx, q, update)
+	if err := res.Decode(&f); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+func (r *cdnRepo) MarkManyAsDeletable(ctx context.Context, mongoIDs []primitive.ObjectID) ([]*entities.File, error) {
+
+	// Files marked meanwhile by another request have another marker
+	deletedBy := primitive.NewObjectID()
+
+	q := bson.D{{"_id", bson.D{{"$in", mongoIDs}}}, {"is_deletable", false}}
+
+	res, err := r.db.Collection(FileCollection).UpdateMany(ctx, q, deletableUpdate(deletedBy))
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if res.ModifiedCount == 0 {
+		return nil, nil
+	}
+
+	q = bson.D{{"_id", bson.D{{"$in", mongoIDs}}}, {"deleted_by", deletedBy}}
+
+	return r.findFiles(ctx, q, int64(len(mongoIDs)))
+}
+
+// deletableUpdate marks file as deletable now by request identified with deletedBy.
+// Alias of deleted file could be taken by another one
+func deletableUpdate(deletedBy primitive.ObjectID) bson.D {
+	return bson.D{
+		{"$set", bson.D{{"is_deletable", true}, {"deleted_at", time.Now()}, {"deleted_by", deletedBy}}},
+		{"$unset", bson.D{{"alias", ""}}},
+	}
+}
+
+func (r *cdnRepo) GetFiles(ctx context.Context, bucket string, dto dto.BatchDeleteDto, limit int64) ([]*entities.File, error) {
+
+	q := bson.D{{"bucket", bucket}, {"is_deletable", false}}
+	if len(dto.IDs) != 0 {
+		q = append(q, bson.E{"uuid", bson.D{{"$in", dto.IDs}}})
+	}
+
+	// Keys are validated by handler, so they're never operators
+	for k, v := range dto.Metadata {
+		q = append(q, bson.E{"metadata." + k, v})
+	}
+
+	return r.findFiles(ctx, q, limit)
+}
+
+func (r *cdnRepo) GetExpiredFiles(ctx context.Context, bucket string, uploadedBefore time.Time, limit int64) ([]*entities.File, error) {
+
+	// ObjectID starts with its creation time
+	q := bson.D{
+		{"bucket", bucket},
+		{"is_deletable", false},
+		{"_id", bson.D{{"$lt", primitive.NewObjectIDFromTimestamp(uploadedBefore)}}},
+	}
+
+	return r.findFiles(ctx, q, limit)
+}
+
+func (r *cdnRepo) GetDeletedFiles(ctx context.Context, bucket string, deletedBefore time.Time, limit int64) ([]*entities.File, error) {
+
+	// Files marked before deleted_at was recorded are old enough
+	q := bson.D{
+		{"bucket", bucket},
+		{"is_deletable", true},
+		{"$or", bson.A{
+			bson.D{{"deleted_at", bson.D{{"$lt", deletedBefore}}}},
+			bson.D{{"deleted_at", bson.D{{"$exists", false}}}},
+		}},
+	}
+
+	return r.findFiles(ctx, q, limit)
+}
+
+func (r *cdnRepo) findFiles(ctx context.Context, q bson.D, limit int64) ([]*entities.File, error) {
+
+	opts := options.Find().SetLimit(limit)
+	c, err := r.db.Collection(FileCollection).Find(ctx, q, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close(ctx)
+
+	var files []*entities.File
+
+	for c.Next(ctx) {
+		var f entities.File
+		if err := c.Decode(&f); err != nil {
+			return nil, err
+		}
+		files = append(files, &f)
 	}
 
-	return nil
+	return files, c.Err()
 }
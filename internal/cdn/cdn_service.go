@@ -2,19 +2,25 @@ package cdn
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"path"
+	"sync"
+	"time"
 
 	"animakuro/cdn/internal/cdn/cdnutil"
 	"animakuro/cdn/internal/cdn/dto"
+	cdnpath "animakuro/cdn/internal/cdn/path"
 	"animakuro/cdn/internal/entities"
 	"animakuro/cdn/internal/formdata"
 	"animakuro/cdn/internal/fs"
 
+	aliascache "animakuro/cdn/pkg/cache/alias"
 	bucketcache "animakuro/cdn/pkg/cache/bucket"
 	filecache "animakuro/cdn/pkg/cache/file"
 	"animakuro/cdn/pkg/dealer"
+	"animakuro/cdn/pkg/usage"
 
 	"github.com/gabriel-vasile/mimetype"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -24,6 +30,11 @@ import (
 const (
 	saveRetries   = 5
 	deleteRetries = 5
+
+	// Resolved aliases are cached for a while, so alias reassigned by another
+	// instance is picked up after aliasTTL at most
+	aliasCacheSize = 10000
+	aliasTTL       = time.Minute
 )
 
 type Service interface {
@@ -32,22 +43,48 @@ type Service interface {
 	GetBucketDB(ctx context.Context, bucketName string) (*entities.Bucket, error)
 	GetAllBucketsDB(ctx context.Context) ([]*entities.Bucket, error)
 	SaveBucketDB(ctx context.Context, dto dto.CreateBucketDto) (*entities.Bucket, error)
+	UpdateBucketDB(ctx context.Context, bucketName string, dto dto.UpdateBucketDto) (*entities.Bucket, error)
 
 	GetFileDB(ctx context.Context, bucket string, uuid string) (*entities.File, error)
 	SaveFileDB(ctx context.Context, dto dto.SaveFileDto) error
 	MarkAsDeletableDB(ctx context.Context, bucket string, mongoID primitive.ObjectID) error
+	// Marks files of bucket selected by dto as deletable at once, up to limit. Returns UUIDs of marked files
+	MarkManyAsDeletableDB(ctx context.Context, bucket string, dto dto.BatchDeleteDto, limit int64) ([]string, error)
 	DeleteFileDB(ctx context.Context, bucket string, uuid string) error
+	GetExpiredFilesDB(ctx context.Context, bucket string, uploadedBefore time.Time, limit int64) ([]*entities.File, error)
+	GetDeletedFilesDB(ctx context.Context, bucket string, deletedBefore time.Time, limit int64) ([]*entities.File, error)
+	// Replaces current version of file if it's still the given one
+	UpdateFileDB(ctx context.Context, bucket string, uuid string, current int, dto dto.UpdateFileDto) (*entities.File, error)
+	// Assigns alias to file, empty alias removes it
+	SetAliasDB(ctx context.Context, bucket string, uuid string, alias string) error
+	// Returns UUID of file aliased in bucket
+	ResolveAlias(ctx context.Context, bucket string, alias string) (string, error)
 
 	//Internal CDN logic
 	UploadMany(ctx context.Context, bucket string, files []*formdata.UploadFile) ([]string, []string, error)
 	MustSave(buff []byte, path string)
+	// Uploads file as a new version of f. Prior version is kept per bucket's versioning policy
+	UpdateFile(ctx context.Context, f *entities.File, file *formdata.UploadFile) (*entities.File, error)
+	// Uploads retained prior version of f as a new version
+	RollbackFile(ctx context.Context, f *entities.File, version int) (*entities.File, error)
+	// Copies or moves f to bucket as a new file reusing its stored bytes. Returns its id and url
+	TransferFile(ctx context.Context, f *entities.File, bucket string, move bool, keepMetadata bool) (string, string, error)
 
 	ReadFile(path string, hosts []string) ([]byte, error)
 	ReadExisting(path string) ([]byte, bool, error)
+	// Reads original file by bucket and uuid (see modules.FileReader)
+	ReadOriginal(ctx context.Context, bucket string, uuid string) ([]byte, error)
 
 	DeleteAll(path string) error
 	TryDeleteLocally(dirPath string)
 
+	// Bytes and objects stored by bucket
+	Usage(bucket string) usage.Usage
+	// Accounts files written to dir bypassing MustSave (e.g. HLS packages) as derivatives
+	AccountDerivatives(bucket string, dir string)
+	// Removes derivatives of bucket not requested since given time. Returns number of removed files
+	ExpireDerivatives(bucket string, unusedSince time.Time) (int, error)
+
 	ParseMime(buff []byte) string
 }
 
@@ -58,6 +95,10 @@ type cdnService struct {
 	dealer     *dealer.Dealer
 	bc         *bucketcache.BucketCache
 	fc         filecache.FileCache
+	usage      *usage.Tracker
+	aliases    *aliascache.AliasCache
+	// Serializes moving of originals on update
+	updateMu sync.Mutex
 }
 
 func NewService(logger *zap.SugaredLogger,
@@ -73,6 +114,8 @@ func NewService(logger *zap.SugaredLogger,
 		fc:         fileCache,
 		domain:     domain,
 		dealer:     dealer,
+		usage:      usage.New(observeUsage),
+		aliases:    aliascache.NewAliasCache(aliasCacheSize, aliasTTL),
 	}
 }
 
@@ -114,6 +157,10 @@ func (s *cdnService) GetFileDB(ctx context.Context, bucket string, name string)
 
 func (s *cdnService) SaveFileDB(ctx context.Context, dto dto.SaveFileDto) error {
 	ok, err := s.repository.SaveFile(ctx, dto)
+	if errors.Is(err, entities.ErrAliasTaken) {
+		return err
+	}
+
 	if err != nil {
 		return cdnutil.WrapInternal(err, "cdnService.SaveFileDB.s.repository.SaveFile")
 	}
@@ -140,6 +187,20 @@ func (s *cdnService) SaveBucketDB(ctx context.Context, dto dto.CreateBucketDto)
 	return b, nil
 }
 
+func (s *cdnService) UpdateBucketDB(ctx context.Context, bucketName string, dto dto.UpdateBucketDto) (*entities.Bucket, error) {
+	b, err := s.repository.UpdateBucket(ctx, bucketName, dto)
+	if err != nil {
+		return nil, cdnutil.WrapInternal(err, "cdnService.UpdateBucketDB.repository.UpdateBucket")
+	}
+
+	// No bucket was found
+	if b == nil {
+		return nil, entities.ErrBucketNotFound
+	}
+
+	return b, nil
+}
+
 func (s *cdnService) GetAllBucketsDB(ctx context.Context) ([]*entities.Bucket, error) {
 	buckets, err := s.repository.GetAllBuckets(ctx)
 	if err != nil {
@@ -168,17 +229,44 @@ func (s *cdnService) DeleteFileDB(ctx context.Context, bucket string, uuid strin
 }
 
 func (s *cdnService) MarkAsDeletableDB(ctx context.Context, bucket string, mongoID primitive.ObjectID) error {
-	if err := s.repository.MarkAsDeletable(ctx, bucket, mongoID); err != nil {
+	f, err := s.repository.MarkAsDeletable(ctx, bucket, mongoID)
+	if err != nil {
 		return cdnutil.WrapInternal(err, "cdnService.MarkAsDeletableDB.s.repository.MarkAsDeletable")
 	}
+
+	// Alias of deleted file resolves to nothing
+	if f != nil && f.Alias != "" {
+		s.aliases.Remove(bucket, f.Alias)
+	}
 	return nil
 }
 
+func (s *cdnService) GetExpiredFilesDB(ctx context.Context, bucket string, uploadedBefore time.Time, limit int64) ([]*entities.File, error) {
+	files, err := s.repository.GetExpiredFiles(ctx, bucket, uploadedBefore, limit)
+	if err != nil {
+		return nil, cdnutil.WrapInternal(err, "cdnService.GetExpiredFilesDB.s.repository.GetExpiredFiles")
+	}
+
+	return files, nil
+}
+
+func (s *cdnService) GetDeletedFilesDB(ctx context.Context, bucket string, deletedBefore time.Time, limit int64) ([]*entities.File, error) {
+	files, err := s.repository.GetDeletedFiles(ctx, bucket, deletedBefore, limit)
+	if err != nil {
+		return nil, cdnutil.WrapInternal(err, "cdnService.GetDeletedFilesDB.s.repository.GetDeletedFiles")
+	}
+
+	return files, nil
+}
+
 func (s *cdnService) UploadMany(ctx context.Context, bucket string, files []*formdata.UploadFile) ([]string, []string, error) {
 	var urls []string
 	var ids []string
 
-	for _, file := range files {
+	// Files are read and processed first, so quota is checked against bytes actually written
+	buffs := make([][]byte, len(files))
+	var reserved usage.Counter
+	for i, file := range files {
 		osfile, err := file.Open()
 		if err != nil {
 			return nil, nil, cdnutil.WrapInternal(err, "UploadFiles.file.Open")
@@ -189,6 +277,25 @@ func (s *cdnService) UploadMany(ctx context.Context, bucket string, files []*for
 			return nil, nil, cdnutil.WrapInternal(err, "UploadFiles.io.ReadAll")
 		}
 
+		if file.Process != nil {
+			buff, err = file.Process(buff)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		buffs[i] = buff
+		reserved.Bytes += int64(len(buff))
+		reserved.Objects++
+	}
+
+	if err := s.usage.Reserve(bucket, usage.Originals, reserved, s.limits(bucket)); err != nil {
+		return nil, nil, err
+	}
+
+	for i, file := range files {
+		buff := buffs[i]
+
 		j := s.dealer.Run(func() *dealer.JobResult {
 			// todo: move path to var
 			return dealer.NewJobResult(nil, fs.WriteFileToBucket(buff, bucket, file.UUID, file.UploadName))
@@ -196,8 +303,12 @@ func (s *cdnService) UploadMany(ctx context.Context, bucket string, files []*for
 
 		res := j.Wait()
 		if err := res.Err; err != nil {
+			// Files left are never written
+			s.usage.Add(bucket, usage.Originals, usage.Counter{Bytes: -reserved.Bytes, Objects: -reserved.Objects})
 			return nil, nil, cdnutil.WrapInternal(err, "cdnService.UploadFiles.fs.WriteFileToBucket")
 		}
+		reserved.Bytes -= int64(len(buff))
+		reserved.Objects--
 
 		//todo: get host from env
 		fdto := dto.SaveFileDto{
@@ -207,10 +318,14 @@ func (s *cdnService) UploadMany(ctx context.Context, bucket string, files []*for
 			MimeType:    file.MimeType,
 			UUID:        file.UUID,
 			Extension:   "." + file.Extension,
+			Metadata:    file.Metadata,
+			Alias:       file.Alias,
 		}
 
-		err = s.SaveFileDB(ctx, fdto)
+		err := s.SaveFileDB(ctx, fdto)
 		if err != nil {
+			s.usage.Add(bucket, usage.Originals, usage.Counter{Bytes: -reserved.Bytes, Objects: -reserved.Objects})
+
 			// If saving to DB has failed then delete file locally.
 			defer func() {
 				// TODO: move to cdn/path
@@ -222,10 +337,19 @@ func (s *cdnService) UploadMany(ctx context.Context, bucket string, files []*for
 				}
 			}()
 
+			if errors.Is(err, entities.ErrAliasTaken) {
+				return nil, nil, err
+			}
+
 			// Return to client that something went wrong
 			return nil, nil, cdnutil.ChainInternal(err, "cdnService.UploadMany->cdnService.SaveFileDB")
 		}
 
+		// Alias could be cached as one of a file deleted before
+		if file.Alias != "" {
+			s.aliases.Remove(bucket, file.Alias)
+		}
+
 		fileURL := fmt.Sprintf("%s/%s/%s", s.domain, bucket, file.UUID)
 
 		urls = append(urls, fileURL)
@@ -266,7 +390,46 @@ func (s *cdnService) ReadFile(path string, hosts []string) ([]byte, error) {
 	return bits, nil
 }
 
+func (s *cdnService) ReadOriginal(ctx context.Context, bucket string, uuid string) ([]byte, error) {
+	f, err := s.GetFileDB(ctx, bucket, uuid)
+	if err != nil {
+		// Do not wrap
+		return nil, err
+	}
+
+	pathToOriginal := cdnpath.ToOriginalFile(&cdnpath.Original{
+		BucketsPath: fs.BucketsPath(),
+		Bucket:      bucket,
+		UUID:        uuid,
+		DefaultName: fs.DefaultName + f.Extension,
+	})
+
+	bits, err := s.ReadFile(pathToOriginal, f.AvailableIn)
+	if err != nil {
+		return nil, cdnutil.ChainInternal(err, "cdnService.ReadOriginal->cdnService.ReadFile")
+	}
+
+	// Frequently read originals get to the file cache the same way as in Handler.Get
+	s.fc.Increment(pathToOriginal)
+
+	return bits, nil
+}
+
 func (s *cdnService) MustSave(buff []byte, path string) {
+	// Derivatives are never saved over bucket's quota, they're rendered on every request then
+	bucket, _, isInBucket := locate(path)
+	grown := usage.Counter{Bytes: int64(len(buff)), Objects: 1}
+	if size, ok := fs.Size(path); ok {
+		// Overwritten
+		grown = usage.Counter{Bytes: int64(len(buff)) - size}
+	}
+
+	if isInBucket {
+		if err := s.usage.Reserve(bucket, usage.Derivatives, grown, s.limits(bucket)); err != nil {
+			s.logger.Warnf("could not save file: %s. err: %s", path, err.Error())
+			return
+		}
+	}
 
 	var ok bool
 	for i := 0; i < saveRetries; i++ {
@@ -289,6 +452,9 @@ func (s *cdnService) MustSave(buff []byte, path string) {
 
 	if !ok {
 		s.logger.Errorf("could not save file: %s. Fatal", path)
+		if isInBucket {
+			s.usage.Add(bucket, usage.Derivatives, usage.Counter{Bytes: -grown.Bytes, Objects: -grown.Objects})
+		}
 		return
 	}
 
@@ -306,6 +472,8 @@ func (s *cdnService) InitBuckets(ctx context.Context) error {
 	for _, bucket := range buckets {
 		s.bc.Add(bucket)
 		s.logger.Debugf("bucket: '%s' is added to cache", bucket.Name)
+
+		s.scanUsage(bucket.Name)
 	}
 
 	return nil
@@ -315,6 +483,7 @@ func (s *cdnService) ReadExisting(path string) ([]byte, bool, error) {
 	// Lookup in cache firstly
 	bits, isCached := s.fc.Lookup(path)
 	if isCached {
+		s.touch(path)
 		return bits, true, nil
 	}
 
@@ -333,6 +502,7 @@ func (s *cdnService) ReadExisting(path string) ([]byte, bool, error) {
 			return nil, false, cdnutil.WrapInternal(err, "cdnService.TryReadExisting.fs.ReadFile")
 		}
 
+		s.touch(path)
 		return bits, true, nil
 	}
 
@@ -343,6 +513,7 @@ func (s *cdnService) ReadExisting(path string) ([]byte, bool, error) {
 func (s *cdnService) TryDeleteLocally(dirPath string) {
 
 	s.logger.Debugf("trying to delete locally: %s", dirPath)
+	freed := s.usageOf(dirPath)
 	j := s.dealer.Run(func() *dealer.JobResult {
 		return dealer.NewJobResult(nil, fs.TryDelete(dirPath))
 	})
@@ -350,13 +521,17 @@ func (s *cdnService) TryDeleteLocally(dirPath string) {
 	res := j.Wait()
 	if err := res.Err; err != nil {
 		s.logger.Errorf("could not delete locally at: %s", err.Error())
+		return
 	}
+
+	s.release(dirPath, freed)
 	return
 }
 
 func (s *cdnService) DeleteAll(path string) error {
 
 	s.logger.Debugf("deleting all at: %s", path)
+	freed := s.usageOf(path)
 
 	var ok bool
 	for i := 0; i < deleteRetries; i++ {
@@ -373,9 +548,11 @@ func (s *cdnService) DeleteAll(path string) error {
 
 		//Deleted successfully
 		ok = true
+		break
 	}
 
 	if ok {
+		s.release(path, freed)
 		return nil
 	}
 
@@ -0,0 +1,92 @@
+package cdn
+
+import (
+	"fmt"
+	"net/url"
+
+	"animakuro/cdn/internal/entities"
+	"animakuro/cdn/internal/modules"
+)
+
+// Name of resolver removing metadata. Files of modules not implementing it are kept as is
+const stripResolver = "strip"
+
+// stripModuleMap parses bucket's strip policy into ModuleMap of a single strip resolver of module.
+// Nil if module can't strip files
+func (h *Handler) stripModuleMap(policy *entities.StripPolicy, module string) (modules.ModuleMap, error) {
+	if !h.moduleController.HasResolver(module, stripResolver) {
+		return nil, nil
+	}
+
+	q := url.Values{}
+	q.Set(fmt.Sprintf("%s.%s", module, stripResolver), policy.Argument())
+
+	_, mm, err := h.moduleController.Parse(q, []string{module})
+	return mm, err
+}
+
+// validateStrip checks that policy is known and some of bucket's modules could strip files
+func (h *Handler) validateStrip(policy *entities.StripPolicy, bucketModules []string) error {
+	if policy == nil {
+		return nil
+	}
+
+	if policy.On != entities.StripOnUpload && policy.On != entities.StripOnDelivery {
+		return entities.ErrInvalidStrip
+	}
+
+	stripping := false
+	for _, module := range bucketModules {
+		stripMap, err := h.stripModuleMap(policy, module)
+		if err != nil {
+			return err
+		}
+		stripping = stripping || stripMap != nil
+	}
+
+	if !stripping {
+		return entities.ErrStripUnsupported
+	}
+
+	return nil
+}
+
+// withStrip adds strip resolver of module to moduleMap if bucket strips files on delivery.
+// Bucket policy overrides strip requested by client. Original file (nil moduleMap) becomes stripped derivative
+func (h *Handler) withStrip(moduleMap modules.ModuleMap, b *entities.Bucket, module string) (modules.ModuleMap, error) {
+	if b.Strip == nil || b.Strip.On != entities.StripOnDelivery || module == "" {
+		return moduleMap, nil
+	}
+
+	stripMap, err := h.stripModuleMap(b.Strip, module)
+	if err != nil || stripMap == nil {
+		return moduleMap, err
+	}
+
+	merged := make(modules.ModuleMap, len(moduleMap)+len(stripMap))
+	for resolver, arg := range moduleMap {
+		merged[resolver] = arg
+	}
+	for resolver, arg := range stripMap {
+		merged[resolver] = arg
+	}
+
+	return merged, nil
+}
+
+// stripOnUpload returns formdata.UploadFile.Process stripping originals of module
+// if bucket strips files on upload. Returns nil otherwise
+func (h *Handler) stripOnUpload(b *entities.Bucket, module string) (func(buff []byte) ([]byte, error), error) {
+	if b.Strip == nil || b.Strip.On != entities.StripOnUpload || module == "" {
+		return nil, nil
+	}
+
+	stripMap, err := h.stripModuleMap(b.Strip, module)
+	if err != nil || stripMap == nil {
+		return nil, err
+	}
+
+	return func(buff []byte) ([]byte, error) {
+		return h.render(buff, b, module, stripMap)
+	}, nil
+}
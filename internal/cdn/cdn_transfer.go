@@ -0,0 +1,222 @@
+package cdn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+
+	cdn_go "animakuro/cdn"
+	"animakuro/cdn/internal/cdn/cdnutil"
+	"animakuro/cdn/internal/cdn/dto"
+	cdn_errors "animakuro/cdn/internal/cdn/errors"
+	cdnpath "animakuro/cdn/internal/cdn/path"
+	"animakuro/cdn/internal/entities"
+	"animakuro/cdn/internal/formdata"
+	"animakuro/cdn/internal/fs"
+	"animakuro/cdn/pkg/dealer"
+	"animakuro/cdn/pkg/http/response"
+	"animakuro/cdn/pkg/usage"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Max files copied or moved by a single request
+const maxTransferBatch = 1000
+
+// Transfer copies or moves a single file or a batch of files to bucket given by
+// cdn_go.URLDestinationKey. Auth of both buckets is checked by jwt middleware's Transfer.
+// Batch responds with result of every file, a single file with its error if any
+func (h *Handler) Transfer(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	bucket := vars[cdn_go.BucketKey]
+	uuid := vars[cdn_go.FileUUIDKey]
+	move := vars[cdn_go.TransferKey] == cdn_go.TransferMove
+
+	destination, err := h.bc.Get(r.URL.Query().Get(cdn_go.URLDestinationKey))
+	if err != nil {
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	if move && destination.Name == bucket {
+		cdn_errors.ToHttp(h.logger, w, entities.ErrSameBucket)
+		return
+	}
+
+	// Body is optional for a single file
+	var inp dto.TransferDto
+	if err := json.NewDecoder(r.Body).Decode(&inp); err != nil && err != io.EOF {
+		err = cdnutil.WrapInternal(err, "Handler.Transfer.json.Decode")
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	if uuid != "" {
+		id, url, err := h.transfer(r.Context(), bucket, uuid, destination, move, inp.Metadata)
+		if err != nil {
+			cdn_errors.ToHttp(h.logger, w, err)
+			return
+		}
+
+		response.Json(h.logger, w, http.StatusCreated, response.JSON{
+			"id":  id,
+			"url": url,
+		})
+		return
+	}
+
+	if len(inp.IDs) == 0 {
+		cdn_errors.ToHttp(h.logger, w, entities.ErrNoFiles)
+		return
+	}
+
+	if len(inp.IDs) > maxTransferBatch {
+		err := fmt.Errorf("%w: %d files exceed limit of %d", entities.ErrBatchTooLarge, len(inp.IDs), maxTransferBatch)
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	// Files are transferred one by one, failure of one doesn't stop the others
+	results := make([]response.JSON, 0, len(inp.IDs))
+	for _, source := range inp.IDs {
+		id, url, err := h.transfer(r.Context(), bucket, source, destination, move, inp.Metadata)
+		if err != nil {
+			message, code := cdn_errors.Describe(h.logger, err)
+			results = append(results, response.JSON{
+				"source": source,
+				"status": code,
+				"error":  message,
+			})
+			continue
+		}
+
+		results = append(results, response.JSON{
+			"source": source,
+			"status": http.StatusCreated,
+			"id":     id,
+			"url":    url,
+		})
+	}
+
+	response.Json(h.logger, w, http.StatusOK, response.JSON{
+		"results": results,
+	})
+}
+
+// transfer copies or moves file of bucket to destination and starts background work on a new file
+// just like upload does. Returns its id and url
+func (h *Handler) transfer(ctx context.Context, bucket string, uuid string, destination *entities.Bucket, move bool, keepMetadata bool) (string, string, error) {
+	f, err := h.service.GetFileDB(ctx, bucket, uuid)
+	if err != nil {
+		return "", "", err
+	}
+
+	id, url, err := h.service.TransferFile(ctx, f, destination.Name, move, keepMetadata)
+	if err != nil {
+		return "", "", err
+	}
+
+	h.afterUpload(destination, []string{id})
+	return id, url, nil
+}
+
+func (s *cdnService) TransferFile(ctx context.Context, f *entities.File, bucket string, move bool, keepMetadata bool) (string, string, error) {
+	b, err := s.bc.Get(bucket)
+	if err != nil {
+		return "", "", err
+	}
+
+	sourceDir := path.Join(fs.BucketsPath(), cdnpath.ToDir(f.Bucket, f.UUID))
+	pathToSource := path.Join(sourceDir, fs.DefaultName+f.Extension)
+
+	size, ok := fs.Size(pathToSource)
+	if !ok {
+		return "", "", entities.ErrFileNotFound
+	}
+
+	// Destination accepts files of its upload policy only
+	err = formdata.CheckPolicy([]*formdata.UploadFile{{MimeType: f.MimeType, Size: size}}, b.Upload)
+	if err != nil {
+		return "", "", err
+	}
+
+	added := usage.Counter{Bytes: size, Objects: 1}
+	if err := s.usage.Reserve(bucket, usage.Originals, added, s.limits(bucket)); err != nil {
+		return "", "", err
+	}
+	giveBack := func() {
+		s.usage.Add(bucket, usage.Originals, usage.Counter{Bytes: -added.Bytes, Objects: -added.Objects})
+	}
+
+	// UUIDs are unique across buckets, so the new file gets its own even if moved
+	id := uuid.New().String()
+	targetDir := path.Join(fs.BucketsPath(), cdnpath.ToDir(bucket, id))
+	pathToTarget := path.Join(targetDir, fs.DefaultName+f.Extension)
+
+	// Stored bytes are reused. Derivatives and prior versions are not,
+	// destination renders its own ones
+	transfer := fs.Link
+	if move {
+		transfer = fs.Move
+	}
+
+	j := s.dealer.Run(func() *dealer.JobResult {
+		return dealer.NewJobResult(nil, transfer(pathToSource, pathToTarget))
+	})
+
+	if err := j.Wait().Err; err != nil {
+		giveBack()
+		return "", "", cdnutil.ChainInternal(err, "cdnService.TransferFile->transfer")
+	}
+
+	fdto := dto.SaveFileDto{
+		Name:        fs.DefaultName + f.Extension,
+		Bucket:      bucket,
+		AvailableIn: []string{s.domain},
+		MimeType:    f.MimeType,
+		UUID:        id,
+		Extension:   f.Extension,
+	}
+	if keepMetadata {
+		fdto.Metadata = f.Metadata
+	}
+
+	if err := s.SaveFileDB(ctx, fdto); err != nil {
+		if move {
+			if err := fs.Move(pathToTarget, pathToSource); err != nil {
+				s.logger.Errorf("could not move back: %s. err: %s", pathToTarget, err.Error())
+			}
+		}
+
+		if err := fs.TryDelete(targetDir); err != nil {
+			s.logger.Errorf("could not delete: %s. err: %s", targetDir, err.Error())
+		}
+
+		giveBack()
+		return "", "", cdnutil.ChainInternal(err, "cdnService.TransferFile->cdnService.SaveFileDB")
+	}
+
+	if move {
+		// Source is deleted the same way as on Handler.Delete. Moved original is not in its dir anymore
+		s.usage.Add(f.Bucket, usage.Originals, usage.Counter{Bytes: -size, Objects: -1})
+
+		if err := s.MarkAsDeletableDB(ctx, f.Bucket, f.ID); err != nil {
+			s.logger.Errorf("could not mark moved file: %s/%s. err: %s", f.Bucket, f.UUID, err.Error())
+		}
+
+		if err := s.DeleteAll(sourceDir); err != nil {
+			s.logger.Errorf("could not delete moved file: %s. err: %s", sourceDir, err.Error())
+		}
+
+		// Cached files of source are never requested again
+		s.fc.Invalidate(sourceDir)
+	}
+
+	s.logger.Debugf("transferred: %s/%s to %s/%s", f.Bucket, f.UUID, bucket, id)
+	return id, fmt.Sprintf("%s/%s/%s", s.domain, bucket, id), nil
+}
@@ -0,0 +1,82 @@
+package cdn
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"animakuro/cdn/internal/entities"
+	"animakuro/cdn/internal/formdata"
+)
+
+// validateUpload checks that policy's types are well-formed and limits are not negative
+func (h *Handler) validateUpload(policy *entities.UploadPolicy) error {
+	if policy == nil {
+		return nil
+	}
+
+	if policy.MaxFileSize < 0 || policy.MaxRequestSize < 0 || policy.MaxFiles < 0 {
+		return entities.ErrInvalidUploadPolicy
+	}
+
+	for _, t := range policy.MimeTypes {
+		if t != strings.ToLower(t) {
+			return entities.ErrInvalidUploadPolicy
+		}
+
+		// Top-level type, e.g. "image/"
+		if top, sub, ok := strings.Cut(t, "/"); ok && top != "" && sub == "" {
+			continue
+		}
+
+		if mediaType, params, err := mime.ParseMediaType(t); err != nil || mediaType != t || len(params) != 0 {
+			return entities.ErrInvalidUploadPolicy
+		}
+	}
+
+	return nil
+}
+
+// uploadLimit is max bytes of upload request to bucket
+func (h *Handler) uploadLimit(b *entities.Bucket) int64 {
+	// Config holds megabytes
+	limit := h.memConfig.MaxUploadSize * 1_000_000
+	if b.Upload != nil && b.Upload.MaxRequestSize > 0 && b.Upload.MaxRequestSize < limit {
+		limit = b.Upload.MaxRequestSize
+	}
+
+	return limit
+}
+
+// parseUpload parses files of upload request within bucket's limits. Request is kept in memory
+// as a whole, so files violating bucket's policy are rejected before anything is written to disk
+func (h *Handler) parseUpload(r *http.Request, b *entities.Bucket) ([]*formdata.UploadFile, error) {
+	limit := h.uploadLimit(b)
+	if r.ContentLength > limit {
+		return nil, fmt.Errorf("%w: %d bytes exceed limit of %d", formdata.ErrRequestTooLarge, r.ContentLength, limit)
+	}
+
+	body := formdata.LimitBody(r.Body, limit)
+	r.Body = body
+
+	// Form never exceeds memory limit, so none of its files is spilled into temporary ones
+	if err := r.ParseMultipartForm(limit); err != nil {
+		if body.Exceeded() {
+			return nil, fmt.Errorf("%w: exceeds limit of %d bytes", formdata.ErrRequestTooLarge, limit)
+		}
+		return nil, fmt.Errorf("%w: %v", formdata.ErrInvalidForm, err)
+	}
+
+	// Get files attached to MultipartForm
+	files, err := formdata.ParseFiles(r.MultipartForm)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := formdata.CheckPolicy(files, b.Upload); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
@@ -0,0 +1,161 @@
+package cdn
+
+import (
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	cdn_go "animakuro/cdn"
+	cdn_errors "animakuro/cdn/internal/cdn/errors"
+	cdnpath "animakuro/cdn/internal/cdn/path"
+	"animakuro/cdn/internal/entities"
+	"animakuro/cdn/internal/fs"
+	"animakuro/cdn/pkg/http/response"
+	"animakuro/cdn/pkg/metrics"
+	"animakuro/cdn/pkg/usage"
+
+	"github.com/gorilla/mux"
+)
+
+// validateQuota checks that quota's limits are not negative
+func (h *Handler) validateQuota(quota *entities.QuotaPolicy) error {
+	if quota == nil {
+		return nil
+	}
+
+	if quota.MaxBytes < 0 || quota.MaxObjects < 0 {
+		return entities.ErrInvalidQuota
+	}
+
+	return nil
+}
+
+// GetUsage writes bytes and objects stored by bucket along with its quota
+func (h *Handler) GetUsage(w http.ResponseWriter, r *http.Request) {
+	bucket := mux.Vars(r)[cdn_go.BucketKey]
+
+	b, err := h.bc.Get(bucket)
+	if err != nil {
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	u := h.service.Usage(b.Name)
+	response.Json(h.logger, w, http.StatusOK, response.JSON{
+		"bucket":      b.Name,
+		"originals":   u.Originals,
+		"derivatives": u.Derivatives,
+		"total":       u.Total(),
+		"quota":       b.Quota,
+	})
+}
+
+func (s *cdnService) Usage(bucket string) usage.Usage {
+	return s.usage.Get(bucket)
+}
+
+func (s *cdnService) AccountDerivatives(bucket string, dir string) {
+	u, err := usage.Scan(dir, func(string) string { return usage.Derivatives })
+	if err != nil {
+		s.logger.Errorf("could not account usage of: %s. err: %s", dir, err.Error())
+		return
+	}
+
+	s.usage.Add(bucket, usage.Derivatives, u.Derivatives)
+}
+
+// scanUsage counts files bucket stores on disk
+func (s *cdnService) scanUsage(bucket string) {
+	u, err := usage.Scan(path.Join(fs.BucketsPath(), bucket), classify)
+	if err != nil {
+		s.logger.Errorf("could not scan usage of bucket: %s. err: %s", bucket, err.Error())
+		return
+	}
+
+	s.usage.Set(bucket, u)
+	s.logger.Debugf("bucket: '%s' stores %d bytes", bucket, u.Total().Bytes)
+}
+
+// limits of bucket's quota. Buckets not in cache are not limited
+func (s *cdnService) limits(bucket string) usage.Limits {
+	b, err := s.bc.Get(bucket)
+	if err != nil || b.Quota == nil {
+		return usage.Limits{}
+	}
+
+	return usage.Limits{MaxBytes: b.Quota.MaxBytes, MaxObjects: b.Quota.MaxObjects}
+}
+
+// usageOf counts files at p (file or dir) before it's deleted
+func (s *cdnService) usageOf(p string) usage.Usage {
+	_, rel, ok := locate(p)
+	if !ok {
+		return usage.Usage{}
+	}
+
+	u, err := usage.Scan(p, func(r string) string {
+		return classify(path.Join(rel, r))
+	})
+	if err != nil {
+		s.logger.Errorf("could not account usage of: %s. err: %s", p, err.Error())
+	}
+
+	return u
+}
+
+// release subtracts usage of deleted files at p
+func (s *cdnService) release(p string, freed usage.Usage) {
+	bucket, _, ok := locate(p)
+	if !ok {
+		return
+	}
+
+	s.usage.Add(bucket, usage.Originals, usage.Counter{Bytes: -freed.Originals.Bytes, Objects: -freed.Originals.Objects})
+	s.usage.Add(bucket, usage.Derivatives, usage.Counter{Bytes: -freed.Derivatives.Bytes, Objects: -freed.Derivatives.Objects})
+}
+
+// locate splits p into bucket and path relative to bucket's dir. False if p is not in a bucket
+func locate(p string) (string, string, bool) {
+	rel, err := filepath.Rel(fs.BucketsPath(), p)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", "", false
+	}
+
+	bucket, rest, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	return bucket, rest, true
+}
+
+// classify tells kind of file at rel path in bucket's dir.
+// Originals are stored as uuid/data.{ext} and uuid/versions/{n}/data.{ext}, everything else is derived from them
+func classify(rel string) string {
+	parts := strings.Split(rel, "/")
+	switch {
+	// Bucket's meta
+	case len(parts) == 1:
+		return ""
+	case len(parts) == 2 && isOriginalName(parts[1]):
+		return usage.Originals
+	case len(parts) == 4 && parts[1] == cdnpath.VersionsDir && isOriginalName(parts[3]):
+		return usage.Originals
+	default:
+		return usage.Derivatives
+	}
+}
+
+func isOriginalName(name string) bool {
+	if name == fs.DefaultName {
+		return true
+	}
+
+	// Compressed variants of originals (data.css.gz) are derivatives
+	return strings.HasPrefix(name, fs.DefaultName+".") && strings.Count(name, ".") == 1
+}
+
+// observeUsage exposes bucket's usage as gauges
+func observeUsage(bucket string, u usage.Usage) {
+	metrics.BucketBytes.WithLabelValues(bucket, usage.Originals).Set(float64(u.Originals.Bytes))
+	metrics.BucketBytes.WithLabelValues(bucket, usage.Derivatives).Set(float64(u.Derivatives.Bytes))
+	metrics.BucketObjects.WithLabelValues(bucket, usage.Originals).Set(float64(u.Originals.Objects))
+	metrics.BucketObjects.WithLabelValues(bucket, usage.Derivatives).Set(float64(u.Derivatives.Objects))
+}
@@ -0,0 +1,359 @@
+package cdn
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	cdn_go "animakuro/cdn"
+	"animakuro/cdn/internal/cdn/cdnutil"
+	"animakuro/cdn/internal/cdn/dto"
+	cdn_errors "animakuro/cdn/internal/cdn/errors"
+	cdnpath "animakuro/cdn/internal/cdn/path"
+	"animakuro/cdn/internal/entities"
+	"animakuro/cdn/internal/formdata"
+	"animakuro/cdn/internal/fs"
+	"animakuro/cdn/pkg/dealer"
+	"animakuro/cdn/pkg/http/response"
+	"animakuro/cdn/pkg/usage"
+
+	"github.com/gorilla/mux"
+)
+
+// validateVersioning checks that versioning doesn't keep negative number of versions
+func (h *Handler) validateVersioning(versioning *entities.VersioningPolicy) error {
+	if versioning == nil {
+		return nil
+	}
+
+	if versioning.Keep < 0 {
+		return entities.ErrInvalidVersioning
+	}
+
+	return nil
+}
+
+// parseVersion parses version number of URL query or path
+func parseVersion(s string) (int, error) {
+	version, err := strconv.Atoi(s)
+	if err != nil || version < 1 {
+		return 0, entities.ErrInvalidVersion
+	}
+
+	return version, nil
+}
+
+// requestedVersion takes version out of URL query, so it's not mistaken for resolvers.
+// Zero means current version
+func requestedVersion(q url.Values) (int, error) {
+	if !q.Has(cdn_go.URLVersionKey) {
+		return 0, nil
+	}
+
+	s := q.Get(cdn_go.URLVersionKey)
+	q.Del(cdn_go.URLVersionKey)
+
+	return parseVersion(s)
+}
+
+// Update uploads a new version of file keeping its URL.
+// Prior version is kept as long as bucket's versioning policy allows
+func (h *Handler) Update(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	bucket := vars[cdn_go.BucketKey]
+	uuid := vars[cdn_go.FileUUIDKey]
+
+	b, err := h.bc.Get(bucket)
+	if err != nil {
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	f, err := h.service.GetFileDB(r.Context(), bucket, uuid)
+	if err != nil {
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	files, err := h.parseUpload(r, b)
+	if err != nil {
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	if len(files) != 1 {
+		cdn_errors.ToHttp(h.logger, w, entities.ErrSingleFileOnly)
+		return
+	}
+
+	// New version replaces file at the same place
+	file := files[0]
+	file.UUID = f.UUID
+
+	if err := h.prepareUpload(b, files); err != nil {
+		h.setRetryAfter(w, err)
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	updated, err := h.service.UpdateFile(r.Context(), f, file)
+	if err != nil {
+		h.setRetryAfter(w, err)
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	h.afterUpload(b, []string{updated.UUID})
+
+	response.Json(h.logger, w, http.StatusOK, response.JSON{
+		"id":       updated.UUID,
+		"version":  updated.CurrentVersion(),
+		"metadata": updated.Metadata,
+	})
+}
+
+// GetVersions writes current and retained prior versions of file, oldest first
+func (h *Handler) GetVersions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	f, err := h.service.GetFileDB(r.Context(), vars[cdn_go.BucketKey], vars[cdn_go.FileUUIDKey])
+	if err != nil {
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	versions := append(append([]entities.FileVersion{}, f.Versions...), f.Current())
+	response.Json(h.logger, w, http.StatusOK, response.JSON{
+		"id":       f.UUID,
+		"current":  f.CurrentVersion(),
+		"versions": versions,
+	})
+}
+
+// Rollback makes retained prior version current again. It's uploaded as a new version,
+// so the current one is kept the same way as on Update
+func (h *Handler) Rollback(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	bucket := vars[cdn_go.BucketKey]
+	uuid := vars[cdn_go.FileUUIDKey]
+
+	version, err := parseVersion(vars[cdn_go.VersionKey])
+	if err != nil {
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	b, err := h.bc.Get(bucket)
+	if err != nil {
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	f, err := h.service.GetFileDB(r.Context(), bucket, uuid)
+	if err != nil {
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	updated, err := h.service.RollbackFile(r.Context(), f, version)
+	if err != nil {
+		cdn_errors.ToHttp(h.logger, w, err)
+		return
+	}
+
+	h.afterUpload(b, []string{updated.UUID})
+
+	response.Json(h.logger, w, http.StatusOK, response.JSON{
+		"id":      updated.UUID,
+		"version": updated.CurrentVersion(),
+	})
+}
+
+func (s *cdnService) UpdateFileDB(ctx context.Context, bucket string, uuid string, current int, dto dto.UpdateFileDto) (*entities.File, error) {
+	f, err := s.repository.UpdateFile(ctx, bucket, uuid, current, dto)
+	if err != nil {
+		return nil, cdnutil.WrapInternal(err, "cdnService.UpdateFileDB.repository.UpdateFile")
+	}
+
+	// Updated or deleted meanwhile
+	if f == nil {
+		return nil, entities.ErrVersionConflict
+	}
+
+	return f, nil
+}
+
+func (s *cdnService) UpdateFile(ctx context.Context, f *entities.File, file *formdata.UploadFile) (*entities.File, error) {
+	osfile, err := file.Open()
+	if err != nil {
+		return nil, cdnutil.WrapInternal(err, "cdnService.UpdateFile.file.Open")
+	}
+
+	buff, err := io.ReadAll(osfile)
+	if err != nil {
+		return nil, cdnutil.WrapInternal(err, "cdnService.UpdateFile.io.ReadAll")
+	}
+
+	if file.Process != nil {
+		buff, err = file.Process(buff)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s.replace(ctx, f, entities.FileVersion{
+		MimeType:  file.MimeType,
+		Extension: "." + file.Extension,
+		Metadata:  file.Metadata,
+	}, buff)
+}
+
+func (s *cdnService) RollbackFile(ctx context.Context, f *entities.File, version int) (*entities.File, error) {
+	// Nothing to roll back
+	if version == f.CurrentVersion() {
+		return f, nil
+	}
+
+	v, ok := f.FindVersion(version)
+	if !ok {
+		return nil, entities.ErrVersionNotFound
+	}
+
+	pathToVersion := path.Join(cdnpath.ToVersionDir(fs.BucketsPath(), f.Bucket, f.UUID, version), fs.DefaultName+v.Extension)
+	j := s.dealer.Run(func() *dealer.JobResult {
+		return dealer.NewJobResult(fs.ReadFile(pathToVersion))
+	})
+
+	res := j.Wait()
+	buff, err := res.Out.([]byte), res.Err
+	if err != nil {
+		return nil, cdnutil.WrapInternal(err, "cdnService.RollbackFile.fs.ReadFile")
+	}
+
+	return s.replace(ctx, f, v, buff)
+}
+
+// replace makes buff the original of next version of f. Current original is moved to
+// its version's dir (or deleted if bucket keeps no versions) and everything derived from it is deleted.
+// Database is updated first and only if f is still current, so concurrent updates never lose files
+func (s *cdnService) replace(ctx context.Context, f *entities.File, next entities.FileVersion, buff []byte) (*entities.File, error) {
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+
+	dir := path.Join(fs.BucketsPath(), cdnpath.ToDir(f.Bucket, f.UUID))
+	pathToCurrent := path.Join(dir, fs.DefaultName+f.Extension)
+	pathToNext := path.Join(dir, fs.DefaultName+next.Extension)
+
+	keep := 0
+	if b, err := s.bc.Get(f.Bucket); err == nil {
+		keep = b.KeepVersions()
+	}
+
+	// Current original is either kept as a prior version or replaced
+	grown := usage.Counter{Bytes: int64(len(buff)), Objects: 1}
+	if keep == 0 {
+		size, _ := fs.Size(pathToCurrent)
+		grown = usage.Counter{Bytes: int64(len(buff)) - size}
+	}
+
+	if err := s.usage.Reserve(f.Bucket, usage.Originals, grown, s.limits(f.Bucket)); err != nil {
+		return nil, err
+	}
+	giveBack := func() {
+		s.usage.Add(f.Bucket, usage.Originals, usage.Counter{Bytes: -grown.Bytes, Objects: -grown.Objects})
+	}
+
+	// Hidden until database knows about it
+	staging := path.Join(dir, "."+fs.DefaultName+next.Extension+".next")
+	j := s.dealer.Run(func() *dealer.JobResult {
+		return dealer.NewJobResult(nil, fs.WriteFile(staging, buff))
+	})
+
+	if err := j.Wait().Err; err != nil {
+		giveBack()
+		return nil, cdnutil.WrapInternal(err, "cdnService.replace.fs.WriteFile")
+	}
+
+	// Oldest versions are dropped over bucket's limit
+	versions := append([]entities.FileVersion{}, f.Versions...)
+	if keep > 0 {
+		versions = append(versions, f.Current())
+	}
+
+	var dropped []entities.FileVersion
+	if over := len(versions) - keep; over > 0 {
+		dropped, versions = versions[:over], versions[over:]
+	}
+
+	now := time.Now()
+	updated, err := s.UpdateFileDB(ctx, f.Bucket, f.UUID, f.CurrentVersion(), dto.UpdateFileDto{
+		MimeType:  next.MimeType,
+		Extension: next.Extension,
+		Metadata:  next.Metadata,
+		Version:   f.CurrentVersion() + 1,
+		UpdatedAt: now,
+		Versions:  versions,
+	})
+	if err != nil {
+		if err := os.Remove(staging); err != nil {
+			s.logger.Errorf("could not remove: %s. err: %s", staging, err.Error())
+		}
+		giveBack()
+		// Do not wrap
+		return nil, err
+	}
+
+	if keep > 0 {
+		pathToPrior := path.Join(cdnpath.ToVersionDir(fs.BucketsPath(), f.Bucket, f.UUID, f.CurrentVersion()), fs.DefaultName+f.Extension)
+		if err := fs.Move(pathToCurrent, pathToPrior); err != nil {
+			s.logger.Errorf("could not keep version: %d of: %s. err: %s", f.CurrentVersion(), dir, err.Error())
+		}
+	} else if err := os.Remove(pathToCurrent); err != nil && !os.IsNotExist(err) {
+		s.logger.Errorf("could not remove: %s. err: %s", pathToCurrent, err.Error())
+	}
+
+	if err := fs.Move(staging, pathToNext); err != nil {
+		return nil, cdnutil.ChainInternal(err, "cdnService.replace->fs.Move")
+	}
+
+	s.deleteDerived(dir)
+	for _, v := range dropped {
+		if err := s.DeleteAll(cdnpath.ToVersionDir(fs.BucketsPath(), f.Bucket, f.UUID, v.Version)); err != nil {
+			s.logger.Errorf("could not delete version: %d of: %s. err: %s", v.Version, dir, err.Error())
+		}
+	}
+
+	// Cached files of prior versions are cached by other paths now
+	s.fc.Invalidate(dir)
+
+	s.logger.Debugf("updated: %s to version: %d", dir, updated.CurrentVersion())
+	return updated, nil
+}
+
+// deleteDerived deletes derivatives, compressed variants and HLS package of original in dir.
+// Prior versions and files being written are kept
+func (s *cdnService) deleteDerived(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		s.logger.Errorf("could not read: %s. err: %s", dir, err.Error())
+		return
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		if name == cdnpath.VersionsDir || name[0] == '.' || (!e.IsDir() && isOriginalName(name)) {
+			continue
+		}
+
+		if err := s.DeleteAll(path.Join(dir, name)); err != nil {
+			s.logger.Errorf("could not delete: %s. err: %s", path.Join(dir, name), err.Error())
+		}
+	}
+}
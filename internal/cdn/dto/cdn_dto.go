@@ -1,6 +1,10 @@
 package dto
 
 import (
+	"encoding/json"
+	"sort"
+	"time"
+
 	"animakuro/cdn/internal/entities"
 )
 
@@ -11,10 +15,136 @@ type SaveFileDto struct {
 	MimeType    string   `bson:"mimeType"`
 	UUID        string   `bson:"uuid"`
 	Extension   string   `bson:"extension"`
+	// Computed by bucket's module at upload, e.g. placeholders
+	Metadata map[string]string `bson:"metadata,omitempty"`
+	// Optional, see entities.File
+	Alias string `bson:"alias,omitempty"`
 }
 
 type CreateBucketDto struct {
-	Name       string                `json:"name" validate:"required"`
-	Module     string                `json:"module" validate:"required"`
+	Name    string   `json:"name" validate:"required"`
+	Modules []string `json:"modules" bson:"modules" validate:"required,min=1"`
+	// Deprecated: single module buckets could still be created with it instead of Modules
+	Module     string                `json:"module" bson:"-"`
 	Operations []*entities.Operation `json:"operations" validate:"required"`
+
+	BucketSettings `bson:",inline"`
+}
+
+// BucketSettings could be changed after bucket is created (see UpdateBucketDto)
+type BucketSettings struct {
+	Presets     map[string]entities.Preset `json:"presets" bson:"presets"`
+	PresetsOnly bool                       `json:"presets_only" bson:"presets_only"`
+	Eager       []string                   `json:"eager" bson:"eager"`
+	Strip       *entities.StripPolicy      `json:"strip" bson:"strip"`
+	HLS         *entities.HLSPolicy        `json:"hls" bson:"hls"`
+	Upload      *entities.UploadPolicy     `json:"upload" bson:"upload"`
+	Quota       *entities.QuotaPolicy      `json:"quota" bson:"quota"`
+	Lifecycle   *entities.LifecyclePolicy  `json:"lifecycle" bson:"lifecycle"`
+	Versioning  *entities.VersioningPolicy `json:"versioning" bson:"versioning"`
+}
+
+// UpdateBucketDto updates settings present in request only, the rest of bucket is kept.
+// Null removes policy. json and bson names of fields are the same
+type UpdateBucketDto struct {
+	BucketSettings `bson:",inline"`
+
+	// Fields present in request
+	present map[string]bool
+}
+
+func (d *UpdateBucketDto) UnmarshalJSON(data []byte) error {
+	type fields UpdateBucketDto
+	if err := json.Unmarshal(data, (*fields)(d)); err != nil {
+		return err
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	d.present = make(map[string]bool, len(raw))
+	for k := range raw {
+		d.present[k] = true
+	}
+
+	return nil
+}
+
+// Has tells whether field (by its json name) is present in request
+func (d *UpdateBucketDto) Has(field string) bool {
+	return d.present[field]
+}
+
+// Present returns names of fields present in request, sorted
+func (d *UpdateBucketDto) Present() []string {
+	fields := make([]string, 0, len(d.present))
+	for k := range d.present {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+
+	return fields
+}
+
+// Keep fills fields missing in request with ones of b, so they're validated together
+func (d *UpdateBucketDto) Keep(b *entities.Bucket) {
+	if !d.Has("presets") {
+		d.Presets = b.Presets
+	}
+	if !d.Has("presets_only") {
+		d.PresetsOnly = b.PresetsOnly
+	}
+	if !d.Has("eager") {
+		d.Eager = b.Eager
+	}
+	if !d.Has("strip") {
+		d.Strip = b.Strip
+	}
+	if !d.Has("hls") {
+		d.HLS = b.HLS
+	}
+	if !d.Has("upload") {
+		d.Upload = b.Upload
+	}
+	if !d.Has("quota") {
+		d.Quota = b.Quota
+	}
+	if !d.Has("lifecycle") {
+		d.Lifecycle = b.Lifecycle
+	}
+	if !d.Has("versioning") {
+		d.Versioning = b.Versioning
+	}
+}
+
+// UpdateFileDto replaces current version of file
+type UpdateFileDto struct {
+	MimeType  string                 `bson:"mimeType"`
+	Extension string                 `bson:"extension"`
+	Metadata  map[string]string      `bson:"metadata"`
+	Version   int                    `bson:"version"`
+	UpdatedAt time.Time              `bson:"updated_at"`
+	Versions  []entities.FileVersion `bson:"versions"`
+}
+
+// TransferDto lists files copied or moved to another bucket
+type TransferDto struct {
+	// Ignored if a single file is transferred
+	IDs []string `json:"ids"`
+	// Whether metadata computed at upload is carried to new files
+	Metadata bool `json:"metadata"`
+}
+
+// AliasDto assigns alias to file. Empty alias removes it
+type AliasDto struct {
+	Alias string `json:"alias"`
+}
+
+// BatchDeleteDto selects files deleted at once, either by their ids or by metadata
+type BatchDeleteDto struct {
+	IDs []string `json:"ids"`
+	// Files having every given metadata value, e.g. {"owner": "42"}
+	Metadata map[string]string `json:"metadata"`
 }
@@ -12,11 +12,25 @@ import (
 	"animakuro/cdn/internal/modules"
 	module_errors "animakuro/cdn/internal/modules/errors"
 	"animakuro/cdn/pkg/http/response"
+	"animakuro/cdn/pkg/pool"
+	"animakuro/cdn/pkg/usage"
 
 	"go.uber.org/zap"
 )
 
 func ToHttp(logger *zap.SugaredLogger, w http.ResponseWriter, err error) {
+	resp, code := Describe(logger, err)
+
+	response.Json(logger, w, code, response.JSON{
+		"message": resp,
+	})
+
+	return
+}
+
+// Describe returns message and status code client gets for err, e.g. for a single item of batch.
+// Internal errors are logged
+func Describe(logger *zap.SugaredLogger, err error) (string, int) {
 
 	var (
 		m       *module_errors.ModuleError
@@ -39,15 +53,11 @@ func ToHttp(logger *zap.SugaredLogger, w http.ResponseWriter, err error) {
 		resp, code = parse(err)
 	}
 
-	response.Json(logger, w, code, response.JSON{
-		"message": resp,
-	})
-
 	if code > http.StatusMethodNotAllowed && !skiplog {
 		logger.Error(err.Error())
 	}
 
-	return
+	return resp, code
 }
 
 func parse(err error) (string, int) {
@@ -85,6 +95,33 @@ func parse(err error) (string, int) {
 
 	case is(entities.ErrFileAlreadyExists):
 		return err.Error(), http.StatusConflict
+
+	case is(entities.ErrVersionNotFound):
+		return err.Error(), http.StatusNotFound
+
+	case is(entities.ErrInvalidVersion):
+		return err.Error(), http.StatusBadRequest
+
+	case is(entities.ErrVersionConflict):
+		return err.Error(), http.StatusConflict
+
+	case is(entities.ErrSingleFileOnly):
+		return err.Error(), http.StatusBadRequest
+
+	case is(entities.ErrBatchTooLarge):
+		return err.Error(), http.StatusBadRequest
+
+	case is(entities.ErrSameBucket):
+		return err.Error(), http.StatusBadRequest
+
+	case is(entities.ErrInvalidAlias):
+		return err.Error(), http.StatusBadRequest
+
+	case is(entities.ErrAliasTaken):
+		return err.Error(), http.StatusConflict
+
+	case is(entities.ErrInvalidFilter):
+		return err.Error(), http.StatusBadRequest
 	// --- File entity END
 
 	// Bucket entity
@@ -93,6 +130,47 @@ func parse(err error) (string, int) {
 
 	case is(entities.ErrBucketAlreadyExists):
 		return err.Error(), http.StatusConflict
+
+	case is(entities.ErrPresetNotFound):
+		return err.Error(), http.StatusNotFound
+
+	case is(entities.ErrPresetsOnly):
+		return err.Error(), http.StatusForbidden
+
+	case is(entities.ErrPresetWithResolvers):
+		return err.Error(), http.StatusBadRequest
+
+	case is(entities.ErrInvalidEager):
+		return err.Error(), http.StatusBadRequest
+
+	case is(entities.ErrInvalidStrip):
+		return err.Error(), http.StatusBadRequest
+	case is(entities.ErrStripUnsupported):
+		return err.Error(), http.StatusBadRequest
+
+	case is(entities.ErrInvalidHLS):
+		return err.Error(), http.StatusBadRequest
+
+	case is(entities.ErrHLSUnavailable):
+		return err.Error(), http.StatusBadRequest
+
+	case is(entities.ErrHLSNotFound):
+		return err.Error(), http.StatusNotFound
+
+	case is(entities.ErrInvalidUploadPolicy):
+		return err.Error(), http.StatusBadRequest
+
+	case is(entities.ErrInvalidQuota):
+		return err.Error(), http.StatusBadRequest
+
+	case is(entities.ErrInvalidLifecycle):
+		return err.Error(), http.StatusBadRequest
+
+	case is(entities.ErrInvalidVersioning):
+		return err.Error(), http.StatusBadRequest
+
+	case is(usage.ErrQuotaExceeded):
+		return err.Error(), http.StatusInsufficientStorage
 	// --- Bucket entity END
 
 	// Formdata
@@ -101,11 +179,29 @@ func parse(err error) (string, int) {
 
 	case is(entities.ErrNoFiles):
 		return err.Error(), http.StatusBadRequest
+
+	case is(formdata.ErrInvalidForm):
+		return err.Error(), http.StatusBadRequest
+
+	case is(formdata.ErrTooManyFiles):
+		return err.Error(), http.StatusBadRequest
+
+	case is(formdata.ErrFileTooLarge):
+		return err.Error(), http.StatusRequestEntityTooLarge
+
+	case is(formdata.ErrRequestTooLarge):
+		return err.Error(), http.StatusRequestEntityTooLarge
+
+	case is(formdata.ErrMimeTypeNotAllowed):
+		return err.Error(), http.StatusUnsupportedMediaType
 	// --- Formdata END
 
 	// Module errors
 	case is(modules.ErrNotFound):
 		return err.Error(), http.StatusBadRequest
+
+	case is(pool.ErrQueueFull):
+		return err.Error(), http.StatusServiceUnavailable
 	// --- Module END
 
 	default:
@@ -9,6 +9,7 @@ import (
 	entities "animakuro/cdn/internal/entities"
 	context "context"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 	primitive "go.mongodb.org/mongo-driver/bson/primitive"
@@ -82,6 +83,36 @@ func (mr *MockRepositoryMockRecorder) GetBucket(ctx, name interface{}) *gomock.C
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBucket", reflect.TypeOf((*MockRepository)(nil).GetBucket), ctx, name)
 }
 
+// GetDeletedFiles mocks base method.
+func (m *MockRepository) GetDeletedFiles(ctx context.Context, bucket string, deletedBefore time.Time, limit int64) ([]*entities.File, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetDeletedFiles", ctx, bucket, deletedBefore, limit)
+	ret0, _ := ret[0].([]*entities.File)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetDeletedFiles indicates an expected call of GetDeletedFiles.
+func (mr *MockRepositoryMockRecorder) GetDeletedFiles(ctx, bucket, deletedBefore, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDeletedFiles", reflect.TypeOf((*MockRepository)(nil).GetDeletedFiles), ctx, bucket, deletedBefore, limit)
+}
+
+// GetExpiredFiles mocks base method.
+func (m *MockRepository) GetExpiredFiles(ctx context.Context, bucket string, uploadedBefore time.Time, limit int64) ([]*entities.File, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetExpiredFiles", ctx, bucket, uploadedBefore, limit)
+	ret0, _ := ret[0].([]*entities.File)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetExpiredFiles indicates an expected call of GetExpiredFiles.
+func (mr *MockRepositoryMockRecorder) GetExpiredFiles(ctx, bucket, uploadedBefore, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetExpiredFiles", reflect.TypeOf((*MockRepository)(nil).GetExpiredFiles), ctx, bucket, uploadedBefore, limit)
+}
+
 // GetFile mocks base method.
 func (m *MockRepository) GetFile(ctx context.Context, bucket, uuid string) (*entities.File, error) {
 	m.ctrl.T.Helper()
@@ -97,12 +128,43 @@ func (mr *MockRepositoryMockRecorder) GetFile(ctx, bucket, uuid interface{}) *go
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetFile", reflect.TypeOf((*MockRepository)(nil).GetFile), ctx, bucket, uuid)
 }
 
+// GetFileByAlias mocks base method.
+func (m *MockRepository) GetFileByAlias(ctx context.Context, bucket, alias string) (*entities.File, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetFileByAlias", ctx, bucket, alias)
+	ret0, _ := ret[0].(*entities.File)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetFileByAlias indicates an expected call of GetFileByAlias.
+func (mr *MockRepositoryMockRecorder) GetFileByAlias(ctx, bucket, alias interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetFileByAlias", reflect.TypeOf((*MockRepository)(nil).GetFileByAlias), ctx, bucket, alias)
+}
+
+// GetFiles mocks base method.
+func (m *MockRepository) GetFiles(ctx context.Context, bucket string, dto dto.BatchDeleteDto, limit int64) ([]*entities.File, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetFiles", ctx, bucket, dto, limit)
+	ret0, _ := ret[0].([]*entities.File)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetFiles indicates an expected call of GetFiles.
+func (mr *MockRepositoryMockRecorder) GetFiles(ctx, bucket, dto, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetFiles", reflect.TypeOf((*MockRepository)(nil).GetFiles), ctx, bucket, dto, limit)
+}
+
 // MarkAsDeletable mocks base method.
-func (m *MockRepository) MarkAsDeletable(ctx context.Context, bucket string, mongoID primitive.ObjectID) error {
+func (m *MockRepository) MarkAsDeletable(ctx context.Context, bucket string, mongoID primitive.ObjectID) (*entities.File, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "MarkAsDeletable", ctx, bucket, mongoID)
-	ret0, _ := ret[0].(error)
-	return ret0
+	ret0, _ := ret[0].(*entities.File)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
 // MarkAsDeletable indicates an expected call of MarkAsDeletable.
@@ -111,6 +173,21 @@ func (mr *MockRepositoryMockRecorder) MarkAsDeletable(ctx, bucket, mongoID inter
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MarkAsDeletable", reflect.TypeOf((*MockRepository)(nil).MarkAsDeletable), ctx, bucket, mongoID)
 }
 
+// MarkManyAsDeletable mocks base method.
+func (m *MockRepository) MarkManyAsDeletable(ctx context.Context, mongoIDs []primitive.ObjectID) ([]*entities.File, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MarkManyAsDeletable", ctx, mongoIDs)
+	ret0, _ := ret[0].([]*entities.File)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// MarkManyAsDeletable indicates an expected call of MarkManyAsDeletable.
+func (mr *MockRepositoryMockRecorder) MarkManyAsDeletable(ctx, mongoIDs interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MarkManyAsDeletable", reflect.TypeOf((*MockRepository)(nil).MarkManyAsDeletable), ctx, mongoIDs)
+}
+
 // SaveBucket mocks base method.
 func (m *MockRepository) SaveBucket(ctx context.Context, dto dto.CreateBucketDto) (*entities.Bucket, error) {
 	m.ctrl.T.Helper()
@@ -140,3 +217,48 @@ func (mr *MockRepositoryMockRecorder) SaveFile(ctx, dto interface{}) *gomock.Cal
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveFile", reflect.TypeOf((*MockRepository)(nil).SaveFile), ctx, dto)
 }
+
+// SetAlias mocks base method.
+func (m *MockRepository) SetAlias(ctx context.Context, bucket, uuid, alias string) (*entities.File, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetAlias", ctx, bucket, uuid, alias)
+	ret0, _ := ret[0].(*entities.File)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SetAlias indicates an expected call of SetAlias.
+func (mr *MockRepositoryMockRecorder) SetAlias(ctx, bucket, uuid, alias interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetAlias", reflect.TypeOf((*MockRepository)(nil).SetAlias), ctx, bucket, uuid, alias)
+}
+
+// UpdateBucket mocks base method.
+func (m *MockRepository) UpdateBucket(ctx context.Context, name string, dto dto.UpdateBucketDto) (*entities.Bucket, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateBucket", ctx, name, dto)
+	ret0, _ := ret[0].(*entities.Bucket)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateBucket indicates an expected call of UpdateBucket.
+func (mr *MockRepositoryMockRecorder) UpdateBucket(ctx, name, dto interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateBucket", reflect.TypeOf((*MockRepository)(nil).UpdateBucket), ctx, name, dto)
+}
+
+// UpdateFile mocks base method.
+func (m *MockRepository) UpdateFile(ctx context.Context, bucket, uuid string, current int, dto dto.UpdateFileDto) (*entities.File, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateFile", ctx, bucket, uuid, current, dto)
+	ret0, _ := ret[0].(*entities.File)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateFile indicates an expected call of UpdateFile.
+func (mr *MockRepositoryMockRecorder) UpdateFile(ctx, bucket, uuid, current, dto interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateFile", reflect.TypeOf((*MockRepository)(nil).UpdateFile), ctx, bucket, uuid, current, dto)
+}
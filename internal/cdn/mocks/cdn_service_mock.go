@@ -8,8 +8,10 @@ import (
 	dto "animakuro/cdn/internal/cdn/dto"
 	entities "animakuro/cdn/internal/entities"
 	formdata "animakuro/cdn/internal/formdata"
+	usage "animakuro/cdn/pkg/usage"
 	context "context"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 	primitive "go.mongodb.org/mongo-driver/bson/primitive"
@@ -38,6 +40,18 @@ func (m *MockService) EXPECT() *MockServiceMockRecorder {
 	return m.recorder
 }
 
+// AccountDerivatives mocks base method.
+func (m *MockService) AccountDerivatives(bucket, dir string) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "AccountDerivatives", bucket, dir)
+}
+
+// AccountDerivatives indicates an expected call of AccountDerivatives.
+func (mr *MockServiceMockRecorder) AccountDerivatives(bucket, dir interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AccountDerivatives", reflect.TypeOf((*MockService)(nil).AccountDerivatives), bucket, dir)
+}
+
 // DeleteAll mocks base method.
 func (m *MockService) DeleteAll(path string) error {
 	m.ctrl.T.Helper()
@@ -66,6 +80,21 @@ func (mr *MockServiceMockRecorder) DeleteFileDB(ctx, bucket, uuid interface{}) *
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteFileDB", reflect.TypeOf((*MockService)(nil).DeleteFileDB), ctx, bucket, uuid)
 }
 
+// ExpireDerivatives mocks base method.
+func (m *MockService) ExpireDerivatives(bucket string, unusedSince time.Time) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ExpireDerivatives", bucket, unusedSince)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ExpireDerivatives indicates an expected call of ExpireDerivatives.
+func (mr *MockServiceMockRecorder) ExpireDerivatives(bucket, unusedSince interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExpireDerivatives", reflect.TypeOf((*MockService)(nil).ExpireDerivatives), bucket, unusedSince)
+}
+
 // GetAllBucketsDB mocks base method.
 func (m *MockService) GetAllBucketsDB(ctx context.Context) ([]*entities.Bucket, error) {
 	m.ctrl.T.Helper()
@@ -96,6 +125,36 @@ func (mr *MockServiceMockRecorder) GetBucketDB(ctx, bucketName interface{}) *gom
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBucketDB", reflect.TypeOf((*MockService)(nil).GetBucketDB), ctx, bucketName)
 }
 
+// GetDeletedFilesDB mocks base method.
+func (m *MockService) GetDeletedFilesDB(ctx context.Context, bucket string, deletedBefore time.Time, limit int64) ([]*entities.File, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetDeletedFilesDB", ctx, bucket, deletedBefore, limit)
+	ret0, _ := ret[0].([]*entities.File)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetDeletedFilesDB indicates an expected call of GetDeletedFilesDB.
+func (mr *MockServiceMockRecorder) GetDeletedFilesDB(ctx, bucket, deletedBefore, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDeletedFilesDB", reflect.TypeOf((*MockService)(nil).GetDeletedFilesDB), ctx, bucket, deletedBefore, limit)
+}
+
+// GetExpiredFilesDB mocks base method.
+func (m *MockService) GetExpiredFilesDB(ctx context.Context, bucket string, uploadedBefore time.Time, limit int64) ([]*entities.File, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetExpiredFilesDB", ctx, bucket, uploadedBefore, limit)
+	ret0, _ := ret[0].([]*entities.File)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetExpiredFilesDB indicates an expected call of GetExpiredFilesDB.
+func (mr *MockServiceMockRecorder) GetExpiredFilesDB(ctx, bucket, uploadedBefore, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetExpiredFilesDB", reflect.TypeOf((*MockService)(nil).GetExpiredFilesDB), ctx, bucket, uploadedBefore, limit)
+}
+
 // GetFileDB mocks base method.
 func (m *MockService) GetFileDB(ctx context.Context, bucket, uuid string) (*entities.File, error) {
 	m.ctrl.T.Helper()
@@ -139,6 +198,21 @@ func (mr *MockServiceMockRecorder) MarkAsDeletableDB(ctx, bucket, mongoID interf
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MarkAsDeletableDB", reflect.TypeOf((*MockService)(nil).MarkAsDeletableDB), ctx, bucket, mongoID)
 }
 
+// MarkManyAsDeletableDB mocks base method.
+func (m *MockService) MarkManyAsDeletableDB(ctx context.Context, bucket string, dto dto.BatchDeleteDto, limit int64) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MarkManyAsDeletableDB", ctx, bucket, dto, limit)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// MarkManyAsDeletableDB indicates an expected call of MarkManyAsDeletableDB.
+func (mr *MockServiceMockRecorder) MarkManyAsDeletableDB(ctx, bucket, dto, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MarkManyAsDeletableDB", reflect.TypeOf((*MockService)(nil).MarkManyAsDeletableDB), ctx, bucket, dto, limit)
+}
+
 // MustSave mocks base method.
 func (m *MockService) MustSave(buff []byte, path string) {
 	m.ctrl.T.Helper()
@@ -196,6 +270,51 @@ func (mr *MockServiceMockRecorder) ReadFile(path, hosts interface{}) *gomock.Cal
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadFile", reflect.TypeOf((*MockService)(nil).ReadFile), path, hosts)
 }
 
+// ReadOriginal mocks base method.
+func (m *MockService) ReadOriginal(ctx context.Context, bucket, uuid string) ([]byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReadOriginal", ctx, bucket, uuid)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReadOriginal indicates an expected call of ReadOriginal.
+func (mr *MockServiceMockRecorder) ReadOriginal(ctx, bucket, uuid interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadOriginal", reflect.TypeOf((*MockService)(nil).ReadOriginal), ctx, bucket, uuid)
+}
+
+// ResolveAlias mocks base method.
+func (m *MockService) ResolveAlias(ctx context.Context, bucket, alias string) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResolveAlias", ctx, bucket, alias)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ResolveAlias indicates an expected call of ResolveAlias.
+func (mr *MockServiceMockRecorder) ResolveAlias(ctx, bucket, alias interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResolveAlias", reflect.TypeOf((*MockService)(nil).ResolveAlias), ctx, bucket, alias)
+}
+
+// RollbackFile mocks base method.
+func (m *MockService) RollbackFile(ctx context.Context, f *entities.File, version int) (*entities.File, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RollbackFile", ctx, f, version)
+	ret0, _ := ret[0].(*entities.File)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RollbackFile indicates an expected call of RollbackFile.
+func (mr *MockServiceMockRecorder) RollbackFile(ctx, f, version interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RollbackFile", reflect.TypeOf((*MockService)(nil).RollbackFile), ctx, f, version)
+}
+
 // SaveBucketDB mocks base method.
 func (m *MockService) SaveBucketDB(ctx context.Context, dto dto.CreateBucketDto) (*entities.Bucket, error) {
 	m.ctrl.T.Helper()
@@ -225,6 +344,36 @@ func (mr *MockServiceMockRecorder) SaveFileDB(ctx, dto interface{}) *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveFileDB", reflect.TypeOf((*MockService)(nil).SaveFileDB), ctx, dto)
 }
 
+// SetAliasDB mocks base method.
+func (m *MockService) SetAliasDB(ctx context.Context, bucket, uuid, alias string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetAliasDB", ctx, bucket, uuid, alias)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetAliasDB indicates an expected call of SetAliasDB.
+func (mr *MockServiceMockRecorder) SetAliasDB(ctx, bucket, uuid, alias interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetAliasDB", reflect.TypeOf((*MockService)(nil).SetAliasDB), ctx, bucket, uuid, alias)
+}
+
+// TransferFile mocks base method.
+func (m *MockService) TransferFile(ctx context.Context, f *entities.File, bucket string, move, keepMetadata bool) (string, string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TransferFile", ctx, f, bucket, move, keepMetadata)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// TransferFile indicates an expected call of TransferFile.
+func (mr *MockServiceMockRecorder) TransferFile(ctx, f, bucket, move, keepMetadata interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TransferFile", reflect.TypeOf((*MockService)(nil).TransferFile), ctx, f, bucket, move, keepMetadata)
+}
+
 // TryDeleteLocally mocks base method.
 func (m *MockService) TryDeleteLocally(dirPath string) {
 	m.ctrl.T.Helper()
@@ -237,6 +386,51 @@ func (mr *MockServiceMockRecorder) TryDeleteLocally(dirPath interface{}) *gomock
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TryDeleteLocally", reflect.TypeOf((*MockService)(nil).TryDeleteLocally), dirPath)
 }
 
+// UpdateBucketDB mocks base method.
+func (m *MockService) UpdateBucketDB(ctx context.Context, bucketName string, dto dto.UpdateBucketDto) (*entities.Bucket, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateBucketDB", ctx, bucketName, dto)
+	ret0, _ := ret[0].(*entities.Bucket)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateBucketDB indicates an expected call of UpdateBucketDB.
+func (mr *MockServiceMockRecorder) UpdateBucketDB(ctx, bucketName, dto interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateBucketDB", reflect.TypeOf((*MockService)(nil).UpdateBucketDB), ctx, bucketName, dto)
+}
+
+// UpdateFile mocks base method.
+func (m *MockService) UpdateFile(ctx context.Context, f *entities.File, file *formdata.UploadFile) (*entities.File, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateFile", ctx, f, file)
+	ret0, _ := ret[0].(*entities.File)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateFile indicates an expected call of UpdateFile.
+func (mr *MockServiceMockRecorder) UpdateFile(ctx, f, file interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateFile", reflect.TypeOf((*MockService)(nil).UpdateFile), ctx, f, file)
+}
+
+// UpdateFileDB mocks base method.
+func (m *MockService) UpdateFileDB(ctx context.Context, bucket, uuid string, current int, dto dto.UpdateFileDto) (*entities.File, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateFileDB", ctx, bucket, uuid, current, dto)
+	ret0, _ := ret[0].(*entities.File)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateFileDB indicates an expected call of UpdateFileDB.
+func (mr *MockServiceMockRecorder) UpdateFileDB(ctx, bucket, uuid, current, dto interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateFileDB", reflect.TypeOf((*MockService)(nil).UpdateFileDB), ctx, bucket, uuid, current, dto)
+}
+
 // UploadMany mocks base method.
 func (m *MockService) UploadMany(ctx context.Context, bucket string, files []*formdata.UploadFile) ([]string, []string, error) {
 	m.ctrl.T.Helper()
@@ -252,3 +446,17 @@ func (mr *MockServiceMockRecorder) UploadMany(ctx, bucket, files interface{}) *g
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UploadMany", reflect.TypeOf((*MockService)(nil).UploadMany), ctx, bucket, files)
 }
+
+// Usage mocks base method.
+func (m *MockService) Usage(bucket string) usage.Usage {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Usage", bucket)
+	ret0, _ := ret[0].(usage.Usage)
+	return ret0
+}
+
+// Usage indicates an expected call of Usage.
+func (mr *MockServiceMockRecorder) Usage(bucket interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Usage", reflect.TypeOf((*MockService)(nil).Usage), bucket)
+}
@@ -1,7 +1,13 @@
 // Package cdnpath contains utility functions for making paths to different cdn files
 package cdnpath
 
-import "path"
+import (
+	"path"
+	"strconv"
+)
+
+// VersionsDir is dir of original's dir prior versions are stored in
+const VersionsDir = "versions"
 
 type Existing struct {
 	BucketsPath string
@@ -32,3 +38,15 @@ func ToOriginalFile(og *Original) string {
 func ToDir(bucket, UUID string) string {
 	return path.Join(bucket, UUID)
 }
+
+// ToVersionDir makes path to dir prior version of a file and its derivatives are stored in
+// e.g. /local/buckets/site-content/abcd-eafs/versions/2
+func ToVersionDir(bucketsPath, bucket, UUID string, version int) string {
+	return path.Join(bucketsPath, bucket, UUID, VersionsDir, strconv.Itoa(version))
+}
+
+// ToHLSDir makes path to dir HLS package of a video is stored in
+// e.g. /local/buckets/site-content/abcd-eafs/hls
+func ToHLSDir(bucketsPath, bucket, UUID string) string {
+	return path.Join(bucketsPath, bucket, UUID, "hls")
+}
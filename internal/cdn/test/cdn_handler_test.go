@@ -2,19 +2,37 @@ package cdn
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"animakuro/cdn/config"
 	"animakuro/cdn/internal/cdn"
+	"animakuro/cdn/internal/cdn/dto"
 	mock_cdn "animakuro/cdn/internal/cdn/mocks"
 	"animakuro/cdn/internal/entities"
+	"animakuro/cdn/internal/formdata"
+	"animakuro/cdn/internal/fs"
 	"animakuro/cdn/internal/modules"
 	mock_modules "animakuro/cdn/internal/modules/mocks"
 	bucketcache "animakuro/cdn/pkg/cache/bucket"
 	filecache "animakuro/cdn/pkg/cache/file"
+	"animakuro/cdn/pkg/hash"
+	"animakuro/cdn/pkg/hls"
+	"animakuro/cdn/pkg/middleware"
+	"animakuro/cdn/pkg/pool"
+	"animakuro/cdn/pkg/precompress"
+	"animakuro/cdn/pkg/usage"
 
 	"github.com/gabriel-vasile/mimetype"
 	"github.com/golang/mock/gomock"
@@ -40,7 +58,84 @@ var bucket = &entities.Bucket{
 			Keys: []string{"abcd"},
 		},
 	},
-	Module: "image",
+	Modules: []string{"image"},
+}
+
+var presetsBucket = &entities.Bucket{
+	ID:   primitive.ObjectID{},
+	Name: "posters",
+	Operations: []*entities.Operation{
+		{
+			Name: "get",
+			Type: "public",
+		},
+	},
+	Modules: []string{"image"},
+	Presets: map[string]entities.Preset{
+		"thumb": {
+			"image.resize": "200x0",
+			"image.webp":   "true",
+		},
+	},
+	PresetsOnly: true,
+}
+
+var stripBucket = &entities.Bucket{
+	ID:   primitive.ObjectID{},
+	Name: "avatars",
+	Operations: []*entities.Operation{
+		{
+			Name: "get",
+			Type: "public",
+		},
+	},
+	Modules: []string{"image"},
+	Strip: &entities.StripPolicy{
+		On:   entities.StripOnDelivery,
+		Keep: "orientation",
+	},
+}
+
+var textBucket = &entities.Bucket{
+	ID:   primitive.ObjectID{},
+	Name: "static",
+	Operations: []*entities.Operation{
+		{
+			Name: "get",
+			Type: "public",
+		},
+	},
+	Modules: []string{"text"},
+}
+
+var siteBucket = &entities.Bucket{
+	ID:   primitive.ObjectID{},
+	Name: "site",
+	Operations: []*entities.Operation{
+		{
+			Name: "get",
+			Type: "public",
+		},
+	},
+	Modules: []string{"image", "text"},
+}
+
+var uploadBucket = &entities.Bucket{
+	ID:   primitive.ObjectID{},
+	Name: "styles",
+	Operations: []*entities.Operation{
+		{
+			Name: "post",
+			Type: "public",
+		},
+	},
+	Modules: []string{"text"},
+	Upload: &entities.UploadPolicy{
+		MimeTypes:      []string{"text/css", "application/javascript"},
+		MaxFileSize:    100,
+		MaxRequestSize: 1000,
+		MaxFiles:       2,
+	},
 }
 
 // Do not use t.Parallel(). It breaks mocking with EXPECT()
@@ -60,6 +155,8 @@ func TestGet(t *testing.T) {
 		FileCache:        deps.FileCache,
 		Service:          service,
 		ModuleController: moduleController,
+		Processing:       deps.Processing,
+		ProcessingConfig: deps.ProcessingConfig,
 		// Pass nil: see cdn_handler_test.go:97
 		Middlewares: nil,
 		MemConfig:   nil,
@@ -190,8 +287,8 @@ func TestGet(t *testing.T) {
 			},
 			IsDeletable: false,
 			Bucket:      bucket.Name,
-			MimeType:    "text/plain; charset=utf-8",
-			Extension:   ".txt",
+			MimeType:    "image/png",
+			Extension:   ".png",
 		}
 
 		// Make it that ReadExisting returns that file is not available
@@ -204,7 +301,7 @@ func TestGet(t *testing.T) {
 		// Should be called with resolved bits
 		service.EXPECT().MustSave(mockResolvedBits, gomock.Any() /* path */).Times(1)
 
-		moduleController.EXPECT().UseResolvers(gomock.Any(), bucket.Module, gomock.Any()).DoAndReturn(
+		moduleController.EXPECT().UseResolvers(gomock.Any(), "image", gomock.Any()).DoAndReturn(
 			func(buff *bytes.Buffer, module string, mm modules.ModuleMap) error {
 				// Write some data to buffer. See cdn_handler.go:217
 				buff.Reset()
@@ -236,6 +333,73 @@ func TestGet(t *testing.T) {
 		require.Equal(t, "text/plain; charset=utf-8", contentType)
 	})
 
+	t.Run("should render proccessed file once for concurrent requests", func(t *testing.T) {
+		const n = 10
+		mockBits := []byte("Hello world!")
+		mockResolvedBits := []byte("Hello mama!")
+
+		DBFile := &entities.File{
+			ID:   primitive.NewObjectID(),
+			UUID: uuid.NewString(),
+			AvailableIn: []string{
+				"cdn.com",
+			},
+			IsDeletable: false,
+			Bucket:      bucket.Name,
+			MimeType:    "image/png",
+			Extension:   ".png",
+		}
+
+		// Every request has read the original
+		readWg := new(sync.WaitGroup)
+		readWg.Add(n)
+
+		service.EXPECT().ReadExisting(gomock.Any()).Return(nil /* bits */, false /* isAvailable */, nil).Times(n)
+		service.EXPECT().GetFileDB(gomock.Any(), bucket.Name, fileID /* uuid */).Return(DBFile, nil).Times(n)
+		service.EXPECT().ReadFile(gomock.Any(), DBFile.AvailableIn).DoAndReturn(
+			func(path string, hosts []string) ([]byte, error) {
+				readWg.Done()
+				return mockBits, nil
+			},
+		).Times(n)
+
+		// Single render and single save
+		service.EXPECT().MustSave(mockResolvedBits, gomock.Any() /* path */).Times(1)
+		moduleController.EXPECT().UseResolvers(gomock.Any(), "image", gomock.Any()).DoAndReturn(
+			func(buff *bytes.Buffer, module string, mm modules.ModuleMap) error {
+				// Hold the render until the rest join the flight
+				readWg.Wait()
+				time.Sleep(time.Millisecond * 50)
+
+				buff.Reset()
+				buff.Write(mockResolvedBits)
+				return nil
+			},
+		).Times(1)
+
+		url := fmt.Sprintf("https://cdn.com/%s/%s?image.webp=true", bucket.Name, fileID /* uuid */)
+
+		wg := new(sync.WaitGroup)
+		recorders := make([]*httptest.ResponseRecorder, n)
+		for i := 0; i < n; i++ {
+			r, err := http.NewRequest(http.MethodGet, url, nil)
+			require.NoError(t, err)
+
+			recorders[i] = httptest.NewRecorder()
+			wg.Add(1)
+			go func(w *httptest.ResponseRecorder) {
+				defer wg.Done()
+				router.ServeHTTP(w, r)
+			}(recorders[i])
+		}
+		wg.Wait()
+
+		for _, w := range recorders {
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, mockResolvedBits, w.Body.Bytes())
+		}
+	})
+
 	t.Run("should return ErrNotFound because file is marked for deletion. Get original file", func(t *testing.T) {
 
 		DBFile := &entities.File{
@@ -277,14 +441,15 @@ func TestGet(t *testing.T) {
 
 }
 
-func TestDelete(t *testing.T) {
-
+func TestGetQueueFull(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
 	service, moduleController := getMocks(ctrl)
 	deps := setupDeps()
 
+	router := deps.Mux
+
 	handler := cdn.NewHandler(&cdn.HandlerDeps{
 		Logger:           deps.Logger,
 		Mux:              deps.Mux,
@@ -292,128 +457,1515 @@ func TestDelete(t *testing.T) {
 		FileCache:        deps.FileCache,
 		Service:          service,
 		ModuleController: moduleController,
-		// Pass nil: see cdn_handler_test.go:97
-		Middlewares: nil,
-		MemConfig:   nil,
+		// Never accepts renders
+		Processing:       pool.New(1, 0, 0),
+		ProcessingConfig: deps.ProcessingConfig,
 	})
 
-	router := deps.Mux
-
-	router.HandleFunc("/{bucket}/{fileUUID}", handler.Delete)
+	router.HandleFunc("/{bucket}/{fileUUID}", handler.Get)
 
 	fileID := uuid.NewString()
 
-	t.Run("should mark file as deletable", func(t *testing.T) {
+	t.Run("should return 503 with Retry-After if processing queue is full", func(t *testing.T) {
 		DBFile := &entities.File{
 			ID:          primitive.NewObjectID(),
-			UUID:        uuid.NewString(),
-			Bucket:      bucket.Name,
+			UUID:        fileID,
 			AvailableIn: []string{"cdn.com"},
-			MimeType:    "text/plain; charset=utf-8",
-			Extension:   ".txt",
-			// Not marked yet
-			IsDeletable: false,
+			Bucket:      bucket.Name,
+			MimeType:    "image/png",
+			Extension:   ".png",
 		}
 
-		service.EXPECT().GetFileDB(gomock.Any(), bucket.Name, fileID).Return(DBFile, nil).Times(1)
+		service.EXPECT().ReadExisting(gomock.Any()).Return(nil /* bits */, false /* isAvailable */, nil).Times(1)
+		service.EXPECT().GetFileDB(gomock.Any(), bucket.Name, fileID /* uuid */).Return(DBFile, nil).Times(1)
+		service.EXPECT().ReadFile(gomock.Any(), DBFile.AvailableIn).Return([]byte("Hello world!"), nil).Times(1)
 
-		service.EXPECT().MarkAsDeletableDB(gomock.Any(), bucket.Name, DBFile.ID).Return(nil).Times(1)
+		url := fmt.Sprintf("https://cdn.com/%s/%s?image.webp=true", bucket.Name, fileID /* uuid */)
+		r, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
 
-		url := fmt.Sprintf("https://cdn.com/%s/%s", bucket.Name, fileID /* uuid */)
+		w := httptest.NewRecorder()
 
-		r, err := http.NewRequest(http.MethodDelete, url, nil)
+		// Will call handler.Get
+		router.ServeHTTP(w, r)
+
+		expectedResponse := fmt.Sprintf(`{"message":"%s"}`, pool.ErrQueueFull.Error())
+		require.Equal(t, http.StatusServiceUnavailable, w.Code)
+		require.Equal(t, expectedResponse, w.Body.String())
+		require.Equal(t, "1", w.Header().Get("Retry-After"))
+	})
+}
+
+func TestGetWithStrip(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, moduleController := getMocks(ctrl)
+	deps := setupDeps()
+
+	router := deps.Mux
+
+	handler := cdn.NewHandler(&cdn.HandlerDeps{
+		Logger:           deps.Logger,
+		Mux:              deps.Mux,
+		BucketCache:      deps.BucketCache,
+		FileCache:        deps.FileCache,
+		Service:          service,
+		ModuleController: moduleController,
+		Processing:       deps.Processing,
+		ProcessingConfig: deps.ProcessingConfig,
+	})
+
+	router.HandleFunc("/{bucket}/{fileUUID}", handler.Get)
+
+	fileID := uuid.NewString()
+	mockBits := []byte("hello world!")
+	raw := func(mm modules.ModuleMap) string {
+		return modules.NewController(deps.Logger, nil, nil).Raw("image", mm, fileID)
+	}
+
+	t.Run("should serve stripped derivative instead of original", func(t *testing.T) {
+		DBFile := &entities.File{UUID: fileID, Bucket: stripBucket.Name, MimeType: "image/jpeg", Extension: ".jpg"}
+		service.EXPECT().GetFileDB(gomock.Any(), stripBucket.Name, fileID).Return(DBFile, nil).Times(1)
+
+		expectedPath := path.Join(fs.BucketsPath(), stripBucket.Name, fileID, hash.SHA1Name(raw(modules.ModuleMap{"strip": "orientation"})))
+		service.EXPECT().ReadExisting(expectedPath).Return(mockBits, true /* isAvailable */, nil).Times(1)
+
+		url := fmt.Sprintf("https://cdn.com/%s/%s", stripBucket.Name, fileID)
+		r, err := http.NewRequest(http.MethodGet, url, nil)
 		require.NoError(t, err)
 
 		w := httptest.NewRecorder()
 
-		// Will call handler.Delete
 		router.ServeHTTP(w, r)
 
-		code := w.Code
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, mockBits, w.Body.Bytes())
+	})
 
-		require.Equal(t, http.StatusOK, code)
-		require.Nil(t, w.Body.Bytes())
+	t.Run("should override strip requested by client", func(t *testing.T) {
+		expectedPath := path.Join(fs.BucketsPath(), stripBucket.Name, fileID, hash.SHA1Name(raw(modules.ModuleMap{"strip": "orientation", "webp": "true"})))
+		service.EXPECT().ReadExisting(expectedPath).Return(mockBits, true /* isAvailable */, nil).Times(1)
+
+		url := fmt.Sprintf("https://cdn.com/%s/%s?image.webp=true&image.strip=false", stripBucket.Name, fileID)
+		r, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, mockBits, w.Body.Bytes())
 	})
+}
 
-	t.Run("should return error ErrFileAlreadyDeleted", func(t *testing.T) {
-		DBFile := &entities.File{
-			ID:          primitive.NewObjectID(),
-			UUID:        uuid.NewString(),
-			Bucket:      bucket.Name,
-			AvailableIn: []string{"cdn.com"},
-			MimeType:    "text/plain; charset=utf-8",
-			Extension:   ".txt",
-			// Already marked for deletion
-			IsDeletable: true,
-		}
+func TestGetHLS(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
 
-		service.EXPECT().GetFileDB(gomock.Any(), bucket.Name, fileID).Return(DBFile, nil)
+	service, moduleController := getMocks(ctrl)
+	deps := setupDeps()
 
-		url := fmt.Sprintf("https://cdn.com/%s/%s", bucket.Name, fileID /* uuid */)
+	router := deps.Mux
 
-		r, err := http.NewRequest(http.MethodDelete, url, nil)
+	handler := cdn.NewHandler(&cdn.HandlerDeps{
+		Logger:           deps.Logger,
+		Mux:              deps.Mux,
+		BucketCache:      deps.BucketCache,
+		FileCache:        deps.FileCache,
+		Service:          service,
+		ModuleController: moduleController,
+		Processing:       deps.Processing,
+		ProcessingConfig: deps.ProcessingConfig,
+	})
+
+	router.HandleFunc("/{bucket}/{fileUUID}/hls/{hlsPath:.+}", handler.GetHLS)
+
+	fileID := uuid.NewString()
+	master := []byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=2000\n720p/index.m3u8\n")
+
+	hlsFile := &entities.File{UUID: fileID}
+
+	t.Run("should sign playlist URIs of private bucket", func(t *testing.T) {
+		service.EXPECT().GetFileDB(gomock.Any(), bucket.Name, fileID).Return(hlsFile, nil).Times(1)
+		expectedPath := path.Join(fs.BucketsPath(), bucket.Name, fileID, "hls", "master.m3u8")
+		service.EXPECT().ReadExisting(expectedPath).Return(master, true /* isAvailable */, nil).Times(1)
+
+		url := fmt.Sprintf("https://cdn.com/%s/%s/hls/master.m3u8?auth=token", bucket.Name, fileID)
+		r, err := http.NewRequest(http.MethodGet, url, nil)
 		require.NoError(t, err)
 
 		w := httptest.NewRecorder()
 
-		// Will call handler.Delete
 		router.ServeHTTP(w, r)
 
-		code := w.Code
-		respStr := w.Body.String()
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "application/vnd.apple.mpegurl", w.Header().Get("Content-Type"))
 
-		expectedResponse := fmt.Sprintf(`{"message":"%s"}`, entities.ErrFileAlreadyDeleted.Error())
+		lines := strings.Split(w.Body.String(), "\n")
+		require.Equal(t, "#EXT-X-STREAM-INF:BANDWIDTH=2000", lines[1])
 
-		require.Equal(t, http.StatusBadRequest, code)
-		require.Equal(t, expectedResponse, respStr)
+		// Signed with the first key of get, token isn't passed along
+		// Resolved relatively to the playlist like players do
+		uri, err := r.URL.Parse(lines[2])
+		require.NoError(t, err)
+		require.Equal(t, path.Join("/", bucket.Name, fileID, "hls", "720p/index.m3u8"), uri.Path)
+		require.Empty(t, uri.Query().Get("auth"))
+
+		expires, err := strconv.ParseInt(uri.Query().Get(hls.ExpiresKey), 10, 64)
+		require.NoError(t, err)
+		require.InDelta(t, time.Now().Add(time.Hour*4).Unix(), expires, 5)
+		require.True(t, hls.Verify([]string{"abcd"}, bucket.Name+"/"+fileID, "720p/index.m3u8", expires, uri.Query().Get(hls.SignatureKey), time.Now()))
 	})
-}
 
-func getMocks(ctrl *gomock.Controller) (service *mock_cdn.MockService, moduleControllerMock *mock_modules.MockController) {
-	service = mock_cdn.NewMockService(ctrl)
-	moduleControllerMock = mock_modules.NewMockController(ctrl)
-	moduleController := modules.NewController(setupDeps().Logger)
+	t.Run("should serve playlist of public bucket as is", func(t *testing.T) {
+		service.EXPECT().GetFileDB(gomock.Any(), presetsBucket.Name, fileID).Return(hlsFile, nil).Times(1)
+		expectedPath := path.Join(fs.BucketsPath(), presetsBucket.Name, fileID, "hls", "master.m3u8")
+		service.EXPECT().ReadExisting(expectedPath).Return(master, true /* isAvailable */, nil).Times(1)
 
-	// Keep real implementations
-	{
-		moduleControllerMock.EXPECT().Raw(gomock.Any(), gomock.Any()).DoAndReturn(
-			func(mm modules.ModuleMap, uuid string) string {
-				return moduleController.Raw(mm, uuid)
-			},
-		).AnyTimes()
+		url := fmt.Sprintf("https://cdn.com/%s/%s/hls/master.m3u8", presetsBucket.Name, fileID)
+		r, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
 
-		moduleControllerMock.EXPECT().Parse(gomock.Any(), gomock.Any()).DoAndReturn(
-			func(q url.Values, module string) (modules.ModuleMap, error) {
-				return moduleController.Parse(q, module)
-			},
-		).AnyTimes()
+		w := httptest.NewRecorder()
 
-		service.EXPECT().ParseMime(gomock.Any()).DoAndReturn(
-			func(buff []byte) string {
-				return mimetype.Detect(buff).String()
-			},
-		).AnyTimes()
-	}
+		router.ServeHTTP(w, r)
 
-	// Naked return!
-	return
-}
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, master, w.Body.Bytes())
+	})
 
-func setupDeps() *cdn.HandlerDeps {
-	logger := zap.NewNop().Sugar()
-	bucketCache := bucketcache.NewBucketCache()
-	fileCache := &filecache.NoOpFilecache{}
-	router := mux.NewRouter()
+	t.Run("should serve segment", func(t *testing.T) {
+		segment := []byte("segment")
+		service.EXPECT().GetFileDB(gomock.Any(), bucket.Name, fileID).Return(hlsFile, nil).Times(1)
+		expectedPath := path.Join(fs.BucketsPath(), bucket.Name, fileID, "hls", "720p", "seg_001.ts")
+		service.EXPECT().ReadExisting(expectedPath).Return(segment, true /* isAvailable */, nil).Times(1)
 
-	bucketCache.Add(bucket)
+		url := fmt.Sprintf("https://cdn.com/%s/%s/hls/720p/seg_001.ts?auth=token", bucket.Name, fileID)
+		r, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
 
-	return &cdn.HandlerDeps{
-		Logger:      logger,
-		BucketCache: bucketCache,
-		FileCache:   fileCache,
-		Mux:         router,
-		Middlewares: nil,
-		MemConfig:   nil,
-	}
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "video/mp2t", w.Header().Get("Content-Type"))
+		require.Equal(t, segment, w.Body.Bytes())
+	})
 
+	t.Run("should return not found", func(t *testing.T) {
+		service.EXPECT().GetFileDB(gomock.Any(), bucket.Name, fileID).Return(hlsFile, nil).Times(1)
+		expectedPath := path.Join(fs.BucketsPath(), bucket.Name, fileID, "hls", "master.m3u8")
+		service.EXPECT().ReadExisting(expectedPath).Return(nil, false /* isAvailable */, nil).Times(1)
+
+		for _, hlsPath := range []string{"master.m3u8", "720p/original.mp4"} {
+			url := fmt.Sprintf("https://cdn.com/%s/%s/hls/%s", bucket.Name, fileID, hlsPath)
+			r, err := http.NewRequest(http.MethodGet, url, nil)
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, r)
+
+			expectedResponse := fmt.Sprintf(`{"message":"%s"}`, entities.ErrHLSNotFound)
+			require.Equal(t, http.StatusNotFound, w.Code, hlsPath)
+			require.Equal(t, expectedResponse, w.Body.String())
+		}
+	})
+
+	t.Run("should not serve package of deleted file", func(t *testing.T) {
+		// Deleted files are not found, see cdnService.GetFileDB
+		service.EXPECT().GetFileDB(gomock.Any(), bucket.Name, fileID).Return(nil, entities.ErrFileNotFound).Times(1)
+
+		url := fmt.Sprintf("https://cdn.com/%s/%s/hls/720p/seg_001.ts?auth=token", bucket.Name, fileID)
+		r, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestGetPrecompressed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, moduleController := getMocks(ctrl)
+	deps := setupDeps()
+
+	router := deps.Mux
+
+	handler := cdn.NewHandler(&cdn.HandlerDeps{
+		Logger:           deps.Logger,
+		Mux:              deps.Mux,
+		BucketCache:      deps.BucketCache,
+		FileCache:        deps.FileCache,
+		Service:          service,
+		ModuleController: moduleController,
+		Processing:       deps.Processing,
+		ProcessingConfig: deps.ProcessingConfig,
+		// Gzip only
+		Compressor: precompress.New(""),
+	})
+
+	router.HandleFunc("/{bucket}/{fileUUID}", handler.Get)
+
+	fileID := uuid.NewString()
+	DBFile := &entities.File{
+		ID:          primitive.NewObjectID(),
+		UUID:        fileID,
+		AvailableIn: []string{"cdn.com"},
+		Bucket:      textBucket.Name,
+		MimeType:    "text/css",
+		Extension:   ".css",
+	}
+
+	pathToOriginal := path.Join(fs.BucketsPath(), textBucket.Name, fileID, fs.DefaultName+DBFile.Extension)
+
+	t.Run("should serve gzip variant of original", func(t *testing.T) {
+		gzipped := []byte("gzipped")
+
+		service.EXPECT().GetFileDB(gomock.Any(), textBucket.Name, fileID).Return(DBFile, nil).Times(1)
+		service.EXPECT().ReadExisting(pathToOriginal+".gz").Return(gzipped, true, nil).Times(1)
+
+		url := fmt.Sprintf("https://cdn.com/%s/%s", textBucket.Name, fileID)
+		r, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		r.Header.Set("Accept-Encoding", "br, gzip")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, gzipped, w.Body.Bytes())
+		require.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+		require.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+		require.Equal(t, DBFile.MimeType, w.Header().Get("Content-Type"))
+	})
+
+	t.Run("should serve original to client not accepting gzip", func(t *testing.T) {
+		css := []byte("body { margin: 0 }")
+
+		service.EXPECT().GetFileDB(gomock.Any(), textBucket.Name, fileID).Return(DBFile, nil).Times(1)
+		service.EXPECT().ReadFile(pathToOriginal, DBFile.AvailableIn).Return(css, nil).Times(1)
+
+		url := fmt.Sprintf("https://cdn.com/%s/%s", textBucket.Name, fileID)
+		r, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		r.Header.Set("Accept-Encoding", "gzip;q=0")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, css, w.Body.Bytes())
+		require.Empty(t, w.Header().Get("Content-Encoding"))
+		require.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	})
+
+	t.Run("should serve minified derivative with its content type if variant is missing", func(t *testing.T) {
+		minified := []byte("body{margin:0}")
+
+		raw := modules.NewController(deps.Logger, nil, nil).Raw("text", modules.ModuleMap{"minify": "css"}, fileID)
+		pathToExisting := path.Join(fs.BucketsPath(), textBucket.Name, fileID, hash.SHA1Name(raw))
+
+		service.EXPECT().ReadExisting(pathToExisting+".gz").Return(nil, false, nil).Times(1)
+		service.EXPECT().ReadExisting(pathToExisting).Return(minified, true, nil).Times(1)
+
+		url := fmt.Sprintf("https://cdn.com/%s/%s?text.minify=css", textBucket.Name, fileID)
+		r, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		r.Header.Set("Accept-Encoding", "gzip")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, minified, w.Body.Bytes())
+		require.Empty(t, w.Header().Get("Content-Encoding"))
+		require.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+		require.Equal(t, "text/css; charset=utf-8", w.Header().Get("Content-Type"))
+	})
+
+	t.Run("should not vary by encoding in bucket without precompression", func(t *testing.T) {
+		service.EXPECT().GetFileDB(gomock.Any(), bucket.Name, fileID).Return(DBFile, nil).Times(1)
+		service.EXPECT().ReadFile(gomock.Any(), DBFile.AvailableIn).Return([]byte("hello"), nil).Times(1)
+
+		url := fmt.Sprintf("https://cdn.com/%s/%s", bucket.Name, fileID)
+		r, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		r.Header.Set("Accept-Encoding", "gzip")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Empty(t, w.Header().Get("Content-Encoding"))
+		require.Empty(t, w.Header().Get("Vary"))
+	})
+}
+
+func TestGetMultipleModules(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, moduleController := getMocks(ctrl)
+	deps := setupDeps()
+
+	router := deps.Mux
+
+	handler := cdn.NewHandler(&cdn.HandlerDeps{
+		Logger:           deps.Logger,
+		Mux:              deps.Mux,
+		BucketCache:      deps.BucketCache,
+		FileCache:        deps.FileCache,
+		Service:          service,
+		ModuleController: moduleController,
+		Processing:       deps.Processing,
+		ProcessingConfig: deps.ProcessingConfig,
+	})
+
+	router.HandleFunc("/{bucket}/{fileUUID}", handler.Get)
+
+	fileID := uuid.NewString()
+
+	t.Run("should render derivative by module applying to file", func(t *testing.T) {
+		DBFile := &entities.File{UUID: fileID, Bucket: siteBucket.Name, AvailableIn: []string{"cdn.com"}, MimeType: "text/css", Extension: ".css"}
+
+		service.EXPECT().ReadExisting(gomock.Any()).Return(nil, false, nil).Times(1)
+		service.EXPECT().GetFileDB(gomock.Any(), siteBucket.Name, fileID).Return(DBFile, nil).Times(1)
+		service.EXPECT().ReadFile(gomock.Any(), DBFile.AvailableIn).Return([]byte("a { color: red; }"), nil).Times(1)
+		service.EXPECT().MustSave([]byte("a{color:red}"), gomock.Any()).Times(1)
+		moduleController.EXPECT().UseResolvers(gomock.Any(), "text", gomock.Any()).DoAndReturn(
+			func(buff *bytes.Buffer, module string, mm modules.ModuleMap) error {
+				return modules.NewController(deps.Logger, nil, nil).UseResolvers(buff, module, mm)
+			},
+		).Times(1)
+
+		url := fmt.Sprintf("https://cdn.com/%s/%s?text.minify=css", siteBucket.Name, fileID)
+		r, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "a{color:red}", w.Body.String())
+		require.Equal(t, "text/css; charset=utf-8", w.Header().Get("Content-Type"))
+	})
+
+	t.Run("should return 400 if module doesn't apply to file", func(t *testing.T) {
+		DBFile := &entities.File{UUID: fileID, Bucket: siteBucket.Name, AvailableIn: []string{"cdn.com"}, MimeType: "image/png", Extension: ".png"}
+
+		service.EXPECT().ReadExisting(gomock.Any()).Return(nil, false, nil).Times(1)
+		service.EXPECT().GetFileDB(gomock.Any(), siteBucket.Name, fileID).Return(DBFile, nil).Times(1)
+
+		url := fmt.Sprintf("https://cdn.com/%s/%s?text.minify=css", siteBucket.Name, fileID)
+		r, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.Equal(t, `{"message":"resolvers of module text don't apply to image/png files"}`, w.Body.String())
+	})
+
+	t.Run("should return 400 if resolvers of several modules are requested", func(t *testing.T) {
+		url := fmt.Sprintf("https://cdn.com/%s/%s?text.minify=css&image.webp=true", siteBucket.Name, fileID)
+		r, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.Contains(t, w.Body.String(), "can't be combined")
+	})
+}
+
+func TestGetWithPresets(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, moduleController := getMocks(ctrl)
+	deps := setupDeps()
+
+	router := deps.Mux
+
+	handler := cdn.NewHandler(&cdn.HandlerDeps{
+		Logger:           deps.Logger,
+		Mux:              deps.Mux,
+		BucketCache:      deps.BucketCache,
+		FileCache:        deps.FileCache,
+		Service:          service,
+		ModuleController: moduleController,
+		Processing:       deps.Processing,
+		ProcessingConfig: deps.ProcessingConfig,
+	})
+
+	router.HandleFunc("/{bucket}/{fileUUID}", handler.Get)
+
+	fileID := uuid.NewString()
+
+	t.Run("should expand preset to the same derivative as equivalent query", func(t *testing.T) {
+		mockBits := []byte("hello world!")
+
+		raw := modules.NewController(deps.Logger, nil, nil).Raw("image", modules.ModuleMap{"resize": "200x0", "webp": "true"}, fileID)
+		expectedPath := path.Join(fs.BucketsPath(), presetsBucket.Name, fileID, hash.SHA1Name(raw))
+
+		service.EXPECT().ReadExisting(expectedPath).Return(mockBits, true /* isAvailable */, nil).Times(1)
+
+		url := fmt.Sprintf("https://cdn.com/%s/%s?preset=thumb", presetsBucket.Name, fileID)
+		r, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, mockBits, w.Body.Bytes())
+	})
+
+	t.Run("should return error. Preset does not exist", func(t *testing.T) {
+		url := fmt.Sprintf("https://cdn.com/%s/%s?preset=huge", presetsBucket.Name, fileID)
+		r, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, r)
+
+		expectedResponse := fmt.Sprintf(`{"message":"%s"}`, entities.ErrPresetNotFound)
+		require.Equal(t, http.StatusNotFound, w.Code)
+		require.Equal(t, expectedResponse, w.Body.String())
+	})
+
+	t.Run("should return error. Preset is combined with resolvers", func(t *testing.T) {
+		url := fmt.Sprintf("https://cdn.com/%s/%s?preset=thumb&image.blur=10", presetsBucket.Name, fileID)
+		r, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, r)
+
+		expectedResponse := fmt.Sprintf(`{"message":"%s"}`, entities.ErrPresetWithResolvers)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.Equal(t, expectedResponse, w.Body.String())
+	})
+
+	t.Run("should return error. Bucket accepts presets only", func(t *testing.T) {
+		url := fmt.Sprintf("https://cdn.com/%s/%s?image.resize=5000x5000", presetsBucket.Name, fileID)
+		r, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, r)
+
+		expectedResponse := fmt.Sprintf(`{"message":"%s"}`, entities.ErrPresetsOnly)
+		require.Equal(t, http.StatusForbidden, w.Code)
+		require.Equal(t, expectedResponse, w.Body.String())
+	})
+}
+
+func TestDelete(t *testing.T) {
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, moduleController := getMocks(ctrl)
+	deps := setupDeps()
+
+	handler := cdn.NewHandler(&cdn.HandlerDeps{
+		Logger:           deps.Logger,
+		Mux:              deps.Mux,
+		BucketCache:      deps.BucketCache,
+		FileCache:        deps.FileCache,
+		Service:          service,
+		ModuleController: moduleController,
+		// Pass nil: see cdn_handler_test.go:97
+		Middlewares: nil,
+		MemConfig:   nil,
+	})
+
+	router := deps.Mux
+
+	router.HandleFunc("/{bucket}/{fileUUID}", handler.Delete)
+
+	fileID := uuid.NewString()
+
+	t.Run("should mark file as deletable", func(t *testing.T) {
+		DBFile := &entities.File{
+			ID:          primitive.NewObjectID(),
+			UUID:        uuid.NewString(),
+			Bucket:      bucket.Name,
+			AvailableIn: []string{"cdn.com"},
+			MimeType:    "text/plain; charset=utf-8",
+			Extension:   ".txt",
+			// Not marked yet
+			IsDeletable: false,
+		}
+
+		service.EXPECT().GetFileDB(gomock.Any(), bucket.Name, fileID).Return(DBFile, nil).Times(1)
+
+		service.EXPECT().MarkAsDeletableDB(gomock.Any(), bucket.Name, DBFile.ID).Return(nil).Times(1)
+
+		url := fmt.Sprintf("https://cdn.com/%s/%s", bucket.Name, fileID /* uuid */)
+
+		r, err := http.NewRequest(http.MethodDelete, url, nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		// Will call handler.Delete
+		router.ServeHTTP(w, r)
+
+		code := w.Code
+
+		require.Equal(t, http.StatusOK, code)
+		require.Nil(t, w.Body.Bytes())
+	})
+
+	t.Run("should return error ErrFileAlreadyDeleted", func(t *testing.T) {
+		DBFile := &entities.File{
+			ID:          primitive.NewObjectID(),
+			UUID:        uuid.NewString(),
+			Bucket:      bucket.Name,
+			AvailableIn: []string{"cdn.com"},
+			MimeType:    "text/plain; charset=utf-8",
+			Extension:   ".txt",
+			// Already marked for deletion
+			IsDeletable: true,
+		}
+
+		service.EXPECT().GetFileDB(gomock.Any(), bucket.Name, fileID).Return(DBFile, nil)
+
+		url := fmt.Sprintf("https://cdn.com/%s/%s", bucket.Name, fileID /* uuid */)
+
+		r, err := http.NewRequest(http.MethodDelete, url, nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+
+		// Will call handler.Delete
+		router.ServeHTTP(w, r)
+
+		code := w.Code
+		respStr := w.Body.String()
+
+		expectedResponse := fmt.Sprintf(`{"message":"%s"}`, entities.ErrFileAlreadyDeleted.Error())
+
+		require.Equal(t, http.StatusBadRequest, code)
+		require.Equal(t, expectedResponse, respStr)
+	})
+}
+
+func getMocks(ctrl *gomock.Controller) (service *mock_cdn.MockService, moduleControllerMock *mock_modules.MockController) {
+	service = mock_cdn.NewMockService(ctrl)
+	moduleControllerMock = mock_modules.NewMockController(ctrl)
+	moduleController := modules.NewController(setupDeps().Logger, nil, nil)
+
+	// Keep real implementations
+	{
+		moduleControllerMock.EXPECT().Raw(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+			func(module string, mm modules.ModuleMap, uuid string) string {
+				return moduleController.Raw(module, mm, uuid)
+			},
+		).AnyTimes()
+
+		moduleControllerMock.EXPECT().Parse(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(q url.Values, bucketModules []string) (string, modules.ModuleMap, error) {
+				return moduleController.Parse(q, bucketModules)
+			},
+		).AnyTimes()
+
+		moduleControllerMock.EXPECT().ParsePreset(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(preset entities.Preset, bucketModules []string) (string, modules.ModuleMap, error) {
+				return moduleController.ParsePreset(preset, bucketModules)
+			},
+		).AnyTimes()
+
+		moduleControllerMock.EXPECT().HasResolver(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(module, resolverName string) bool {
+				return moduleController.HasResolver(module, resolverName)
+			},
+		).AnyTimes()
+
+		moduleControllerMock.EXPECT().Select(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(bucketModules []string, mime string) string {
+				return moduleController.Select(bucketModules, mime)
+			},
+		).AnyTimes()
+
+		moduleControllerMock.EXPECT().CheckMime(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(module string, mime string) error {
+				return moduleController.CheckMime(module, mime)
+			},
+		).AnyTimes()
+
+		moduleControllerMock.EXPECT().ContentType(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(module string, mm modules.ModuleMap) string {
+				return moduleController.ContentType(module, mm)
+			},
+		).AnyTimes()
+
+		moduleControllerMock.EXPECT().Precompressed(gomock.Any()).DoAndReturn(
+			func(module string) bool {
+				return moduleController.Precompressed(module)
+			},
+		).AnyTimes()
+
+		moduleControllerMock.EXPECT().Pin(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+			func(ctx context.Context, module string, mm modules.ModuleMap) (modules.ModuleMap, error) {
+				return moduleController.Pin(ctx, module, mm)
+			},
+		).AnyTimes()
+
+		service.EXPECT().ParseMime(gomock.Any()).DoAndReturn(
+			func(buff []byte) string {
+				return mimetype.Detect(buff).String()
+			},
+		).AnyTimes()
+	}
+
+	// Naked return!
+	return
+}
+
+func setupDeps() *cdn.HandlerDeps {
+	logger := zap.NewNop().Sugar()
+	bucketCache := bucketcache.NewBucketCache()
+	fileCache := &filecache.NoOpFilecache{}
+	router := mux.NewRouter()
+
+	bucketCache.Add(bucket)
+	bucketCache.Add(presetsBucket)
+	bucketCache.Add(stripBucket)
+	bucketCache.Add(textBucket)
+	bucketCache.Add(siteBucket)
+	bucketCache.Add(uploadBucket)
+
+	processing := pool.New(2, 64, 64)
+	processing.Start()
+
+	return &cdn.HandlerDeps{
+		Logger:      logger,
+		BucketCache: bucketCache,
+		FileCache:   fileCache,
+		Mux:         router,
+		Middlewares: nil,
+		MemConfig:   nil,
+		Processing:  processing,
+		ProcessingConfig: &config.ProcessingConfig{
+			RetryAfter: 1,
+		},
+	}
+
+}
+
+type uploadPart struct {
+	name        string
+	contentType string
+	bits        []byte
+}
+
+func uploadRequest(t *testing.T, bucket string, parts ...uploadPart) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range parts {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, part.name))
+		h.Set("Content-Type", part.contentType)
+
+		pw, err := mw.CreatePart(h)
+		require.NoError(t, err)
+		_, err = pw.Write(part.bits)
+		require.NoError(t, err)
+	}
+	require.NoError(t, mw.Close())
+
+	r, err := http.NewRequest(http.MethodPost, fmt.Sprintf("https://cdn.com/%s", bucket), &body)
+	require.NoError(t, err)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+
+	return r
+}
+
+func TestUploadPolicy(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, moduleController := getMocks(ctrl)
+	deps := setupDeps()
+
+	router := deps.Mux
+
+	handler := cdn.NewHandler(&cdn.HandlerDeps{
+		Logger:           deps.Logger,
+		Mux:              deps.Mux,
+		BucketCache:      deps.BucketCache,
+		FileCache:        deps.FileCache,
+		Service:          service,
+		ModuleController: moduleController,
+		MemConfig:        &config.MemoryConfig{MaxUploadSize: 1},
+		Processing:       deps.Processing,
+		ProcessingConfig: deps.ProcessingConfig,
+	})
+
+	router.HandleFunc("/{bucket}", handler.Upload)
+
+	css := []byte("a { color: red }")
+	js := []byte("let a = 1")
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+	t.Run("should upload files of allowed types", func(t *testing.T) {
+		moduleController.EXPECT().Check("text", gomock.Any()).Return(nil).Times(2)
+		moduleController.EXPECT().Describe("text", gomock.Any()).Return(nil, nil).Times(2)
+
+		service.EXPECT().UploadMany(gomock.Any(), uploadBucket.Name, gomock.Any()).DoAndReturn(
+			func(_ interface{}, _ string, files []*formdata.UploadFile) ([]string, []string, error) {
+				require.Len(t, files, 2)
+				// Sniffing can't tell these from plain text, so declared types are kept
+				require.Equal(t, "text/css", files[0].MimeType)
+				require.Equal(t, "application/javascript", files[1].MimeType)
+				return []string{"url1", "url2"}, []string{files[0].UUID, files[1].UUID}, nil
+			},
+		).Times(1)
+
+		r := uploadRequest(t, uploadBucket.Name,
+			uploadPart{"a.css", "text/css", css},
+			uploadPart{"a.js", "application/javascript", js},
+		)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	})
+
+	t.Run("should reject files violating policy", func(t *testing.T) {
+		cases := []struct {
+			name  string
+			parts []uploadPart
+			code  int
+			msg   string
+		}{
+			{
+				name:  "type detected by contents",
+				parts: []uploadPart{{"a.css", "text/css", png}},
+				code:  http.StatusUnsupportedMediaType,
+				msg:   "file type is not allowed: image/png",
+			},
+			{
+				name:  "type of plain text declared as html",
+				parts: []uploadPart{{"a.html", "text/html", css}},
+				code:  http.StatusUnsupportedMediaType,
+				msg:   "file type is not allowed: text/plain",
+			},
+			{
+				name:  "file size",
+				parts: []uploadPart{{"a.css", "text/css", bytes.Repeat(css, 10)}},
+				code:  http.StatusRequestEntityTooLarge,
+				msg:   "file is too large: 160 bytes exceed limit of 100",
+			},
+			{
+				name:  "number of files",
+				parts: []uploadPart{{"a.css", "text/css", css}, {"b.css", "text/css", css}, {"c.css", "text/css", css}},
+				code:  http.StatusBadRequest,
+				msg:   "too many files: 3 files exceed limit of 2",
+			},
+			{
+				name:  "request size",
+				parts: []uploadPart{{"a.css", "text/css", bytes.Repeat(css, 100)}},
+				code:  http.StatusRequestEntityTooLarge,
+				msg:   "request is too large",
+			},
+		}
+
+		for _, tc := range cases {
+			r := uploadRequest(t, uploadBucket.Name, tc.parts...)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			require.Equal(t, tc.code, w.Code, tc.name)
+			require.Contains(t, w.Body.String(), tc.msg, tc.name)
+		}
+	})
+
+	t.Run("should reject too large request of unknown length", func(t *testing.T) {
+		r := uploadRequest(t, uploadBucket.Name, uploadPart{"a.css", "text/css", bytes.Repeat(css, 100)})
+		r.ContentLength = -1
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		require.Contains(t, w.Body.String(), "request is too large: exceeds limit of 1000 bytes")
+	})
+}
+
+func TestGetUsage(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, moduleController := getMocks(ctrl)
+	deps := setupDeps()
+
+	quotaBucket := &entities.Bucket{
+		ID:      primitive.NewObjectID(),
+		Name:    "quota",
+		Modules: []string{"text"},
+		Quota:   &entities.QuotaPolicy{MaxBytes: 1000, MaxObjects: 10},
+	}
+	deps.BucketCache.Add(quotaBucket)
+
+	handler := cdn.NewHandler(&cdn.HandlerDeps{
+		Logger:           deps.Logger,
+		Mux:              deps.Mux,
+		BucketCache:      deps.BucketCache,
+		FileCache:        deps.FileCache,
+		Service:          service,
+		ModuleController: moduleController,
+	})
+
+	router := deps.Mux
+	router.HandleFunc("/api/bucket/{bucket}/usage", handler.GetUsage)
+
+	t.Run("should write usage and quota", func(t *testing.T) {
+		service.EXPECT().Usage(quotaBucket.Name).Return(usage.Usage{
+			Originals:   usage.Counter{Bytes: 300, Objects: 3},
+			Derivatives: usage.Counter{Bytes: 50, Objects: 5},
+		}).Times(1)
+
+		r := httptest.NewRequest(http.MethodGet, "https://cdn.com/api/bucket/quota/usage", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.JSONEq(t, `{
+			"bucket": "quota",
+			"originals": {"bytes": 300, "objects": 3},
+			"derivatives": {"bytes": 50, "objects": 5},
+			"total": {"bytes": 350, "objects": 8},
+			"quota": {"max_bytes": 1000, "max_objects": 10}
+		}`, w.Body.String())
+	})
+
+	t.Run("should return error ErrBucketNotFound", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "https://cdn.com/api/bucket/nope/usage", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestUpdateBucket(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, moduleController := getMocks(ctrl)
+	deps := setupDeps()
+
+	versionedBucket := &entities.Bucket{
+		ID:         primitive.NewObjectID(),
+		Name:       "versioned",
+		Modules:    []string{"image"},
+		Presets:    presetsBucket.Presets,
+		Eager:      []string{"thumb"},
+		Versioning: &entities.VersioningPolicy{Keep: 3},
+	}
+	deps.BucketCache.Add(versionedBucket)
+
+	handler := cdn.NewHandler(&cdn.HandlerDeps{
+		Logger:           deps.Logger,
+		Mux:              deps.Mux,
+		BucketCache:      deps.BucketCache,
+		FileCache:        deps.FileCache,
+		Service:          service,
+		ModuleController: moduleController,
+	})
+
+	router := deps.Mux
+	router.HandleFunc("/api/bucket/{bucket}", handler.UpdateBucket).Methods(http.MethodPatch)
+
+	t.Run("should update only settings present in request", func(t *testing.T) {
+		service.EXPECT().UpdateBucketDB(gomock.Any(), versionedBucket.Name, gomock.Any()).
+			DoAndReturn(func(_ context.Context, _ string, inp dto.UpdateBucketDto) (*entities.Bucket, error) {
+				require.Equal(t, []string{"presets_only"}, inp.Present())
+
+				b := *versionedBucket
+				b.PresetsOnly = inp.PresetsOnly
+				return &b, nil
+			}).Times(1)
+
+		body := strings.NewReader(`{"presets_only": true}`)
+		r := httptest.NewRequest(http.MethodPatch, "https://cdn.com/api/bucket/versioned", body)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("should validate request along with kept settings", func(t *testing.T) {
+		// Eager thumb preset is kept, so removing the preset is invalid
+		body := strings.NewReader(`{"presets": {}}`)
+		r := httptest.NewRequest(http.MethodPatch, "https://cdn.com/api/bucket/versioned", body)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestUpdate(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, moduleController := getMocks(ctrl)
+	deps := setupDeps()
+
+	router := deps.Mux
+
+	handler := cdn.NewHandler(&cdn.HandlerDeps{
+		Logger:           deps.Logger,
+		Mux:              deps.Mux,
+		BucketCache:      deps.BucketCache,
+		FileCache:        deps.FileCache,
+		Service:          service,
+		ModuleController: moduleController,
+		MemConfig:        &config.MemoryConfig{MaxUploadSize: 1},
+		Processing:       deps.Processing,
+		ProcessingConfig: deps.ProcessingConfig,
+	})
+
+	router.HandleFunc("/{bucket}/{fileUUID}", handler.Update).Methods(http.MethodPut)
+	router.HandleFunc("/{bucket}/{fileUUID}/versions/{version}/rollback", handler.Rollback).Methods(http.MethodPost)
+
+	DBFile := &entities.File{
+		ID:        primitive.NewObjectID(),
+		UUID:      uuid.NewString(),
+		Bucket:    uploadBucket.Name,
+		MimeType:  "text/css",
+		Extension: ".css",
+	}
+
+	css := []byte("a { color: blue }")
+	updateRequest := func(parts ...uploadPart) *http.Request {
+		r := uploadRequest(t, uploadBucket.Name, parts...)
+		r.Method = http.MethodPut
+		r.URL.Path = fmt.Sprintf("/%s/%s", uploadBucket.Name, DBFile.UUID)
+		return r
+	}
+
+	t.Run("should upload new version of file", func(t *testing.T) {
+		service.EXPECT().GetFileDB(gomock.Any(), uploadBucket.Name, DBFile.UUID).Return(DBFile, nil).Times(1)
+		moduleController.EXPECT().Check("text", gomock.Any()).Return(nil).Times(1)
+		moduleController.EXPECT().Describe("text", gomock.Any()).Return(nil, nil).Times(1)
+
+		service.EXPECT().UpdateFile(gomock.Any(), DBFile, gomock.Any()).DoAndReturn(
+			func(_ interface{}, f *entities.File, file *formdata.UploadFile) (*entities.File, error) {
+				// Replaces file at the same place
+				require.Equal(t, f.UUID, file.UUID)
+				require.Equal(t, "text/css", file.MimeType)
+				return &entities.File{UUID: f.UUID, Version: 2}, nil
+			},
+		).Times(1)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, updateRequest(uploadPart{"b.css", "text/css", css}))
+
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.JSONEq(t, fmt.Sprintf(`{"id": "%s", "version": 2, "metadata": null}`, DBFile.UUID), w.Body.String())
+	})
+
+	t.Run("should reject several files", func(t *testing.T) {
+		service.EXPECT().GetFileDB(gomock.Any(), uploadBucket.Name, DBFile.UUID).Return(DBFile, nil).Times(1)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, updateRequest(uploadPart{"a.css", "text/css", css}, uploadPart{"b.css", "text/css", css}))
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.Contains(t, w.Body.String(), entities.ErrSingleFileOnly.Error())
+	})
+
+	t.Run("should return conflict if file is updated meanwhile", func(t *testing.T) {
+		service.EXPECT().GetFileDB(gomock.Any(), uploadBucket.Name, DBFile.UUID).Return(DBFile, nil).Times(1)
+		moduleController.EXPECT().Check("text", gomock.Any()).Return(nil).Times(1)
+		moduleController.EXPECT().Describe("text", gomock.Any()).Return(nil, nil).Times(1)
+		service.EXPECT().UpdateFile(gomock.Any(), DBFile, gomock.Any()).Return(nil, entities.ErrVersionConflict).Times(1)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, updateRequest(uploadPart{"b.css", "text/css", css}))
+
+		require.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("should roll back to prior version", func(t *testing.T) {
+		service.EXPECT().GetFileDB(gomock.Any(), uploadBucket.Name, DBFile.UUID).Return(DBFile, nil).Times(1)
+		service.EXPECT().RollbackFile(gomock.Any(), DBFile, 1).Return(&entities.File{UUID: DBFile.UUID, Version: 3}, nil).Times(1)
+
+		url := fmt.Sprintf("https://cdn.com/%s/%s/versions/1/rollback", uploadBucket.Name, DBFile.UUID)
+		r := httptest.NewRequest(http.MethodPost, url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.JSONEq(t, fmt.Sprintf(`{"id": "%s", "version": 3}`, DBFile.UUID), w.Body.String())
+	})
+
+	t.Run("should reject invalid version", func(t *testing.T) {
+		url := fmt.Sprintf("https://cdn.com/%s/%s/versions/0/rollback", uploadBucket.Name, DBFile.UUID)
+		r := httptest.NewRequest(http.MethodPost, url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestGetVersion(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, moduleController := getMocks(ctrl)
+	deps := setupDeps()
+
+	router := deps.Mux
+
+	handler := cdn.NewHandler(&cdn.HandlerDeps{
+		Logger:           deps.Logger,
+		Mux:              deps.Mux,
+		BucketCache:      deps.BucketCache,
+		FileCache:        deps.FileCache,
+		Service:          service,
+		ModuleController: moduleController,
+		Processing:       deps.Processing,
+		ProcessingConfig: deps.ProcessingConfig,
+	})
+
+	router.HandleFunc("/{bucket}/{fileUUID}", handler.Get)
+	router.HandleFunc("/{bucket}/{fileUUID}/versions", handler.GetVersions)
+
+	DBFile := &entities.File{
+		ID:          primitive.NewObjectID(),
+		UUID:        uuid.NewString(),
+		AvailableIn: []string{"cdn.com"},
+		Bucket:      textBucket.Name,
+		MimeType:    "text/css",
+		Extension:   ".css",
+		Version:     2,
+		UpdatedAt:   time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC),
+		Versions: []entities.FileVersion{
+			{Version: 1, MimeType: "text/plain", Extension: ".txt", CreatedAt: time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		},
+	}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		url := fmt.Sprintf("https://cdn.com/%s/%s%s", textBucket.Name, DBFile.UUID, query)
+		r := httptest.NewRequest(http.MethodGet, url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("should serve original of prior version", func(t *testing.T) {
+		service.EXPECT().GetFileDB(gomock.Any(), textBucket.Name, DBFile.UUID).Return(DBFile, nil).Times(1)
+		service.EXPECT().ReadFile(gomock.Any(), DBFile.AvailableIn).DoAndReturn(
+			func(p string, _ []string) ([]byte, error) {
+				require.True(t, strings.HasSuffix(p, DBFile.UUID+"/versions/1/data.txt"), p)
+				return []byte("v1"), nil
+			},
+		).Times(1)
+
+		w := get("?version=1")
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "v1", w.Body.String())
+		require.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+	})
+
+	t.Run("should serve current version", func(t *testing.T) {
+		service.EXPECT().GetFileDB(gomock.Any(), textBucket.Name, DBFile.UUID).Return(DBFile, nil).Times(1)
+		service.EXPECT().ReadFile(gomock.Any(), DBFile.AvailableIn).DoAndReturn(
+			func(p string, _ []string) ([]byte, error) {
+				require.True(t, strings.HasSuffix(p, DBFile.UUID+"/data.css"), p)
+				return []byte("v2"), nil
+			},
+		).Times(1)
+
+		w := get("?version=2")
+
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "v2", w.Body.String())
+	})
+
+	t.Run("should return error ErrVersionNotFound", func(t *testing.T) {
+		service.EXPECT().GetFileDB(gomock.Any(), textBucket.Name, DBFile.UUID).Return(DBFile, nil).Times(1)
+
+		w := get("?version=5")
+		require.Equal(t, http.StatusNotFound, w.Code)
+		require.Contains(t, w.Body.String(), entities.ErrVersionNotFound.Error())
+	})
+
+	t.Run("should return error ErrInvalidVersion", func(t *testing.T) {
+		w := get("?version=latest")
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("should list versions", func(t *testing.T) {
+		service.EXPECT().GetFileDB(gomock.Any(), textBucket.Name, DBFile.UUID).Return(DBFile, nil).Times(1)
+
+		w := get("/versions")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.JSONEq(t, fmt.Sprintf(`{
+			"id": "%s",
+			"current": 2,
+			"versions": [
+				{"version": 1, "mime_type": "text/plain", "extension": ".txt", "created_at": "2026-10-18T00:00:00Z"},
+				{"version": 2, "mime_type": "text/css", "extension": ".css", "created_at": "2026-10-19T00:00:00Z"}
+			]
+		}`, DBFile.UUID), w.Body.String())
+	})
+}
+
+func TestTransfer(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, moduleController := getMocks(ctrl)
+	deps := setupDeps()
+
+	router := deps.Mux
+
+	handler := cdn.NewHandler(&cdn.HandlerDeps{
+		Logger:           deps.Logger,
+		Mux:              deps.Mux,
+		BucketCache:      deps.BucketCache,
+		FileCache:        deps.FileCache,
+		Service:          service,
+		ModuleController: moduleController,
+		Processing:       deps.Processing,
+		ProcessingConfig: deps.ProcessingConfig,
+	})
+
+	router.HandleFunc("/{bucket}/{transfer:copy|move}", handler.Transfer).Methods(http.MethodPost)
+	router.HandleFunc("/{bucket}/{fileUUID}/{transfer:copy|move}", handler.Transfer).Methods(http.MethodPost)
+
+	DBFile := &entities.File{
+		ID:        primitive.NewObjectID(),
+		UUID:      uuid.NewString(),
+		Bucket:    textBucket.Name,
+		MimeType:  "text/css",
+		Extension: ".css",
+	}
+
+	transfer := func(target string, body string) *httptest.ResponseRecorder {
+		url := fmt.Sprintf("https://cdn.com/%s/%s", textBucket.Name, target)
+		r := httptest.NewRequest(http.MethodPost, url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("should copy a single file", func(t *testing.T) {
+		service.EXPECT().GetFileDB(gomock.Any(), textBucket.Name, DBFile.UUID).Return(DBFile, nil).Times(1)
+		service.EXPECT().TransferFile(gomock.Any(), DBFile, uploadBucket.Name, false, true).Return("new-id", "cdn.com/styles/new-id", nil).Times(1)
+
+		w := transfer(DBFile.UUID+"/copy?to="+uploadBucket.Name, `{"metadata": true}`)
+
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		require.JSONEq(t, `{"id": "new-id", "url": "cdn.com/styles/new-id"}`, w.Body.String())
+	})
+
+	t.Run("should move a batch reporting every file", func(t *testing.T) {
+		service.EXPECT().GetFileDB(gomock.Any(), textBucket.Name, DBFile.UUID).Return(DBFile, nil).Times(1)
+		service.EXPECT().GetFileDB(gomock.Any(), textBucket.Name, "missing").Return(nil, entities.ErrFileNotFound).Times(1)
+		service.EXPECT().TransferFile(gomock.Any(), DBFile, uploadBucket.Name, true, false).Return("new-id", "cdn.com/styles/new-id", nil).Times(1)
+
+		w := transfer("move?to="+uploadBucket.Name, fmt.Sprintf(`{"ids": ["%s", "missing"]}`, DBFile.UUID))
+
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.JSONEq(t, fmt.Sprintf(`{"results": [
+			{"source": "%s", "status": 201, "id": "new-id", "url": "cdn.com/styles/new-id"},
+			{"source": "missing", "status": 404, "error": "file not found"}
+		]}`, DBFile.UUID), w.Body.String())
+	})
+
+	t.Run("should not move file to its own bucket", func(t *testing.T) {
+		w := transfer(DBFile.UUID+"/move?to="+textBucket.Name, "")
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("should return error ErrBucketNotFound", func(t *testing.T) {
+		w := transfer(DBFile.UUID+"/copy?to=nope", "")
+		require.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("should return error ErrNoFiles", func(t *testing.T) {
+		w := transfer("copy?to="+uploadBucket.Name, `{"ids": []}`)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestAlias(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, moduleController := getMocks(ctrl)
+	deps := setupDeps()
+
+	router := deps.Mux
+
+	handler := cdn.NewHandler(&cdn.HandlerDeps{
+		Logger:           deps.Logger,
+		Mux:              deps.Mux,
+		Middlewares:      middleware.NewMiddlewares(deps.Logger, deps.BucketCache, ""),
+		BucketCache:      deps.BucketCache,
+		FileCache:        deps.FileCache,
+		Service:          service,
+		ModuleController: moduleController,
+		MemConfig:        &config.MemoryConfig{MaxUploadSize: 1},
+		Processing:       deps.Processing,
+		ProcessingConfig: deps.ProcessingConfig,
+	})
+
+	// Aliases are resolved by routes
+	handler.InitRoutes()
+
+	DBFile := &entities.File{
+		ID:          primitive.NewObjectID(),
+		UUID:        uuid.NewString(),
+		AvailableIn: []string{"cdn.com"},
+		Bucket:      textBucket.Name,
+		MimeType:    "text/css",
+		Extension:   ".css",
+	}
+
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("should serve file by alias", func(t *testing.T) {
+		for _, alias := range []string{"main.css", "posters/naruto-s1.css"} {
+			service.EXPECT().ResolveAlias(gomock.Any(), textBucket.Name, alias).Return(DBFile.UUID, nil).Times(1)
+			service.EXPECT().GetFileDB(gomock.Any(), textBucket.Name, DBFile.UUID).Return(DBFile, nil).Times(1)
+			service.EXPECT().ReadFile(gomock.Any(), DBFile.AvailableIn).DoAndReturn(
+				func(p string, _ []string) ([]byte, error) {
+					require.True(t, strings.HasSuffix(p, DBFile.UUID+"/data.css"), p)
+					return []byte("a { color: red }"), nil
+				},
+			).Times(1)
+
+			w := serve(httptest.NewRequest(http.MethodGet, fmt.Sprintf("https://cdn.com/%s/%s", textBucket.Name, alias), nil))
+
+			require.Equal(t, http.StatusOK, w.Code, alias)
+			require.Equal(t, "a { color: red }", w.Body.String(), alias)
+		}
+	})
+
+	t.Run("should not resolve UUID", func(t *testing.T) {
+		service.EXPECT().GetFileDB(gomock.Any(), textBucket.Name, DBFile.UUID).Return(DBFile, nil).Times(1)
+		service.EXPECT().ReadFile(gomock.Any(), DBFile.AvailableIn).Return([]byte("a { color: red }"), nil).Times(1)
+
+		w := serve(httptest.NewRequest(http.MethodGet, fmt.Sprintf("https://cdn.com/%s/%s", textBucket.Name, DBFile.UUID), nil))
+		require.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("should return error ErrFileNotFound", func(t *testing.T) {
+		service.EXPECT().ResolveAlias(gomock.Any(), textBucket.Name, "posters/missing.css").Return("", entities.ErrFileNotFound).Times(1)
+
+		w := serve(httptest.NewRequest(http.MethodGet, fmt.Sprintf("https://cdn.com/%s/posters/missing.css", textBucket.Name), nil))
+		require.Equal(t, http.StatusNotFound, w.Code)
+
+		// Never a valid alias
+		w = serve(httptest.NewRequest(http.MethodGet, fmt.Sprintf("https://cdn.com/%s/posters/.hidden", textBucket.Name), nil))
+		require.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("should not reveal aliases of private bucket", func(t *testing.T) {
+		// Without token alias is never resolved
+		w := serve(httptest.NewRequest(http.MethodGet, fmt.Sprintf("https://cdn.com/%s/posters/naruto-s1.css", uploadBucket.Name), nil))
+		require.Equal(t, http.StatusForbidden, w.Code)
+
+		// Unknown alias is denied like invalid token is
+		service.EXPECT().ResolveAlias(gomock.Any(), uploadBucket.Name, "posters/missing.css").Return("", entities.ErrFileNotFound).Times(1)
+		w = serve(httptest.NewRequest(http.MethodGet, fmt.Sprintf("https://cdn.com/%s/posters/missing.css?auth=invalid", uploadBucket.Name), nil))
+		require.Equal(t, http.StatusForbidden, w.Code)
+
+		service.EXPECT().ResolveAlias(gomock.Any(), uploadBucket.Name, "posters/naruto-s1.css").Return(DBFile.UUID, nil).Times(1)
+		w = serve(httptest.NewRequest(http.MethodGet, fmt.Sprintf("https://cdn.com/%s/posters/naruto-s1.css?auth=invalid", uploadBucket.Name), nil))
+		require.Equal(t, http.StatusForbidden, w.Code)
+
+		w = serve(httptest.NewRequest(http.MethodGet, fmt.Sprintf("https://cdn.com/%s/posters/.hidden?auth=invalid", uploadBucket.Name), nil))
+		require.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	setAlias := func(alias string) *httptest.ResponseRecorder {
+		url := fmt.Sprintf("https://cdn.com/%s/%s/alias", uploadBucket.Name, DBFile.UUID)
+		return serve(httptest.NewRequest(http.MethodPut, url, strings.NewReader(fmt.Sprintf(`{"alias": "%s"}`, alias))))
+	}
+
+	t.Run("should set alias", func(t *testing.T) {
+		service.EXPECT().SetAliasDB(gomock.Any(), uploadBucket.Name, DBFile.UUID, "posters/naruto-s1.jpg").Return(nil).Times(1)
+
+		w := setAlias("posters/naruto-s1.jpg")
+
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.JSONEq(t, fmt.Sprintf(`{"id": "%s", "alias": "posters/naruto-s1.jpg"}`, DBFile.UUID), w.Body.String())
+	})
+
+	t.Run("should remove alias", func(t *testing.T) {
+		service.EXPECT().SetAliasDB(gomock.Any(), uploadBucket.Name, DBFile.UUID, "").Return(nil).Times(1)
+
+		w := setAlias("")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	})
+
+	t.Run("should return error ErrAliasTaken", func(t *testing.T) {
+		service.EXPECT().SetAliasDB(gomock.Any(), uploadBucket.Name, DBFile.UUID, "taken.jpg").Return(entities.ErrAliasTaken).Times(1)
+
+		w := setAlias("taken.jpg")
+		require.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("should return error ErrInvalidAlias", func(t *testing.T) {
+		for _, alias := range []string{"posters//a.jpg", "/a.jpg", "a b.jpg", "posters/versions/1", "hls/a", uuid.NewString(), strings.Repeat("a", 256)} {
+			w := setAlias(alias)
+			require.Equal(t, http.StatusBadRequest, w.Code, alias)
+		}
+	})
+
+	upload := func(alias string, files int) *http.Request {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for i := 0; i < files; i++ {
+			h := make(textproto.MIMEHeader)
+			h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%d.css"`, i))
+			h.Set("Content-Type", "text/css")
+
+			pw, err := mw.CreatePart(h)
+			require.NoError(t, err)
+			_, err = pw.Write([]byte("a { color: red }"))
+			require.NoError(t, err)
+		}
+		require.NoError(t, mw.WriteField("alias", alias))
+		require.NoError(t, mw.Close())
+
+		r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("https://cdn.com/%s", uploadBucket.Name), &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		return r
+	}
+
+	t.Run("should upload file with alias", func(t *testing.T) {
+		moduleController.EXPECT().Check("text", gomock.Any()).Return(nil).Times(1)
+		moduleController.EXPECT().Describe("text", gomock.Any()).Return(nil, nil).Times(1)
+
+		service.EXPECT().UploadMany(gomock.Any(), uploadBucket.Name, gomock.Any()).DoAndReturn(
+			func(_ interface{}, _ string, files []*formdata.UploadFile) ([]string, []string, error) {
+				require.Equal(t, "site/main.css", files[0].Alias)
+				return []string{"url"}, []string{files[0].UUID}, nil
+			},
+		).Times(1)
+
+		w := serve(upload("site/main.css", 1))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	})
+
+	t.Run("should return error ErrSingleFileOnly", func(t *testing.T) {
+		w := serve(upload("site/main.css", 2))
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.Contains(t, w.Body.String(), entities.ErrSingleFileOnly.Error())
+	})
+}
+
+func TestBatchDelete(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service, moduleController := getMocks(ctrl)
+	deps := setupDeps()
+
+	router := deps.Mux
+
+	handler := cdn.NewHandler(&cdn.HandlerDeps{
+		Logger:           deps.Logger,
+		Mux:              deps.Mux,
+		BucketCache:      deps.BucketCache,
+		FileCache:        deps.FileCache,
+		Service:          service,
+		ModuleController: moduleController,
+		Processing:       deps.Processing,
+		ProcessingConfig: deps.ProcessingConfig,
+	})
+
+	router.HandleFunc("/{bucket}/delete", handler.BatchDelete).Methods(http.MethodPost)
+
+	batchDelete := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, fmt.Sprintf("https://cdn.com/%s/delete", textBucket.Name), strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("should delete files by ids reporting every file", func(t *testing.T) {
+		inp := dto.BatchDeleteDto{IDs: []string{"a", "missing", "b"}}
+		service.EXPECT().MarkManyAsDeletableDB(gomock.Any(), textBucket.Name, inp, gomock.Any()).Return([]string{"b", "a"}, nil).Times(1)
+
+		w := batchDelete(`{"ids": ["a", "missing", "b"]}`)
+
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.JSONEq(t, `{"results": [
+			{"id": "a", "status": 200},
+			{"id": "missing", "status": 404, "error": "file not found"},
+			{"id": "b", "status": 200}
+		]}`, w.Body.String())
+	})
+
+	t.Run("should delete files by metadata", func(t *testing.T) {
+		inp := dto.BatchDeleteDto{Metadata: map[string]string{"owner": "42"}}
+		service.EXPECT().MarkManyAsDeletableDB(gomock.Any(), textBucket.Name, inp, gomock.Any()).Return([]string{"a", "b"}, nil).Times(1)
+
+		w := batchDelete(`{"metadata": {"owner": "42"}}`)
+
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.JSONEq(t, `{"results": [{"id": "a", "status": 200}, {"id": "b", "status": 200}]}`, w.Body.String())
+	})
+
+	t.Run("should return error ErrInvalidFilter", func(t *testing.T) {
+		for _, body := range []string{
+			`{}`,
+			`{"ids": ["a"], "metadata": {"owner": "42"}}`,
+			`{"metadata": {"$where": "1"}}`,
+			`{"metadata": {"owner.id": "42"}}`,
+		} {
+			w := batchDelete(body)
+			require.Equal(t, http.StatusBadRequest, w.Code, body)
+			require.Contains(t, w.Body.String(), "either ids or metadata must be given", body)
+		}
+	})
+
+	t.Run("should return error ErrBatchTooLarge", func(t *testing.T) {
+		ids := make([]string, 10001)
+		for i := range ids {
+			ids[i] = fmt.Sprintf(`"%d"`, i)
+		}
+
+		w := batchDelete(fmt.Sprintf(`{"ids": [%s]}`, strings.Join(ids, ",")))
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.Contains(t, w.Body.String(), entities.ErrBatchTooLarge.Error())
+	})
 }
@@ -0,0 +1,131 @@
+package cdn
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"animakuro/cdn/config"
+	"animakuro/cdn/internal/cdn"
+	mock_cdn "animakuro/cdn/internal/cdn/mocks"
+	"animakuro/cdn/internal/entities"
+	"animakuro/cdn/internal/fs"
+	bucketcache "animakuro/cdn/pkg/cache/bucket"
+
+	"github.com/golang/mock/gomock"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+func TestLifecycle(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	fs.SetBucketsPath(testBucketsPath)
+
+	service := mock_cdn.NewMockService(ctrl)
+
+	bc := bucketcache.NewBucketCache()
+	bc.Add(&entities.Bucket{
+		ID:   primitive.NewObjectID(),
+		Name: "attachments",
+		Lifecycle: &entities.LifecyclePolicy{
+			ExpireOriginalsAfter:   7,
+			ExpireDerivativesAfter: 30,
+			PurgeDeletedAfter:      1,
+		},
+	})
+	// No rules
+	bc.Add(&entities.Bucket{ID: primitive.NewObjectID(), Name: "kept"})
+
+	now := time.Now()
+	newFile := func() *entities.File {
+		return &entities.File{ID: primitive.NewObjectID(), UUID: uuid.NewString(), Bucket: "attachments"}
+	}
+
+	// Batches go on until the last one is short
+	first := []*entities.File{newFile(), newFile()}
+	second := []*entities.File{newFile()}
+	gomock.InOrder(
+		service.EXPECT().GetExpiredFilesDB(gomock.Any(), "attachments", now.Add(-time.Hour*24*7), int64(2)).Return(first, nil),
+		service.EXPECT().GetExpiredFilesDB(gomock.Any(), "attachments", now.Add(-time.Hour*24*7), int64(2)).Return(second, nil),
+	)
+	for _, f := range append(first, second...) {
+		service.EXPECT().MarkAsDeletableDB(gomock.Any(), "attachments", f.ID).Return(nil).Times(1)
+	}
+
+	service.EXPECT().ExpireDerivatives("attachments", now.Add(-time.Hour*24*30)).Return(3, nil).Times(1)
+
+	// Files are removed from disk before database, failed ones are retried next time
+	purged, failed := newFile(), newFile()
+	service.EXPECT().GetDeletedFilesDB(gomock.Any(), "attachments", now.Add(-time.Hour*24), int64(2)).Return([]*entities.File{purged, failed}, nil).Times(1)
+	service.EXPECT().DeleteAll(path.Join(testBucketsPath, "attachments", purged.UUID)).Return(nil).Times(1)
+	service.EXPECT().DeleteFileDB(gomock.Any(), "attachments", purged.UUID).Return(nil).Times(1)
+	service.EXPECT().DeleteAll(path.Join(testBucketsPath, "attachments", failed.UUID)).Return(entities.ErrFileCantDelete).Times(1)
+	// Another batch since the first one was full
+	service.EXPECT().GetDeletedFilesDB(gomock.Any(), "attachments", now.Add(-time.Hour*24), int64(2)).Return([]*entities.File{failed}, nil).Times(1)
+	service.EXPECT().DeleteAll(path.Join(testBucketsPath, "attachments", failed.UUID)).Return(entities.ErrFileCantDelete).Times(1)
+
+	lifecycle := cdn.NewLifecycle(zap.NewNop().Sugar(), service, bc, &config.LifecycleConfig{
+		Interval:  time.Hour,
+		BatchSize: 2,
+	})
+	lifecycle.Run(context.Background(), now)
+}
+
+func TestExpireDerivatives(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	repo, logger, bc, fc, domain, d := initDeps(ctrl)
+	defer ctrl.Finish()
+
+	d.Start()
+	defer d.Stop()
+
+	require.NoError(t, fs.CreateBucket(testBucket))
+	defer func() {
+		require.NoError(t, fs.TryDelete(path.Join(fs.BucketsPath(), testBucket)))
+	}()
+
+	dir := path.Join(fs.BucketsPath(), testBucket, uuid.NewString())
+	require.NoError(t, os.MkdirAll(path.Join(dir, "hls"), 0777))
+
+	old := time.Now().Add(-time.Hour * 24 * 10)
+	files := map[string]time.Time{
+		"data.css":    old,
+		"data.css.gz": old,
+		"hls/seg.ts":  old,
+		"unused":      old,
+		"unused.br":   old,
+		"requested":   old,
+		"fresh":       time.Now(),
+	}
+	for name, mtime := range files {
+		p := path.Join(dir, name)
+		require.NoError(t, os.WriteFile(p, []byte("a{}"), 0666))
+		require.NoError(t, os.Chtimes(p, mtime, mtime))
+	}
+
+	service := cdn.NewService(logger, repo, bc, fc, domain, d)
+
+	// Served derivative counts as used
+	_, ok, err := service.ReadExisting(path.Join(dir, "requested"))
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	n, err := service.ExpireDerivatives(testBucket, time.Now().Add(-time.Hour*24))
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	for name := range files {
+		expired := name == "unused" || name == "unused.br"
+		require.Equal(t, !expired, fs.IsExists(path.Join(dir, name)), name)
+	}
+
+	_, err = service.ExpireDerivatives("nope", time.Now())
+	require.True(t, errors.Is(err, os.ErrNotExist))
+}
@@ -19,6 +19,7 @@ import (
 	bucketcache "animakuro/cdn/pkg/cache/bucket"
 	filecache "animakuro/cdn/pkg/cache/file"
 	"animakuro/cdn/pkg/dealer"
+	"animakuro/cdn/pkg/usage"
 
 	"github.com/golang/mock/gomock"
 	"github.com/google/uuid"
@@ -49,7 +50,7 @@ func initDeps(ctrl *gomock.Controller) (*mock_cdn.MockRepository, *zap.SugaredLo
 			{Name: "delete", Type: "public"},
 			{Name: "post", Type: "public"},
 		},
-		Module: "image",
+		Modules: []string{"image"},
 	})
 
 	domain := "cdn.animakuro"
@@ -198,3 +199,435 @@ func TestMustSaveOk(t *testing.T) {
 	}()
 
 }
+
+func TestQuota(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	repo, logger, bc, fc, domain, d := initDeps(ctrl)
+	defer ctrl.Finish()
+
+	const quotaBucket = "quota"
+	bc.Add(&entities.Bucket{
+		ID:      primitive.NewObjectID(),
+		Name:    quotaBucket,
+		Modules: []string{"text"},
+		Quota:   &entities.QuotaPolicy{MaxBytes: 20, MaxObjects: 2},
+	})
+
+	d.Start()
+	defer d.Stop()
+
+	err := fs.CreateBucket(quotaBucket)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, fs.TryDelete(path.Join(fs.BucketsPath(), quotaBucket)))
+	}()
+
+	textFile := func(data string) *formdata.UploadFile {
+		return &formdata.UploadFile{
+			UploadName: fs.DefaultName + ".txt",
+			Extension:  "txt",
+			MimeType:   "text/plain",
+			Size:       int64(len(data)),
+			UUID:       uuid.NewString(),
+			Open: func() (multipart.File, error) {
+				return &MockFile{data: []byte(data)}, nil
+			},
+		}
+	}
+
+	ctx := context.TODO()
+	repo.EXPECT().SaveFile(ctx, gomock.Any()).Return(true, nil).Times(1)
+
+	service := cdn.NewService(logger, repo, bc, fc, domain, d)
+
+	f := textFile("hello world")
+	_, _, err = service.UploadMany(ctx, quotaBucket, []*formdata.UploadFile{f})
+	require.NoError(t, err)
+	require.Equal(t, usage.Counter{Bytes: 11, Objects: 1}, service.Usage(quotaBucket).Originals)
+
+	// Nothing is written over quota
+	over := textFile("hello world")
+	_, _, err = service.UploadMany(ctx, quotaBucket, []*formdata.UploadFile{over})
+	require.ErrorIs(t, err, usage.ErrQuotaExceeded)
+	require.False(t, fs.IsExists(path.Join(fs.BucketsPath(), quotaBucket, over.UUID)))
+	require.Equal(t, usage.Counter{Bytes: 11, Objects: 1}, service.Usage(quotaBucket).Originals)
+
+	// Derivatives count towards bytes
+	derivative := path.Join(fs.BucketsPath(), quotaBucket, f.UUID, "derivative")
+	service.MustSave([]byte("12345"), derivative)
+	require.True(t, fs.IsExists(derivative))
+
+	skipped := path.Join(fs.BucketsPath(), quotaBucket, f.UUID, "skipped")
+	service.MustSave([]byte("1234567890"), skipped)
+	require.False(t, fs.IsExists(skipped))
+
+	// Overwritten derivative takes its new size only
+	service.MustSave([]byte("123456789"), derivative)
+	require.Equal(t, usage.Usage{
+		Originals:   usage.Counter{Bytes: 11, Objects: 1},
+		Derivatives: usage.Counter{Bytes: 9, Objects: 1},
+	}, service.Usage(quotaBucket))
+
+	err = service.DeleteAll(path.Join(fs.BucketsPath(), quotaBucket, f.UUID))
+	require.NoError(t, err)
+	require.Equal(t, usage.Usage{}, service.Usage(quotaBucket))
+}
+
+func TestUpdateFile(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	repo, logger, bc, fc, domain, d := initDeps(ctrl)
+	defer ctrl.Finish()
+
+	const versionedBucket = "versioned"
+	bc.Add(&entities.Bucket{
+		ID:         primitive.NewObjectID(),
+		Name:       versionedBucket,
+		Modules:    []string{"text"},
+		Versioning: &entities.VersioningPolicy{Keep: 1},
+	})
+
+	d.Start()
+	defer d.Stop()
+
+	err := fs.CreateBucket(versionedBucket)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, fs.TryDelete(path.Join(fs.BucketsPath(), versionedBucket)))
+	}()
+
+	f := &entities.File{
+		ID:        primitive.NewObjectID(),
+		Bucket:    versionedBucket,
+		UUID:      uuid.NewString(),
+		MimeType:  "text/plain",
+		Extension: ".txt",
+	}
+	dir := path.Join(fs.BucketsPath(), versionedBucket, f.UUID)
+	require.NoError(t, fs.WriteFileToBucket([]byte("v1"), versionedBucket, f.UUID, fs.DefaultName+".txt"))
+
+	// Derived from version 1
+	require.NoError(t, fs.WriteFile(path.Join(dir, "derivative"), []byte("d1")))
+	require.NoError(t, fs.WriteFile(path.Join(dir, fs.DefaultName+".txt.gz"), []byte("gz")))
+
+	textFile := func(data string, ext string) *formdata.UploadFile {
+		return &formdata.UploadFile{
+			UploadName: fs.DefaultName + "." + ext,
+			Extension:  ext,
+			MimeType:   "text/plain",
+			Size:       int64(len(data)),
+			UUID:       f.UUID,
+			Open: func() (multipart.File, error) {
+				return &MockFile{data: []byte(data)}, nil
+			},
+		}
+	}
+
+	ctx := context.TODO()
+	updated := func(current int) {
+		repo.EXPECT().UpdateFile(ctx, versionedBucket, f.UUID, current, gomock.Any()).DoAndReturn(
+			func(_ context.Context, _ string, _ string, _ int, d dto.UpdateFileDto) (*entities.File, error) {
+				return &entities.File{
+					ID:        f.ID,
+					Bucket:    versionedBucket,
+					UUID:      f.UUID,
+					MimeType:  d.MimeType,
+					Extension: d.Extension,
+					Version:   d.Version,
+					UpdatedAt: d.UpdatedAt,
+					Versions:  d.Versions,
+				}, nil
+			}).Times(1)
+	}
+
+	service := cdn.NewService(logger, repo, bc, fc, domain, d)
+
+	readFile := func(p string) string {
+		bits, err := fs.ReadFile(path.Join(dir, p))
+		require.NoError(t, err)
+		return string(bits)
+	}
+
+	t.Run("should keep prior version and delete its derivatives", func(t *testing.T) {
+		updated(1)
+
+		f, err = service.UpdateFile(ctx, f, textFile("v2", "md"))
+		require.NoError(t, err)
+		require.Equal(t, 2, f.CurrentVersion())
+		require.Len(t, f.Versions, 1)
+		require.Equal(t, ".txt", f.Versions[0].Extension)
+
+		require.Equal(t, "v2", readFile(fs.DefaultName+".md"))
+		require.Equal(t, "v1", readFile("versions/1/"+fs.DefaultName+".txt"))
+		require.False(t, fs.IsExists(path.Join(dir, fs.DefaultName+".txt")))
+		require.False(t, fs.IsExists(path.Join(dir, "derivative")))
+		require.False(t, fs.IsExists(path.Join(dir, fs.DefaultName+".txt.gz")))
+	})
+
+	t.Run("should drop versions over bucket's limit", func(t *testing.T) {
+		updated(2)
+
+		f, err = service.UpdateFile(ctx, f, textFile("v3", "txt"))
+		require.NoError(t, err)
+		require.Equal(t, 3, f.CurrentVersion())
+		require.Len(t, f.Versions, 1)
+		require.Equal(t, 2, f.Versions[0].Version)
+
+		require.Equal(t, "v3", readFile(fs.DefaultName+".txt"))
+		require.Equal(t, "v2", readFile("versions/2/"+fs.DefaultName+".md"))
+		require.False(t, fs.IsExists(cdnpath.ToVersionDir(fs.BucketsPath(), versionedBucket, f.UUID, 1)))
+	})
+
+	t.Run("should roll back as a new version", func(t *testing.T) {
+		updated(3)
+
+		_, err := service.RollbackFile(ctx, f, 1)
+		require.ErrorIs(t, err, entities.ErrVersionNotFound)
+
+		f, err = service.RollbackFile(ctx, f, 2)
+		require.NoError(t, err)
+		require.Equal(t, 4, f.CurrentVersion())
+		require.Equal(t, ".md", f.Extension)
+
+		require.Equal(t, "v2", readFile(fs.DefaultName+".md"))
+		require.Equal(t, "v3", readFile("versions/3/"+fs.DefaultName+".txt"))
+		require.False(t, fs.IsExists(cdnpath.ToVersionDir(fs.BucketsPath(), versionedBucket, f.UUID, 2)))
+	})
+
+	t.Run("should not touch files if updated meanwhile", func(t *testing.T) {
+		repo.EXPECT().UpdateFile(ctx, versionedBucket, f.UUID, 4, gomock.Any()).Return(nil, nil).Times(1)
+		before := service.Usage(versionedBucket)
+
+		_, err := service.UpdateFile(ctx, f, textFile("v5", "txt"))
+		require.ErrorIs(t, err, entities.ErrVersionConflict)
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+		require.Equal(t, "v2", readFile(fs.DefaultName+".md"))
+		require.Equal(t, before, service.Usage(versionedBucket))
+	})
+}
+
+func TestTransferFile(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	repo, logger, bc, fc, domain, d := initDeps(ctrl)
+	defer ctrl.Finish()
+
+	const (
+		moderation = "moderation"
+		public     = "public-site"
+	)
+	bc.Add(&entities.Bucket{ID: primitive.NewObjectID(), Name: moderation, Modules: []string{"text"}})
+	bc.Add(&entities.Bucket{
+		ID:      primitive.NewObjectID(),
+		Name:    public,
+		Modules: []string{"text"},
+		Upload:  &entities.UploadPolicy{MimeTypes: []string{"text/"}},
+	})
+
+	d.Start()
+	defer d.Stop()
+
+	for _, b := range []string{moderation, public} {
+		require.NoError(t, fs.CreateBucket(b))
+		defer func(b string) {
+			require.NoError(t, fs.TryDelete(path.Join(fs.BucketsPath(), b)))
+		}(b)
+	}
+
+	stored := func(mimeType string) *entities.File {
+		f := &entities.File{
+			ID:        primitive.NewObjectID(),
+			Bucket:    moderation,
+			UUID:      uuid.NewString(),
+			MimeType:  mimeType,
+			Extension: ".txt",
+			Metadata:  map[string]string{"lines": "1"},
+		}
+		require.NoError(t, fs.WriteFileToBucket([]byte("approved"), moderation, f.UUID, fs.DefaultName+f.Extension))
+		require.NoError(t, fs.WriteFile(path.Join(fs.BucketsPath(), moderation, f.UUID, "derivative"), []byte("d")))
+		return f
+	}
+
+	original := func(bucket string, uuid string) string {
+		return path.Join(fs.BucketsPath(), bucket, uuid, fs.DefaultName+".txt")
+	}
+
+	ctx := context.TODO()
+	service := cdn.NewService(logger, repo, bc, fc, domain, d)
+
+	t.Run("should copy file sharing its bytes", func(t *testing.T) {
+		f := stored("text/plain")
+
+		repo.EXPECT().SaveFile(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, d dto.SaveFileDto) (bool, error) {
+			require.Equal(t, public, d.Bucket)
+			require.Equal(t, f.Metadata, d.Metadata)
+			require.NotEqual(t, f.UUID, d.UUID)
+			return true, nil
+		}).Times(1)
+
+		id, url, err := service.TransferFile(ctx, f, public, false, true)
+		require.NoError(t, err)
+		require.Equal(t, domain+"/"+public+"/"+id, url)
+
+		source, err := os.Stat(original(moderation, f.UUID))
+		require.NoError(t, err)
+		target, err := os.Stat(original(public, id))
+		require.NoError(t, err)
+		require.True(t, os.SameFile(source, target))
+
+		// Destination renders its own derivatives
+		require.False(t, fs.IsExists(path.Join(fs.BucketsPath(), public, id, "derivative")))
+		require.Equal(t, usage.Counter{Bytes: 8, Objects: 1}, service.Usage(public).Originals)
+	})
+
+	t.Run("should move file deleting the source", func(t *testing.T) {
+		f := stored("text/plain")
+
+		repo.EXPECT().SaveFile(ctx, gomock.Any()).DoAndReturn(func(_ context.Context, d dto.SaveFileDto) (bool, error) {
+			require.Nil(t, d.Metadata)
+			return true, nil
+		}).Times(1)
+		repo.EXPECT().MarkAsDeletable(ctx, moderation, f.ID).Return(f, nil).Times(1)
+
+		id, _, err := service.TransferFile(ctx, f, public, true, false)
+		require.NoError(t, err)
+
+		bits, err := fs.ReadFile(original(public, id))
+		require.NoError(t, err)
+		require.Equal(t, "approved", string(bits))
+		require.False(t, fs.IsExists(path.Join(fs.BucketsPath(), moderation, f.UUID)))
+	})
+
+	t.Run("should keep source if file is not saved", func(t *testing.T) {
+		f := stored("text/plain")
+		before := service.Usage(public)
+
+		repo.EXPECT().SaveFile(ctx, gomock.Any()).Return(false, nil).Times(1)
+
+		_, _, err := service.TransferFile(ctx, f, public, true, false)
+		require.ErrorIs(t, err, entities.ErrFileAlreadyExists)
+		require.True(t, fs.IsExists(original(moderation, f.UUID)))
+		require.Equal(t, before, service.Usage(public))
+	})
+
+	t.Run("should reject file violating destination's upload policy", func(t *testing.T) {
+		f := stored("application/pdf")
+
+		_, _, err := service.TransferFile(ctx, f, public, false, false)
+		require.ErrorIs(t, err, formdata.ErrMimeTypeNotAllowed)
+	})
+}
+
+func TestResolveAlias(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	repo, logger, bc, fc, domain, d := initDeps(ctrl)
+	defer ctrl.Finish()
+
+	ctx := context.TODO()
+	service := cdn.NewService(logger, repo, bc, fc, domain, d)
+
+	f := &entities.File{ID: primitive.NewObjectID(), Bucket: "image", UUID: uuid.NewString(), Alias: "posters/naruto-s1.jpg"}
+
+	t.Run("should resolve alias once", func(t *testing.T) {
+		repo.EXPECT().GetFileByAlias(ctx, f.Bucket, f.Alias).Return(f, nil).Times(1)
+
+		for i := 0; i < 2; i++ {
+			id, err := service.ResolveAlias(ctx, f.Bucket, f.Alias)
+			require.NoError(t, err)
+			require.Equal(t, f.UUID, id)
+		}
+	})
+
+	t.Run("should forget alias once it's changed", func(t *testing.T) {
+		repo.EXPECT().SetAlias(ctx, f.Bucket, f.UUID, "posters/naruto.jpg").Return(f, nil).Times(1)
+		require.NoError(t, service.SetAliasDB(ctx, f.Bucket, f.UUID, "posters/naruto.jpg"))
+
+		repo.EXPECT().GetFileByAlias(ctx, f.Bucket, f.Alias).Return(nil, nil).Times(1)
+		_, err := service.ResolveAlias(ctx, f.Bucket, f.Alias)
+		require.ErrorIs(t, err, entities.ErrFileNotFound)
+	})
+
+	t.Run("should forget alias of deleted file", func(t *testing.T) {
+		deleted := &entities.File{ID: primitive.NewObjectID(), Bucket: f.Bucket, UUID: uuid.NewString(), Alias: "posters/bleach.jpg"}
+
+		repo.EXPECT().GetFileByAlias(ctx, f.Bucket, deleted.Alias).Return(deleted, nil).Times(1)
+		_, err := service.ResolveAlias(ctx, f.Bucket, deleted.Alias)
+		require.NoError(t, err)
+
+		repo.EXPECT().MarkAsDeletable(ctx, f.Bucket, deleted.ID).Return(deleted, nil).Times(1)
+		require.NoError(t, service.MarkAsDeletableDB(ctx, f.Bucket, deleted.ID))
+
+		repo.EXPECT().GetFileByAlias(ctx, f.Bucket, deleted.Alias).Return(nil, nil).Times(1)
+		_, err = service.ResolveAlias(ctx, f.Bucket, deleted.Alias)
+		require.ErrorIs(t, err, entities.ErrFileNotFound)
+	})
+
+	t.Run("should return error ErrAliasTaken", func(t *testing.T) {
+		repo.EXPECT().SetAlias(ctx, f.Bucket, f.UUID, "taken.jpg").Return(nil, entities.ErrAliasTaken).Times(1)
+
+		err := service.SetAliasDB(ctx, f.Bucket, f.UUID, "taken.jpg")
+		require.ErrorIs(t, err, entities.ErrAliasTaken)
+	})
+
+	t.Run("should return error ErrFileNotFound", func(t *testing.T) {
+		repo.EXPECT().SetAlias(ctx, f.Bucket, "missing", "a.jpg").Return(nil, nil).Times(1)
+		require.ErrorIs(t, service.SetAliasDB(ctx, f.Bucket, "missing", "a.jpg"), entities.ErrFileNotFound)
+
+		// Deleted meanwhile
+		deleted := &entities.File{UUID: uuid.NewString(), IsDeletable: true}
+		repo.EXPECT().GetFileByAlias(ctx, f.Bucket, "deleted.jpg").Return(deleted, nil).Times(1)
+		_, err := service.ResolveAlias(ctx, f.Bucket, "deleted.jpg")
+		require.ErrorIs(t, err, entities.ErrFileNotFound)
+	})
+}
+
+func TestMarkManyAsDeletable(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	repo, logger, bc, fc, domain, d := initDeps(ctrl)
+	defer ctrl.Finish()
+
+	ctx := context.TODO()
+	service := cdn.NewService(logger, repo, bc, fc, domain, d)
+
+	files := []*entities.File{
+		{ID: primitive.NewObjectID(), Bucket: "image", UUID: uuid.NewString(), Alias: "posters/naruto.jpg"},
+		{ID: primitive.NewObjectID(), Bucket: "image", UUID: uuid.NewString()},
+	}
+	filter := dto.BatchDeleteDto{Metadata: map[string]string{"owner": "42"}}
+
+	t.Run("should mark files with a single write", func(t *testing.T) {
+		repo.EXPECT().GetFileByAlias(ctx, "image", files[0].Alias).Return(files[0], nil).Times(1)
+		_, err := service.ResolveAlias(ctx, "image", files[0].Alias)
+		require.NoError(t, err)
+
+		repo.EXPECT().GetFiles(ctx, "image", filter, int64(100)).Return(files, nil).Times(1)
+		repo.EXPECT().MarkManyAsDeletable(ctx, []primitive.ObjectID{files[0].ID, files[1].ID}).Return(files, nil).Times(1)
+
+		uuids, err := service.MarkManyAsDeletableDB(ctx, "image", filter, 100)
+		require.NoError(t, err)
+		require.Equal(t, []string{files[0].UUID, files[1].UUID}, uuids)
+
+		// Alias of deleted file resolves to nothing
+		repo.EXPECT().GetFileByAlias(ctx, "image", files[0].Alias).Return(nil, nil).Times(1)
+		_, err = service.ResolveAlias(ctx, "image", files[0].Alias)
+		require.ErrorIs(t, err, entities.ErrFileNotFound)
+	})
+
+	t.Run("should not report files marked meanwhile", func(t *testing.T) {
+		repo.EXPECT().GetFiles(ctx, "image", filter, int64(100)).Return(files, nil).Times(1)
+		repo.EXPECT().MarkManyAsDeletable(ctx, []primitive.ObjectID{files[0].ID, files[1].ID}).Return(files[1:], nil).Times(1)
+
+		uuids, err := service.MarkManyAsDeletableDB(ctx, "image", filter, 100)
+		require.NoError(t, err)
+		require.Equal(t, []string{files[1].UUID}, uuids)
+	})
+
+	t.Run("should not write if nothing is found", func(t *testing.T) {
+		repo.EXPECT().GetFiles(ctx, "image", filter, int64(100)).Return(nil, nil).Times(1)
+
+		uuids, err := service.MarkManyAsDeletableDB(ctx, "image", filter, 100)
+		require.NoError(t, err)
+		require.Empty(t, uuids)
+	})
+}
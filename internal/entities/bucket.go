@@ -2,6 +2,7 @@ package entities
 
 import (
 	"errors"
+	"strings"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
@@ -9,14 +10,149 @@ import (
 var ErrBucketNotFound = errors.New("bucket not found")
 var ErrBucketAlreadyExists = errors.New("bucket already exists")
 var ErrBucketsNotDefined = errors.New("no buckets are defined in database")
+var ErrPresetNotFound = errors.New("preset not found")
+var ErrPresetsOnly = errors.New("bucket accepts presets only")
+var ErrPresetWithResolvers = errors.New("preset can't be combined with resolvers")
+var ErrInvalidEager = errors.New("eager must contain preset names or resolvers queries")
+var ErrInvalidStrip = errors.New("strip.on must be upload or delivery")
+var ErrStripUnsupported = errors.New("none of bucket's modules could strip files")
+var ErrInvalidHLS = errors.New("hls.renditions must be distinct heights of 144, 240, 360, 480, 720 or 1080")
+var ErrHLSUnavailable = errors.New("hls packaging is unavailable")
+var ErrHLSNotFound = errors.New("hls package not found")
+var ErrInvalidUploadPolicy = errors.New("upload.mime_types must be types (image/png) or top-level types (image/), limits can't be negative")
+var ErrInvalidQuota = errors.New("quota limits can't be negative")
+var ErrInvalidLifecycle = errors.New("lifecycle days can't be negative")
+var ErrInvalidVersioning = errors.New("versioning.keep can't be negative")
+
+// Strip policies
+const (
+	// Originals are stripped before they're saved
+	StripOnUpload = "upload"
+	// Every file served from bucket is stripped, originals are kept as is
+	StripOnDelivery = "delivery"
+)
 
 type Bucket struct {
 	ID         primitive.ObjectID `bson:"_id"`
 	Name       string             `bson:"name"`
 	Operations []*Operation       `bson:"operations"`
-	Module     string             `bson:"module"`
+	// Modules file could be processed by. Module is selected by file's MIME type
+	Modules []string `bson:"modules"`
+	// Named sets of resolvers, requested as ?preset={name}
+	Presets map[string]Preset `bson:"presets"`
+	// If set, clients can't request resolvers other than via presets
+	PresetsOnly bool `bson:"presets_only"`
+	// Presets names or resolvers queries (e.g. "image.webp=true") which
+	// are rendered right after upload
+	Eager []string `bson:"eager"`
+	// Removes metadata (EXIF, GPS...) of bucket's files. Nil keeps files as is
+	Strip *StripPolicy `bson:"strip"`
+	// Packages uploaded videos into HLS. Nil disables packaging
+	HLS *HLSPolicy `bson:"hls"`
+	// Limits files uploaded to bucket. Nil accepts any files
+	Upload *UploadPolicy `bson:"upload"`
+	// Limits disk space bucket takes. Nil means no limit
+	Quota *QuotaPolicy `bson:"quota"`
+	// Expires bucket's files. Nil keeps them forever
+	Lifecycle *LifecyclePolicy `bson:"lifecycle"`
+	// Keeps prior versions of updated files. Nil keeps none
+	Versioning *VersioningPolicy `bson:"versioning"`
+}
+
+// StripPolicy describes when and how metadata of bucket's files is removed
+type StripPolicy struct {
+	// StripOnUpload or StripOnDelivery
+	On string `json:"on" bson:"on"`
+	// What to keep, e.g. "orientation,icc". Empty strips everything
+	Keep string `json:"keep" bson:"keep"`
+}
+
+// Argument returns strip resolver argument
+func (p *StripPolicy) Argument() string {
+	if p.Keep == "" {
+		return "true"
+	}
+
+	return p.Keep
 }
 
+// HLSRenditions are heights video could be packaged to
+var HLSRenditions = []int{144, 240, 360, 480, 720, 1080}
+
+// HLSPolicy describes renditions uploaded videos are packaged to
+type HLSPolicy struct {
+	// Heights of renditions, e.g. [360, 720]. Videos are never upscaled
+	Renditions []int `json:"renditions" bson:"renditions"`
+}
+
+// UploadPolicy describes files bucket accepts. Zero limit means no limit
+type UploadPolicy struct {
+	// Types of files detected by their contents, e.g. ["image/", "application/pdf"].
+	// Type followed by slash matches every subtype. Empty accepts any type
+	MimeTypes []string `json:"mime_types" bson:"mime_types"`
+	// Max bytes of a single file
+	MaxFileSize int64 `json:"max_file_size" bson:"max_file_size"`
+	// Max bytes of the whole upload request
+	MaxRequestSize int64 `json:"max_request_size" bson:"max_request_size"`
+	// Max files of a single upload request
+	MaxFiles int `json:"max_files" bson:"max_files"`
+}
+
+// Allows tells whether file of mimeType could be uploaded
+func (p *UploadPolicy) Allows(mimeType string) bool {
+	if len(p.MimeTypes) == 0 {
+		return true
+	}
+
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	mimeType = strings.ToLower(strings.TrimSpace(mimeType))
+
+	for _, allowed := range p.MimeTypes {
+		if allowed == mimeType || strings.HasSuffix(allowed, "/") && strings.HasPrefix(mimeType, allowed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// QuotaPolicy limits files stored by bucket. Zero limit means no limit
+type QuotaPolicy struct {
+	// Max bytes of originals and derivatives together
+	MaxBytes int64 `json:"max_bytes" bson:"max_bytes"`
+	// Max originals (uploaded files). Derivatives are not counted
+	MaxObjects int64 `json:"max_objects" bson:"max_objects"`
+}
+
+// LifecyclePolicy describes when bucket's files are deleted. Zero days disable the rule
+type LifecyclePolicy struct {
+	// Originals are deleted (marked as deletable) this many days after upload
+	ExpireOriginalsAfter int `json:"expire_originals_after" bson:"expire_originals_after"`
+	// Derivatives not requested for this many days are removed from disk
+	ExpireDerivativesAfter int `json:"expire_derivatives_after" bson:"expire_derivatives_after"`
+	// Deleted files are removed from disk and database this many days after deletion
+	PurgeDeletedAfter int `json:"purge_deleted_after" bson:"purge_deleted_after"`
+}
+
+// VersioningPolicy describes prior versions kept when files are updated
+type VersioningPolicy struct {
+	// Max prior versions kept per file. Older ones are deleted
+	Keep int `json:"keep" bson:"keep"`
+}
+
+// KeepVersions returns max prior versions bucket keeps per file
+func (b *Bucket) KeepVersions() int {
+	if b.Versioning == nil {
+		return 0
+	}
+
+	return b.Versioning.Keep
+}
+
+// Preset maps URL query keys to resolver arguments
+// e.g. {"image.resize": "200x0", "image.webp": "true"}
+type Preset map[string]string
+
 type Operation struct {
 	// Post or Get or Delete
 	Name string `json:"operation" validate:"required" bson:"name"`
@@ -2,6 +2,7 @@ package entities
 
 import (
 	"errors"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
@@ -12,6 +13,15 @@ var (
 	ErrNoFiles            = errors.New("no files")
 	ErrFileCantDelete     = errors.New("could not delete file")
 	ErrFileAlreadyDeleted = errors.New("file has already deleted")
+	ErrVersionNotFound    = errors.New("version not found")
+	ErrInvalidVersion     = errors.New("version must be a positive number")
+	ErrVersionConflict    = errors.New("file has been updated meanwhile")
+	ErrSingleFileOnly     = errors.New("exactly one file must be uploaded")
+	ErrBatchTooLarge      = errors.New("too many files in batch")
+	ErrSameBucket         = errors.New("file can't be moved to its own bucket")
+	ErrInvalidAlias       = errors.New("alias must be a path of letters, digits, '.', '_' and '-' up to 255 characters, not a UUID or reserved name")
+	ErrAliasTaken         = errors.New("alias is already taken")
+	ErrInvalidFilter      = errors.New("either ids or metadata must be given, metadata keys can't be empty, contain '.' or start with '$'")
 )
 
 //todo: compute hash file <filename><size> to prevent same files upload
@@ -22,8 +32,71 @@ type File struct {
 	// List of cdn hosts where file is available
 	AvailableIn []string `bson:"availableIn"`
 	// Marked with `isDeletable` file no longer can be accessed via Get
-	IsDeletable bool   `bson:"is_deletable"`
-	Bucket      string `bson:"bucket"`
-	MimeType    string `bson:"mimeType"`
-	Extension   string `bson:"extension"`
+	IsDeletable bool `bson:"is_deletable"`
+	// When file was marked. Zero for files marked before it was recorded
+	DeletedAt time.Time `bson:"deleted_at,omitempty"`
+	// Unique per request which marked file, so that files marked by one request are told apart
+	DeletedBy primitive.ObjectID `bson:"deleted_by,omitempty"`
+	Bucket    string             `bson:"bucket"`
+	MimeType  string             `bson:"mimeType"`
+	Extension string             `bson:"extension"`
+	// Computed by bucket's module at upload, e.g. placeholders
+	Metadata map[string]string `bson:"metadata"`
+	// Path file is available by besides its UUID, unique in bucket. Optional
+	Alias string `bson:"alias,omitempty"`
+	// Number of current version. Zero for files never updated, same as 1
+	Version int `bson:"version,omitempty"`
+	// When current version was uploaded. Zero for files never updated
+	UpdatedAt time.Time `bson:"updated_at,omitempty"`
+	// Prior versions retained by bucket's versioning policy, oldest first
+	Versions []FileVersion `bson:"versions,omitempty"`
+}
+
+// FileVersion describes original file of a single version
+type FileVersion struct {
+	Version   int               `json:"version" bson:"version"`
+	MimeType  string            `json:"mime_type" bson:"mimeType"`
+	Extension string            `json:"extension" bson:"extension"`
+	Metadata  map[string]string `json:"metadata,omitempty" bson:"metadata,omitempty"`
+	CreatedAt time.Time         `json:"created_at" bson:"created_at"`
+}
+
+// CurrentVersion returns number of current version
+func (f *File) CurrentVersion() int {
+	if f.Version == 0 {
+		return 1
+	}
+
+	return f.Version
+}
+
+// Current describes current version
+func (f *File) Current() FileVersion {
+	createdAt := f.UpdatedAt
+	if createdAt.IsZero() {
+		createdAt = f.ID.Timestamp()
+	}
+
+	return FileVersion{
+		Version:   f.CurrentVersion(),
+		MimeType:  f.MimeType,
+		Extension: f.Extension,
+		Metadata:  f.Metadata,
+		CreatedAt: createdAt,
+	}
+}
+
+// FindVersion returns current or retained prior version
+func (f *File) FindVersion(version int) (FileVersion, bool) {
+	if version == f.CurrentVersion() {
+		return f.Current(), true
+	}
+
+	for _, v := range f.Versions {
+		if v.Version == version {
+			return v, true
+		}
+	}
+
+	return FileVersion{}, false
 }
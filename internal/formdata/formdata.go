@@ -1,11 +1,16 @@
 package formdata
 
 import (
+	"fmt"
+	"io"
+	"mime"
 	"mime/multipart"
 	"strings"
 
+	"animakuro/cdn/internal/entities"
 	"animakuro/cdn/internal/fs"
 
+	"github.com/gabriel-vasile/mimetype"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 )
@@ -13,6 +18,12 @@ import (
 var (
 	ErrInvalidExtension = errors.New("file has invalid extension")
 	ErrNoFiles          = errors.New("no files")
+	ErrInvalidForm      = errors.New("invalid multipart form")
+	// Upload policy violations
+	ErrTooManyFiles       = errors.New("too many files")
+	ErrFileTooLarge       = errors.New("file is too large")
+	ErrRequestTooLarge    = errors.New("request is too large")
+	ErrMimeTypeNotAllowed = errors.New("file type is not allowed")
 )
 
 type UploadFile struct {
@@ -23,6 +34,12 @@ type UploadFile struct {
 	MimeType   string
 	Size       int64
 	Open       func() (multipart.File, error)
+	// Applied to file contents before it's saved (e.g. metadata stripping). Optional
+	Process func(buff []byte) ([]byte, error)
+	// Saved along with the file (e.g. placeholders). Optional
+	Metadata map[string]string
+	// Path file is available by besides its UUID. Optional
+	Alias string
 }
 
 func ParseFiles(form *multipart.Form) ([]*UploadFile, error) {
@@ -46,7 +63,13 @@ func ParseFiles(form *multipart.Form) ([]*UploadFile, error) {
 			upl.Extension = spl[len(spl)-1]
 			upl.Size = v.Size
 			upl.UploadName = fs.DefaultName + "." + upl.Extension
-			upl.MimeType = v.Header.Get("Content-Type")
+
+			mimeType, err := sniff(v)
+			if err != nil {
+				return nil, err
+			}
+			upl.MimeType = mimeType
+
 			parsed = append(parsed, &upl)
 		}
 
@@ -59,3 +82,113 @@ func ParseFiles(form *multipart.Form) ([]*UploadFile, error) {
 
 	return parsed, nil
 }
+
+// Types sniffing tells from plain text by extension only. Contents of the rest of text types
+// (e.g. text/html or image/svg+xml rendered by browsers) must agree with declared type
+var plainTextTypes = []string{"text/css", "text/javascript", "text/csv"}
+
+// sniff detects type of file by its contents. Type client declared is kept only if
+// contents agree with it or can't tell it (e.g. CSS is plain text for sniffing)
+func sniff(fh *multipart.FileHeader) (string, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return "", fmt.Errorf("formdata.sniff.fh.Open: %w", err)
+	}
+	defer f.Close()
+
+	detected, err := mimetype.DetectReader(f)
+	if err != nil {
+		return "", fmt.Errorf("formdata.sniff.mimetype.DetectReader: %w", err)
+	}
+
+	declared := fh.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(declared)
+	if err != nil {
+		return detected.String(), nil
+	}
+
+	if detected.Is(mediaType) {
+		return declared, nil
+	}
+
+	if detected.Is("text/plain") && isPlainText(mediaType) {
+		return declared, nil
+	}
+
+	return detected.String(), nil
+}
+
+// isPlainText tells whether mediaType (or its alias, e.g. application/javascript) is one of plainTextTypes
+func isPlainText(mediaType string) bool {
+	for _, t := range plainTextTypes {
+		if mediaType == t {
+			return true
+		}
+		if known := mimetype.Lookup(t); known != nil && known.Is(mediaType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckPolicy validates parsed files against bucket's upload policy. Nil policy accepts any files
+func CheckPolicy(files []*UploadFile, policy *entities.UploadPolicy) error {
+	if policy == nil {
+		return nil
+	}
+
+	if policy.MaxFiles > 0 && len(files) > policy.MaxFiles {
+		return fmt.Errorf("%w: %d files exceed limit of %d", ErrTooManyFiles, len(files), policy.MaxFiles)
+	}
+
+	for _, file := range files {
+		if policy.MaxFileSize > 0 && file.Size > policy.MaxFileSize {
+			return fmt.Errorf("%w: %d bytes exceed limit of %d", ErrFileTooLarge, file.Size, policy.MaxFileSize)
+		}
+
+		if !policy.Allows(file.MimeType) {
+			return fmt.Errorf("%w: %s", ErrMimeTypeNotAllowed, file.MimeType)
+		}
+	}
+
+	return nil
+}
+
+// LimitedBody fails reading of request body exceeding limit
+// without reading its rest, so that big uploads never hit the disk
+type LimitedBody struct {
+	io.ReadCloser
+	left     int64
+	exceeded bool
+}
+
+func LimitBody(body io.ReadCloser, limit int64) *LimitedBody {
+	return &LimitedBody{ReadCloser: body, left: limit}
+}
+
+func (b *LimitedBody) Read(p []byte) (int, error) {
+	if b.left < 0 {
+		b.exceeded = true
+		return 0, ErrRequestTooLarge
+	}
+
+	// Read a byte over the limit to tell body of exactly limit bytes from a bigger one
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	if b.left < 0 {
+		b.exceeded = true
+		return 0, ErrRequestTooLarge
+	}
+
+	return n, err
+}
+
+// Exceeded tells whether reading failed because of the limit
+func (b *LimitedBody) Exceeded() bool {
+	return b.exceeded
+}
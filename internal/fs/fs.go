@@ -6,6 +6,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"animakuro/cdn/internal/cdn/cdnutil"
 	"animakuro/cdn/internal/entities"
@@ -54,6 +55,93 @@ func IsExists(path string) bool {
 	return true
 }
 
+// Size returns size of file at path. False if there's no file
+func Size(path string) (int64, bool) {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return 0, false
+	}
+
+	return info.Size(), true
+}
+
+// Stat describes file at path. Nil if there's none
+func Stat(path string) os.FileInfo {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+
+	return info
+}
+
+// Changed tells whether file at path is not the one described by info anymore, e.g. it's replaced.
+// Nil info is never changed
+func Changed(path string, info os.FileInfo) bool {
+	if info == nil {
+		return false
+	}
+
+	current, err := os.Stat(path)
+	return err != nil || !os.SameFile(info, current)
+}
+
+// Move renames file or dir creating destination's parent dir
+func Move(from string, to string) error {
+	if err := createDir(path.Dir(to)); err != nil {
+		return cdnutil.ChainInternal(err, "fs.Move->fs.createDir")
+	}
+
+	if err := os.Rename(from, to); err != nil {
+		return cdnutil.WrapInternal(err, "fs.Move.os.Rename")
+	}
+
+	return nil
+}
+
+// Link makes file at to share contents with file at from creating destination's parent dir.
+// File is copied if it can't be hard linked, e.g. it's on another device
+func Link(from string, to string) error {
+	if err := createDir(path.Dir(to)); err != nil {
+		return cdnutil.ChainInternal(err, "fs.Link->fs.createDir")
+	}
+
+	if err := os.Link(from, to); err == nil {
+		return nil
+	}
+
+	buff, err := ReadFile(from)
+	if err != nil {
+		return cdnutil.ChainInternal(err, "fs.Link->fs.ReadFile")
+	}
+
+	if err := WriteFile(to, buff); err != nil {
+		return cdnutil.ChainInternal(err, "fs.Link->fs.WriteFile")
+	}
+
+	return nil
+}
+
+// Touch sets modification time of file at path to now unless it's been set within d.
+// Modification time of derivatives tells when they were requested last
+func Touch(path string, d time.Duration) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return cdnutil.WrapInternal(err, "fs.Touch.os.Stat")
+	}
+
+	now := time.Now()
+	if now.Sub(info.ModTime()) < d {
+		return nil
+	}
+
+	if err := os.Chtimes(path, now, now); err != nil {
+		return cdnutil.WrapInternal(err, "fs.Touch.os.Chtimes")
+	}
+
+	return nil
+}
+
 func ReadFile(path string) ([]byte, error) {
 
 	f, err := os.Open(path)
@@ -95,10 +183,35 @@ func WriteFileToBucket(buff []byte, bucket string, uuid string, fileName string)
 	return nil
 }
 
-func WriteFile(path string, buff []byte) error {
-	err := os.WriteFile(path, buff, 0777)
+// WriteFile writes buff to a temporary file next to path and renames it to path.
+// Rename is atomic, so readers never see partially written file
+func WriteFile(p string, buff []byte) error {
+	tmp, err := os.CreateTemp(path.Dir(p), "."+path.Base(p)+".tmp-*")
 	if err != nil {
-		return cdnutil.WrapInternal(err, "fs.WriteFile.os.WriteFile")
+		return cdnutil.WrapInternal(err, "fs.WriteFile.os.CreateTemp")
+	}
+	tmpPath := tmp.Name()
+
+	if _, err := tmp.Write(buff); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return cdnutil.WrapInternal(err, "fs.WriteFile.tmp.Write")
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return cdnutil.WrapInternal(err, "fs.WriteFile.tmp.Close")
+	}
+
+	// CreateTemp creates files with 0600
+	if err := os.Chmod(tmpPath, 0777); err != nil {
+		os.Remove(tmpPath)
+		return cdnutil.WrapInternal(err, "fs.WriteFile.os.Chmod")
+	}
+
+	if err := os.Rename(tmpPath, p); err != nil {
+		os.Remove(tmpPath)
+		return cdnutil.WrapInternal(err, "fs.WriteFile.os.Rename")
 	}
 
 	return nil
@@ -0,0 +1,141 @@
+package modules
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	module_errors "animakuro/cdn/internal/modules/errors"
+	"animakuro/cdn/pkg/ffmpeg"
+)
+
+// Formats of image.video
+const (
+	videoMP4  = "mp4"
+	videoWebM = "webm"
+)
+
+const (
+	// Quality of animated WebP and WebM frames
+	animatedWebPQuality = "80"
+	webmCRF             = "32"
+)
+
+var ErrInvalidFrame = errors.New("frame must be a non-negative integer")
+
+// animation is what ffmpeg-based resolvers share
+type animation struct {
+	runner *ffmpeg.Runner
+	limits imageLimits
+}
+
+// animatedExt returns extension ffmpeg reads animated image by.
+// Empty string means still image or animation ffmpeg can't decode (WebP)
+func animatedExt(buff []byte) string {
+	if countFrames(buff) < 2 {
+		return ""
+	}
+
+	switch {
+	case bytes.HasPrefix(buff, []byte("GIF8")):
+		return ".gif"
+	case bytes.HasPrefix(buff, []byte("\x89PNG\r\n\x1a\n")):
+		return ".apng"
+	default:
+		return ""
+	}
+}
+
+// run applies ffmpeg within render timeout. Frames are capped,
+// so that declared frame count can't be bypassed
+func (a *animation) run(buff *bytes.Buffer, inExt, outExt, op string, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), a.limits.renderTimeout)
+	defer cancel()
+
+	args = append([]string{"-frames:v", strconv.Itoa(a.limits.maxFrames)}, args...)
+	out, err := a.runner.Run(ctx, buff.Bytes(), inExt, outExt, args...)
+	if err != nil {
+		return module_errors.WrapInternal(err, op)
+	}
+
+	(*buff).Reset()
+	(*buff).Write(out)
+
+	return nil
+}
+
+// webpfn keeps animation of GIF and APNG. Still images are converted by libvips
+func (a *animation) webpfn(buff *bytes.Buffer, arg interface{}) error {
+	if arg != TrueStr {
+		return nil
+	}
+
+	ext := animatedExt(buff.Bytes())
+	if ext == "" {
+		return webpfn(buff, arg)
+	}
+
+	return a.run(buff, ext, ".webp", "image.webpfn.ffmpeg.Run",
+		"-c:v", "libwebp_anim", "-loop", "0", "-q:v", animatedWebPQuality, "-an")
+}
+
+// videofn converts animated image to muted video, which is usually
+// many times smaller than GIF
+func (a *animation) videofn(buff *bytes.Buffer, arg interface{}) error {
+	format, ok := arg.(string)
+	if !ok || (format != videoMP4 && format != videoWebM) {
+		return nil
+	}
+
+	ext := animatedExt(buff.Bytes())
+	if ext == "" {
+		return module_errors.NewHttp(http.StatusBadRequest, module_errors.NotAnimated, video)
+	}
+
+	if format == videoMP4 {
+		// H.264 with yuv420p requires even dimensions.
+		// faststart moves index to the beginning, so playback starts before download ends
+		return a.run(buff, ext, ".mp4", "image.videofn.ffmpeg.Run",
+			"-c:v", "libx264", "-pix_fmt", "yuv420p", "-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2",
+			"-movflags", "+faststart", "-an")
+	}
+
+	return a.run(buff, ext, ".webm", "image.videofn.ffmpeg.Run",
+		"-c:v", "libvpx-vp9", "-b:v", "0", "-crf", webmCRF, "-an")
+}
+
+// framefn extracts a single frame of animated image as PNG (e.g. still poster of GIF).
+// Frame 0 of still image is the image itself
+func (a *animation) framefn(buff *bytes.Buffer, arg interface{}) error {
+	n, ok := arg.(int)
+	if !ok {
+		return nil
+	}
+
+	frames := countFrames(buff.Bytes())
+	if n >= frames {
+		return module_errors.NewHttp(http.StatusBadRequest, module_errors.FrameOutOfRange, n, frames)
+	}
+
+	ext := animatedExt(buff.Bytes())
+	if ext == "" {
+		if frames > 1 {
+			return module_errors.NewHttp(http.StatusBadRequest, module_errors.NotAnimated, frame)
+		}
+		return nil
+	}
+
+	return a.run(buff, ext, ".png", "image.framefn.ffmpeg.Run",
+		"-vf", "select=eq(n\\,"+strconv.Itoa(n)+")", "-frames:v", "1", "-c:v", "png")
+}
+
+func parseFrame(arg string) (interface{}, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 0 {
+		return nil, ErrInvalidFrame
+	}
+
+	return n, nil
+}
@@ -0,0 +1,326 @@
+package modules
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"animakuro/cdn/config"
+	module_errors "animakuro/cdn/internal/modules/errors"
+	"animakuro/cdn/pkg/ffmpeg"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+const (
+	audioModuleName = "audio"
+	bitrate         = "bitrate"
+	waveform        = "waveform"
+)
+
+// Formats of audio.format
+const (
+	formatMP3  = "mp3"
+	formatOgg  = "ogg"
+	formatAAC  = "aac"
+	formatOpus = "opus"
+)
+
+// Outputs of audio.waveform
+const (
+	waveformJSON = "json"
+	waveformPNG  = "png"
+)
+
+const (
+	defaultAudioRenderTimeout = time.Minute
+
+	// Audio is decoded to mono PCM of this rate to compute waveform
+	waveformSampleRate = 8000
+	// Peaks of JSON waveform and columns of PNG one
+	waveformPoints = 1000
+	waveformHeight = 200
+
+	// Bytes of Ogg page header preceding codec identification
+	oggHeaderLen = 28
+)
+
+var waveformColor = color.NRGBA{R: 0x1f, G: 0x29, B: 0x37, A: 0xff}
+
+var ErrInvalidBitrate = errors.New("bitrate must be one of 64, 96, 128, 160, 192, 256, 320")
+
+// Bitrates of audio.bitrate (kbps)
+var bitrates = []int{64, 96, 128, 160, 192, 256, 320}
+
+// waveformData is JSON output of audio.waveform
+type waveformData struct {
+	// Seconds
+	Duration float64 `json:"duration"`
+	// Peak amplitude of every of waveformPoints equal slices in range [0, 1]
+	Peaks []float64 `json:"peaks"`
+}
+
+type audioResolvers struct {
+	*transcoder
+}
+
+// newAudioModule registers audio module. Like video it's registered only along with runner
+func newAudioModule(cfg *config.AudioConfig, runner *ffmpeg.Runner) *Module {
+	timeout := defaultAudioRenderTimeout
+	if cfg != nil && cfg.RenderTimeout > 0 {
+		timeout = cfg.RenderTimeout
+	}
+
+	a := &audioResolvers{&transcoder{runner: runner, timeout: timeout}}
+
+	m := &Module{
+		Name:                     audioModuleName,
+		Resolvers:                make(map[string]ResolverFunc),
+		Defaults:                 make(Defaults),
+		AllowedResolverArguments: make(map[string][]string),
+		Timeout:                  timeout,
+		MimeTypes:                []string{"audio/"},
+	}
+
+	m.Resolvers[trim] = a.trimfn
+	m.Resolvers[format] = a.formatfn
+	m.Resolvers[bitrate] = a.bitratefn
+	m.Resolvers[waveform] = a.waveformfn
+
+	m.AllowedResolverArguments[format] = []string{formatMP3, formatOgg, formatAAC, formatOpus}
+	m.AllowedResolverArguments[waveform] = []string{waveformJSON, waveformPNG}
+
+	m.ArgumentParsers = map[string]ArgumentParser{
+		trim:    parseTrim,
+		bitrate: parseBitrate,
+	}
+
+	// Trim is lossless, so it goes first.
+	// Format encodes at high quality, so that bitrate re-encoding it loses little.
+	// Waveform is not audio, nothing could follow it
+	m.Order = []string{trim, format, bitrate, waveform}
+
+	return m
+}
+
+// audioCodec tells lossy format of buff and extension ffmpeg writes it by.
+// Empty format means lossless or unknown audio
+func audioCodec(buff []byte) (string, string) {
+	mtype := mimetype.Detect(buff)
+
+	switch {
+	case mtype.Is("audio/mpeg"):
+		return formatMP3, ".mp3"
+	case mtype.Is("audio/ogg"):
+		// Opus, Vorbis and FLAC share container. Codec follows header of the first page
+		switch codec := buff[oggHeaderLen:]; {
+		case bytes.HasPrefix(codec, []byte("OpusHead")):
+			return formatOpus, ".opus"
+		case bytes.HasPrefix(codec, []byte("\x01vorbis")):
+			return formatOgg, ".ogg"
+		default:
+			return "", mtype.Extension()
+		}
+	case mtype.Is("audio/mp4"), mtype.Is("audio/x-m4a"), mtype.Is("audio/aac"):
+		return formatAAC, ".m4a"
+	default:
+		return "", mtype.Extension()
+	}
+}
+
+// audioEncoderArgs are codec options of format. Without bitrate formats are encoded
+// at high quality (so that audio.bitrate re-encoding them loses little)
+func audioEncoderArgs(format string, kbps int) []string {
+	args := []string{"-map", "0:a:0", "-vn"}
+
+	rate := func(high string) string {
+		if kbps == 0 {
+			return high
+		}
+		return strconv.Itoa(kbps) + "k"
+	}
+
+	switch format {
+	case formatMP3:
+		return append(args, "-c:a", "libmp3lame", "-b:a", rate("320k"))
+	case formatOgg:
+		return append(args, "-c:a", "libvorbis", "-b:a", rate("320k"))
+	case formatOpus:
+		return append(args, "-c:a", "libopus", "-b:a", rate("256k"))
+	default:
+		return append(args, "-c:a", "aac", "-b:a", rate("320k"), "-movflags", "+faststart")
+	}
+}
+
+// formatExt is extension ffmpeg picks muxer of format by
+func formatExt(format string) string {
+	switch format {
+	case formatMP3:
+		return ".mp3"
+	case formatOgg:
+		return ".ogg"
+	case formatOpus:
+		return ".opus"
+	default:
+		return ".m4a"
+	}
+}
+
+// trimfn cuts clip (e.g. preview) without re-encoding
+func (a *audioResolvers) trimfn(buff *bytes.Buffer, arg interface{}) error {
+	targ, ok := arg.(trimArgument)
+	if !ok {
+		return nil
+	}
+
+	_, ext := audioCodec(buff.Bytes())
+
+	err := a.run(buff, targ.start, ext, "audio.trimfn.ffmpeg.Run",
+		"-t", seconds(targ.end-targ.start), "-map", "0:a:0", "-c", "copy")
+	if errors.Is(err, ffmpeg.ErrNoOutput) {
+		return module_errors.Wrap(err, http.StatusBadRequest, module_errors.TimestampOutOfRange, seconds(targ.start))
+	}
+
+	return err
+}
+
+func (a *audioResolvers) formatfn(buff *bytes.Buffer, arg interface{}) error {
+	format, ok := arg.(string)
+	if !ok {
+		return nil
+	}
+
+	return a.run(buff, 0, formatExt(format), "audio.formatfn.ffmpeg.Run", audioEncoderArgs(format, 0)...)
+}
+
+// bitratefn re-encodes lossy audio keeping its format.
+// Lossless audio must be given a format (audio.format) first
+func (a *audioResolvers) bitratefn(buff *bytes.Buffer, arg interface{}) error {
+	kbps, ok := arg.(int)
+	if !ok {
+		return nil
+	}
+
+	format, _ := audioCodec(buff.Bytes())
+	if format == "" {
+		return module_errors.NewHttp(http.StatusBadRequest, module_errors.BitrateOfLossless)
+	}
+
+	return a.run(buff, 0, formatExt(format), "audio.bitratefn.ffmpeg.Run", audioEncoderArgs(format, kbps)...)
+}
+
+// waveformfn replaces audio with its peaks as JSON or PNG
+func (a *audioResolvers) waveformfn(buff *bytes.Buffer, arg interface{}) error {
+	output, ok := arg.(string)
+	if !ok {
+		return nil
+	}
+
+	// Decode to mono 16-bit PCM
+	err := a.run(buff, 0, ".raw", "audio.waveformfn.ffmpeg.Run",
+		"-map", "0:a:0", "-ac", "1", "-ar", strconv.Itoa(waveformSampleRate), "-f", "s16le", "-c:a", "pcm_s16le")
+	if err != nil {
+		return err
+	}
+
+	data := newWaveform(buff.Bytes())
+
+	var out []byte
+	if output == waveformPNG {
+		out, err = data.png()
+	} else {
+		out, err = json.Marshal(data)
+	}
+	if err != nil {
+		return module_errors.WrapInternal(err, "audio.waveformfn.encode")
+	}
+
+	(*buff).Reset()
+	(*buff).Write(out)
+
+	return nil
+}
+
+// newWaveform computes peaks of mono 16-bit little-endian PCM
+func newWaveform(pcm []byte) *waveformData {
+	samples := len(pcm) / 2
+	data := &waveformData{
+		Duration: math.Round(float64(samples)/waveformSampleRate*1000) / 1000,
+		Peaks:    make([]float64, 0, waveformPoints),
+	}
+
+	if samples == 0 {
+		return data
+	}
+
+	points := waveformPoints
+	if samples < points {
+		points = samples
+	}
+
+	for i := 0; i < points; i++ {
+		from, to := i*samples/points, (i+1)*samples/points
+
+		var peak int
+		for s := from; s < to; s++ {
+			v := int(int16(binary.LittleEndian.Uint16(pcm[s*2:])))
+			if v < 0 {
+				v = -v
+			}
+			if v > peak {
+				peak = v
+			}
+		}
+
+		data.Peaks = append(data.Peaks, math.Round(float64(peak)/math.MaxInt16*100)/100)
+	}
+
+	return data
+}
+
+// png draws peaks as bars mirrored around horizontal axis on transparent background
+func (w *waveformData) png() ([]byte, error) {
+	width := len(w.Peaks)
+	if width == 0 {
+		width = 1
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, waveformHeight))
+	middle := waveformHeight / 2
+	for x, peak := range w.Peaks {
+		half := int(math.Ceil(math.Min(peak, 1) * float64(middle)))
+		for y := middle - half; y < middle+half; y++ {
+			img.SetNRGBA(x, y, waveformColor)
+		}
+	}
+
+	out := new(bytes.Buffer)
+	if err := png.Encode(out, img); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+func parseBitrate(arg string) (interface{}, error) {
+	kbps, err := strconv.Atoi(arg)
+	if err != nil {
+		return nil, ErrInvalidBitrate
+	}
+
+	for _, b := range bitrates {
+		if kbps == b {
+			return kbps, nil
+		}
+	}
+
+	return nil, ErrInvalidBitrate
+}
@@ -1,8 +1,17 @@
 package modules
 
 import (
+	"animakuro/cdn/config"
+	"animakuro/cdn/internal/entities"
 	module_errors "animakuro/cdn/internal/modules/errors"
+	"animakuro/cdn/pkg/ffmpeg"
+	"animakuro/cdn/pkg/plugin"
+	"animakuro/cdn/pkg/pool"
+	"animakuro/cdn/pkg/poppler"
+	"animakuro/cdn/pkg/wasm"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -14,64 +23,159 @@ import (
 type Controller interface {
 	// Applies resolvers agains buff (file processing)
 	UseResolvers(buff *bytes.Buffer, module string, mm ModuleMap) error
-	// Parses URL query and module into ModuleMap
-	Parse(q url.Values, bucketModule string) (ModuleMap, error)
-	// Sorts moduleMap and concatenates all members and uuid
-	Raw(mm ModuleMap, uuid string) string
+	// Parses URL query into ModuleMap of a single module out of bucket's ones.
+	// Returns module query refers to
+	Parse(q url.Values, bucketModules []string) (string, ModuleMap, error)
+	// Expands bucket preset into ModuleMap the same way Parse does
+	ParsePreset(preset entities.Preset, bucketModules []string) (string, ModuleMap, error)
+	// Sorts moduleMap of module and concatenates all members and uuid
+	Raw(module string, mm ModuleMap, uuid string) string
 	// Checks whether module exists
 	DoesModuleExist(module string) bool
+	// Checks whether module implements resolver
+	HasResolver(module, resolverName string) bool
+	// Selects module of bucketModules applying to file of mime.
+	// Empty if there's none
+	Select(bucketModules []string, mime string) string
+	// Checks that module applies to file of mime
+	CheckMime(module string, mime string) error
+	// Validates file against module limits (e.g. at upload)
+	Check(module string, buff []byte) error
+	// Computes metadata of uploaded file
+	Describe(module string, buff []byte) (map[string]string, error)
+	// Content type of derivative module knows better than sniffing. Empty if it doesn't
+	ContentType(module string, mm ModuleMap) string
+	// Tells whether files of module are served precompressed
+	Precompressed(module string) bool
+	// Fixes moduleMap to the current state of files its resolvers depend on besides the original.
+	// Must be applied before moduleMap is turned into name of derivative (see Raw)
+	Pin(ctx context.Context, module string, mm ModuleMap) (ModuleMap, error)
+	// Stops plugins
+	Close()
 }
 
 type controller struct {
 	modules map[string]*Module
+	plugins []*plugin.Plugin
 	logger  *zap.SugaredLogger
 }
 
-func NewController(logger *zap.SugaredLogger) Controller {
+// NewController registers all modules. cfg and reader are optional,
+// resolvers depending on them are not registered if they're nil.
+// Resolvers depending on ffmpeg (poppler) are not registered if it's not found.
+// Plugins which don't start (WebAssembly resolvers which are invalid) are not registered either
+func NewController(logger *zap.SugaredLogger, cfg *config.ModulesConfig, reader FileReader) Controller {
 	c := &controller{
 		modules: make(map[string]*Module, 1),
 		logger:  logger,
 	}
 
-	imgModule := newImageModule()
+	if cfg == nil {
+		cfg = &config.ModulesConfig{}
+	}
+
+	var runner *ffmpeg.Runner
+	if cfg.FFmpeg != nil {
+		r, err := ffmpeg.New(cfg.FFmpeg.Path)
+		if err != nil {
+			logger.Warnf("ffmpeg resolvers are disabled: %v", err)
+		}
+		runner = r
+	}
+
+	imgModule := newImageModule(cfg.Image, runner, reader)
 	c.registerModule(imgModule)
+
+	if cfg.Document != nil {
+		p, err := poppler.New(cfg.Document.PdftoppmPath, cfg.Document.PdfinfoPath)
+		if err != nil {
+			logger.Warnf("document module is disabled: %v", err)
+		} else {
+			c.registerModule(newDocumentModule(cfg.Document, newImageLimits(cfg.Image), p, imgModule))
+		}
+	}
+
+	c.registerModule(newTextModule(cfg.Text))
+
+	if runner != nil {
+		c.registerModule(newVideoModule(cfg.Video, runner))
+		c.registerModule(newAudioModule(cfg.Audio, runner))
+	}
+
+	// WebAssembly resolvers extend built-in modules only, so they go before plugins
+	if cfg.Wasm != nil && len(cfg.Wasm.Resolvers) != 0 {
+		limits := wasm.Limits{MaxMemory: cfg.Wasm.MaxMemory}
+		if runtime, err := wasm.New(context.Background(), limits); err != nil {
+			logger.Warnf("wasm resolvers are disabled: %v", err)
+		} else {
+			for _, rcfg := range cfg.Wasm.Resolvers {
+				if err := c.registerWasmResolver(runtime, cfg.Wasm, rcfg); err != nil {
+					logger.Warnf("wasm resolver %s.%s is disabled: %v", rcfg.Module, rcfg.Name, err)
+				}
+			}
+		}
+	}
+
+	for _, pcfg := range cfg.Plugins {
+		if err := c.registerPlugin(pcfg); err != nil {
+			logger.Warnf("plugin %s is disabled: %v", pcfg.Path, err)
+		}
+	}
 	return c
 }
 
-func (c *controller) Parse(q url.Values, bucketModule string) (ModuleMap, error) {
-	// bucketModule represents module that bucket was created with.
-	// If it doesn't exist but query has some module-related keys then return err
-	if bucketModule == "" {
-		return nil, module_errors.NewHttp(http.StatusBadRequest, module_errors.UnableToApplyModules)
+// registerPlugin starts plugin and registers module it describes.
+// Built-in modules can't be overridden
+func (c *controller) registerPlugin(cfg *config.PluginConfig) error {
+	p, manifest, err := plugin.Start(c.logger, cfg.Path, cfg.Args, cfg.StartTimeout)
+	if err != nil {
+		return err
 	}
 
-	// Get rid of auth query key
-	clearQuery(&q)
+	if c.DoesModuleExist(manifest.Name) {
+		p.Close()
+		return fmt.Errorf("module %s already exists", manifest.Name)
+	}
 
-	// Nothing to parse
-	if len(q) == 0 {
-		return nil, nil
+	m, err := newPluginModule(p, manifest)
+	if err != nil {
+		p.Close()
+		return err
 	}
+	m.Timeout = cfg.RenderTimeout
 
-	modmap := make(ModuleMap)
+	c.registerModule(m)
+	c.plugins = append(c.plugins, p)
+	c.logger.Infof("plugin %s registered module %s", cfg.Path, m.Name)
 
-	// Try to get module
-	module, ok := c.modules[bucketModule]
-	if !ok {
-		return nil, module_errors.Wrap(ErrNotFound, http.StatusBadRequest, ErrNotFound.Error())
+	return nil
+}
+
+func (c *controller) Close() {
+	for _, p := range c.plugins {
+		p.Close()
 	}
+}
 
-	// Module defaults
-	defaults := module.Defaults
+func (c *controller) Parse(q url.Values, bucketModules []string) (string, ModuleMap, error) {
+	// bucketModules represent modules that bucket was created with.
+	// If there are none but query has some module-related keys then return err
+	if len(bucketModules) == 0 {
+		return "", nil, module_errors.NewHttp(http.StatusBadRequest, module_errors.UnableToApplyModules)
+	}
+
+	// Get rid of auth query key
+	clearQuery(&q)
 
-	for defRName, defRValue := range defaults {
-		modmap[defRName] = defRValue
+	// Nothing to parse
+	if len(q) == 0 {
+		return "", nil, nil
 	}
 
-	// Number of times default value has changed to query's.
-	// e.g. If client sends all default module values then
-	// diffHits should be equal 0 and then nil map should be returned.
-	var diffHits int
+	modmap := make(ModuleMap)
+
+	// Module the first key refers to. The rest must refer to the same one
+	var queryModule string
 
 	// Allowed resolver arguments for certain module
 	var allowedArguments []string
@@ -79,61 +183,261 @@ func (c *controller) Parse(q url.Values, bucketModule string) (ModuleMap, error)
 
 		resolverName, resolverArgument, module, err := valuesFromQueryPair(key, values)
 		if err != nil {
-			return nil, module_errors.Wrap(err, http.StatusBadRequest, err.Error())
+			return "", nil, module_errors.Wrap(err, http.StatusBadRequest, err.Error())
 		}
 
-		if module != bucketModule {
-			return nil, module_errors.NewHttp(http.StatusBadRequest, module_errors.ModuleNotFound, module)
+		if !contains(bucketModules, module) {
+			return "", nil, module_errors.NewHttp(http.StatusBadRequest, module_errors.ModuleNotFound, module)
 		}
 
-		allowedArguments = c.allowedArguments(module, resolverName)
+		if queryModule == "" {
+			queryModule = module
+		} else if module != queryModule {
+			return "", nil, module_errors.NewHttp(http.StatusBadRequest, module_errors.MixedModules, queryModule, module)
+		}
 
-		// Validate resolver value
-		var ok bool
-		for _, arg := range allowedArguments {
-			if resolverArgument == arg {
-				ok = true
-				break
-			}
+		// Bucket could be created with module which is not registered anymore (e.g. ffmpeg is gone)
+		if !c.DoesModuleExist(module) {
+			return "", nil, module_errors.Wrap(ErrNotFound, http.StatusBadRequest, ErrNotFound.Error())
 		}
 
-		// Invalid resolver argument is passed
-		if ok == false {
-			return nil, module_errors.NewHttp(http.StatusBadRequest, module_errors.UnknownResolverArgument, resolverArgument, resolverName)
+		if !c.HasResolver(module, resolverName) {
+			return "", nil, module_errors.NewHttp(http.StatusBadRequest, module_errors.UnknownResolver, resolverName)
+		}
+
+		// Typed resolver argument
+		if parser, ok := c.argumentParser(module, resolverName); ok {
+			if _, err := parser(resolverArgument); err != nil {
+				return "", nil, module_errors.Wrap(err, http.StatusBadRequest, module_errors.InvalidResolverArgument, resolverArgument, resolverName, err.Error())
+			}
+		} else {
+			allowedArguments = c.allowedArguments(module, resolverName)
+
+			// Validate resolver value
+			var ok bool
+			for _, arg := range allowedArguments {
+				if resolverArgument == arg {
+					ok = true
+					break
+				}
+			}
+
+			// Invalid resolver argument is passed
+			if ok == false {
+				return "", nil, module_errors.NewHttp(http.StatusBadRequest, module_errors.UnknownResolverArgument, resolverArgument, resolverName)
+			}
 		}
 
-		// Fill map if value is not default
-		if defaults[resolverName] != resolverArgument {
+		// Fill map only if value is not default.
+		// Default values are never part of moduleMap so that Raw
+		// (and derivative hash) doesn't depend on resolvers that do nothing
+		if c.modules[module].Defaults[resolverName] != resolverArgument {
 			modmap[resolverName] = resolverArgument
-			diffHits += 1
 		}
 
 	}
 
 	// As stated above, return nil map to indicate original file that
-	// all resolver args passed are false... -> original file
-	if diffHits == 0 {
-		return nil, nil
+	// all resolver args passed are default... -> original file
+	if len(modmap) == 0 {
+		return "", nil, nil
+	}
+
+	return queryModule, modmap, nil
+}
+
+func (c *controller) ParsePreset(preset entities.Preset, bucketModules []string) (string, ModuleMap, error) {
+	q := make(url.Values, len(preset))
+	for key, arg := range preset {
+		q.Set(key, arg)
 	}
 
-	return modmap, nil
+	return c.Parse(q, bucketModules)
 }
 
-// UseResolvers mutates initial buff according to moduleMap
+// UseResolvers mutates initial buff according to moduleMap.
+// Resolvers are applied in module's Order within module's Timeout
 func (c *controller) UseResolvers(buff *bytes.Buffer, module string, mm ModuleMap) error {
+	m := c.modules[module]
+
+	if err := c.Check(module, buff.Bytes()); err != nil {
+		return err
+	}
+
+	if m.Render != nil {
+		return c.render(buff, m, mm)
+	}
+
+	if m.Timeout == 0 {
+		return c.useResolvers(context.Background(), buff, m, mm)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	// Resolvers can't be interrupted. Work is done on a copy, so abandoned render never touches buff,
+	// and stops before the next resolver. Pool worker is held until it returns, see pool.Lingering
+	work := bytes.NewBuffer(append(make([]byte, 0, buff.Len()), buff.Bytes()...))
+	done := make(chan error, 1)
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		defer func() {
+			if r := recover(); r != nil {
+				done <- module_errors.WrapInternal(fmt.Errorf("%v", r), "controller.UseResolvers.recover")
+			}
+		}()
+		done <- c.useResolvers(ctx, work, m, mm)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+		buff.Reset()
+		buff.Write(work.Bytes())
+		return nil
+	case <-ctx.Done():
+		return &pool.Lingering{
+			Err:  module_errors.NewHttp(http.StatusUnprocessableEntity, module_errors.RenderTimeout, m.Timeout),
+			Done: finished,
+		}
+	}
+}
+
+// render applies resolvers of module having Render. There's no need in a copy of buff,
+// Render gives up through ctx rather than keeps running after timeout
+func (c *controller) render(buff *bytes.Buffer, m *Module, mm ModuleMap) error {
+	ctx := context.Background()
+	if m.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.Timeout)
+		defer cancel()
+	}
+
+	err := m.Render(ctx, buff, mm)
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return module_errors.NewHttp(http.StatusUnprocessableEntity, module_errors.RenderTimeout, m.Timeout)
+	}
+
+	var merr *module_errors.ModuleError
+	if errors.As(err, &merr) {
+		return err
+	}
+
+	return module_errors.WrapInternal(err, "controller.render.m.Render")
+}
+
+func (c *controller) useResolvers(ctx context.Context, buff *bytes.Buffer, m *Module, mm ModuleMap) error {
 	// Prevents null check in the loop (compiler optimization)
 	_ = buff
-	for resolverName, resolverArg := range mm {
-		r := c.resolver(module, resolverName)
-		err := r(buff, resolverArg)
+	for _, resolverName := range m.Order {
+		rawArg, ok := mm[resolverName]
+		if !ok {
+			continue
+		}
+
+		// Render is abandoned
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		resolverArg, err := c.parseArgument(m.Name, resolverName, rawArg)
+		if err != nil {
+			return err
+		}
+
+		if options, ok := m.Options[resolverName]; ok {
+			optionsArg := OptionsArgument{Arg: resolverArg, Options: make(map[string]interface{}, len(options))}
+			for _, option := range options {
+				rawOption, ok := mm[option]
+				if !ok {
+					continue
+				}
+
+				if optionsArg.Options[option], err = c.parseArgument(m.Name, option, rawOption); err != nil {
+					return err
+				}
+			}
+			resolverArg = optionsArg
+		}
+
+		r := c.resolver(m.Name, resolverName)
+		err = r(buff, resolverArg)
 		if err != nil {
-			return module_errors.WrapInternal(err, "controller.UseResolvers.r")
+			// Resolver has already decided what client should get
+			var merr *module_errors.ModuleError
+			if errors.As(err, &merr) {
+				return err
+			}
+			return module_errors.WrapInternal(err, "controller.useResolvers.r")
 		}
 	}
 
 	return nil
 }
 
+// parseArgument converts raw argument to typed one if resolver has ArgumentParser
+func (c *controller) parseArgument(module, resolverName, rawArg string) (interface{}, error) {
+	parser, ok := c.argumentParser(module, resolverName)
+	if !ok {
+		return rawArg, nil
+	}
+
+	arg, err := parser(rawArg)
+	if err != nil {
+		return nil, module_errors.Wrap(err, http.StatusBadRequest, module_errors.InvalidResolverArgument, rawArg, resolverName, err.Error())
+	}
+
+	return arg, nil
+}
+
+func (c *controller) Check(module string, buff []byte) error {
+	m, ok := c.modules[module]
+	if !ok || m.Check == nil {
+		return nil
+	}
+
+	return m.Check(buff)
+}
+
+func (c *controller) Describe(module string, buff []byte) (map[string]string, error) {
+	m, ok := c.modules[module]
+	if !ok || m.Describe == nil {
+		return nil, nil
+	}
+
+	return m.Describe(buff)
+}
+
+func (c *controller) ContentType(module string, mm ModuleMap) string {
+	m, ok := c.modules[module]
+	if !ok || m.ContentType == nil {
+		return ""
+	}
+
+	return m.ContentType(mm)
+}
+
+func (c *controller) Precompressed(module string) bool {
+	m, ok := c.modules[module]
+	return ok && m.Precompress
+}
+
+func (c *controller) Pin(ctx context.Context, module string, mm ModuleMap) (ModuleMap, error) {
+	m, ok := c.modules[module]
+	if !ok || m.Pin == nil || mm == nil {
+		return mm, nil
+	}
+
+	return m.Pin(ctx, mm)
+}
+
 func (c *controller) DoesModuleExist(m string) bool {
 	// Empty return
 	if m == "" {
@@ -145,7 +449,67 @@ func (c *controller) DoesModuleExist(m string) bool {
 	return ok
 }
 
-func (c *controller) Raw(mm ModuleMap, uuid string) string {
+// HasResolver checks registration rather than func, resolvers of modules having Render are nil
+func (c *controller) HasResolver(module, resolverName string) bool {
+	m, ok := c.modules[module]
+	if !ok {
+		return false
+	}
+
+	_, ok = m.Resolvers[resolverName]
+	return ok
+}
+
+// Select prefers module declaring mime itself to module declaring its top-level type
+// (e.g. text for image/svg+xml rather than image). Ties are broken by order of bucketModules
+func (c *controller) Select(bucketModules []string, mime string) string {
+	var (
+		selected string
+		best     int
+	)
+	for _, name := range bucketModules {
+		m, ok := c.modules[name]
+		if !ok {
+			continue
+		}
+
+		match := 1
+		if len(m.MimeTypes) != 0 {
+			match = matchMime(m.MimeTypes, mime)
+		}
+
+		if match > best {
+			selected, best = name, match
+		}
+	}
+
+	return selected
+}
+
+func (c *controller) CheckMime(module string, mime string) error {
+	m, ok := c.modules[module]
+	if !ok {
+		return module_errors.Wrap(ErrNotFound, http.StatusBadRequest, ErrNotFound.Error())
+	}
+
+	if len(m.MimeTypes) != 0 && matchMime(m.MimeTypes, mime) == 0 {
+		if mime == "" {
+			mime = "untyped"
+		}
+		return module_errors.NewHttp(http.StatusBadRequest, module_errors.ModuleNotApplicable, module, mime)
+	}
+
+	return nil
+}
+
+// Image resolvers whose defaults were part of every image moduleMap before defaults were dropped from it
+var legacyDefaults = []string{webp, resized}
+
+func (c *controller) Raw(module string, mm ModuleMap, uuid string) string {
+	if module == imageModuleName {
+		mm = withLegacyDefaults(mm)
+	}
+
 	var names []string
 	for k := range mm {
 		names = append(names, k)
@@ -163,6 +527,43 @@ func (c *controller) Raw(mm ModuleMap, uuid string) string {
 	return rawv + uuid
 }
 
+// withLegacyDefaults adds defaults of legacyDefaults to image moduleMap having any of them,
+// so Raw (and names of derivatives already stored) is the same as when defaults were in moduleMap.
+// Other moduleMaps, image ones without legacyDefaults included, never had defaults
+func withLegacyDefaults(mm ModuleMap) ModuleMap {
+	var legacy bool
+	for _, name := range legacyDefaults {
+		if _, ok := mm[name]; ok {
+			legacy = true
+			break
+		}
+	}
+
+	if !legacy {
+		return mm
+	}
+
+	withDefaults := make(ModuleMap, len(mm)+len(legacyDefaults))
+	for _, name := range legacyDefaults {
+		withDefaults[name] = FalseStr
+	}
+	for k, v := range mm {
+		withDefaults[k] = v
+	}
+
+	return withDefaults
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (c *controller) registerModule(module *Module) {
 	c.modules[module.Name] = module
 }
@@ -175,6 +576,11 @@ func (c *controller) resolver(module, resolverName string) ResolverFunc {
 	return c.modules[module].Resolvers[resolverName]
 }
 
+func (c *controller) argumentParser(module, resolverName string) (ArgumentParser, bool) {
+	parser, ok := c.modules[module].ArgumentParsers[resolverName]
+	return parser, ok
+}
+
 func (c *controller) allowedArguments(module, resolverName string) []string {
 	return c.modules[module].AllowedResolverArguments[resolverName]
 }
@@ -0,0 +1,291 @@
+package modules
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"animakuro/cdn/config"
+	module_errors "animakuro/cdn/internal/modules/errors"
+	"animakuro/cdn/pkg/poppler"
+)
+
+const (
+	documentModuleName = "document"
+	page               = "page"
+	dpi                = "dpi"
+	thumbnail          = "thumbnail"
+)
+
+// Metadata keys of documents
+const (
+	MetaPages = "pages"
+)
+
+const (
+	defaultDocumentRenderTimeout = time.Minute
+
+	defaultDPI = 150
+	minDPI     = 36
+	maxDPI     = 600
+
+	defaultThumbnailWidth = 256
+	minThumbnailWidth     = 32
+	maxThumbnailWidth     = 1024
+)
+
+var (
+	ErrInvalidPage      = errors.New("page must be a positive integer")
+	ErrInvalidDPI       = errors.New("dpi must be an integer in range [36, 600]")
+	ErrInvalidThumbnail = errors.New("thumbnail must be true or width in range [32, 1024]")
+)
+
+type documentResolvers struct {
+	poppler *poppler.Poppler
+	timeout time.Duration
+	// Rendered pages are images, so they're limited the same way
+	maxPixels int
+	check     func(buff []byte) error
+}
+
+// newDocumentModule registers document module along with image resolvers,
+// which are applied to the rendered page (e.g. document.page=3&document.resize=200x0).
+// It's registered only if poppler is found
+func newDocumentModule(cfg *config.DocumentConfig, limits imageLimits, p *poppler.Poppler, image *Module) *Module {
+	timeout := defaultDocumentRenderTimeout
+	if cfg != nil && cfg.RenderTimeout > 0 {
+		timeout = cfg.RenderTimeout
+	}
+
+	d := &documentResolvers{poppler: p, timeout: timeout, maxPixels: limits.maxInputPixels, check: image.Check}
+
+	m := &Module{
+		Name:                     documentModuleName,
+		Resolvers:                make(map[string]ResolverFunc),
+		Defaults:                 make(Defaults),
+		AllowedResolverArguments: make(map[string][]string),
+		ArgumentParsers:          make(map[string]ArgumentParser),
+		Timeout:                  timeout,
+		Describe:                 d.describe,
+		Options:                  map[string][]string{page: {dpi}},
+		MimeTypes:                []string{"application/pdf"},
+		// Image resolvers depend on the same files
+		Pin: image.Pin,
+	}
+
+	m.Resolvers[page] = d.pagefn
+	m.Resolvers[thumbnail] = d.thumbnailfn
+	// Option of page
+	m.Resolvers[dpi] = func(*bytes.Buffer, interface{}) error { return nil }
+
+	m.Defaults[dpi] = strconv.Itoa(defaultDPI)
+	m.Defaults[thumbnail] = FalseStr
+
+	m.ArgumentParsers[page] = parsePage
+	m.ArgumentParsers[dpi] = parseDPI
+	m.ArgumentParsers[thumbnail] = parseThumbnail
+
+	m.Order = []string{page, thumbnail}
+
+	// Image resolvers follow rasterizing ones. Animation is irrelevant for pages
+	for _, name := range image.Order {
+		resolver, ok := image.Resolvers[name]
+		if !ok || name == frame || name == video {
+			continue
+		}
+
+		m.Resolvers[name] = d.rasterized(resolver)
+		if def, ok := image.Defaults[name]; ok {
+			m.Defaults[name] = def
+		}
+		if allowed, ok := image.AllowedResolverArguments[name]; ok {
+			m.AllowedResolverArguments[name] = allowed
+		}
+		if parser, ok := image.ArgumentParsers[name]; ok {
+			m.ArgumentParsers[name] = parser
+		}
+		m.Order = append(m.Order, name)
+	}
+
+	return m
+}
+
+func isPDF(buff []byte) bool {
+	return bytes.HasPrefix(buff, []byte("%PDF-"))
+}
+
+// pagefn renders page of document to PNG at requested (or default) dpi
+func (d *documentResolvers) pagefn(buff *bytes.Buffer, arg interface{}) error {
+	oarg, ok := arg.(OptionsArgument)
+	if !ok {
+		return nil
+	}
+	n, ok := oarg.Arg.(int)
+	if !ok {
+		return nil
+	}
+
+	resolution := defaultDPI
+	if r, ok := oarg.Options[dpi].(int); ok {
+		resolution = r
+	}
+
+	return d.render(buff, n, resolution)
+}
+
+// thumbnailfn renders the first page to PNG of given width
+func (d *documentResolvers) thumbnailfn(buff *bytes.Buffer, arg interface{}) error {
+	width, ok := arg.(int)
+	if !ok {
+		return nil
+	}
+
+	if !isPDF(buff.Bytes()) {
+		return module_errors.NewHttp(http.StatusBadRequest, module_errors.NotDocument, thumbnail)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	info, err := d.poppler.Info(ctx, buff.Bytes(), 1)
+	if err != nil {
+		return module_errors.WrapInternal(err, "document.thumbnailfn.poppler.Info")
+	}
+
+	// Height follows aspect ratio of the page
+	if info.Width > 0 {
+		if err := d.checkSize(float64(width), float64(width)*info.Height/info.Width); err != nil {
+			return err
+		}
+	}
+
+	out, err := d.poppler.RenderWidth(ctx, buff.Bytes(), 1, width)
+	if err != nil {
+		return module_errors.WrapInternal(err, "document.thumbnailfn.poppler.RenderWidth")
+	}
+
+	return d.write(buff, out)
+}
+
+func (d *documentResolvers) render(buff *bytes.Buffer, n, resolution int) error {
+	if !isPDF(buff.Bytes()) {
+		return module_errors.NewHttp(http.StatusBadRequest, module_errors.NotDocument, page)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	info, err := d.poppler.Info(ctx, buff.Bytes(), n)
+	if err != nil {
+		return module_errors.WrapInternal(err, "document.render.poppler.Info")
+	}
+
+	if n > info.Pages {
+		return module_errors.NewHttp(http.StatusBadRequest, module_errors.PageOutOfRange, n, info.Pages)
+	}
+
+	// Page size is in points, 72 per inch
+	if err := d.checkSize(info.Width*float64(resolution)/72, info.Height*float64(resolution)/72); err != nil {
+		return err
+	}
+
+	out, err := d.poppler.Render(ctx, buff.Bytes(), n, resolution)
+	if err != nil {
+		return module_errors.WrapInternal(err, "document.render.poppler.Render")
+	}
+
+	return d.write(buff, out)
+}
+
+// checkSize rejects page before it's rendered to more pixels than image is allowed to have
+func (d *documentResolvers) checkSize(width, height float64) error {
+	width, height = math.Ceil(width), math.Ceil(height)
+	if width*height > float64(d.maxPixels) {
+		return module_errors.NewHttp(http.StatusRequestEntityTooLarge, module_errors.PageTooLarge, int(width), int(height), d.maxPixels)
+	}
+
+	return nil
+}
+
+// write replaces document with rendered page, once it passes limits of images
+func (d *documentResolvers) write(buff *bytes.Buffer, out []byte) error {
+	if d.check != nil {
+		if err := d.check(out); err != nil {
+			return err
+		}
+	}
+
+	(*buff).Reset()
+	(*buff).Write(out)
+
+	return nil
+}
+
+// rasterized wraps image resolver, so that the first page is rendered
+// if no page was requested explicitly
+func (d *documentResolvers) rasterized(resolver ResolverFunc) ResolverFunc {
+	return func(buff *bytes.Buffer, arg interface{}) error {
+		if isPDF(buff.Bytes()) {
+			if err := d.render(buff, 1, defaultDPI); err != nil {
+				return err
+			}
+		}
+
+		return resolver(buff, arg)
+	}
+}
+
+// describe counts pages of uploaded document
+func (d *documentResolvers) describe(buff []byte) (map[string]string, error) {
+	if !isPDF(buff) {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	pages, err := d.poppler.Pages(ctx, buff)
+	if err != nil {
+		return nil, module_errors.WrapInternal(err, "document.describe.poppler.Pages")
+	}
+
+	return map[string]string{MetaPages: strconv.Itoa(pages)}, nil
+}
+
+func parsePage(arg string) (interface{}, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 {
+		return nil, ErrInvalidPage
+	}
+
+	return n, nil
+}
+
+func parseDPI(arg string) (interface{}, error) {
+	r, err := strconv.Atoi(arg)
+	if err != nil || r < minDPI || r > maxDPI {
+		return nil, ErrInvalidDPI
+	}
+
+	return r, nil
+}
+
+func parseThumbnail(arg string) (interface{}, error) {
+	switch arg {
+	case TrueStr:
+		return defaultThumbnailWidth, nil
+	case FalseStr:
+		return nil, nil
+	}
+
+	width, err := strconv.Atoi(arg)
+	if err != nil || width < minThumbnailWidth || width > maxThumbnailWidth {
+		return nil, ErrInvalidThumbnail
+	}
+
+	return width, nil
+}
@@ -9,7 +9,30 @@ import (
 var (
 	ModuleNotFound          = "module %s not found"
 	UnknownResolverArgument = "unknown resolver argument %s on resolver %s"
+	InvalidResolverArgument = "invalid resolver argument %s on resolver %s: %s"
+	UnknownResolver         = "unknown resolver %s"
+	WatermarkNotFound       = "watermark %s not found"
+	WatermarkNotImage       = "watermark %s is not an image"
 	UnableToApplyModules    = "unable to apply modules for this bucket"
+	ImageTooLarge           = "image of %dx%d exceeds limit of %d pixels"
+	TooManyFrames           = "image has %d frames exceeding limit of %d"
+	OutputTooLarge          = "output of %dx%d exceeds max dimension of %d"
+	RenderTimeout           = "processing took longer than %s"
+	NotAnimated             = "%s requires animated GIF or PNG"
+	FrameOutOfRange         = "frame %d is out of range, image has %d frames"
+	NotVideo                = "%s requires video"
+	UnsupportedMedia        = "file is not of a supported media container"
+	TimestampOutOfRange     = "timestamp %s is out of duration"
+	BitrateOfLossless       = "bitrate requires lossy audio, combine it with format"
+	NotDocument             = "%s requires PDF document"
+	PageOutOfRange          = "page %d is out of range, document has %d pages"
+	PageTooLarge            = "page of %dx%d exceeds limit of %d pixels"
+	NotText                 = "file is not UTF-8 text"
+	InvalidText             = "file is not valid %s: %s"
+	MixedModules            = "resolvers of modules %s and %s can't be combined"
+	ModuleNotApplicable     = "resolvers of module %s don't apply to %s files"
+	PluginUnavailable       = "module %s is temporarily unavailable"
+	TransformLimit          = "%s exceeded resource limits"
 )
 
 const (
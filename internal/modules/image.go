@@ -2,40 +2,156 @@ package modules
 
 import (
 	"bytes"
+	"encoding/hex"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
 
+	"animakuro/cdn/config"
 	module_errors "animakuro/cdn/internal/modules/errors"
+	"animakuro/cdn/pkg/ffmpeg"
 
 	"github.com/h2non/bimg"
 )
 
 const (
 	yAxisResizePercent = 0.2114
+	maxBlurSigma       = 100
+	maxSharpenRadius   = 10
+	minQuality         = 1
+	maxQuality         = 100
 )
 
 const (
 	imageModuleName = "image"
 	webp            = "webp"
 	resized         = "resized"
+	rotate          = "rotate"
+	flip            = "flip"
+	flop            = "flop"
+	blur            = "blur"
+	sharpen         = "sharpen"
+	grayscale       = "grayscale"
+	background      = "background"
+	watermark       = "watermark"
+	resize          = "resize"
+	quality         = "quality"
+	strip           = "strip"
+	placeholder     = "placeholder"
+	video           = "video"
+	frame           = "frame"
 )
 
-func newImageModule() *Module {
+const (
+	autoRotate = "auto"
+)
+
+var (
+	ErrInvalidAngle   = errors.New("angle must be one of 0, 90, 180, 270 or auto")
+	ErrInvalidSigma   = errors.New("sigma must be a number in range [0, 100]")
+	ErrInvalidRadius  = errors.New("radius must be an integer in range [0, 10]")
+	ErrInvalidColor   = errors.New("color must be hex RRGGBB")
+	ErrInvalidSize    = errors.New("size must be {width}x{height}, where 0 keeps aspect ratio")
+	ErrInvalidQuality = errors.New("quality must be an integer in range [1, 100]")
+)
+
+// resizeArgument is typed argument of resize resolver
+type resizeArgument struct {
+	width  int
+	height int
+}
+
+// rotateArgument is typed argument of rotate resolver
+type rotateArgument struct {
+	auto  bool
+	angle bimg.Angle
+}
+
+// newImageModule registers image resolvers. Animation-aware ones
+// (webp of animated images, video, frame) are only registered along with runner
+func newImageModule(cfg *config.ImageConfig, runner *ffmpeg.Runner, reader FileReader) *Module {
+	limits := newImageLimits(cfg)
+
 	m := &Module{
 		Name:                     imageModuleName,
 		Resolvers:                make(map[string]ResolverFunc),
 		Defaults:                 make(Defaults),
 		AllowedResolverArguments: make(map[string][]string),
+		Check:                    newImageCheck(limits),
+		Timeout:                  limits.renderTimeout,
+		MimeTypes:                []string{"image/"},
+		Describe:                 newImageDescribe(cfg != nil && cfg.LQIP),
 	}
 
 	//Set resolvers
 	m.Resolvers[webp] = webpfn
 	m.Resolvers[resized] = resizedfn
+	m.Resolvers[rotate] = rotatefn
+	m.Resolvers[flip] = flipfn
+	m.Resolvers[flop] = flopfn
+	m.Resolvers[blur] = blurfn
+	m.Resolvers[sharpen] = sharpenfn
+	m.Resolvers[grayscale] = grayscalefn
+	m.Resolvers[background] = backgroundfn
+	m.Resolvers[resize] = newResizefn(limits.maxOutputDimension)
+	m.Resolvers[quality] = qualityfn
+	m.Resolvers[strip] = stripfn
+	m.Resolvers[placeholder] = placeholderfn
 
 	//Set defaults
 	m.Defaults[webp] = FalseStr
 	m.Defaults[resized] = FalseStr
+	m.Defaults[rotate] = "0"
+	m.Defaults[flip] = FalseStr
+	m.Defaults[flop] = FalseStr
+	m.Defaults[blur] = "0"
+	m.Defaults[sharpen] = "0"
+	m.Defaults[grayscale] = FalseStr
+	m.Defaults[strip] = FalseStr
+	m.Defaults[placeholder] = FalseStr
 
 	m.AllowedResolverArguments[webp] = []string{TrueStr, FalseStr}
 	m.AllowedResolverArguments[resized] = []string{TrueStr, FalseStr}
+	m.AllowedResolverArguments[flip] = []string{TrueStr, FalseStr}
+	m.AllowedResolverArguments[flop] = []string{TrueStr, FalseStr}
+	m.AllowedResolverArguments[grayscale] = []string{TrueStr, FalseStr}
+
+	//Set typed arguments
+	m.ArgumentParsers = map[string]ArgumentParser{
+		rotate:      parseRotate,
+		blur:        parseSigma,
+		sharpen:     parseRadius,
+		background:  parseColor,
+		resize:      parseSize,
+		quality:     parseQuality,
+		strip:       parseStrip,
+		placeholder: parsePlaceholder,
+	}
+
+	// Geometry goes first, then effects.
+	// Format conversion and quality are always the last ones
+	// followed by strip, so that nothing re-encoded brings metadata back
+	// Frame is extracted before anything else, and video is the very last
+	// as nothing else could process it
+	m.Order = []string{frame, rotate, flip, flop, resized, resize, background, blur, sharpen, grayscale, watermark, placeholder, webp, quality, strip, video}
+
+	// Watermark overlays are read from the designated bucket
+	if cfg != nil && cfg.WatermarkBucket != "" && reader != nil {
+		m.Resolvers[watermark] = newWatermarkfn(reader, cfg.WatermarkBucket)
+		m.ArgumentParsers[watermark] = parseWatermark
+		m.Pin = newWatermarkPin(reader, cfg.WatermarkBucket)
+	}
+
+	if runner != nil {
+		a := &animation{runner: runner, limits: limits}
+		m.Resolvers[webp] = a.webpfn
+		m.Resolvers[video] = a.videofn
+		m.Resolvers[frame] = a.framefn
+		m.AllowedResolverArguments[video] = []string{videoMP4, videoWebM}
+		m.ArgumentParsers[frame] = parseFrame
+	}
 
 	return m
 }
@@ -85,3 +201,324 @@ func resizedfn(buff *bytes.Buffer, arg interface{}) error {
 
 	return nil
 }
+
+func rotatefn(buff *bytes.Buffer, arg interface{}) error {
+	rarg, ok := arg.(rotateArgument)
+	if !ok || (!rarg.auto && rarg.angle == bimg.D0) {
+		return nil
+	}
+
+	img := bimg.NewImage(buff.Bytes())
+
+	var (
+		newimg []byte
+		err    error
+	)
+	if rarg.auto {
+		// Uses EXIF orientation
+		newimg, err = img.AutoRotate()
+	} else {
+		newimg, err = img.Rotate(rarg.angle)
+	}
+	if err != nil {
+		return module_errors.WrapInternal(err, "image.rotatefn.img.Rotate")
+	}
+
+	(*buff).Reset()
+	(*buff).Write(newimg)
+
+	return nil
+}
+
+func flipfn(buff *bytes.Buffer, arg interface{}) error {
+	if arg != TrueStr {
+		return nil
+	}
+
+	img := bimg.NewImage(buff.Bytes())
+
+	// bimg naming is the opposite of ours: Flop mirrors vertically (upside-down)
+	newimg, err := img.Flop()
+	if err != nil {
+		return module_errors.WrapInternal(err, "image.flipfn.img.Flop")
+	}
+
+	(*buff).Reset()
+	(*buff).Write(newimg)
+
+	return nil
+}
+
+func flopfn(buff *bytes.Buffer, arg interface{}) error {
+	if arg != TrueStr {
+		return nil
+	}
+
+	img := bimg.NewImage(buff.Bytes())
+
+	// Mirrors horizontally (left-right)
+	newimg, err := img.Flip()
+	if err != nil {
+		return module_errors.WrapInternal(err, "image.flopfn.img.Flip")
+	}
+
+	(*buff).Reset()
+	(*buff).Write(newimg)
+
+	return nil
+}
+
+func blurfn(buff *bytes.Buffer, arg interface{}) error {
+	sigma, ok := arg.(float64)
+	if !ok || sigma == 0 {
+		return nil
+	}
+
+	img := bimg.NewImage(buff.Bytes())
+
+	newimg, err := img.Process(bimg.Options{
+		GaussianBlur: bimg.GaussianBlur{Sigma: sigma},
+	})
+	if err != nil {
+		return module_errors.WrapInternal(err, "image.blurfn.img.Process")
+	}
+
+	(*buff).Reset()
+	(*buff).Write(newimg)
+
+	return nil
+}
+
+func sharpenfn(buff *bytes.Buffer, arg interface{}) error {
+	radius, ok := arg.(int)
+	if !ok || radius == 0 {
+		return nil
+	}
+
+	img := bimg.NewImage(buff.Bytes())
+
+	// libvips defaults for the rest of sharpen parameters
+	newimg, err := img.Process(bimg.Options{
+		Sharpen: bimg.Sharpen{
+			Radius: radius,
+			X1:     2,
+			Y2:     10,
+			Y3:     20,
+			M1:     0,
+			M2:     3,
+		},
+	})
+	if err != nil {
+		return module_errors.WrapInternal(err, "image.sharpenfn.img.Process")
+	}
+
+	(*buff).Reset()
+	(*buff).Write(newimg)
+
+	return nil
+}
+
+func grayscalefn(buff *bytes.Buffer, arg interface{}) error {
+	if arg != TrueStr {
+		return nil
+	}
+
+	img := bimg.NewImage(buff.Bytes())
+
+	newimg, err := img.Colourspace(bimg.InterpretationBW)
+	if err != nil {
+		return module_errors.WrapInternal(err, "image.grayscalefn.img.Colourspace")
+	}
+
+	(*buff).Reset()
+	(*buff).Write(newimg)
+
+	return nil
+}
+
+// backgroundfn fills transparent areas of an image with color
+func backgroundfn(buff *bytes.Buffer, arg interface{}) error {
+	color, ok := arg.(bimg.Color)
+	if !ok {
+		return nil
+	}
+
+	img := bimg.NewImage(buff.Bytes())
+
+	// bimg skips flattening on black background, so it's
+	// nudged to the closest non-black color
+	if color == bimg.ColorBlack {
+		color = bimg.Color{R: 0, G: 0, B: 1}
+	}
+
+	newimg, err := img.Process(bimg.Options{
+		Background: color,
+	})
+	if err != nil {
+		return module_errors.WrapInternal(err, "image.backgroundfn.img.Process")
+	}
+
+	(*buff).Reset()
+	(*buff).Write(newimg)
+
+	return nil
+}
+
+// newResizefn returns resolver that resizes image unless
+// either side of the result exceeds maxDimension
+func newResizefn(maxDimension int) ResolverFunc {
+	return func(buff *bytes.Buffer, arg interface{}) error {
+		rarg, ok := arg.(resizeArgument)
+		if !ok {
+			return nil
+		}
+
+		img := bimg.NewImage(buff.Bytes())
+
+		size, err := img.Size()
+		if err != nil {
+			return module_errors.WrapInternal(err, "image.resizefn.img.Size")
+		}
+
+		width, height := resizeOutput(size, rarg)
+		if width > maxDimension || height > maxDimension {
+			return module_errors.NewHttp(http.StatusBadRequest, module_errors.OutputTooLarge, width, height, maxDimension)
+		}
+
+		newimg, err := img.Process(bimg.Options{
+			Width:  rarg.width,
+			Height: rarg.height,
+			Crop:   rarg.width > 0 && rarg.height > 0,
+		})
+		if err != nil {
+			return module_errors.WrapInternal(err, "image.resizefn.img.Process")
+		}
+
+		(*buff).Reset()
+		(*buff).Write(newimg)
+
+		return nil
+	}
+}
+
+// resizeOutput calculates size of resized image. Zero side keeps aspect ratio
+func resizeOutput(size bimg.ImageSize, arg resizeArgument) (int, int) {
+	width, height := arg.width, arg.height
+	if size.Width == 0 || size.Height == 0 {
+		return width, height
+	}
+
+	if width == 0 {
+		width = int(math.Round(float64(size.Width) * float64(height) / float64(size.Height)))
+	}
+	if height == 0 {
+		height = int(math.Round(float64(size.Height) * float64(width) / float64(size.Width)))
+	}
+
+	return width, height
+}
+
+// qualityfn re-encodes image with quality keeping its format
+func qualityfn(buff *bytes.Buffer, arg interface{}) error {
+	q, ok := arg.(int)
+	if !ok {
+		return nil
+	}
+
+	img := bimg.NewImage(buff.Bytes())
+
+	newimg, err := img.Process(bimg.Options{
+		Quality: q,
+	})
+	if err != nil {
+		return module_errors.WrapInternal(err, "image.qualityfn.img.Process")
+	}
+
+	(*buff).Reset()
+	(*buff).Write(newimg)
+
+	return nil
+}
+
+// parseSize parses {width}x{height} e.g. 200x0, 0x300 or 200x300
+func parseSize(arg string) (interface{}, error) {
+	w, h, ok := strings.Cut(arg, "x")
+	if !ok {
+		return nil, ErrInvalidSize
+	}
+
+	width, err := strconv.Atoi(w)
+	if err != nil || width < 0 || width > bimg.MaxSize() {
+		return nil, ErrInvalidSize
+	}
+
+	height, err := strconv.Atoi(h)
+	if err != nil || height < 0 || height > bimg.MaxSize() {
+		return nil, ErrInvalidSize
+	}
+
+	if width == 0 && height == 0 {
+		return nil, ErrInvalidSize
+	}
+
+	return resizeArgument{width: width, height: height}, nil
+}
+
+func parseQuality(arg string) (interface{}, error) {
+	q, err := strconv.Atoi(arg)
+	if err != nil || q < minQuality || q > maxQuality {
+		return nil, ErrInvalidQuality
+	}
+
+	return q, nil
+}
+
+func parseRotate(arg string) (interface{}, error) {
+	if arg == autoRotate {
+		return rotateArgument{auto: true}, nil
+	}
+
+	angle, err := strconv.Atoi(arg)
+	if err != nil {
+		return nil, ErrInvalidAngle
+	}
+
+	switch bimg.Angle(angle) {
+	case bimg.D0, bimg.D90, bimg.D180, bimg.D270:
+		return rotateArgument{angle: bimg.Angle(angle)}, nil
+	default:
+		return nil, ErrInvalidAngle
+	}
+}
+
+func parseSigma(arg string) (interface{}, error) {
+	sigma, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(sigma) || sigma < 0 || sigma > maxBlurSigma {
+		return nil, ErrInvalidSigma
+	}
+
+	return sigma, nil
+}
+
+func parseRadius(arg string) (interface{}, error) {
+	radius, err := strconv.Atoi(arg)
+	if err != nil || radius < 0 || radius > maxSharpenRadius {
+		return nil, ErrInvalidRadius
+	}
+
+	return radius, nil
+}
+
+// parseColor parses hex color e.g. "ff00aa" into bimg.Color
+func parseColor(arg string) (interface{}, error) {
+	if len(arg) != 6 {
+		return nil, ErrInvalidColor
+	}
+
+	rgb, err := hex.DecodeString(arg)
+	if err != nil {
+		return nil, ErrInvalidColor
+	}
+
+	return bimg.Color{R: rgb[0], G: rgb[1], B: rgb[2]}, nil
+}
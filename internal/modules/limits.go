@@ -0,0 +1,189 @@
+package modules
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"time"
+
+	"animakuro/cdn/config"
+	module_errors "animakuro/cdn/internal/modules/errors"
+
+	"github.com/h2non/bimg"
+)
+
+// imageLimits protect from decompression bombs: tiny files declaring huge images
+type imageLimits struct {
+	maxInputPixels     int
+	maxOutputDimension int
+	maxFrames          int
+	renderTimeout      time.Duration
+}
+
+func newImageLimits(cfg *config.ImageConfig) imageLimits {
+	l := imageLimits{
+		maxInputPixels:     config.DefaultMaxInputPixels,
+		maxOutputDimension: config.DefaultMaxOutputDimension,
+		maxFrames:          config.DefaultMaxFrames,
+		renderTimeout:      config.DefaultImageRenderTimeout,
+	}
+	if cfg == nil {
+		return l
+	}
+
+	if cfg.MaxInputPixels > 0 {
+		l.maxInputPixels = cfg.MaxInputPixels
+	}
+	if cfg.MaxOutputDimension > 0 {
+		l.maxOutputDimension = cfg.MaxOutputDimension
+	}
+	if cfg.MaxFrames > 0 {
+		l.maxFrames = cfg.MaxFrames
+	}
+	if cfg.RenderTimeout > 0 {
+		l.renderTimeout = cfg.RenderTimeout
+	}
+
+	return l
+}
+
+// newImageCheck returns Module.Check rejecting images exceeding limits.
+// Only headers are read, so nothing is decoded before the check passes
+func newImageCheck(l imageLimits) func(buff []byte) error {
+	return func(buff []byte) error {
+		// Not an image. Resolvers decide on their own
+		if bimg.DetermineImageType(buff) == bimg.UNKNOWN {
+			return nil
+		}
+
+		size, err := bimg.NewImage(buff).Size()
+		if err != nil {
+			return module_errors.WrapInternal(err, "image.check.img.Size")
+		}
+
+		if size.Width*size.Height > l.maxInputPixels {
+			return module_errors.NewHttp(http.StatusRequestEntityTooLarge, module_errors.ImageTooLarge, size.Width, size.Height, l.maxInputPixels)
+		}
+
+		if frames := countFrames(buff); frames > l.maxFrames {
+			return module_errors.NewHttp(http.StatusRequestEntityTooLarge, module_errors.TooManyFrames, frames, l.maxFrames)
+		}
+
+		return nil
+	}
+}
+
+// countFrames counts frames of animated GIF, WebP and PNG (APNG) without decoding them.
+// Any other image has a single frame
+func countFrames(buff []byte) int {
+	switch {
+	case bytes.HasPrefix(buff, []byte("GIF8")):
+		return countGIFFrames(buff)
+	case len(buff) >= 12 && bytes.Equal(buff[0:4], []byte("RIFF")) && bytes.Equal(buff[8:12], []byte("WEBP")):
+		return countWebPFrames(buff)
+	case bytes.HasPrefix(buff, []byte("\x89PNG\r\n\x1a\n")):
+		return countPNGFrames(buff)
+	default:
+		return 1
+	}
+}
+
+// countGIFFrames walks GIF blocks counting image descriptors
+func countGIFFrames(buff []byte) int {
+	// Header (6) + logical screen descriptor (7)
+	const headerLen = 13
+	if len(buff) < headerLen {
+		return 1
+	}
+
+	pos := headerLen
+	if flags := buff[10]; flags&0x80 != 0 {
+		// Global color table
+		pos += 3 << ((flags & 0x07) + 1)
+	}
+
+	var frames int
+	for pos < len(buff) {
+		switch buff[pos] {
+		// Image descriptor
+		case 0x2C:
+			if pos+10 > len(buff) {
+				return frames
+			}
+			flags := buff[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				// Local color table
+				pos += 3 << ((flags & 0x07) + 1)
+			}
+			// LZW minimum code size
+			pos++
+			pos = skipGIFSubBlocks(buff, pos)
+			frames++
+		// Extension
+		case 0x21:
+			pos = skipGIFSubBlocks(buff, pos+2)
+		// Trailer or garbage
+		default:
+			return frames
+		}
+	}
+
+	return frames
+}
+
+func skipGIFSubBlocks(buff []byte, pos int) int {
+	for pos < len(buff) {
+		size := int(buff[pos])
+		pos++
+		if size == 0 {
+			break
+		}
+		pos += size
+	}
+
+	return pos
+}
+
+// countWebPFrames counts ANMF chunks of RIFF container
+func countWebPFrames(buff []byte) int {
+	var frames int
+	for pos := 12; pos+8 <= len(buff); {
+		size := int(binary.LittleEndian.Uint32(buff[pos+4 : pos+8]))
+		if bytes.Equal(buff[pos:pos+4], []byte("ANMF")) {
+			frames++
+		}
+		// Chunks are padded to even size
+		pos += 8 + size + size&1
+	}
+
+	if frames == 0 {
+		return 1
+	}
+
+	return frames
+}
+
+// countPNGFrames reads num_frames of acTL chunk
+func countPNGFrames(buff []byte) int {
+	for pos := 8; pos+8 <= len(buff); {
+		size := int(binary.BigEndian.Uint32(buff[pos : pos+4]))
+		typ := string(buff[pos+4 : pos+8])
+
+		switch typ {
+		case "acTL":
+			if pos+12 > len(buff) {
+				return 1
+			}
+			return int(binary.BigEndian.Uint32(buff[pos+8 : pos+12]))
+		// acTL must precede image data
+		case "IDAT", "IEND":
+			return 1
+		}
+
+		// length + type + data + crc
+		pos += 12 + size
+	}
+
+	return 1
+}
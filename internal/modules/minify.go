@@ -0,0 +1,509 @@
+package modules
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Minifiers below are conservative: they drop comments and whitespace
+// that's insignificant for sure and leave everything else as is.
+// Strings, regular expressions, template literals and elements
+// whose content is whitespace sensitive are copied verbatim
+
+// Tags content of which is copied verbatim
+var (
+	htmlRawTags = map[string]bool{"pre": true, "textarea": true, "script": true, "style": true}
+	svgRawTags  = map[string]bool{"script": true, "style": true, "text": true}
+)
+
+// JS keywords after which slash starts regular expression rather than division
+var jsRegexKeywords = map[string]bool{
+	"return": true, "typeof": true, "instanceof": true, "in": true, "of": true, "new": true, "delete": true,
+	"void": true, "throw": true, "case": true, "do": true, "else": true, "yield": true, "await": true,
+}
+
+func minifyJSON(src []byte) ([]byte, error) {
+	var buff bytes.Buffer
+	if err := json.Compact(&buff, src); err != nil {
+		return nil, err
+	}
+
+	return buff.Bytes(), nil
+}
+
+func minifyCSS(src []byte) []byte {
+	out := make([]byte, 0, len(src))
+	space := false
+
+	// separate writes pending whitespace if it's significant before c
+	separate := func(c byte) {
+		if space && len(out) != 0 && !isCSSTightAfter(out[len(out)-1]) && !isCSSTightBefore(c) {
+			out = append(out, ' ')
+		}
+		space = false
+	}
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case isSpace(c):
+			space = true
+			i++
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := skipBlockComment(src, i)
+			// Keep license comments (/*! ... */)
+			if i+2 < len(src) && src[i+2] == '!' {
+				separate(c)
+				out = append(out, src[i:end]...)
+			} else {
+				space = true
+			}
+			i = end
+		case c == '"' || c == '\'':
+			separate(c)
+			end := skipString(src, i)
+			out = append(out, src[i:end]...)
+			i = end
+		default:
+			separate(c)
+			// Last declaration doesn't need semicolon
+			if c == '}' && len(out) != 0 && out[len(out)-1] == ';' {
+				out = out[:len(out)-1]
+			}
+			out = append(out, c)
+			i++
+
+			// Unquoted url may contain anything but closing parenthesis (e.g. //)
+			if c == '(' && len(out) >= 4 && bytes.EqualFold(out[len(out)-4:len(out)-1], []byte("url")) {
+				j := i
+				for j < len(src) && isSpace(src[j]) {
+					j++
+				}
+				if j < len(src) && src[j] != '"' && src[j] != '\'' {
+					end := bytes.IndexByte(src[j:], ')')
+					if end == -1 {
+						end = len(src) - j
+					}
+					out = append(out, bytes.TrimSpace(src[j:j+end])...)
+					i = j + end
+				}
+			}
+		}
+	}
+
+	return out
+}
+
+// Whitespace after these is insignificant in CSS
+func isCSSTightAfter(c byte) bool {
+	return c == '{' || c == '}' || c == ';' || c == ',' || c == '>' || c == ':' || c == '('
+}
+
+// Whitespace before these is insignificant in CSS.
+// Colon is missing on purpose: "a :hover" differs from "a:hover"
+func isCSSTightBefore(c byte) bool {
+	return c == '{' || c == '}' || c == ';' || c == ',' || c == '>' || c == ')'
+}
+
+// minifyJS drops comments and collapses whitespace. Line breaks are kept
+// where automatic semicolon insertion could depend on them
+func minifyJS(src []byte) []byte {
+	out := make([]byte, 0, len(src))
+	var space, newline bool
+
+	i := 0
+	// Hashbang is a line comment allowed at start only
+	if bytes.HasPrefix(src, []byte("#!")) {
+		i = lineEnd(src, 0)
+		out = append(out, src[:i]...)
+	}
+
+	// separate writes pending whitespace if it's significant before c
+	separate := func(c byte) {
+		if len(out) != 0 {
+			prev := out[len(out)-1]
+			switch {
+			case newline && !isJSTightAfterNewline(prev) && !isJSTightBeforeNewline(c):
+				out = append(out, '\n')
+			case (space || newline) && needsJSSpace(out, c):
+				out = append(out, ' ')
+			}
+		}
+		space, newline = false, false
+	}
+
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == '\n' || c == '\r':
+			newline = true
+			i++
+		case isSpace(c):
+			space = true
+			i++
+		case c == '/' && i+1 < len(src) && src[i+1] == '/':
+			i = lineEnd(src, i)
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := skipBlockComment(src, i)
+			if i+2 < len(src) && src[i+2] == '!' {
+				separate(c)
+				out = append(out, src[i:end]...)
+			} else if bytes.IndexByte(src[i:end], '\n') != -1 {
+				// Multiline comment terminates statement like line break does
+				newline = true
+			} else {
+				space = true
+			}
+			i = end
+		default:
+			end := i + 1
+			switch {
+			case c == '"' || c == '\'':
+				end = skipString(src, i)
+			case c == '`':
+				end = skipTemplate(src, i)
+			case c == '/' && isJSRegexAllowed(out):
+				end = skipRegex(src, i)
+			}
+
+			separate(c)
+			out = append(out, src[i:end]...)
+			i = end
+		}
+	}
+
+	return out
+}
+
+// Line break after these never ends statement
+func isJSTightAfterNewline(c byte) bool {
+	return c == '{' || c == ';' || c == ',' || c == '(' || c == '[' || c == '\n'
+}
+
+// Line break before these never ends statement
+func isJSTightBeforeNewline(c byte) bool {
+	return c == '}' || c == ')' || c == ']' || c == ';' || c == ','
+}
+
+// needsJSSpace tells whether dropping whitespace between out and c
+// would merge tokens (e.g. identifiers, "a - -b", "x / /re/", "1 .toFixed")
+func needsJSSpace(out []byte, c byte) bool {
+	prev := out[len(out)-1]
+	switch {
+	case isWordByte(prev) && isWordByte(c):
+		return true
+	case (prev == '+' || prev == '-') && (c == '+' || c == '-'):
+		return true
+	case prev == '/' && (c == '/' || c == '*'):
+		return true
+	case c == '.' && isDigit(prev):
+		return true
+	}
+
+	return false
+}
+
+// isJSRegexAllowed tells whether slash following out starts regular expression
+func isJSRegexAllowed(out []byte) bool {
+	if len(out) == 0 {
+		return true
+	}
+
+	prev := out[len(out)-1]
+	if isWordByte(prev) {
+		start := len(out)
+		for start > 0 && isWordByte(out[start-1]) {
+			start--
+		}
+		return jsRegexKeywords[string(out[start:])]
+	}
+
+	switch prev {
+	case ')', ']', '}', '"', '\'', '`':
+		return false
+	}
+
+	return true
+}
+
+// skipRegex returns end of regular expression literal starting at i.
+// If it's not terminated on the same line slash is taken as is
+func skipRegex(src []byte, i int) int {
+	inClass := false
+	for j := i + 1; j < len(src); j++ {
+		switch src[j] {
+		case '\\':
+			j++
+		case '\n', '\r':
+			return i + 1
+		case '[':
+			inClass = true
+		case ']':
+			inClass = false
+		case '/':
+			if inClass {
+				continue
+			}
+			j++
+			for j < len(src) && isWordByte(src[j]) {
+				j++
+			}
+			return j
+		}
+	}
+
+	return i + 1
+}
+
+// skipTemplate returns end of template literal starting at i
+func skipTemplate(src []byte, i int) int {
+	for j := i + 1; j < len(src); j++ {
+		switch src[j] {
+		case '\\':
+			j++
+		case '`':
+			return j + 1
+		case '$':
+			if j+1 < len(src) && src[j+1] == '{' {
+				j = skipTemplateExpr(src, j+2) - 1
+			}
+		}
+	}
+
+	return len(src)
+}
+
+// skipTemplateExpr returns end of template substitution
+// (right after closing brace) starting at i
+func skipTemplateExpr(src []byte, i int) int {
+	depth := 1
+	for j := i; j < len(src); {
+		switch c := src[j]; {
+		case c == '{':
+			depth++
+			j++
+		case c == '}':
+			depth--
+			j++
+			if depth == 0 {
+				return j
+			}
+		case c == '"' || c == '\'':
+			j = skipString(src, j)
+		case c == '`':
+			j = skipTemplate(src, j)
+		case c == '/' && j+1 < len(src) && src[j+1] == '/':
+			j = lineEnd(src, j)
+		case c == '/' && j+1 < len(src) && src[j+1] == '*':
+			j = skipBlockComment(src, j)
+		default:
+			j++
+		}
+	}
+
+	return len(src)
+}
+
+// minifyMarkup minifies HTML and SVG. Whitespace in text is collapsed,
+// with dropBlank whitespace touching tags is dropped altogether (fine for SVG, not for HTML).
+// Content of raw tags is copied verbatim
+func minifyMarkup(src []byte, raw map[string]bool, dropBlank bool) []byte {
+	out := make([]byte, 0, len(src))
+	space := false
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case isSpace(c):
+			space = true
+			i++
+		case c == '<' && bytes.HasPrefix(src[i:], []byte("<!--")):
+			end := skipUntil(src, i+4, "-->")
+			// Conditional comments are not comments for IE
+			if bytes.HasPrefix(src[i:], []byte("<!--[if")) {
+				out = appendMarkupSpace(out, space, dropBlank, true)
+				space = false
+				out = append(out, src[i:end]...)
+			}
+			i = end
+		case c == '<' && bytes.HasPrefix(src[i:], []byte("<![CDATA[")):
+			end := skipUntil(src, i, "]]>")
+			out = appendMarkupSpace(out, space, dropBlank, true)
+			space = false
+			out = append(out, src[i:end]...)
+			i = end
+		case c == '<' && i+1 < len(src) && (src[i+1] == '!' || src[i+1] == '?'):
+			// Doctype and XML declaration
+			end := skipUntil(src, i, ">")
+			out = appendMarkupSpace(out, space, dropBlank, true)
+			space = false
+			out = append(out, src[i:end]...)
+			i = end
+		case c == '<' && i+1 < len(src) && (isLetter(src[i+1]) || src[i+1] == '/'):
+			out = appendMarkupSpace(out, space, dropBlank, true)
+			space = false
+
+			var name string
+			out, i, name = appendTag(out, src, i)
+			if name == "" || !raw[name] {
+				continue
+			}
+
+			// Verbatim up to closing tag
+			end := indexFold(src[i:], "</"+name)
+			if end == -1 {
+				end = len(src) - i
+			}
+			out = append(out, src[i:i+end]...)
+			i += end
+		default:
+			out = appendMarkupSpace(out, space, dropBlank, false)
+			space = false
+			out = append(out, c)
+			i++
+		}
+	}
+
+	return out
+}
+
+// appendMarkupSpace writes pending whitespace to out. beforeTag tells whether it's followed by tag
+func appendMarkupSpace(out []byte, space, dropBlank, beforeTag bool) []byte {
+	if !space || len(out) == 0 {
+		return out
+	}
+
+	if dropBlank && (beforeTag || out[len(out)-1] == '>') {
+		return out
+	}
+
+	return append(out, ' ')
+}
+
+// appendTag writes tag starting at i to out collapsing whitespace between attributes.
+// Returns lowercase name of opening tag (empty for closing and self-closing ones)
+func appendTag(out []byte, src []byte, i int) ([]byte, int, string) {
+	start := i + 1
+	closing := src[start] == '/'
+	if closing {
+		start++
+	}
+
+	nameEnd := start
+	for nameEnd < len(src) && (isWordByte(src[nameEnd]) || src[nameEnd] == '-' || src[nameEnd] == ':') {
+		nameEnd++
+	}
+	name := string(bytes.ToLower(src[start:nameEnd]))
+
+	out = append(out, src[i:nameEnd]...)
+	space := false
+	for j := nameEnd; j < len(src); j++ {
+		c := src[j]
+		switch {
+		case isSpace(c):
+			space = true
+		case c == '"' || c == '\'':
+			if space && out[len(out)-1] != '=' {
+				out = append(out, ' ')
+			}
+			space = false
+
+			end := bytes.IndexByte(src[j+1:], c)
+			if end == -1 {
+				end = len(src) - j - 1
+			}
+			out = append(out, src[j:j+1+end]...)
+			j += end
+			if j+1 < len(src) {
+				out = append(out, c)
+				j++
+			}
+		case c == '>':
+			out = append(out, c)
+			if closing || out[len(out)-2] == '/' {
+				name = ""
+			}
+			return out, j + 1, name
+		default:
+			if space && c != '=' && out[len(out)-1] != '=' {
+				out = append(out, ' ')
+			}
+			space = false
+			out = append(out, c)
+		}
+	}
+
+	return out, len(src), ""
+}
+
+// skipString returns end of quoted string starting at i.
+// Unterminated string ends at line break
+func skipString(src []byte, i int) int {
+	quote := src[i]
+	for j := i + 1; j < len(src); j++ {
+		switch src[j] {
+		case '\\':
+			j++
+		case quote:
+			return j + 1
+		case '\n':
+			return j
+		}
+	}
+
+	return len(src)
+}
+
+func skipBlockComment(src []byte, i int) int {
+	return skipUntil(src, i+2, "*/")
+}
+
+// skipUntil returns end of first occurrence of token at or after i.
+// Everything is skipped if there's none
+func skipUntil(src []byte, i int, token string) int {
+	end := bytes.Index(src[i:], []byte(token))
+	if end == -1 {
+		return len(src)
+	}
+
+	return i + end + len(token)
+}
+
+// lineEnd returns index of line break ending line i belongs to
+func lineEnd(src []byte, i int) int {
+	end := bytes.IndexAny(src[i:], "\r\n")
+	if end == -1 {
+		return len(src)
+	}
+
+	return i + end
+}
+
+// indexFold is bytes.Index ignoring case of ASCII substr
+func indexFold(s []byte, substr string) int {
+	for i := 0; i+len(substr) <= len(s); i++ {
+		if bytes.EqualFold(s[i:i+len(substr)], []byte(substr)) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\f' || c == '\v' || c == '\n' || c == '\r'
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isWordByte tells whether c could be part of identifier, keyword or number.
+// Non ASCII bytes are taken as letters
+func isWordByte(c byte) bool {
+	return isLetter(c) || isDigit(c) || c == '_' || c == '$' || c == '\\' || c >= 0x80
+}
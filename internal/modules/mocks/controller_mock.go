@@ -5,8 +5,10 @@
 package mock_modules
 
 import (
+	entities "animakuro/cdn/internal/entities"
 	modules "animakuro/cdn/internal/modules"
 	bytes "bytes"
+	context "context"
 	url "net/url"
 	reflect "reflect"
 
@@ -36,6 +38,75 @@ func (m *MockController) EXPECT() *MockControllerMockRecorder {
 	return m.recorder
 }
 
+// Check mocks base method.
+func (m *MockController) Check(module string, buff []byte) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Check", module, buff)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Check indicates an expected call of Check.
+func (mr *MockControllerMockRecorder) Check(module, buff interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Check", reflect.TypeOf((*MockController)(nil).Check), module, buff)
+}
+
+// CheckMime mocks base method.
+func (m *MockController) CheckMime(module, mime string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CheckMime", module, mime)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CheckMime indicates an expected call of CheckMime.
+func (mr *MockControllerMockRecorder) CheckMime(module, mime interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CheckMime", reflect.TypeOf((*MockController)(nil).CheckMime), module, mime)
+}
+
+// Close mocks base method.
+func (m *MockController) Close() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Close")
+}
+
+// Close indicates an expected call of Close.
+func (mr *MockControllerMockRecorder) Close() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockController)(nil).Close))
+}
+
+// ContentType mocks base method.
+func (m *MockController) ContentType(module string, mm modules.ModuleMap) string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ContentType", module, mm)
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// ContentType indicates an expected call of ContentType.
+func (mr *MockControllerMockRecorder) ContentType(module, mm interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ContentType", reflect.TypeOf((*MockController)(nil).ContentType), module, mm)
+}
+
+// Describe mocks base method.
+func (m *MockController) Describe(module string, buff []byte) (map[string]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Describe", module, buff)
+	ret0, _ := ret[0].(map[string]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Describe indicates an expected call of Describe.
+func (mr *MockControllerMockRecorder) Describe(module, buff interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Describe", reflect.TypeOf((*MockController)(nil).Describe), module, buff)
+}
+
 // DoesModuleExist mocks base method.
 func (m *MockController) DoesModuleExist(module string) bool {
 	m.ctrl.T.Helper()
@@ -50,33 +121,107 @@ func (mr *MockControllerMockRecorder) DoesModuleExist(module interface{}) *gomoc
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DoesModuleExist", reflect.TypeOf((*MockController)(nil).DoesModuleExist), module)
 }
 
+// HasResolver mocks base method.
+func (m *MockController) HasResolver(module, resolverName string) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "HasResolver", module, resolverName)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// HasResolver indicates an expected call of HasResolver.
+func (mr *MockControllerMockRecorder) HasResolver(module, resolverName interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HasResolver", reflect.TypeOf((*MockController)(nil).HasResolver), module, resolverName)
+}
+
 // Parse mocks base method.
-func (m *MockController) Parse(q url.Values, bucketModule string) (modules.ModuleMap, error) {
+func (m *MockController) Parse(q url.Values, bucketModules []string) (string, modules.ModuleMap, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Parse", q, bucketModules)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(modules.ModuleMap)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// Parse indicates an expected call of Parse.
+func (mr *MockControllerMockRecorder) Parse(q, bucketModules interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Parse", reflect.TypeOf((*MockController)(nil).Parse), q, bucketModules)
+}
+
+// ParsePreset mocks base method.
+func (m *MockController) ParsePreset(preset entities.Preset, bucketModules []string) (string, modules.ModuleMap, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Parse", q, bucketModule)
+	ret := m.ctrl.Call(m, "ParsePreset", preset, bucketModules)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(modules.ModuleMap)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// ParsePreset indicates an expected call of ParsePreset.
+func (mr *MockControllerMockRecorder) ParsePreset(preset, bucketModules interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ParsePreset", reflect.TypeOf((*MockController)(nil).ParsePreset), preset, bucketModules)
+}
+
+// Pin mocks base method.
+func (m *MockController) Pin(ctx context.Context, module string, mm modules.ModuleMap) (modules.ModuleMap, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Pin", ctx, module, mm)
 	ret0, _ := ret[0].(modules.ModuleMap)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// Parse indicates an expected call of Parse.
-func (mr *MockControllerMockRecorder) Parse(q, bucketModule interface{}) *gomock.Call {
+// Pin indicates an expected call of Pin.
+func (mr *MockControllerMockRecorder) Pin(ctx, module, mm interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Parse", reflect.TypeOf((*MockController)(nil).Parse), q, bucketModule)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Pin", reflect.TypeOf((*MockController)(nil).Pin), ctx, module, mm)
+}
+
+// Precompressed mocks base method.
+func (m *MockController) Precompressed(module string) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Precompressed", module)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// Precompressed indicates an expected call of Precompressed.
+func (mr *MockControllerMockRecorder) Precompressed(module interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Precompressed", reflect.TypeOf((*MockController)(nil).Precompressed), module)
 }
 
 // Raw mocks base method.
-func (m *MockController) Raw(mm modules.ModuleMap, uuid string) string {
+func (m *MockController) Raw(module string, mm modules.ModuleMap, uuid string) string {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Raw", mm, uuid)
+	ret := m.ctrl.Call(m, "Raw", module, mm, uuid)
 	ret0, _ := ret[0].(string)
 	return ret0
 }
 
 // Raw indicates an expected call of Raw.
-func (mr *MockControllerMockRecorder) Raw(mm, uuid interface{}) *gomock.Call {
+func (mr *MockControllerMockRecorder) Raw(module, mm, uuid interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Raw", reflect.TypeOf((*MockController)(nil).Raw), module, mm, uuid)
+}
+
+// Select mocks base method.
+func (m *MockController) Select(bucketModules []string, mime string) string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Select", bucketModules, mime)
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// Select indicates an expected call of Select.
+func (mr *MockControllerMockRecorder) Select(bucketModules, mime interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Raw", reflect.TypeOf((*MockController)(nil).Raw), mm, uuid)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Select", reflect.TypeOf((*MockController)(nil).Select), bucketModules, mime)
 }
 
 // UseResolvers mocks base method.
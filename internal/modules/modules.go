@@ -2,11 +2,14 @@ package modules
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"net/url"
 	"strings"
+	"time"
 
 	cdn_go "animakuro/cdn"
+	"animakuro/cdn/internal/entities"
 )
 
 var (
@@ -20,11 +23,59 @@ const (
 	FalseStr = "false"
 )
 
+// FileReader reads original files stored in CDN and their meta.
+// Used by resolvers that depend on other files (e.g. image.watermark)
+type FileReader interface {
+	ReadOriginal(ctx context.Context, bucket string, uuid string) ([]byte, error)
+	GetFileDB(ctx context.Context, bucket string, uuid string) (*entities.File, error)
+}
+
 type Module struct {
 	Name                     string
 	Resolvers                map[string]ResolverFunc
 	Defaults                 Defaults
 	AllowedResolverArguments map[string][]string
+	// Resolvers having ArgumentParser accept any argument the parser
+	// could convert to a typed value instead of AllowedResolverArguments
+	ArgumentParsers map[string]ArgumentParser
+	// Order in which resolvers are applied (see controller.UseResolvers)
+	Order []string
+	// Check validates file before resolvers are applied and when it's uploaded.
+	// Nil accepts any file
+	Check func(buff []byte) error
+	// Max time resolvers of a single render may take. Zero means no limit
+	Timeout time.Duration
+	// Describe computes metadata saved along with uploaded file (e.g. placeholders).
+	// Nil map means nothing to save. Nil func describes nothing
+	Describe func(buff []byte) (map[string]string, error)
+	// Options maps resolver to resolvers parametrizing it rather than applied on their own
+	// (e.g. document.dpi of document.page). Resolver gets them as OptionsArgument.
+	// Options need a resolver to be parsed, but aren't part of Order
+	Options map[string][]string
+	// ContentType of derivative for modules whose output can't be sniffed (e.g. CSS).
+	// Empty string or nil func leaves it to sniffing
+	ContentType func(mm ModuleMap) string
+	// Precompress tells that files of module are worth storing
+	// compressed along with originals and derivatives (e.g. text)
+	Precompress bool
+	// MimeTypes of files module applies to. Type followed by slash (e.g. "image/")
+	// matches every subtype. Empty applies to any file
+	MimeTypes []string
+	// Render applies all requested resolvers at once instead of Resolvers (e.g. plugins).
+	// Resolvers of such module are nil, they're only registered to be parsed.
+	// Unlike resolvers, Render is interrupted through ctx when Timeout is exceeded
+	Render func(ctx context.Context, buff *bytes.Buffer, mm ModuleMap) error
+	// Pin fixes moduleMap to the current state of files its resolvers depend on besides the original
+	// (e.g. version of watermark overlay), so that derivatives rendered before they changed aren't served.
+	// Nil func pins nothing
+	Pin func(ctx context.Context, mm ModuleMap) (ModuleMap, error)
+}
+
+// OptionsArgument is argument of resolver having Options.
+// Options which are not requested (or default) are missing
+type OptionsArgument struct {
+	Arg     interface{}
+	Options map[string]interface{}
 }
 
 type (
@@ -34,6 +85,10 @@ type (
 
 	ResolverFunc func(buff *bytes.Buffer, arg interface{}) error
 
+	// ArgumentParser converts raw resolver argument from URL query to typed value
+	// that's passed to ResolverFunc
+	ArgumentParser func(arg string) (interface{}, error)
+
 	RegisterFunc func() *Module
 )
 
@@ -60,7 +115,27 @@ func valuesFromQueryPair(key string, values []string) (resolverName string, reso
 	return
 }
 
+// matchMime tells how exactly mime matches one of types:
+// 2 - the same type, 1 - the same top-level type, 0 - no match
+func matchMime(types []string, mime string) int {
+	mime, _, _ = strings.Cut(mime, ";")
+	mime = strings.ToLower(strings.TrimSpace(mime))
+
+	match := 0
+	for _, t := range types {
+		switch {
+		case t == mime:
+			return 2
+		case strings.HasSuffix(t, "/") && strings.HasPrefix(mime, t):
+			match = 1
+		}
+	}
+
+	return match
+}
+
 //clearQuery removes all unnecessary query keys for module parsing
 func clearQuery(q *url.Values) {
 	q.Del(cdn_go.URLAuthKey)
+	q.Del(cdn_go.URLPresetKey)
 }
@@ -1,16 +1,33 @@
 package modules
 
 import (
+	"animakuro/cdn/config"
+	"animakuro/cdn/internal/entities"
 	module_errors "animakuro/cdn/internal/modules/errors"
+	"animakuro/cdn/pkg/plugin"
+	"animakuro/cdn/pkg/pool"
+	"animakuro/cdn/pkg/poppler"
 	"go.uber.org/zap"
 
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"math"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/h2non/bimg"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
@@ -20,14 +37,14 @@ func TestModuleController(t *testing.T) {
 	t.Run("should parse ok", func(t *testing.T) {
 		t.Parallel()
 
-		controller := NewController(logger)
+		controller := NewController(logger, nil, nil)
 
 		mockQuery := fmt.Sprintf("%s.webp=true&%s.resized=false", imageModuleName, imageModuleName)
 
 		q, err := url.ParseQuery(mockQuery)
 		require.NoError(t, err)
 
-		moduleMap, err := controller.Parse(q, imageModuleName)
+		_, moduleMap, err := controller.Parse(q, []string{imageModuleName})
 		require.NoError(t, err)
 
 		// Must not be nil because query contains non false arguments
@@ -39,14 +56,14 @@ func TestModuleController(t *testing.T) {
 	t.Run("should not parse (module does not exist)", func(t *testing.T) {
 		t.Parallel()
 
-		controller := NewController(logger)
+		controller := NewController(logger, nil, nil)
 
 		mockQuery := "joe-biden.resolver=true"
 
 		q, err := url.ParseQuery(mockQuery)
 		require.NoError(t, err)
 
-		moduleMap, err := controller.Parse(q, "joe-biden")
+		_, moduleMap, err := controller.Parse(q, []string{"joe-biden"})
 		require.Error(t, err)
 		require.Nil(t, moduleMap)
 
@@ -65,10 +82,72 @@ func TestModuleController(t *testing.T) {
 
 	})
 
+	t.Run("should parse typed arguments", func(t *testing.T) {
+		t.Parallel()
+
+		controller := NewController(logger, nil, nil)
+
+		mockQuery := "image.rotate=90&image.blur=2.5&image.sharpen=3&image.background=ff00aa&image.flip=true"
+
+		q, err := url.ParseQuery(mockQuery)
+		require.NoError(t, err)
+
+		_, moduleMap, err := controller.Parse(q, []string{imageModuleName})
+		require.NoError(t, err)
+		require.Len(t, moduleMap, 5)
+		require.Equal(t, "90", moduleMap[rotate])
+		require.Equal(t, "ff00aa", moduleMap[background])
+	})
+
+	t.Run("should not parse invalid typed arguments", func(t *testing.T) {
+		t.Parallel()
+
+		controller := NewController(logger, nil, nil)
+
+		for _, mockQuery := range []string{
+			"image.rotate=45",
+			"image.blur=-1",
+			"image.blur=NaN",
+			"image.sharpen=11",
+			"image.background=red",
+			"image.resize=0x0",
+			"image.resize=200",
+			"image.resize=100000x0",
+			"image.quality=0",
+			"image.unknown=true",
+		} {
+			q, err := url.ParseQuery(mockQuery)
+			require.NoError(t, err)
+
+			_, moduleMap, err := controller.Parse(q, []string{imageModuleName})
+			require.Error(t, err, mockQuery)
+			require.Nil(t, moduleMap)
+
+			var m *module_errors.ModuleError
+			require.True(t, errors.As(err, &m))
+
+			_, code := m.ToHTTP()
+			require.Equal(t, http.StatusBadRequest, code)
+		}
+	})
+
+	t.Run("should return nil map if all arguments are default", func(t *testing.T) {
+		t.Parallel()
+
+		controller := NewController(logger, nil, nil)
+
+		q, err := url.ParseQuery("image.rotate=0&image.webp=false&image.blur=0")
+		require.NoError(t, err)
+
+		_, moduleMap, err := controller.Parse(q, []string{imageModuleName})
+		require.NoError(t, err)
+		require.Nil(t, moduleMap)
+	})
+
 	t.Run("should run concurrent operations", func(t *testing.T) {
 		t.Parallel()
 
-		c := NewController(logger)
+		c := NewController(logger, nil, nil)
 
 		N := 500
 		wg := new(sync.WaitGroup)
@@ -83,7 +162,7 @@ func TestModuleController(t *testing.T) {
 				mockQuery := "image.webp=true"
 				q, _ := url.ParseQuery(mockQuery)
 
-				moduleMap, err := c.Parse(q, imageModuleName)
+				_, moduleMap, err := c.Parse(q, []string{imageModuleName})
 				require.NoError(t, err)
 				require.NotNil(t, moduleMap)
 				defer wg.Done()
@@ -107,4 +186,1420 @@ func TestModuleController(t *testing.T) {
 		wg.Wait()
 
 	})
+
+	t.Run("should keep raw of image derivatives stored before defaults were dropped", func(t *testing.T) {
+		t.Parallel()
+
+		controller := NewController(logger, nil, nil)
+
+		// Defaults used to be a part of every image moduleMap
+		require.Equal(t, "resized=falsewebp=trueuuid", controller.Raw(imageModuleName, ModuleMap{webp: TrueStr}, "uuid"))
+		require.Equal(t, "resized=truewebp=falseuuid", controller.Raw(imageModuleName, ModuleMap{resized: TrueStr}, "uuid"))
+		require.Equal(t, "resized=falserotate=90webp=trueuuid", controller.Raw(imageModuleName, ModuleMap{webp: TrueStr, rotate: "90"}, "uuid"))
+
+		// Other moduleMaps never had them
+		require.Equal(t, "rotate=90uuid", controller.Raw(imageModuleName, ModuleMap{rotate: "90"}, "uuid"))
+		require.Equal(t, "webp=trueuuid", controller.Raw(documentModuleName, ModuleMap{webp: TrueStr}, "uuid"))
+	})
+}
+
+// mockFileReader stores file meta only, nil file is not found
+type mockFileReader struct {
+	file *entities.File
+}
+
+func (m *mockFileReader) ReadOriginal(ctx context.Context, bucket string, uuid string) ([]byte, error) {
+	return nil, nil
+}
+
+func (m *mockFileReader) GetFileDB(ctx context.Context, bucket string, uuid string) (*entities.File, error) {
+	if m.file == nil {
+		return nil, entities.ErrFileNotFound
+	}
+
+	return m.file, nil
+}
+
+func TestWatermark(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	overlayID := "0b5d1c43-3c35-4fb5-9d36-0b0a5a2b6f1e"
+
+	t.Run("should parse watermark only if bucket is configured", func(t *testing.T) {
+		t.Parallel()
+
+		q, err := url.ParseQuery(fmt.Sprintf("image.watermark=%s,position:north,opacity:0.5", overlayID))
+		require.NoError(t, err)
+
+		withWatermark := NewController(logger, &config.ModulesConfig{Image: &config.ImageConfig{WatermarkBucket: "watermarks"}}, &mockFileReader{})
+		_, moduleMap, err := withWatermark.Parse(q, []string{imageModuleName})
+		require.NoError(t, err)
+		require.Contains(t, withWatermark.Raw(imageModuleName, moduleMap, "uuid"), overlayID)
+
+		withoutWatermark := NewController(logger, nil, nil)
+		_, moduleMap, err = withoutWatermark.Parse(q, []string{imageModuleName})
+		require.Error(t, err)
+		require.Nil(t, moduleMap)
+	})
+
+	t.Run("should parse watermark argument", func(t *testing.T) {
+		t.Parallel()
+
+		arg, err := parseWatermark(overlayID)
+		require.NoError(t, err)
+		require.Equal(t, watermarkArgument{
+			uuid:     overlayID,
+			position: defaultWatermarkPosition,
+			opacity:  defaultWatermarkOpacity,
+			scale:    defaultWatermarkScale,
+			margin:   defaultWatermarkMargin,
+		}, arg)
+
+		arg, err = parseWatermark(overlayID + ",position:southwest,opacity:0.3,scale:0.5,margin:0")
+		require.NoError(t, err)
+		require.Equal(t, watermarkArgument{
+			uuid:     overlayID,
+			position: southWest,
+			opacity:  0.3,
+			scale:    0.5,
+			margin:   0,
+		}, arg)
+
+		for _, invalid := range []string{
+			"not-uuid",
+			overlayID + ",position",
+			overlayID + ",position:middle",
+			overlayID + ",opacity:0",
+			overlayID + ",opacity:NaN",
+			overlayID + ",scale:2",
+			overlayID + ",margin:-1",
+			overlayID + ",size:10",
+			overlayID + ",version:0",
+		} {
+			_, err := parseWatermark(invalid)
+			require.Error(t, err, invalid)
+		}
+	})
+
+	t.Run("should place watermark inside image", func(t *testing.T) {
+		t.Parallel()
+
+		img := bimg.ImageSize{Width: 1000, Height: 500}
+		overlay := bimg.ImageSize{Width: 400, Height: 200}
+
+		arg := watermarkArgument{position: southEast, scale: 0.2, margin: 10}
+		width, height := watermarkSize(img, overlay, arg)
+		require.Equal(t, 200, width)
+		require.Equal(t, 100, height)
+
+		left, top := watermarkOffset(img, bimg.ImageSize{Width: width, Height: height}, arg)
+		require.Equal(t, 790, left)
+		require.Equal(t, 390, top)
+
+		// Overlay is taller than image
+		arg = watermarkArgument{position: center, scale: 1, margin: 0}
+		width, height = watermarkSize(img, bimg.ImageSize{Width: 100, Height: 1000}, arg)
+		require.Equal(t, 50, width)
+		require.Equal(t, 500, height)
+
+		left, top = watermarkOffset(img, bimg.ImageSize{Width: width, Height: height}, arg)
+		require.Equal(t, 475, left)
+		require.Equal(t, 0, top)
+	})
+
+	t.Run("should pin watermark to overlay version", func(t *testing.T) {
+		t.Parallel()
+
+		cfg := &config.ModulesConfig{Image: &config.ImageConfig{WatermarkBucket: "watermarks"}}
+		mm := ModuleMap{watermark: overlayID + ",opacity:0.5,version:7", "resize": "100x0"}
+
+		// Never replaced overlay keeps names of derivatives rendered before
+		pinned, err := NewController(logger, cfg, &mockFileReader{file: &entities.File{Version: 1}}).Pin(context.Background(), imageModuleName, mm)
+		require.NoError(t, err)
+		require.Equal(t, overlayID+",opacity:0.5", pinned[watermark])
+		require.Equal(t, "100x0", pinned["resize"])
+
+		replaced := NewController(logger, cfg, &mockFileReader{file: &entities.File{Version: 3}})
+		pinned, err = replaced.Pin(context.Background(), imageModuleName, mm)
+		require.NoError(t, err)
+		require.Equal(t, overlayID+",opacity:0.5,version:3", pinned[watermark])
+		// Requested moduleMap is left as is
+		require.Equal(t, overlayID+",opacity:0.5,version:7", mm[watermark])
+
+		_, err = parseWatermark(pinned[watermark])
+		require.NoError(t, err)
+
+		// Missing overlay is reported on render
+		pinned, err = NewController(logger, cfg, &mockFileReader{}).Pin(context.Background(), imageModuleName, mm)
+		require.NoError(t, err)
+		require.Equal(t, overlayID+",opacity:0.5", pinned[watermark])
+
+		// Modules without files to pin to
+		pinned, err = replaced.Pin(context.Background(), "video", ModuleMap{"resize": "100x0"})
+		require.NoError(t, err)
+		require.Equal(t, ModuleMap{"resize": "100x0"}, pinned)
+	})
+}
+
+func TestImageLimits(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+
+	t.Run("should count frames of animated images", func(t *testing.T) {
+		t.Parallel()
+
+		palette := color.Palette{color.Black, color.White}
+		anim := &gif.GIF{}
+		for i := 0; i < 3; i++ {
+			anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 4, 4), palette))
+			anim.Delay = append(anim.Delay, 10)
+		}
+		gifBuff := new(bytes.Buffer)
+		require.NoError(t, gif.EncodeAll(gifBuff, anim))
+		require.Equal(t, 3, countFrames(gifBuff.Bytes()))
+
+		pngBuff := new(bytes.Buffer)
+		require.NoError(t, png.Encode(pngBuff, image.NewGray(image.Rect(0, 0, 4, 4))))
+		require.Equal(t, 1, countFrames(pngBuff.Bytes()))
+
+		// Signature, IHDR and acTL declaring 1000 frames
+		apng := []byte("\x89PNG\r\n\x1a\n")
+		apng = append(apng, chunk("IHDR", make([]byte, 13))...)
+		apng = append(apng, chunk("acTL", []byte{0, 0, 0x03, 0xe8, 0, 0, 0, 0})...)
+		require.Equal(t, 1000, countFrames(apng))
+
+		webpBuff := []byte("RIFF\x00\x00\x00\x00WEBP")
+		webpBuff = append(webpBuff, riffChunk("VP8X", make([]byte, 10))...)
+		webpBuff = append(webpBuff, riffChunk("ANIM", make([]byte, 6))...)
+		webpBuff = append(webpBuff, riffChunk("ANMF", make([]byte, 17))...)
+		webpBuff = append(webpBuff, riffChunk("ANMF", make([]byte, 17))...)
+		require.Equal(t, 2, countFrames(webpBuff))
+
+		require.Equal(t, 1, countFrames([]byte("hello world!")))
+		// Truncated files never panic
+		require.LessOrEqual(t, countFrames(gifBuff.Bytes()[:20]), 1)
+	})
+
+	t.Run("should calculate resized output", func(t *testing.T) {
+		t.Parallel()
+
+		size := bimg.ImageSize{Width: 1000, Height: 500}
+		w, h := resizeOutput(size, resizeArgument{width: 200})
+		require.Equal(t, 200, w)
+		require.Equal(t, 100, h)
+
+		w, h = resizeOutput(size, resizeArgument{height: 5000})
+		require.Equal(t, 10000, w)
+		require.Equal(t, 5000, h)
+	})
+
+	t.Run("should use config limits", func(t *testing.T) {
+		t.Parallel()
+
+		l := newImageLimits(nil)
+		require.Equal(t, config.DefaultMaxInputPixels, l.maxInputPixels)
+		require.Equal(t, config.DefaultImageRenderTimeout, l.renderTimeout)
+
+		l = newImageLimits(&config.ImageConfig{MaxFrames: 10, RenderTimeout: time.Second})
+		require.Equal(t, 10, l.maxFrames)
+		require.Equal(t, config.DefaultMaxOutputDimension, l.maxOutputDimension)
+		require.Equal(t, time.Second, l.renderTimeout)
+	})
+
+	t.Run("should abandon render exceeding timeout", func(t *testing.T) {
+		t.Parallel()
+
+		c := NewController(logger, nil, nil).(*controller)
+		c.registerModule(&Module{
+			Name: "slow",
+			Resolvers: map[string]ResolverFunc{
+				"sleep": func(buff *bytes.Buffer, arg interface{}) error {
+					time.Sleep(time.Millisecond * 200)
+					buff.Reset()
+					return nil
+				},
+			},
+			Order:   []string{"sleep"},
+			Timeout: time.Millisecond * 20,
+		})
+
+		buff := bytes.NewBufferString("hello world!")
+		err := c.UseResolvers(buff, "slow", ModuleMap{"sleep": TrueStr})
+
+		var m *module_errors.ModuleError
+		require.True(t, errors.As(err, &m))
+		_, code := m.ToHTTP()
+		require.Equal(t, http.StatusUnprocessableEntity, code)
+		// Abandoned render doesn't touch buff
+		require.Equal(t, "hello world!", buff.String())
+
+		// Pool worker is held until abandoned render returns
+		var l *pool.Lingering
+		require.True(t, errors.As(err, &l))
+		select {
+		case <-l.Done:
+			t.Fatal("abandoned render is reported done before it returns")
+		default:
+		}
+		<-l.Done
+	})
+
+	t.Run("should stop abandoned render before the next resolver", func(t *testing.T) {
+		t.Parallel()
+
+		c := NewController(logger, nil, nil).(*controller)
+		next := make(chan struct{}, 1)
+		c.registerModule(&Module{
+			Name: "slow",
+			Resolvers: map[string]ResolverFunc{
+				"sleep": func(buff *bytes.Buffer, arg interface{}) error {
+					time.Sleep(time.Millisecond * 100)
+					return nil
+				},
+				"next": func(buff *bytes.Buffer, arg interface{}) error {
+					next <- struct{}{}
+					return nil
+				},
+			},
+			Order:   []string{"sleep", "next"},
+			Timeout: time.Millisecond * 20,
+		})
+
+		err := c.UseResolvers(bytes.NewBufferString("hello world!"), "slow", ModuleMap{"sleep": TrueStr, "next": TrueStr})
+		require.Error(t, err)
+
+		select {
+		case <-next:
+			t.Fatal("abandoned render kept running")
+		case <-time.After(time.Millisecond * 200):
+		}
+	})
+
+	t.Run("should check file before resolvers", func(t *testing.T) {
+		t.Parallel()
+
+		c := NewController(logger, nil, nil).(*controller)
+		var called bool
+		c.registerModule(&Module{
+			Name: "checked",
+			Resolvers: map[string]ResolverFunc{
+				"noop": func(buff *bytes.Buffer, arg interface{}) error {
+					called = true
+					return nil
+				},
+			},
+			Order: []string{"noop"},
+			Check: func(buff []byte) error {
+				return module_errors.NewHttp(http.StatusRequestEntityTooLarge, module_errors.TooManyFrames, 10, 1)
+			},
+		})
+
+		err := c.UseResolvers(bytes.NewBufferString("hello world!"), "checked", ModuleMap{"noop": TrueStr})
+		require.Error(t, err)
+		require.False(t, called)
+		require.Error(t, c.Check("checked", nil))
+	})
+}
+
+// chunk builds PNG chunk (crc isn't checked)
+func chunk(typ string, data []byte) []byte {
+	out := make([]byte, 4, 12+len(data))
+	binary.BigEndian.PutUint32(out, uint32(len(data)))
+	out = append(out, typ...)
+	out = append(out, data...)
+	return append(out, 0, 0, 0, 0)
+}
+
+func riffChunk(fourcc string, data []byte) []byte {
+	out := make([]byte, 8, 8+len(data)+1)
+	copy(out, fourcc)
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(data)))
+	out = append(out, data...)
+	if len(data)%2 == 1 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+func TestStrip(t *testing.T) {
+	t.Run("should parse strip argument", func(t *testing.T) {
+		t.Parallel()
+
+		arg, err := parseStrip(TrueStr)
+		require.NoError(t, err)
+		require.Equal(t, stripArgument{}, arg)
+
+		arg, err = parseStrip("icc,orientation")
+		require.NoError(t, err)
+		require.Equal(t, stripArgument{keepOrientation: true, keepICC: true}, arg)
+
+		arg, err = parseStrip(FalseStr)
+		require.NoError(t, err)
+		require.Nil(t, arg)
+
+		_, err = parseStrip("gps")
+		require.ErrorIs(t, err, ErrInvalidStrip)
+	})
+
+	t.Run("should strip jpeg", func(t *testing.T) {
+		t.Parallel()
+
+		jfif := jpegSegment(0xE0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00"))
+		exif := jpegSegment(0xE1, append([]byte("Exif\x00\x00"), orientationTIFF(6)...))
+		xmp := jpegSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00<gps/>"))
+		icc := jpegSegment(0xE2, []byte("ICC_PROFILE\x00\x01\x01profile"))
+		com := jpegSegment(0xFE, []byte("comment"))
+		dqt := jpegSegment(0xDB, make([]byte, 65))
+		sos := jpegSegment(0xDA, make([]byte, 10))
+		scan := []byte{0x01, 0x02, 0xFF, 0x00, 0x03, 0xFF, 0xD9}
+
+		img := concat([]byte{0xFF, 0xD8}, jfif, exif, xmp, icc, com, dqt, sos, scan)
+
+		out, err := stripJPEG(img, stripArgument{})
+		require.NoError(t, err)
+		require.Equal(t, concat([]byte{0xFF, 0xD8}, jfif, dqt, sos, scan), out)
+
+		out, err = stripJPEG(img, stripArgument{keepOrientation: true, keepICC: true})
+		require.NoError(t, err)
+		require.Equal(t, concat([]byte{0xFF, 0xD8}, jfif, exif, icc, dqt, sos, scan), out)
+		require.Equal(t, 6, jpegOrientation(out[2:]))
+
+		_, err = stripJPEG(img[:30], stripArgument{})
+		require.ErrorIs(t, err, ErrCorruptImage)
+	})
+
+	t.Run("should strip png", func(t *testing.T) {
+		t.Parallel()
+
+		buff := new(bytes.Buffer)
+		require.NoError(t, png.Encode(buff, image.NewGray(image.Rect(0, 0, 4, 4))))
+		plain := buff.Bytes()
+
+		// Insert metadata right after IHDR (signature 8 + IHDR 25)
+		meta := new(bytes.Buffer)
+		writePNGChunk(meta, "tEXt", []byte("GPS\x0055.75,37.61"))
+		writePNGChunk(meta, "eXIf", orientationTIFF(3))
+		img := concat(plain[:33], meta.Bytes(), plain[33:])
+
+		out, err := stripPNG(img, stripArgument{})
+		require.NoError(t, err)
+		require.Equal(t, plain, out)
+
+		out, err = stripPNG(img, stripArgument{keepOrientation: true})
+		require.NoError(t, err)
+		require.Equal(t, 3, pngOrientation(out))
+		require.NotContains(t, string(out), "GPS")
+
+		_, err = png.Decode(bytes.NewReader(out))
+		require.NoError(t, err)
+	})
+
+	t.Run("should strip webp", func(t *testing.T) {
+		t.Parallel()
+
+		vp8x := riffChunk("VP8X", []byte{webpICCFlag | webpEXIFFlag | webpXMPFlag, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+		img := concat(
+			[]byte("RIFF\x00\x00\x00\x00WEBP"),
+			vp8x,
+			riffChunk("ICCP", []byte("profile")),
+			riffChunk("VP8L", make([]byte, 5)),
+			riffChunk("EXIF", orientationTIFF(8)),
+			riffChunk("XMP ", []byte("<gps/>")),
+		)
+
+		out, err := stripWebP(img, stripArgument{})
+		require.NoError(t, err)
+		require.True(t, isWebP(out))
+		require.Equal(t, byte(0), out[20])
+		require.Equal(t, uint32(len(out)-8), binary.LittleEndian.Uint32(out[4:8]))
+		require.NotContains(t, string(out), "gps")
+		require.NotContains(t, string(out), "profile")
+
+		out, err = stripWebP(img, stripArgument{keepOrientation: true, keepICC: true})
+		require.NoError(t, err)
+		require.Equal(t, byte(webpICCFlag|webpEXIFFlag), out[20])
+		require.Contains(t, string(out), "profile")
+		require.NotContains(t, string(out), "gps")
+	})
+}
+
+func jpegSegment(marker byte, data []byte) []byte {
+	out := new(bytes.Buffer)
+	writeJPEGSegment(out, marker, data)
+	return out.Bytes()
+}
+
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, part := range parts {
+		out = append(out, part...)
+	}
+	return out
+}
+
+func TestPlaceholder(t *testing.T) {
+	t.Run("should parse placeholder argument", func(t *testing.T) {
+		t.Parallel()
+
+		arg, err := parsePlaceholder(TrueStr)
+		require.NoError(t, err)
+		require.Equal(t, defaultPlaceholderWidth, arg)
+
+		arg, err = parsePlaceholder("16")
+		require.NoError(t, err)
+		require.Equal(t, 16, arg)
+
+		for _, invalid := range []string{"4", "65", "big"} {
+			_, err := parsePlaceholder(invalid)
+			require.ErrorIs(t, err, ErrInvalidPlaceholder, invalid)
+		}
+	})
+
+	t.Run("should not describe file that is not an image", func(t *testing.T) {
+		t.Parallel()
+
+		c := NewController(zap.NewNop().Sugar(), nil, nil)
+		meta, err := c.Describe(imageModuleName, []byte("hello world!"))
+		require.NoError(t, err)
+		require.Nil(t, meta)
+	})
+}
+
+// fakeFFmpeg writes script that outputs its own arguments instead of converting
+func fakeFFmpeg(t *testing.T) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "ffmpeg")
+	script := "#!/bin/sh\nfor last; do :; done\necho \"$@\" > \"$last\"\n"
+	require.NoError(t, os.WriteFile(path, []byte(script), 0755))
+
+	return path
+}
+
+func TestAnimation(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+
+	palette := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{}
+	for i := 0; i < 3; i++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 4, 4), palette))
+		anim.Delay = append(anim.Delay, 10)
+	}
+	gifBuff := new(bytes.Buffer)
+	require.NoError(t, gif.EncodeAll(gifBuff, anim))
+
+	render := func(t *testing.T, c Controller, query string, input []byte) (string, error) {
+		q, err := url.ParseQuery(query)
+		require.NoError(t, err)
+
+		_, mm, err := c.Parse(q, []string{imageModuleName})
+		if err != nil {
+			return "", err
+		}
+
+		buff := bytes.NewBuffer(append([]byte(nil), input...))
+		err = c.UseResolvers(buff, imageModuleName, mm)
+		return buff.String(), err
+	}
+
+	t.Run("should not register ffmpeg resolvers without ffmpeg", func(t *testing.T) {
+		t.Parallel()
+
+		cfg := &config.ModulesConfig{FFmpeg: &config.FFmpegConfig{Path: filepath.Join(t.TempDir(), "nope")}}
+		c := NewController(logger, cfg, nil)
+
+		_, err := render(t, c, "image.video=mp4", gifBuff.Bytes())
+		require.Error(t, err)
+		_, code := err.(*module_errors.ModuleError).ToHTTP()
+		require.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("should convert animated image with ffmpeg", func(t *testing.T) {
+		t.Parallel()
+
+		cfg := &config.ModulesConfig{
+			Image:  &config.ImageConfig{MaxFrames: 100},
+			FFmpeg: &config.FFmpegConfig{Path: fakeFFmpeg(t)},
+		}
+		c := NewController(logger, cfg, nil)
+
+		out, err := render(t, c, "image.video=mp4", gifBuff.Bytes())
+		require.NoError(t, err)
+		require.Contains(t, out, "-frames:v 100")
+		require.Contains(t, out, "libx264")
+		require.Contains(t, out, "out.mp4")
+
+		out, err = render(t, c, "image.video=webm", gifBuff.Bytes())
+		require.NoError(t, err)
+		require.Contains(t, out, "libvpx-vp9")
+
+		out, err = render(t, c, "image.webp=true", gifBuff.Bytes())
+		require.NoError(t, err)
+		require.Contains(t, out, "libwebp_anim")
+		require.Contains(t, out, "-loop 0")
+
+		out, err = render(t, c, "image.frame=2", gifBuff.Bytes())
+		require.NoError(t, err)
+		require.Contains(t, out, "select=eq(n\\,2)")
+		require.Contains(t, out, "out.png")
+	})
+
+	t.Run("should reject frames out of range and still images", func(t *testing.T) {
+		t.Parallel()
+
+		cfg := &config.ModulesConfig{FFmpeg: &config.FFmpegConfig{Path: fakeFFmpeg(t)}}
+		c := NewController(logger, cfg, nil)
+
+		_, err := render(t, c, "image.frame=3", gifBuff.Bytes())
+		require.Error(t, err)
+		_, code := err.(*module_errors.ModuleError).ToHTTP()
+		require.Equal(t, http.StatusBadRequest, code)
+
+		_, err = render(t, c, "image.frame=-1", gifBuff.Bytes())
+		require.Error(t, err)
+
+		pngBuff := new(bytes.Buffer)
+		require.NoError(t, png.Encode(pngBuff, image.NewGray(image.Rect(0, 0, 4, 4))))
+
+		_, err = render(t, c, "image.video=mp4", pngBuff.Bytes())
+		require.Error(t, err)
+		msg, code := err.(*module_errors.ModuleError).ToHTTP()
+		require.Equal(t, http.StatusBadRequest, code)
+		require.Contains(t, msg, "requires animated")
+
+		// First frame of still image is the image itself
+		out, err := render(t, c, "image.frame=0", pngBuff.Bytes())
+		require.NoError(t, err)
+		require.Equal(t, pngBuff.String(), out)
+	})
+}
+
+func TestVideo(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+
+	// Bare ftyp box is enough to be sniffed as mp4
+	mp4 := []byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom")
+
+	render := func(t *testing.T, c Controller, query string, input []byte) (string, error) {
+		q, err := url.ParseQuery(query)
+		require.NoError(t, err)
+
+		_, mm, err := c.Parse(q, []string{videoModuleName})
+		if err != nil {
+			return "", err
+		}
+
+		buff := bytes.NewBuffer(append([]byte(nil), input...))
+		err = c.UseResolvers(buff, videoModuleName, mm)
+		return buff.String(), err
+	}
+
+	t.Run("should parse timestamps", func(t *testing.T) {
+		t.Parallel()
+
+		for arg, expected := range map[string]time.Duration{
+			"12.5":       time.Millisecond * 12500,
+			"0":          0,
+			"01:02.5":    time.Millisecond * 62500,
+			"1:00:00":    time.Hour,
+			"90":         time.Second * 90,
+			"0:59:59.25": time.Minute*59 + time.Millisecond*59250,
+		} {
+			ts, err := parseTimestamp(arg)
+			require.NoError(t, err, arg)
+			require.Equal(t, expected, ts, arg)
+		}
+
+		for _, invalid := range []string{"", "-1", "1e3", "inf", "1:60", "1.5:00", "1:2:3:4", "ab"} {
+			_, err := parseTimestamp(invalid)
+			require.ErrorIs(t, err, ErrInvalidTimestamp, invalid)
+		}
+
+		arg, err := parseTrim("10-01:00")
+		require.NoError(t, err)
+		require.Equal(t, trimArgument{start: time.Second * 10, end: time.Minute}, arg)
+
+		for _, invalid := range []string{"10", "10-5", "5-5", "a-b", "1-2-3"} {
+			_, err := parseTrim(invalid)
+			require.ErrorIs(t, err, ErrInvalidTrim, invalid)
+		}
+	})
+
+	t.Run("should not register video module without ffmpeg", func(t *testing.T) {
+		t.Parallel()
+
+		cfg := &config.ModulesConfig{FFmpeg: &config.FFmpegConfig{Path: filepath.Join(t.TempDir(), "nope")}}
+		c := NewController(logger, cfg, nil)
+		require.False(t, c.DoesModuleExist(videoModuleName))
+	})
+
+	t.Run("should process video with ffmpeg", func(t *testing.T) {
+		t.Parallel()
+
+		cfg := &config.ModulesConfig{FFmpeg: &config.FFmpegConfig{Path: fakeFFmpeg(t)}}
+		c := NewController(logger, cfg, nil)
+		require.True(t, c.DoesModuleExist(videoModuleName))
+
+		out, err := render(t, c, "video.poster=01:30", mp4)
+		require.NoError(t, err)
+		require.Contains(t, out, "-ss 90.000 -i")
+		require.Contains(t, out, "-frames:v 1")
+		require.Contains(t, out, "out.jpg")
+
+		out, err = render(t, c, "video.trim=10-25", mp4)
+		require.NoError(t, err)
+		require.Contains(t, out, "-ss 10.000 -i")
+		require.Contains(t, out, "-t 15.000")
+		require.Contains(t, out, "out.mp4")
+
+		out, err = render(t, c, "video.scale=720", mp4)
+		require.NoError(t, err)
+		require.Contains(t, out, "scale=-2:min(720\\,trunc(ih/2)*2)")
+		require.Contains(t, out, "libx264")
+
+		out, err = render(t, c, "video.format=webm", mp4)
+		require.NoError(t, err)
+		require.Contains(t, out, "libvpx-vp9")
+		require.Contains(t, out, "out.webm")
+
+		_, err = render(t, c, "video.scale=4320", mp4)
+		require.Error(t, err)
+		_, err = render(t, c, "video.poster=soon", mp4)
+		require.Error(t, err)
+
+		// Playlists could make ffmpeg read local files
+		_, err = render(t, c, "video.format=mp4", []byte("#EXTM3U\n#EXTINF:10,\nfile:///etc/passwd\n"))
+		require.Error(t, err)
+		_, code := err.(*module_errors.ModuleError).ToHTTP()
+		require.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("should reject video resolvers on still images", func(t *testing.T) {
+		t.Parallel()
+
+		cfg := &config.ModulesConfig{FFmpeg: &config.FFmpegConfig{Path: fakeFFmpeg(t)}}
+		c := NewController(logger, cfg, nil)
+
+		pngBuff := new(bytes.Buffer)
+		require.NoError(t, png.Encode(pngBuff, image.NewGray(image.Rect(0, 0, 4, 4))))
+
+		_, err := render(t, c, "video.format=mp4", pngBuff.Bytes())
+		require.Error(t, err)
+		msg, code := err.(*module_errors.ModuleError).ToHTTP()
+		require.Equal(t, http.StatusBadRequest, code)
+		require.Contains(t, msg, "requires video")
+	})
+}
+
+func TestAudio(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+
+	mp3 := append([]byte("ID3\x04\x00\x00\x00\x00\x00\x00"), make([]byte, 32)...)
+	flac := append([]byte("fLaC\x00\x00\x00\x22"), make([]byte, 32)...)
+	// Codec identification follows 28 bytes of Ogg page header
+	ogg := func(codec string) []byte {
+		page := append([]byte("OggS\x00\x02"), make([]byte, 22)...)
+		return append(append(page, codec...), make([]byte, 16)...)
+	}
+	opus := ogg("OpusHead")
+
+	render := func(t *testing.T, c Controller, query string, input []byte) (string, error) {
+		q, err := url.ParseQuery(query)
+		require.NoError(t, err)
+
+		_, mm, err := c.Parse(q, []string{audioModuleName})
+		if err != nil {
+			return "", err
+		}
+
+		buff := bytes.NewBuffer(append([]byte(nil), input...))
+		err = c.UseResolvers(buff, audioModuleName, mm)
+		return buff.String(), err
+	}
+
+	t.Run("should parse bitrate", func(t *testing.T) {
+		t.Parallel()
+
+		arg, err := parseBitrate("128")
+		require.NoError(t, err)
+		require.Equal(t, 128, arg)
+
+		for _, invalid := range []string{"100", "0", "high", "1000"} {
+			_, err := parseBitrate(invalid)
+			require.ErrorIs(t, err, ErrInvalidBitrate, invalid)
+		}
+	})
+
+	t.Run("should tell audio codecs", func(t *testing.T) {
+		t.Parallel()
+
+		format, ext := audioCodec(mp3)
+		require.Equal(t, formatMP3, format)
+		require.Equal(t, ".mp3", ext)
+
+		format, ext = audioCodec(opus)
+		require.Equal(t, formatOpus, format)
+		require.Equal(t, ".opus", ext)
+
+		format, ext = audioCodec(ogg("\x01vorbis"))
+		require.Equal(t, formatOgg, format)
+		require.Equal(t, ".ogg", ext)
+
+		format, ext = audioCodec(flac)
+		require.Empty(t, format)
+		require.Equal(t, ".flac", ext)
+
+		// FLAC in Ogg is lossless as well
+		format, _ = audioCodec(ogg("\x7fFLAC"))
+		require.Empty(t, format)
+	})
+
+	t.Run("should process audio with ffmpeg", func(t *testing.T) {
+		t.Parallel()
+
+		cfg := &config.ModulesConfig{FFmpeg: &config.FFmpegConfig{Path: fakeFFmpeg(t)}}
+		c := NewController(logger, cfg, nil)
+		require.True(t, c.DoesModuleExist(audioModuleName))
+
+		out, err := render(t, c, "audio.format=opus", flac)
+		require.NoError(t, err)
+		require.Contains(t, out, "libopus -b:a 256k")
+		require.Contains(t, out, "out.opus")
+
+		out, err = render(t, c, "audio.bitrate=128", mp3)
+		require.NoError(t, err)
+		require.Contains(t, out, "libmp3lame -b:a 128k")
+		require.Contains(t, out, "out.mp3")
+
+		out, err = render(t, c, "audio.trim=0-30", flac)
+		require.NoError(t, err)
+		require.Contains(t, out, "-t 30.000")
+		require.Contains(t, out, "-c copy")
+		require.Contains(t, out, "out.flac")
+
+		// Fake ffmpeg outputs its arguments instead of PCM, which is still some waveform
+		out, err = render(t, c, "audio.waveform=json", flac)
+		require.NoError(t, err)
+		var data waveformData
+		require.NoError(t, json.Unmarshal([]byte(out), &data))
+		require.NotEmpty(t, data.Peaks)
+	})
+
+	t.Run("should reject bitrate of lossless audio", func(t *testing.T) {
+		t.Parallel()
+
+		cfg := &config.ModulesConfig{FFmpeg: &config.FFmpegConfig{Path: fakeFFmpeg(t)}}
+		c := NewController(logger, cfg, nil)
+
+		_, err := render(t, c, "audio.bitrate=128", flac)
+		require.Error(t, err)
+		_, code := err.(*module_errors.ModuleError).ToHTTP()
+		require.Equal(t, http.StatusBadRequest, code)
+
+		_, err = render(t, c, "audio.format=flac", flac)
+		require.Error(t, err)
+	})
+
+	t.Run("should compute waveform", func(t *testing.T) {
+		t.Parallel()
+
+		// 2 seconds: silence followed by full scale
+		pcm := make([]byte, waveformSampleRate*2*2)
+		for i := len(pcm) / 2; i < len(pcm); i += 2 {
+			binary.LittleEndian.PutUint16(pcm[i:], uint16(math.MaxInt16))
+		}
+
+		data := newWaveform(pcm)
+		require.Equal(t, 2.0, data.Duration)
+		require.Len(t, data.Peaks, waveformPoints)
+		require.Equal(t, 0.0, data.Peaks[0])
+		require.Equal(t, 1.0, data.Peaks[waveformPoints-1])
+
+		out, err := data.png()
+		require.NoError(t, err)
+		img, err := png.Decode(bytes.NewReader(out))
+		require.NoError(t, err)
+		require.Equal(t, image.Rect(0, 0, waveformPoints, waveformHeight), img.Bounds())
+
+		// Silence is transparent, full scale fills the column
+		_, _, _, alpha := img.At(0, waveformHeight/2).RGBA()
+		require.Zero(t, alpha)
+		_, _, _, alpha = img.At(waveformPoints-1, 0).RGBA()
+		require.NotZero(t, alpha)
+
+		require.Empty(t, newWaveform(nil).Peaks)
+	})
+}
+
+// fakePoppler writes scripts of pdftoppm outputting its own arguments
+// and of pdfinfo reporting 3 pages of letter size
+func fakePoppler(t *testing.T) *config.DocumentConfig {
+	t.Helper()
+
+	dir := t.TempDir()
+	pdftoppm := filepath.Join(dir, "pdftoppm")
+	pdfinfo := filepath.Join(dir, "pdfinfo")
+	require.NoError(t, os.WriteFile(pdftoppm, []byte("#!/bin/sh\nfor last; do :; done\necho \"$@\" > \"$last.png\"\n"), 0755))
+	require.NoError(t, os.WriteFile(pdfinfo, []byte("#!/bin/sh\nprintf 'Title: chapter\\nPages:          3\\n'\n"+
+		"if [ \"$1\" = -f ] && [ \"$2\" -le 3 ]; then printf 'Page %4d size: 612 x 792 pts (letter)\\n' \"$2\"; fi\n"), 0755))
+
+	return &config.DocumentConfig{PdftoppmPath: pdftoppm, PdfinfoPath: pdfinfo}
+}
+
+func TestDocument(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	pdf := []byte("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+
+	render := func(t *testing.T, c Controller, query string, input []byte) (string, error) {
+		q, err := url.ParseQuery(query)
+		require.NoError(t, err)
+
+		_, mm, err := c.Parse(q, []string{documentModuleName})
+		if err != nil {
+			return "", err
+		}
+
+		buff := bytes.NewBuffer(append([]byte(nil), input...))
+		err = c.UseResolvers(buff, documentModuleName, mm)
+		return buff.String(), err
+	}
+
+	t.Run("should parse arguments", func(t *testing.T) {
+		t.Parallel()
+
+		arg, err := parsePage("3")
+		require.NoError(t, err)
+		require.Equal(t, 3, arg)
+
+		arg, err = parseThumbnail(TrueStr)
+		require.NoError(t, err)
+		require.Equal(t, defaultThumbnailWidth, arg)
+
+		arg, err = parseThumbnail(FalseStr)
+		require.NoError(t, err)
+		require.Nil(t, arg)
+
+		for _, invalid := range []string{"0", "-1", "first"} {
+			_, err := parsePage(invalid)
+			require.ErrorIs(t, err, ErrInvalidPage, invalid)
+		}
+
+		for _, invalid := range []string{"35", "601", "high"} {
+			_, err := parseDPI(invalid)
+			require.ErrorIs(t, err, ErrInvalidDPI, invalid)
+		}
+
+		for _, invalid := range []string{"16", "2048", "small"} {
+			_, err := parseThumbnail(invalid)
+			require.ErrorIs(t, err, ErrInvalidThumbnail, invalid)
+		}
+	})
+
+	t.Run("should not register document module without poppler", func(t *testing.T) {
+		t.Parallel()
+
+		cfg := &config.ModulesConfig{Document: &config.DocumentConfig{PdftoppmPath: filepath.Join(t.TempDir(), "nope")}}
+		require.False(t, NewController(logger, cfg, nil).DoesModuleExist(documentModuleName))
+		require.False(t, NewController(logger, nil, nil).DoesModuleExist(documentModuleName))
+	})
+
+	t.Run("should render pages", func(t *testing.T) {
+		t.Parallel()
+
+		c := NewController(logger, &config.ModulesConfig{Document: fakePoppler(t)}, nil)
+		require.True(t, c.DoesModuleExist(documentModuleName))
+
+		out, err := render(t, c, "document.page=3&document.dpi=300", pdf)
+		require.NoError(t, err)
+		require.Contains(t, out, "-f 3 -l 3 -png -singlefile -r 300 ")
+
+		out, err = render(t, c, "document.page=2", pdf)
+		require.NoError(t, err)
+		require.Contains(t, out, "-r 150 ")
+
+		// Default thumbnail is the original file
+		_, mm, err := c.Parse(url.Values{"document.thumbnail": {FalseStr}}, []string{documentModuleName})
+		require.NoError(t, err)
+		require.Nil(t, mm)
+
+		out, err = render(t, c, "document.thumbnail=true", pdf)
+		require.NoError(t, err)
+		require.Contains(t, out, "-f 1 -l 1 -png -singlefile -scale-to-x 256 ")
+
+		_, err = render(t, c, "document.page=4", pdf)
+		require.Error(t, err)
+		msg, code := err.(*module_errors.ModuleError).ToHTTP()
+		require.Equal(t, http.StatusBadRequest, code)
+		require.Contains(t, msg, "document has 3 pages")
+
+		_, err = render(t, c, "document.page=1", []byte("hello world!"))
+		require.Error(t, err)
+
+		// Letter page at 600 dpi is 5100x6600
+		limited := NewController(logger, &config.ModulesConfig{Document: fakePoppler(t), Image: &config.ImageConfig{MaxInputPixels: 10_000_000}}, nil)
+		_, err = render(t, limited, "document.page=1&document.dpi=600", pdf)
+		require.Error(t, err)
+		msg, code = err.(*module_errors.ModuleError).ToHTTP()
+		require.Equal(t, http.StatusRequestEntityTooLarge, code)
+		require.Contains(t, msg, "page of 5100x6600 exceeds limit")
+
+		_, err = render(t, limited, "document.page=1&document.dpi=300", pdf)
+		require.NoError(t, err)
+
+		// Image resolvers are chained
+		_, err = render(t, c, "document.page=1&document.blur=abc", pdf)
+		require.Error(t, err)
+		_, mm, err = c.Parse(url.Values{"document.page": {"1"}, "document.resize": {"200x0"}}, []string{documentModuleName})
+		require.NoError(t, err)
+		require.Equal(t, ModuleMap{"page": "1", "resize": "200x0"}, mm)
+	})
+
+	t.Run("should rasterize first page for image resolvers", func(t *testing.T) {
+		t.Parallel()
+
+		p, err := poppler.New(fakePoppler(t).PdftoppmPath, fakePoppler(t).PdfinfoPath)
+		require.NoError(t, err)
+		d := &documentResolvers{poppler: p, timeout: time.Second, maxPixels: newImageLimits(nil).maxInputPixels}
+
+		var got string
+		resolver := d.rasterized(func(buff *bytes.Buffer, arg interface{}) error {
+			got = buff.String()
+			return nil
+		})
+
+		require.NoError(t, resolver(bytes.NewBuffer(pdf), nil))
+		require.Contains(t, got, "-f 1 -l 1 -png -singlefile -r 150 ")
+
+		// Page is already rendered
+		require.NoError(t, resolver(bytes.NewBufferString("png"), nil))
+		require.Equal(t, "png", got)
+	})
+
+	t.Run("should describe page count", func(t *testing.T) {
+		t.Parallel()
+
+		c := NewController(logger, &config.ModulesConfig{Document: fakePoppler(t)}, nil)
+
+		meta, err := c.Describe(documentModuleName, pdf)
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{MetaPages: "3"}, meta)
+
+		meta, err = c.Describe(documentModuleName, []byte("hello world!"))
+		require.NoError(t, err)
+		require.Nil(t, meta)
+	})
+}
+
+func TestText(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	c := NewController(logger, nil, nil)
+
+	minified := func(t *testing.T, lang string, input string) (string, error) {
+		q := url.Values{"text.minify": {lang}}
+		_, mm, err := c.Parse(q, []string{textModuleName})
+		require.NoError(t, err)
+
+		buff := bytes.NewBufferString(input)
+		err = c.UseResolvers(buff, textModuleName, mm)
+		return buff.String(), err
+	}
+
+	t.Run("should minify css", func(t *testing.T) {
+		t.Parallel()
+
+		cases := map[string]string{
+			"body {\n  margin: 0;\n  padding: 0 ;\n}\n":            "body{margin:0;padding:0}",
+			"/* header */\n.a > .b,\n.c .d { color: red; }":        ".a>.b,.c .d{color:red}",
+			"a :hover { }\na:hover{}":                              "a :hover{}a:hover{}",
+			`.q::before { content: "a  /* b */  c"; }`:             `.q::before{content:"a  /* b */  c"}`,
+			".w { width: calc(100% - 2px); }":                      ".w{width:calc(100% - 2px)}",
+			"@media screen and (max-width: 600px) { .m { x: y } }": "@media screen and (max-width:600px){.m{x:y}}",
+			".i { background: url( http://cdn.com/a//b.png ) }":    ".i{background:url(http://cdn.com/a//b.png)}",
+			"/*! license */\n.l { }":                               "/*! license */ .l{}",
+		}
+
+		for input, expected := range cases {
+			out, err := minified(t, langCSS, input)
+			require.NoError(t, err)
+			require.Equal(t, expected, out, input)
+		}
+	})
+
+	t.Run("should minify js", func(t *testing.T) {
+		t.Parallel()
+
+		cases := map[string]string{
+			"// comment\nfunction add(a, b) {\n  return a + b; /* sum */\n}\n": "function add(a,b){return a+b;}",
+			"let a = 1\nlet b = a - -1\nlet c = a + ++b":                       "let a=1\nlet b=a- -1\nlet c=a+ ++b",
+			"const s = 'don\\'t  // touch';":                                   "const s='don\\'t  // touch';",
+			"const r = x.replace(/\\/\\/ [a/]+/g, '');":                        "const r=x.replace(/\\/\\/ [a/]+/g,'');",
+			"return /a  b/.test(s)":                                            "return/a  b/.test(s)",
+			"const half = total / 2 / count":                                   "const half=total/2/count",
+			"const t = `a  ${ f({ b: 1 }) }  // c`":                            "const t=`a  ${ f({ b: 1 }) }  // c`",
+			"x = 1 .toFixed(2)":                                                "x=1 .toFixed(2)",
+			"#!/usr/bin/env node\nrun()":                                       "#!/usr/bin/env node\nrun()",
+		}
+
+		for input, expected := range cases {
+			out, err := minified(t, langJS, input)
+			require.NoError(t, err)
+			require.Equal(t, expected, out, input)
+		}
+	})
+
+	t.Run("should minify html", func(t *testing.T) {
+		t.Parallel()
+
+		input := "<!DOCTYPE html>\n<html>\n  <!-- nav -->\n  <body   class=\"a  b\"\n id = 'x'>\n    <p>Hello,\n      world</p>\n" +
+			"    <pre>  keep\n  this </pre>\n    <!--[if IE]>ie<![endif]-->\n  </body>\n</html>\n"
+		expected := "<!DOCTYPE html> <html> <body class=\"a  b\" id='x'> <p>Hello, world</p> " +
+			"<pre>  keep\n  this </pre> <!--[if IE]>ie<![endif]--> </body> </html>"
+
+		out, err := minified(t, langHTML, input)
+		require.NoError(t, err)
+		require.Equal(t, expected, out)
+	})
+
+	t.Run("should minify svg", func(t *testing.T) {
+		t.Parallel()
+
+		input := "<?xml version=\"1.0\"?>\n<svg xmlns=\"http://www.w3.org/2000/svg\">\n  <!-- icon -->\n" +
+			"  <g>\n    <path d=\"M0 0L1 1\" />\n  </g>\n  <text x=\"1\">  a  b </text>\n</svg>\n"
+		expected := "<?xml version=\"1.0\"?><svg xmlns=\"http://www.w3.org/2000/svg\"><g><path d=\"M0 0L1 1\" /></g>" +
+			"<text x=\"1\">  a  b </text></svg>"
+
+		out, err := minified(t, langSVG, input)
+		require.NoError(t, err)
+		require.Equal(t, expected, out)
+	})
+
+	t.Run("should minify json", func(t *testing.T) {
+		t.Parallel()
+
+		out, err := minified(t, langJSON, "{\n  \"a\": [1, 2],\n  \"b\": \"c  d\"\n}\n")
+		require.NoError(t, err)
+		require.Equal(t, `{"a":[1,2],"b":"c  d"}`, out)
+
+		_, err = minified(t, langJSON, "{\"a\": }")
+		var merr *module_errors.ModuleError
+		require.ErrorAs(t, err, &merr)
+		_, code := merr.ToHTTP()
+		require.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("should reject binary files", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := minified(t, langCSS, "\x89PNG\r\n\x1a\n\x00\x00")
+		var merr *module_errors.ModuleError
+		require.ErrorAs(t, err, &merr)
+		msg, code := merr.ToHTTP()
+		require.Equal(t, http.StatusBadRequest, code)
+		require.Equal(t, module_errors.NotText, msg)
+	})
+
+	t.Run("should tell content type and precompression", func(t *testing.T) {
+		t.Parallel()
+
+		require.True(t, c.Precompressed(textModuleName))
+		require.False(t, c.Precompressed(imageModuleName))
+		require.Equal(t, "text/css; charset=utf-8", c.ContentType(textModuleName, ModuleMap{minify: langCSS}))
+		require.Equal(t, "", c.ContentType(imageModuleName, ModuleMap{"resize": "200x0"}))
+
+		_, _, err := c.Parse(url.Values{"text.minify": {"xml"}}, []string{textModuleName})
+		require.Error(t, err)
+	})
+}
+
+func TestMultipleModules(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	c := NewController(logger, nil, nil)
+	bucketModules := []string{imageModuleName, textModuleName}
+
+	t.Run("should parse resolvers of any bucket's module", func(t *testing.T) {
+		t.Parallel()
+
+		module, mm, err := c.Parse(url.Values{"text.minify": {"css"}}, bucketModules)
+		require.NoError(t, err)
+		require.Equal(t, textModuleName, module)
+		require.Equal(t, ModuleMap{minify: langCSS}, mm)
+
+		module, mm, err = c.ParsePreset(entities.Preset{"image.resize": "200x0"}, bucketModules)
+		require.NoError(t, err)
+		require.Equal(t, imageModuleName, module)
+		require.Equal(t, ModuleMap{"resize": "200x0"}, mm)
+
+		// Default arguments only
+		module, mm, err = c.Parse(url.Values{"image.resized": {FalseStr}}, bucketModules)
+		require.NoError(t, err)
+		require.Empty(t, module)
+		require.Nil(t, mm)
+	})
+
+	t.Run("should not parse resolvers of several modules", func(t *testing.T) {
+		t.Parallel()
+
+		q := url.Values{"image.webp": {TrueStr}, "text.minify": {"css"}}
+		_, _, err := c.Parse(q, bucketModules)
+
+		var merr *module_errors.ModuleError
+		require.ErrorAs(t, err, &merr)
+		msg, code := merr.ToHTTP()
+		require.Equal(t, http.StatusBadRequest, code)
+		require.Contains(t, msg, "can't be combined")
+	})
+
+	t.Run("should not parse module bucket doesn't declare", func(t *testing.T) {
+		t.Parallel()
+
+		_, _, err := c.Parse(url.Values{"text.minify": {"css"}}, []string{imageModuleName})
+
+		var merr *module_errors.ModuleError
+		require.ErrorAs(t, err, &merr)
+		msg, code := merr.ToHTTP()
+		require.Equal(t, http.StatusBadRequest, code)
+		require.Equal(t, fmt.Sprintf(module_errors.ModuleNotFound, textModuleName), msg)
+	})
+
+	t.Run("should select module by mime type", func(t *testing.T) {
+		t.Parallel()
+
+		require.Equal(t, imageModuleName, c.Select(bucketModules, "image/png"))
+		require.Equal(t, textModuleName, c.Select(bucketModules, "text/css; charset=utf-8"))
+		// Declared type beats top-level one regardless of order
+		require.Equal(t, textModuleName, c.Select(bucketModules, "image/svg+xml"))
+		require.Equal(t, textModuleName, c.Select([]string{textModuleName, imageModuleName}, "IMAGE/SVG+XML"))
+		require.Empty(t, c.Select(bucketModules, "video/mp4"))
+		require.Empty(t, c.Select(bucketModules, ""))
+		// Not registered
+		require.Empty(t, c.Select([]string{videoModuleName}, "video/mp4"))
+	})
+
+	t.Run("should check module applies to mime type", func(t *testing.T) {
+		t.Parallel()
+
+		require.NoError(t, c.CheckMime(imageModuleName, "image/jpeg"))
+		require.NoError(t, c.CheckMime(textModuleName, "application/json"))
+
+		err := c.CheckMime(imageModuleName, "video/mp4")
+		var merr *module_errors.ModuleError
+		require.ErrorAs(t, err, &merr)
+		msg, code := merr.ToHTTP()
+		require.Equal(t, http.StatusBadRequest, code)
+		require.Equal(t, "resolvers of module image don't apply to video/mp4 files", msg)
+
+		require.True(t, c.HasResolver(imageModuleName, "strip"))
+		require.False(t, c.HasResolver(textModuleName, "strip"))
+		require.False(t, c.HasResolver("nope", "strip"))
+	})
+}
+
+const pluginHelperEnv = "MODULES_TEST_PLUGIN"
+
+var pluginManifest = &plugin.Manifest{
+	Name: "upper",
+	Resolvers: []plugin.Resolver{
+		{Name: "case", Arguments: []string{"upper", "keep"}, Default: "keep"},
+		{Name: "repeat", Pattern: "[1-9]"},
+		{Name: "act", Arguments: []string{"fail", "hang"}},
+	},
+	MimeTypes: []string{"text/"},
+}
+
+// Test binary serves as plugin when it's run by controller
+func TestMain(m *testing.M) {
+	if os.Getenv(pluginHelperEnv) == "" {
+		os.Exit(m.Run())
+	}
+
+	err := plugin.Serve(pluginManifest, func(resolvers map[string]string, file []byte) ([]byte, error) {
+		switch resolvers["act"] {
+		case "fail":
+			return nil, &plugin.Error{Msg: "file is 100% wrong", Status: http.StatusBadRequest}
+		case "hang":
+			time.Sleep(time.Minute)
+		}
+
+		if resolvers["case"] == "upper" {
+			file = bytes.ToUpper(file)
+		}
+		if n, ok := resolvers["repeat"]; ok {
+			file = bytes.Repeat(file, int(n[0]-'0'))
+		}
+		return file, nil
+	})
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+func TestPlugin(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+
+	t.Run("should render with plugin", func(t *testing.T) {
+		t.Setenv(pluginHelperEnv, "1")
+
+		pcfg := &config.PluginConfig{Path: os.Args[0], RenderTimeout: time.Millisecond * 200, StartTimeout: time.Second * 5}
+		// The second one clashes with the first one
+		c := NewController(logger, &config.ModulesConfig{Plugins: []*config.PluginConfig{pcfg, pcfg}}, nil)
+		defer c.Close()
+		require.Len(t, c.(*controller).plugins, 1)
+
+		bucketModules := []string{imageModuleName, "upper"}
+		require.Equal(t, "upper", c.Select(bucketModules, "text/plain"))
+
+		module, mm, err := c.Parse(url.Values{"upper.case": {"upper"}, "upper.repeat": {"2"}}, bucketModules)
+		require.NoError(t, err)
+		require.Equal(t, "upper", module)
+		require.Equal(t, ModuleMap{"case": "upper", "repeat": "2"}, mm)
+
+		buff := bytes.NewBufferString("ab")
+		require.NoError(t, c.UseResolvers(buff, module, mm))
+		require.Equal(t, "ABAB", buff.String())
+
+		// Defaults only
+		_, mm, err = c.Parse(url.Values{"upper.case": {"keep"}}, bucketModules)
+		require.NoError(t, err)
+		require.Nil(t, mm)
+
+		cases := []struct {
+			q    url.Values
+			code int
+			msg  string
+		}{
+			{url.Values{"upper.repeat": {"0"}}, http.StatusBadRequest, "invalid resolver argument 0 on resolver repeat: invalid arguments"},
+			{url.Values{"upper.act": {"fail"}}, http.StatusBadRequest, "file is 100% wrong"},
+			{url.Values{"upper.act": {"hang"}}, http.StatusUnprocessableEntity, "processing took longer than 200ms"},
+		}
+		for _, tc := range cases {
+			_, mm, err := c.Parse(tc.q, bucketModules)
+			if err == nil {
+				err = c.UseResolvers(bytes.NewBufferString("ab"), "upper", mm)
+			}
+
+			var merr *module_errors.ModuleError
+			require.ErrorAs(t, err, &merr)
+			msg, code := merr.ToHTTP()
+			require.Equal(t, tc.code, code)
+			require.Equal(t, tc.msg, msg)
+		}
+	})
+
+	t.Run("should not register plugin which doesn't start", func(t *testing.T) {
+		cfg := &config.ModulesConfig{Plugins: []*config.PluginConfig{{Path: filepath.Join(t.TempDir(), "nope"), StartTimeout: time.Second}}}
+		c := NewController(logger, cfg, nil)
+		defer c.Close()
+
+		require.Empty(t, c.(*controller).plugins)
+		require.True(t, c.DoesModuleExist(imageModuleName))
+	})
+
+	t.Run("should validate manifest", func(t *testing.T) {
+		t.Parallel()
+
+		resolver := plugin.Resolver{Name: "r", Arguments: []string{"a"}}
+		for _, manifest := range []*plugin.Manifest{
+			{Name: "", Resolvers: []plugin.Resolver{resolver}},
+			{Name: "a.b", Resolvers: []plugin.Resolver{resolver}},
+			{Name: "p"},
+			{Name: "p", Resolvers: []plugin.Resolver{resolver, resolver}},
+			{Name: "p", Resolvers: []plugin.Resolver{{Name: "r.x", Arguments: []string{"a"}}}},
+			{Name: "p", Resolvers: []plugin.Resolver{{Name: "r"}}},
+			{Name: "p", Resolvers: []plugin.Resolver{{Name: "r", Pattern: "("}}},
+		} {
+			_, err := newPluginModule(nil, manifest)
+			require.Error(t, err, manifest)
+		}
+	})
+}
+
+func TestWasm(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+
+	// Transforms of pkg/wasm tests. echo writes its argument and "|" followed by input,
+	// grow runs out of memory
+	transform := func(name string) string {
+		return filepath.Join("..", "..", "pkg", "wasm", "testdata", name+".wasm")
+	}
+
+	invalid := filepath.Join(t.TempDir(), "invalid.wasm")
+	require.NoError(t, os.WriteFile(invalid, []byte("\x00asm"), 0644))
+
+	cfg := &config.ModulesConfig{Wasm: &config.WasmConfig{
+		MaxMemory: 1 << 20,
+		Timeout:   time.Second * 5,
+		Resolvers: []*config.WasmResolverConfig{
+			{Module: textModuleName, Name: "upper", Path: transform("echo"), Argument: "int", Default: "1"},
+			{Module: textModuleName, Name: "shout", Path: transform("echo"), Argument: "string", Arguments: []string{"loud"}},
+			{Module: textModuleName, Name: "blur", Path: transform("echo"), Argument: "float"},
+			{Module: textModuleName, Name: "grow", Path: transform("grow"), Argument: "int"},
+			// Disabled
+			{Module: textModuleName, Name: "minify", Path: transform("echo"), Argument: "int"},
+			{Module: "nope", Name: "upper", Path: transform("echo"), Argument: "int"},
+			{Module: textModuleName, Name: "missing", Path: filepath.Join(t.TempDir(), "nope.wasm"), Argument: "int"},
+			{Module: textModuleName, Name: "invalid", Path: invalid, Argument: "int"},
+			{Module: textModuleName, Name: "untyped", Path: transform("echo"), Argument: "rgb"},
+		},
+	}}
+	c := NewController(logger, cfg, nil)
+	bucketModules := []string{textModuleName}
+
+	t.Run("should register valid resolvers only", func(t *testing.T) {
+		t.Parallel()
+
+		require.True(t, c.HasResolver(textModuleName, "upper"))
+		require.True(t, c.HasResolver(textModuleName, "shout"))
+		require.False(t, c.HasResolver(textModuleName, "missing"))
+		require.False(t, c.HasResolver(textModuleName, "invalid"))
+		require.False(t, c.HasResolver(textModuleName, "untyped"))
+		require.Equal(t, []string{minify, "upper", "shout", "blur", "grow"}, c.(*controller).modules[textModuleName].Order)
+	})
+
+	t.Run("should apply resolvers after module's own ones", func(t *testing.T) {
+		t.Parallel()
+
+		module, mm, err := c.Parse(url.Values{"text.upper": {"16"}, "text.minify": {langJSON}}, bucketModules)
+		require.NoError(t, err)
+
+		buff := bytes.NewBufferString(`{ "a": 1 }`)
+		require.NoError(t, c.UseResolvers(buff, module, mm))
+		require.Equal(t, `16|{"a":1}`, buff.String())
+
+		// Arguments are formatted by their type
+		module, mm, err = c.Parse(url.Values{"text.blur": {"0.50"}}, bucketModules)
+		require.NoError(t, err)
+
+		buff = bytes.NewBufferString("a")
+		require.NoError(t, c.UseResolvers(buff, module, mm))
+		require.Equal(t, "0.5|a", buff.String())
+
+		// Default only
+		_, mm, err = c.Parse(url.Values{"text.upper": {"1"}}, bucketModules)
+		require.NoError(t, err)
+		require.Nil(t, mm)
+	})
+
+	t.Run("should not apply resolvers exceeding limits", func(t *testing.T) {
+		t.Parallel()
+
+		cases := []struct {
+			q    url.Values
+			code int
+			msg  string
+		}{
+			{url.Values{"text.upper": {"x"}}, http.StatusBadRequest, "invalid resolver argument x on resolver upper"},
+			{url.Values{"text.shout": {"quiet"}}, http.StatusBadRequest, "unknown resolver argument quiet on resolver shout"},
+			{url.Values{"text.grow": {"1"}}, http.StatusUnprocessableEntity, "grow exceeded resource limits"},
+		}
+		for _, tc := range cases {
+			_, mm, err := c.Parse(tc.q, bucketModules)
+			if err == nil {
+				err = c.UseResolvers(bytes.NewBufferString("a"), textModuleName, mm)
+			}
+
+			var merr *module_errors.ModuleError
+			require.ErrorAs(t, err, &merr)
+			msg, code := merr.ToHTTP()
+			require.Equal(t, tc.code, code)
+			require.Contains(t, msg, tc.msg)
+		}
+	})
 }
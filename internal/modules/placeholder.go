@@ -0,0 +1,136 @@
+package modules
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image/png"
+	"strconv"
+
+	module_errors "animakuro/cdn/internal/modules/errors"
+	"animakuro/cdn/pkg/blurhash"
+
+	"github.com/h2non/bimg"
+)
+
+// Metadata keys of image files
+const (
+	MetaBlurHash = "blurhash"
+	MetaLQIP     = "lqip"
+	MetaWidth    = "width"
+	MetaHeight   = "height"
+)
+
+const (
+	// Width of thumbnail BlurHash is computed of
+	blurHashWidth = 32
+	// Max components of the longer side
+	blurHashComponents = 4
+	lqipWidth          = 16
+	lqipQuality        = 40
+
+	defaultPlaceholderWidth = 32
+	minPlaceholderWidth     = 8
+	maxPlaceholderWidth     = 64
+	placeholderSigma        = 2
+)
+
+var ErrInvalidPlaceholder = errors.New("placeholder must be true or width in range [8, 64]")
+
+// newImageDescribe returns Module.Describe computing BlurHash and dimensions of uploaded image.
+// If lqip is set, tiny base64 encoded JPEG is computed as well
+func newImageDescribe(lqip bool) func(buff []byte) (map[string]string, error) {
+	return func(buff []byte) (map[string]string, error) {
+		// Not an image
+		if bimg.DetermineImageType(buff) == bimg.UNKNOWN {
+			return nil, nil
+		}
+
+		img := bimg.NewImage(buff)
+
+		size, err := img.Size()
+		if err != nil {
+			return nil, module_errors.WrapInternal(err, "image.describe.img.Size")
+		}
+
+		thumb, err := img.Process(bimg.Options{
+			Width: blurHashWidth,
+			Type:  bimg.PNG,
+		})
+		if err != nil {
+			return nil, module_errors.WrapInternal(err, "image.describe.img.Process")
+		}
+
+		decoded, err := png.Decode(bytes.NewReader(thumb))
+		if err != nil {
+			return nil, module_errors.WrapInternal(err, "image.describe.png.Decode")
+		}
+
+		x, y := blurhash.Components(size.Width, size.Height, blurHashComponents)
+		hash, err := blurhash.Encode(decoded, x, y)
+		if err != nil {
+			return nil, module_errors.WrapInternal(err, "image.describe.blurhash.Encode")
+		}
+
+		meta := map[string]string{
+			MetaBlurHash: hash,
+			MetaWidth:    strconv.Itoa(size.Width),
+			MetaHeight:   strconv.Itoa(size.Height),
+		}
+
+		if lqip {
+			tiny, err := img.Process(bimg.Options{
+				Width:         lqipWidth,
+				Type:          bimg.JPEG,
+				Quality:       lqipQuality,
+				StripMetadata: true,
+			})
+			if err != nil {
+				return nil, module_errors.WrapInternal(err, "image.describe.img.Process")
+			}
+
+			meta[MetaLQIP] = "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(tiny)
+		}
+
+		return meta, nil
+	}
+}
+
+// placeholderfn shrinks image to a tiny blurred one shown while the full one loads
+func placeholderfn(buff *bytes.Buffer, arg interface{}) error {
+	width, ok := arg.(int)
+	if !ok {
+		return nil
+	}
+
+	newimg, err := bimg.NewImage(buff.Bytes()).Process(bimg.Options{
+		Width:         width,
+		GaussianBlur:  bimg.GaussianBlur{Sigma: placeholderSigma},
+		StripMetadata: true,
+	})
+	if err != nil {
+		return module_errors.WrapInternal(err, "image.placeholderfn.img.Process")
+	}
+
+	(*buff).Reset()
+	(*buff).Write(newimg)
+
+	return nil
+}
+
+// parsePlaceholder parses true (default width), false or width in pixels
+func parsePlaceholder(arg string) (interface{}, error) {
+	switch arg {
+	case TrueStr:
+		return defaultPlaceholderWidth, nil
+	case FalseStr:
+		return nil, nil
+	}
+
+	width, err := strconv.Atoi(arg)
+	if err != nil || width < minPlaceholderWidth || width > maxPlaceholderWidth {
+		return nil, ErrInvalidPlaceholder
+	}
+
+	return width, nil
+}
@@ -0,0 +1,109 @@
+package modules
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	module_errors "animakuro/cdn/internal/modules/errors"
+	"animakuro/cdn/pkg/plugin"
+)
+
+// newPluginModule registers module plugin described in manifest.
+// Plugin applies all resolvers of a request in a single call
+func newPluginModule(p *plugin.Plugin, manifest *plugin.Manifest) (*Module, error) {
+	if manifest.Name == "" || strings.Contains(manifest.Name, ".") {
+		return nil, fmt.Errorf("invalid module name %q", manifest.Name)
+	}
+
+	if len(manifest.Resolvers) == 0 {
+		return nil, fmt.Errorf("module %s has no resolvers", manifest.Name)
+	}
+
+	m := &Module{
+		Name:                     manifest.Name,
+		Resolvers:                make(map[string]ResolverFunc, len(manifest.Resolvers)),
+		Defaults:                 make(Defaults),
+		AllowedResolverArguments: make(map[string][]string),
+		ArgumentParsers:          make(map[string]ArgumentParser),
+		MimeTypes:                manifest.MimeTypes,
+	}
+
+	for _, r := range manifest.Resolvers {
+		if r.Name == "" || strings.Contains(r.Name, ".") {
+			return nil, fmt.Errorf("invalid resolver name %q", r.Name)
+		}
+
+		if _, ok := m.Resolvers[r.Name]; ok {
+			return nil, fmt.Errorf("resolver %s is declared twice", r.Name)
+		}
+
+		switch {
+		case len(r.Arguments) != 0:
+			m.AllowedResolverArguments[r.Name] = r.Arguments
+		case r.Pattern != "":
+			parser, err := patternParser(r.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("resolver %s: %w", r.Name, err)
+			}
+			m.ArgumentParsers[r.Name] = parser
+		default:
+			return nil, fmt.Errorf("resolver %s accepts no arguments", r.Name)
+		}
+
+		if r.Default != "" {
+			m.Defaults[r.Name] = r.Default
+		}
+
+		// Never called, see Module.Render
+		m.Resolvers[r.Name] = nil
+		m.Order = append(m.Order, r.Name)
+	}
+
+	m.Render = func(ctx context.Context, buff *bytes.Buffer, mm ModuleMap) error {
+		out, err := p.Render(ctx, mm, buff.Bytes())
+		if err != nil {
+			return pluginError(m.Name, err)
+		}
+
+		buff.Reset()
+		buff.Write(out)
+		return nil
+	}
+
+	return m, nil
+}
+
+// patternParser accepts arguments matching pattern as a whole
+func patternParser(pattern string) (ArgumentParser, error) {
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, err
+	}
+
+	return func(arg string) (interface{}, error) {
+		if !re.MatchString(arg) {
+			return nil, ErrInvalidArgs
+		}
+		return arg, nil
+	}, nil
+}
+
+// pluginError shows client what plugin has to say about the request only.
+// Crashed plugin is being restarted, so client is told to retry
+func pluginError(module string, err error) error {
+	var perr *plugin.Error
+	if errors.As(err, &perr) && perr.Status >= 400 && perr.Status < 500 {
+		return module_errors.Wrap(err, perr.Status, "%s", perr.Msg)
+	}
+
+	if errors.Is(err, plugin.ErrUnavailable) {
+		return module_errors.Wrap(err, http.StatusServiceUnavailable, module_errors.PluginUnavailable, module)
+	}
+
+	return err
+}
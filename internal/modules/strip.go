@@ -0,0 +1,424 @@
+package modules
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"strings"
+
+	module_errors "animakuro/cdn/internal/modules/errors"
+
+	"github.com/h2non/bimg"
+)
+
+// What image.strip could keep
+const (
+	keepOrientation = "orientation"
+	keepICC         = "icc"
+)
+
+const (
+	exifOrientationTag = 0x0112
+	defaultOrientation = 1
+)
+
+var (
+	ErrInvalidStrip = errors.New("strip must be true, false or comma separated list of orientation, icc to keep")
+	ErrCorruptImage = errors.New("image is corrupt")
+)
+
+var (
+	jpegSignature = []byte{0xFF, 0xD8}
+	pngSignature  = []byte("\x89PNG\r\n\x1a\n")
+	exifHeader    = []byte("Exif\x00\x00")
+	iccHeader     = []byte("ICC_PROFILE\x00")
+)
+
+// stripArgument is typed argument of strip resolver.
+// e.g. image.strip=orientation,icc
+type stripArgument struct {
+	// Orientation is kept as minimal EXIF containing orientation only
+	keepOrientation bool
+	// ICC profile keeps colors of wide gamut images correct
+	keepICC bool
+}
+
+// stripfn removes metadata (EXIF, GPS, XMP, IPTC, comments).
+// JPEG, PNG and WebP are stripped without re-encoding, others go through libvips
+func stripfn(buff *bytes.Buffer, arg interface{}) error {
+	sarg, ok := arg.(stripArgument)
+	if !ok {
+		return nil
+	}
+
+	bits := buff.Bytes()
+
+	var (
+		newimg []byte
+		err    error
+	)
+	switch {
+	case bytes.HasPrefix(bits, jpegSignature):
+		newimg, err = stripJPEG(bits, sarg)
+	case bytes.HasPrefix(bits, pngSignature):
+		newimg, err = stripPNG(bits, sarg)
+	case isWebP(bits):
+		newimg, err = stripWebP(bits, sarg)
+	default:
+		// libvips strips everything. Orientation is kept by rotating pixels
+		newimg, err = bimg.NewImage(bits).Process(bimg.Options{
+			StripMetadata: true,
+			NoAutoRotate:  !sarg.keepOrientation,
+		})
+		if err != nil {
+			return module_errors.WrapInternal(err, "image.stripfn.img.Process")
+		}
+	}
+	if err != nil {
+		return module_errors.WrapInternal(err, "image.stripfn")
+	}
+
+	(*buff).Reset()
+	(*buff).Write(newimg)
+
+	return nil
+}
+
+// parseStrip parses true, false or list of what to keep
+func parseStrip(arg string) (interface{}, error) {
+	switch arg {
+	case TrueStr:
+		return stripArgument{}, nil
+	case FalseStr:
+		return nil, nil
+	}
+
+	var sarg stripArgument
+	for _, keep := range strings.Split(arg, ",") {
+		switch keep {
+		case keepOrientation:
+			sarg.keepOrientation = true
+		case keepICC:
+			sarg.keepICC = true
+		default:
+			return nil, ErrInvalidStrip
+		}
+	}
+
+	return sarg, nil
+}
+
+// stripJPEG drops all APPn segments except JFIF (APP0), Adobe (APP14)
+// and optionally ICC profile (APP2) along with comments
+func stripJPEG(bits []byte, arg stripArgument) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(bits)))
+	out.Write(jpegSignature)
+
+	orientation := defaultOrientation
+	if arg.keepOrientation {
+		orientation = jpegOrientation(bits[len(jpegSignature):])
+	}
+	// Minimal EXIF is written once right after JFIF
+	exifWritten := orientation == defaultOrientation
+
+	pos := len(jpegSignature)
+	for {
+		if pos+4 > len(bits) || bits[pos] != 0xFF {
+			return nil, ErrCorruptImage
+		}
+
+		marker := bits[pos+1]
+		// Fill bytes
+		if marker == 0xFF {
+			pos++
+			continue
+		}
+
+		size := int(binary.BigEndian.Uint16(bits[pos+2 : pos+4]))
+		end := pos + 2 + size
+		if size < 2 || end > len(bits) {
+			return nil, ErrCorruptImage
+		}
+		data := bits[pos+4 : end]
+
+		var keep bool
+		switch {
+		// APP0 (JFIF) and APP14 (Adobe, affects colors)
+		case marker == 0xE0 || marker == 0xEE:
+			keep = true
+		// APP2 (ICC)
+		case marker == 0xE2:
+			keep = arg.keepICC && bytes.HasPrefix(data, iccHeader)
+		// Other APPn (EXIF, XMP, IPTC, vendors) and comments
+		case marker >= 0xE0 && marker <= 0xEF, marker == 0xFE:
+		default:
+			keep = true
+		}
+
+		if !exifWritten && marker != 0xE0 {
+			writeJPEGSegment(out, 0xE1, append(append([]byte{}, exifHeader...), orientationTIFF(orientation)...))
+			exifWritten = true
+		}
+
+		if keep {
+			out.Write(bits[pos:end])
+		}
+
+		// Start of scan. The rest is image data
+		if marker == 0xDA {
+			out.Write(bits[end:])
+			return out.Bytes(), nil
+		}
+
+		pos = end
+	}
+}
+
+// jpegOrientation looks for EXIF orientation in segments
+func jpegOrientation(bits []byte) int {
+	for pos := 0; pos+4 <= len(bits) && bits[pos] == 0xFF; {
+		marker := bits[pos+1]
+		if marker == 0xDA {
+			break
+		}
+
+		end := pos + 2 + int(binary.BigEndian.Uint16(bits[pos+2:pos+4]))
+		if end > len(bits) {
+			break
+		}
+
+		data := bits[pos+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(data, exifHeader) {
+			return exifOrientation(data[len(exifHeader):])
+		}
+
+		pos = end
+	}
+
+	return defaultOrientation
+}
+
+func writeJPEGSegment(out *bytes.Buffer, marker byte, data []byte) {
+	out.Write([]byte{0xFF, marker})
+	binary.Write(out, binary.BigEndian, uint16(len(data)+2))
+	out.Write(data)
+}
+
+// stripPNG drops textual chunks, EXIF and time, optionally keeps iCCP
+func stripPNG(bits []byte, arg stripArgument) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(bits)))
+	out.Write(pngSignature)
+
+	orientation := defaultOrientation
+	if arg.keepOrientation {
+		orientation = pngOrientation(bits)
+	}
+
+	for pos := len(pngSignature); pos < len(bits); {
+		if pos+12 > len(bits) {
+			return nil, ErrCorruptImage
+		}
+
+		size := int(binary.BigEndian.Uint32(bits[pos : pos+4]))
+		typ := string(bits[pos+4 : pos+8])
+		// length + type + data + crc
+		end := pos + 12 + size
+		if end > len(bits) {
+			return nil, ErrCorruptImage
+		}
+
+		switch typ {
+		case "tEXt", "zTXt", "iTXt", "eXIf", "tIME":
+		case "iCCP":
+			if arg.keepICC {
+				out.Write(bits[pos:end])
+			}
+		default:
+			out.Write(bits[pos:end])
+		}
+
+		// EXIF must precede image data
+		if typ == "IHDR" && orientation != defaultOrientation {
+			writePNGChunk(out, "eXIf", orientationTIFF(orientation))
+		}
+
+		pos = end
+	}
+
+	return out.Bytes(), nil
+}
+
+func pngOrientation(bits []byte) int {
+	for pos := len(pngSignature); pos+12 <= len(bits); {
+		size := int(binary.BigEndian.Uint32(bits[pos : pos+4]))
+		end := pos + 12 + size
+		if end > len(bits) {
+			break
+		}
+
+		if string(bits[pos+4:pos+8]) == "eXIf" {
+			return exifOrientation(bits[pos+8 : pos+8+size])
+		}
+
+		pos = end
+	}
+
+	return defaultOrientation
+}
+
+func writePNGChunk(out *bytes.Buffer, typ string, data []byte) {
+	binary.Write(out, binary.BigEndian, uint32(len(data)))
+
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+
+	out.WriteString(typ)
+	out.Write(data)
+	binary.Write(out, binary.BigEndian, crc.Sum32())
+}
+
+func isWebP(bits []byte) bool {
+	return len(bits) >= 12 && bytes.Equal(bits[0:4], []byte("RIFF")) && bytes.Equal(bits[8:12], []byte("WEBP"))
+}
+
+// VP8X flags
+const (
+	webpICCFlag  = 0x20
+	webpEXIFFlag = 0x08
+	webpXMPFlag  = 0x04
+)
+
+// stripWebP drops EXIF and XMP chunks of extended WebP, optionally keeps ICCP.
+// Simple WebP has no metadata
+func stripWebP(bits []byte, arg stripArgument) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(bits)))
+	// RIFF size is written at the end
+	out.Write(bits[0:12])
+
+	var (
+		orientation = defaultOrientation
+		flagsAt     = -1
+	)
+
+	for pos := 12; pos < len(bits); {
+		if pos+8 > len(bits) {
+			return nil, ErrCorruptImage
+		}
+
+		fourcc := string(bits[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(bits[pos+4 : pos+8]))
+		// Chunks are padded to even size
+		end := pos + 8 + size + size&1
+		if end > len(bits) {
+			return nil, ErrCorruptImage
+		}
+
+		switch fourcc {
+		case "EXIF":
+			if arg.keepOrientation {
+				orientation = exifOrientation(bytes.TrimPrefix(bits[pos+8:pos+8+size], exifHeader))
+			}
+		case "XMP ":
+		case "ICCP":
+			if arg.keepICC {
+				out.Write(bits[pos:end])
+			}
+		case "VP8X":
+			flagsAt = out.Len() + 8
+			out.Write(bits[pos:end])
+		default:
+			out.Write(bits[pos:end])
+		}
+
+		pos = end
+	}
+
+	// Metadata is allowed in extended format only
+	if flagsAt == -1 {
+		return bits, nil
+	}
+
+	if orientation != defaultOrientation {
+		data := orientationTIFF(orientation)
+		out.WriteString("EXIF")
+		binary.Write(out, binary.LittleEndian, uint32(len(data)))
+		out.Write(data)
+		if len(data)%2 == 1 {
+			out.WriteByte(0)
+		}
+	}
+
+	res := out.Bytes()
+	flags := res[flagsAt] &^ (webpEXIFFlag | webpXMPFlag)
+	if !arg.keepICC {
+		flags &^= webpICCFlag
+	}
+	if orientation != defaultOrientation {
+		flags |= webpEXIFFlag
+	}
+	res[flagsAt] = flags
+	binary.LittleEndian.PutUint32(res[4:8], uint32(len(res)-8))
+
+	return res, nil
+}
+
+// exifOrientation reads orientation tag of IFD0 of TIFF structured EXIF
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return defaultOrientation
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return defaultOrientation
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd+2 > len(tiff) || ifd < 0 {
+		return defaultOrientation
+	}
+
+	entries := int(order.Uint16(tiff[ifd : ifd+2]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+
+		if order.Uint16(tiff[entry:entry+2]) == exifOrientationTag {
+			o := int(order.Uint16(tiff[entry+8 : entry+10]))
+			if o < 1 || o > 8 {
+				return defaultOrientation
+			}
+			return o
+		}
+	}
+
+	return defaultOrientation
+}
+
+// orientationTIFF builds minimal big endian TIFF with IFD0 containing orientation only
+func orientationTIFF(orientation int) []byte {
+	tiff := []byte{
+		'M', 'M', 0x00, 0x2A,
+		// IFD0 offset
+		0x00, 0x00, 0x00, 0x08,
+		// Entries count
+		0x00, 0x01,
+		// Tag, type SHORT, count 1
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01,
+		// Value padded to 4 bytes
+		0x00, byte(orientation), 0x00, 0x00,
+		// Next IFD offset
+		0x00, 0x00, 0x00, 0x00,
+	}
+
+	return tiff
+}
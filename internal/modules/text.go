@@ -0,0 +1,107 @@
+package modules
+
+import (
+	"bytes"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"animakuro/cdn/config"
+	module_errors "animakuro/cdn/internal/modules/errors"
+)
+
+const (
+	textModuleName = "text"
+	minify         = "minify"
+)
+
+// Languages of text.minify
+const (
+	langCSS  = "css"
+	langJS   = "js"
+	langHTML = "html"
+	langJSON = "json"
+	langSVG  = "svg"
+)
+
+const defaultTextRenderTimeout = time.Second * 10
+
+// SVG is text as well, its own type makes text module preferred to image one
+var textMimeTypes = []string{
+	"text/", "application/javascript", "application/x-javascript", "application/json",
+	"application/xml", "application/xhtml+xml", "image/svg+xml",
+}
+
+// Content types of minified files. Sniffing can't tell CSS or JS from plain text
+var textContentTypes = map[string]string{
+	langCSS:  "text/css; charset=utf-8",
+	langJS:   "text/javascript; charset=utf-8",
+	langHTML: "text/html; charset=utf-8",
+	langJSON: "application/json",
+	langSVG:  "image/svg+xml",
+}
+
+// newTextModule registers text module. Files of it are served precompressed
+func newTextModule(cfg *config.TextConfig) *Module {
+	timeout := defaultTextRenderTimeout
+	if cfg != nil && cfg.RenderTimeout > 0 {
+		timeout = cfg.RenderTimeout
+	}
+
+	m := &Module{
+		Name:                     textModuleName,
+		Resolvers:                make(map[string]ResolverFunc),
+		Defaults:                 make(Defaults),
+		AllowedResolverArguments: make(map[string][]string),
+		Check:                    checkText,
+		Timeout:                  timeout,
+		ContentType:              textContentType,
+		Precompress:              true,
+		MimeTypes:                textMimeTypes,
+	}
+
+	m.Resolvers[minify] = minifyfn
+	m.AllowedResolverArguments[minify] = []string{langCSS, langJS, langHTML, langJSON, langSVG}
+	m.Order = []string{minify}
+
+	return m
+}
+
+// checkText accepts UTF-8 text only
+func checkText(buff []byte) error {
+	if !utf8.Valid(buff) || bytes.IndexByte(buff, 0) != -1 {
+		return module_errors.NewHttp(http.StatusBadRequest, module_errors.NotText)
+	}
+
+	return nil
+}
+
+func textContentType(mm ModuleMap) string {
+	return textContentTypes[mm[minify]]
+}
+
+func minifyfn(buff *bytes.Buffer, arg interface{}) error {
+	lang := arg.(string)
+	src := buff.Bytes()
+
+	var out []byte
+	switch lang {
+	case langCSS:
+		out = minifyCSS(src)
+	case langJS:
+		out = minifyJS(src)
+	case langHTML:
+		out = minifyMarkup(src, htmlRawTags, false)
+	case langSVG:
+		out = minifyMarkup(src, svgRawTags, true)
+	case langJSON:
+		var err error
+		if out, err = minifyJSON(src); err != nil {
+			return module_errors.Wrap(err, http.StatusBadRequest, module_errors.InvalidText, lang, err.Error())
+		}
+	}
+
+	buff.Reset()
+	buff.Write(out)
+	return nil
+}
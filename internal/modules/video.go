@@ -0,0 +1,285 @@
+package modules
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"animakuro/cdn/config"
+	module_errors "animakuro/cdn/internal/modules/errors"
+	"animakuro/cdn/pkg/ffmpeg"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+const (
+	videoModuleName = "video"
+	poster          = "poster"
+	scale           = "scale"
+	format          = "format"
+	trim            = "trim"
+)
+
+// Containers of video.format
+const (
+	formatMP4  = "mp4"
+	formatWebM = "webm"
+)
+
+const (
+	defaultVideoRenderTimeout = time.Minute * 2
+
+	// Quality of encoded videos and posters
+	videoCRF     = "23"
+	videoWebMCRF = "32"
+	posterQScale = "3"
+)
+
+var (
+	ErrInvalidTimestamp = errors.New("timestamp must be seconds (e.g. 12.5) or [hh:]mm:ss[.ms]")
+	ErrInvalidTrim      = errors.New("trim must be {start}-{end}, where start is less than end")
+)
+
+// trimArgument is typed argument of trim resolver
+type trimArgument struct {
+	start time.Duration
+	end   time.Duration
+}
+
+// transcoder runs ffmpeg for resolvers of video and audio modules.
+// Each resolver is a single ffmpeg run
+type transcoder struct {
+	runner  *ffmpeg.Runner
+	timeout time.Duration
+}
+
+type videoResolvers struct {
+	*transcoder
+}
+
+// newVideoModule registers video module. It's useless without ffmpeg,
+// so it's registered only along with runner
+func newVideoModule(cfg *config.VideoConfig, runner *ffmpeg.Runner) *Module {
+	timeout := defaultVideoRenderTimeout
+	if cfg != nil && cfg.RenderTimeout > 0 {
+		timeout = cfg.RenderTimeout
+	}
+
+	v := &videoResolvers{&transcoder{runner: runner, timeout: timeout}}
+
+	m := &Module{
+		Name:                     videoModuleName,
+		Resolvers:                make(map[string]ResolverFunc),
+		Defaults:                 make(Defaults),
+		AllowedResolverArguments: make(map[string][]string),
+		Timeout:                  timeout,
+		MimeTypes:                []string{"video/"},
+	}
+
+	m.Resolvers[trim] = v.trimfn
+	m.Resolvers[poster] = v.posterfn
+	m.Resolvers[scale] = v.scalefn
+	m.Resolvers[format] = v.formatfn
+
+	m.AllowedResolverArguments[scale] = []string{"144", "240", "360", "480", "720", "1080"}
+	m.AllowedResolverArguments[format] = []string{formatMP4, formatWebM}
+
+	m.ArgumentParsers = map[string]ArgumentParser{
+		poster: parseTimestamp,
+		trim:   parseTrim,
+	}
+
+	// Trim goes first so that everything else processes less.
+	// Poster goes before scale, so that thumbnail is a scaled poster
+	// rather than poster of a scaled video
+	m.Order = []string{trim, poster, scale, format}
+
+	return m
+}
+
+// run applies ffmpeg within render timeout. Input is seeked to position first, if it's set
+func (t *transcoder) run(buff *bytes.Buffer, seek time.Duration, outExt, op string, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+
+	var inArgs []string
+	if seek > 0 {
+		inArgs = []string{"-ss", seconds(seek)}
+	}
+
+	inExt := mimetype.Detect(buff.Bytes()).Extension()
+	out, err := t.runner.RunInput(ctx, buff.Bytes(), inExt, inArgs, outExt, args...)
+	if errors.Is(err, ffmpeg.ErrUnsupportedInput) {
+		return module_errors.Wrap(err, http.StatusBadRequest, module_errors.UnsupportedMedia)
+	}
+	if err != nil {
+		return module_errors.WrapInternal(err, op)
+	}
+
+	(*buff).Reset()
+	(*buff).Write(out)
+
+	return nil
+}
+
+// isStill tells whether buff is an image (e.g. after video.poster)
+func isStill(buff []byte) bool {
+	return strings.HasPrefix(mimetype.Detect(buff).String(), "image/")
+}
+
+// outputContainer keeps mp4 and webm, anything else is converted to mp4
+func outputContainer(buff []byte) string {
+	if mimetype.Detect(buff).Extension() == "."+formatWebM {
+		return formatWebM
+	}
+
+	return formatMP4
+}
+
+// encoderArgs are codec options of container
+func encoderArgs(container string) []string {
+	if container == formatWebM {
+		return []string{"-c:v", "libvpx-vp9", "-b:v", "0", "-crf", videoWebMCRF, "-c:a", "libopus"}
+	}
+
+	// faststart moves index to the beginning, so playback starts before download ends
+	return []string{"-c:v", "libx264", "-preset", "veryfast", "-crf", videoCRF, "-pix_fmt", "yuv420p", "-c:a", "aac", "-movflags", "+faststart"}
+}
+
+// trimfn cuts clip. Streams are re-encoded, so that cut doesn't depend on keyframes
+func (v *videoResolvers) trimfn(buff *bytes.Buffer, arg interface{}) error {
+	targ, ok := arg.(trimArgument)
+	if !ok {
+		return nil
+	}
+
+	if isStill(buff.Bytes()) {
+		return module_errors.NewHttp(http.StatusBadRequest, module_errors.NotVideo, trim)
+	}
+
+	container := outputContainer(buff.Bytes())
+	args := append([]string{"-t", seconds(targ.end - targ.start)}, encoderArgs(container)...)
+
+	err := v.run(buff, targ.start, "."+container, "video.trimfn.ffmpeg.Run", args...)
+	if errors.Is(err, ffmpeg.ErrNoOutput) {
+		return module_errors.Wrap(err, http.StatusBadRequest, module_errors.TimestampOutOfRange, seconds(targ.start))
+	}
+
+	return err
+}
+
+// posterfn extracts frame at timestamp as JPEG
+func (v *videoResolvers) posterfn(buff *bytes.Buffer, arg interface{}) error {
+	ts, ok := arg.(time.Duration)
+	if !ok {
+		return nil
+	}
+
+	if isStill(buff.Bytes()) {
+		return module_errors.NewHttp(http.StatusBadRequest, module_errors.NotVideo, poster)
+	}
+
+	err := v.run(buff, ts, ".jpg", "video.posterfn.ffmpeg.Run",
+		"-frames:v", "1", "-an", "-c:v", "mjpeg", "-q:v", posterQScale)
+	if errors.Is(err, ffmpeg.ErrNoOutput) {
+		return module_errors.Wrap(err, http.StatusBadRequest, module_errors.TimestampOutOfRange, seconds(ts))
+	}
+
+	return err
+}
+
+// scalefn downscales video or poster to height keeping aspect ratio.
+// Smaller inputs are never upscaled
+func (v *videoResolvers) scalefn(buff *bytes.Buffer, arg interface{}) error {
+	height, ok := arg.(string)
+	if !ok {
+		return nil
+	}
+
+	// Width must be even for yuv420p
+	filter := fmt.Sprintf("scale=-2:min(%s\\,trunc(ih/2)*2)", height)
+
+	if isStill(buff.Bytes()) {
+		return v.run(buff, 0, ".jpg", "video.scalefn.ffmpeg.Run", "-vf", filter, "-c:v", "mjpeg", "-q:v", posterQScale)
+	}
+
+	container := outputContainer(buff.Bytes())
+	args := append([]string{"-vf", filter}, encoderArgs(container)...)
+
+	return v.run(buff, 0, "."+container, "video.scalefn.ffmpeg.Run", args...)
+}
+
+// formatfn transcodes video to container with its codecs
+func (v *videoResolvers) formatfn(buff *bytes.Buffer, arg interface{}) error {
+	container, ok := arg.(string)
+	if !ok || (container != formatMP4 && container != formatWebM) {
+		return nil
+	}
+
+	if isStill(buff.Bytes()) {
+		return module_errors.NewHttp(http.StatusBadRequest, module_errors.NotVideo, format)
+	}
+
+	return v.run(buff, 0, "."+container, "video.formatfn.ffmpeg.Run", encoderArgs(container)...)
+}
+
+// seconds formats duration the way ffmpeg accepts it
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// parseTimestamp accepts seconds (12.5) or [hh:]mm:ss[.ms] (01:02.5)
+func parseTimestamp(arg string) (interface{}, error) {
+	parts := strings.Split(arg, ":")
+	if len(parts) > 3 {
+		return nil, ErrInvalidTimestamp
+	}
+
+	var total float64
+	for i, part := range parts {
+		// Digits only, so that ParseFloat doesn't accept exponents, inf and nan
+		if strings.Trim(part, "0123456789.") != "" {
+			return nil, ErrInvalidTimestamp
+		}
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return nil, ErrInvalidTimestamp
+		}
+		// Only seconds could be fractional. Minutes and seconds of [hh:]mm:ss are less than 60
+		if (i < len(parts)-1 && n != math.Trunc(n)) || (i > 0 && n >= 60) {
+			return nil, ErrInvalidTimestamp
+		}
+		total = total*60 + n
+	}
+
+	return time.Duration(total * float64(time.Second)), nil
+}
+
+func parseTrim(arg string) (interface{}, error) {
+	bounds := strings.Split(arg, "-")
+	if len(bounds) != 2 {
+		return nil, ErrInvalidTrim
+	}
+
+	start, err := parseTimestamp(bounds[0])
+	if err != nil {
+		return nil, ErrInvalidTrim
+	}
+	end, err := parseTimestamp(bounds[1])
+	if err != nil {
+		return nil, ErrInvalidTrim
+	}
+
+	targ := trimArgument{start: start.(time.Duration), end: end.(time.Duration)}
+	if targ.start >= targ.end {
+		return nil, ErrInvalidTrim
+	}
+
+	return targ, nil
+}
@@ -0,0 +1,146 @@
+package modules
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"animakuro/cdn/config"
+	module_errors "animakuro/cdn/internal/modules/errors"
+	"animakuro/cdn/pkg/wasm"
+)
+
+// Types of arguments of WebAssembly resolvers
+const (
+	wasmInt    = "int"
+	wasmFloat  = "float"
+	wasmBool   = "bool"
+	wasmString = "string"
+)
+
+// registerWasmResolver adds resolver done by WebAssembly transform to built-in module.
+// It's applied after module's own resolvers
+func (c *controller) registerWasmResolver(runtime *wasm.Runtime, cfg *config.WasmConfig, rcfg *config.WasmResolverConfig) error {
+	m, ok := c.modules[rcfg.Module]
+	if !ok || m.Render != nil {
+		return fmt.Errorf("%w: %s", ErrNotFound, rcfg.Module)
+	}
+
+	if strings.Contains(rcfg.Name, ".") {
+		return fmt.Errorf("invalid resolver name %q", rcfg.Name)
+	}
+
+	if _, ok := m.Resolvers[rcfg.Name]; ok {
+		return fmt.Errorf("resolver %s already exists", rcfg.Name)
+	}
+
+	transform, err := runtime.Compile(context.Background(), rcfg.Path)
+	if err != nil {
+		return err
+	}
+
+	switch rcfg.Argument {
+	case wasmInt:
+		m.ArgumentParsers = withParser(m.ArgumentParsers, rcfg.Name, parseWasmInt)
+	case wasmFloat:
+		m.ArgumentParsers = withParser(m.ArgumentParsers, rcfg.Name, parseWasmFloat)
+	case wasmBool:
+		m.AllowedResolverArguments[rcfg.Name] = []string{TrueStr, FalseStr}
+	case wasmString:
+		if len(rcfg.Arguments) == 0 {
+			return fmt.Errorf("string resolver %s accepts no arguments", rcfg.Name)
+		}
+		m.AllowedResolverArguments[rcfg.Name] = rcfg.Arguments
+	default:
+		return fmt.Errorf("unknown argument type %q", rcfg.Argument)
+	}
+
+	if rcfg.Default != "" {
+		m.Defaults[rcfg.Name] = rcfg.Default
+	} else if rcfg.Argument == wasmBool {
+		m.Defaults[rcfg.Name] = FalseStr
+	}
+
+	m.Resolvers[rcfg.Name] = wasmResolver(transform, rcfg.Name, cfg.Timeout)
+	m.Order = append(m.Order, rcfg.Name)
+
+	return nil
+}
+
+// wasmResolver runs transform against buff. Every run is limited on its own
+func wasmResolver(transform *wasm.Transform, name string, timeout time.Duration) ResolverFunc {
+	return func(buff *bytes.Buffer, arg interface{}) error {
+		targ, err := wasmArgument(arg)
+		if err != nil {
+			return module_errors.WrapInternal(err, "wasmResolver."+name)
+		}
+
+		ctx := context.Background()
+		if timeout != 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		out, err := transform.Run(ctx, buff.Bytes(), targ)
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			return module_errors.Wrap(err, http.StatusUnprocessableEntity, module_errors.RenderTimeout, timeout)
+		case errors.Is(err, wasm.ErrLimit):
+			return module_errors.Wrap(err, http.StatusUnprocessableEntity, module_errors.TransformLimit, name)
+		case err != nil:
+			return err
+		}
+
+		buff.Reset()
+		buff.Write(out)
+		return nil
+	}
+}
+
+// wasmArgument formats argument parsed according to type of resolver as command-line argument
+func wasmArgument(arg interface{}) (string, error) {
+	switch v := arg.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case string:
+		// bool and string arguments are allowed ones as is
+		return v, nil
+	default:
+		return "", fmt.Errorf("unexpected argument %v of type %T", arg, arg)
+	}
+}
+
+func withParser(parsers map[string]ArgumentParser, name string, parser ArgumentParser) map[string]ArgumentParser {
+	if parsers == nil {
+		parsers = make(map[string]ArgumentParser)
+	}
+	parsers[name] = parser
+
+	return parsers
+}
+
+func parseWasmInt(arg string) (interface{}, error) {
+	return strconv.ParseInt(arg, 10, 64)
+}
+
+func parseWasmFloat(arg string) (interface{}, error) {
+	f, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, ErrInvalidArgs
+	}
+
+	return f, nil
+}
@@ -0,0 +1,288 @@
+package modules
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"animakuro/cdn/internal/entities"
+	module_errors "animakuro/cdn/internal/modules/errors"
+
+	"github.com/google/uuid"
+	"github.com/h2non/bimg"
+)
+
+const (
+	defaultWatermarkPosition = southEast
+	defaultWatermarkOpacity  = 1.0
+	defaultWatermarkScale    = 0.2
+	defaultWatermarkMargin   = 16
+	maxWatermarkMargin       = 1000
+
+	// Max time to read overlay from storage
+	watermarkReadTimeout = time.Second * 5
+)
+
+// Watermark positions
+const (
+	north     = "north"
+	south     = "south"
+	east      = "east"
+	west      = "west"
+	center    = "center"
+	northEast = "northeast"
+	northWest = "northwest"
+	southEast = "southeast"
+	southWest = "southwest"
+)
+
+// Watermark options
+const (
+	positionOption = "position"
+	opacityOption  = "opacity"
+	scaleOption    = "scale"
+	marginOption   = "margin"
+	// Version of the overlay derivative is stamped with, see newWatermarkPin
+	versionOption = "version"
+)
+
+var (
+	ErrInvalidWatermarkUUID     = errors.New("watermark must start with uuid of the overlay")
+	ErrInvalidWatermarkOption   = errors.New("watermark options must be in form of {option}:{value}")
+	ErrUnknownWatermarkOption   = errors.New("unknown watermark option")
+	ErrInvalidWatermarkPosition = errors.New("position must be one of north, south, east, west, center, northeast, northwest, southeast, southwest")
+	ErrInvalidWatermarkOpacity  = errors.New("opacity must be a number in range (0, 1]")
+	ErrInvalidWatermarkScale    = errors.New("scale must be a number in range (0, 1]")
+	ErrInvalidWatermarkMargin   = errors.New("margin must be an integer in range [0, 1000]")
+	ErrInvalidWatermarkVersion  = errors.New("version must be a positive integer")
+)
+
+// watermarkArgument is typed argument of watermark resolver.
+// e.g. image.watermark={uuid},position:southwest,opacity:0.5,scale:0.3,margin:10
+type watermarkArgument struct {
+	// UUID of overlay file. Being part of raw argument, it's also a part of derivative hash
+	uuid     string
+	position string
+	opacity  float64
+	// Overlay width relative to the image width
+	scale  float64
+	margin int
+}
+
+// newWatermarkfn returns resolver that stamps an overlay read from bucket
+// on top of an image
+func newWatermarkfn(reader FileReader, bucket string) ResolverFunc {
+	return func(buff *bytes.Buffer, arg interface{}) error {
+		warg, ok := arg.(watermarkArgument)
+		if !ok {
+			return nil
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), watermarkReadTimeout)
+		defer cancel()
+
+		// Goes through the same path as originals do, thus overlay is file-cached
+		overlay, err := reader.ReadOriginal(ctx, bucket, warg.uuid)
+		if err != nil {
+			if errors.Is(err, entities.ErrFileNotFound) {
+				return module_errors.Wrap(err, http.StatusBadRequest, module_errors.WatermarkNotFound, warg.uuid)
+			}
+			return module_errors.WrapInternal(err, "image.watermarkfn.reader.ReadOriginal")
+		}
+
+		img := bimg.NewImage(buff.Bytes())
+
+		size, err := img.Size()
+		if err != nil {
+			return module_errors.WrapInternal(err, "image.watermarkfn.img.Size")
+		}
+
+		overlaySize, err := bimg.NewImage(overlay).Size()
+		if err != nil {
+			return module_errors.Wrap(err, http.StatusBadRequest, module_errors.WatermarkNotImage, warg.uuid)
+		}
+
+		width, height := watermarkSize(size, overlaySize, warg)
+		overlay, err = bimg.NewImage(overlay).Process(bimg.Options{
+			Width:  width,
+			Height: height,
+			Force:  true,
+			Type:   bimg.PNG,
+		})
+		if err != nil {
+			return module_errors.WrapInternal(err, "image.watermarkfn.overlay.Process")
+		}
+
+		left, top := watermarkOffset(size, bimg.ImageSize{Width: width, Height: height}, warg)
+		newimg, err := img.WatermarkImage(bimg.WatermarkImage{
+			Left:    left,
+			Top:     top,
+			Buf:     overlay,
+			Opacity: float32(warg.opacity),
+		})
+		if err != nil {
+			return module_errors.WrapInternal(err, "image.watermarkfn.img.WatermarkImage")
+		}
+
+		(*buff).Reset()
+		(*buff).Write(newimg)
+
+		return nil
+	}
+}
+
+// newWatermarkPin returns Module.Pin adding current version of the overlay to watermark argument,
+// so that derivatives stamped with an overlay replaced since are not served. Requested version is replaced.
+// Overlays never updated are not pinned, so names of derivatives rendered before are kept
+func newWatermarkPin(reader FileReader, bucket string) func(ctx context.Context, mm ModuleMap) (ModuleMap, error) {
+	return func(ctx context.Context, mm ModuleMap) (ModuleMap, error) {
+		arg, ok := mm[watermark]
+		if !ok {
+			return mm, nil
+		}
+
+		parts := strings.Split(arg, ",")
+		pinned := parts[:1]
+		for _, part := range parts[1:] {
+			if !strings.HasPrefix(part, versionOption+":") {
+				pinned = append(pinned, part)
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, watermarkReadTimeout)
+		defer cancel()
+
+		f, err := reader.GetFileDB(ctx, bucket, parts[0])
+		// Missing overlay is reported by the resolver
+		if err != nil && !errors.Is(err, entities.ErrFileNotFound) {
+			return nil, module_errors.WrapInternal(err, "image.watermarkPin.reader.GetFileDB")
+		}
+
+		if f != nil && f.Version > 1 {
+			pinned = append(pinned, fmt.Sprintf("%s:%d", versionOption, f.Version))
+		}
+
+		withVersion := make(ModuleMap, len(mm))
+		for k, v := range mm {
+			withVersion[k] = v
+		}
+		withVersion[watermark] = strings.Join(pinned, ",")
+
+		return withVersion, nil
+	}
+}
+
+// watermarkSize scales overlay to arg.scale of image width keeping its aspect ratio.
+// Overlay never overflows the image (margins included)
+func watermarkSize(img, overlay bimg.ImageSize, arg watermarkArgument) (int, int) {
+	maxWidth := math.Max(float64(img.Width-2*arg.margin), 1)
+	maxHeight := math.Max(float64(img.Height-2*arg.margin), 1)
+
+	width := math.Min(float64(img.Width)*arg.scale, maxWidth)
+	height := width * float64(overlay.Height) / float64(overlay.Width)
+	if height > maxHeight {
+		width = width * maxHeight / height
+		height = maxHeight
+	}
+
+	return int(math.Max(width, 1)), int(math.Max(height, 1))
+}
+
+func watermarkOffset(img, overlay bimg.ImageSize, arg watermarkArgument) (int, int) {
+	var left, top int
+
+	switch arg.position {
+	case northWest, west, southWest:
+		left = arg.margin
+	case north, center, south:
+		left = (img.Width - overlay.Width) / 2
+	default:
+		left = img.Width - overlay.Width - arg.margin
+	}
+
+	switch arg.position {
+	case northWest, north, northEast:
+		top = arg.margin
+	case west, center, east:
+		top = (img.Height - overlay.Height) / 2
+	default:
+		top = img.Height - overlay.Height - arg.margin
+	}
+
+	if left < 0 {
+		left = 0
+	}
+	if top < 0 {
+		top = 0
+	}
+
+	return left, top
+}
+
+// parseWatermark parses {uuid}[,{option}:{value}...] into watermarkArgument
+func parseWatermark(arg string) (interface{}, error) {
+	parts := strings.Split(arg, ",")
+
+	if _, err := uuid.Parse(parts[0]); err != nil {
+		return nil, ErrInvalidWatermarkUUID
+	}
+
+	warg := watermarkArgument{
+		uuid:     parts[0],
+		position: defaultWatermarkPosition,
+		opacity:  defaultWatermarkOpacity,
+		scale:    defaultWatermarkScale,
+		margin:   defaultWatermarkMargin,
+	}
+
+	for _, part := range parts[1:] {
+		option, value, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, ErrInvalidWatermarkOption
+		}
+
+		switch option {
+		case positionOption:
+			switch value {
+			case north, south, east, west, center, northEast, northWest, southEast, southWest:
+				warg.position = value
+			default:
+				return nil, ErrInvalidWatermarkPosition
+			}
+		case opacityOption:
+			opacity, err := strconv.ParseFloat(value, 64)
+			if err != nil || !(opacity > 0 && opacity <= 1) {
+				return nil, ErrInvalidWatermarkOpacity
+			}
+			warg.opacity = opacity
+		case scaleOption:
+			scale, err := strconv.ParseFloat(value, 64)
+			if err != nil || !(scale > 0 && scale <= 1) {
+				return nil, ErrInvalidWatermarkScale
+			}
+			warg.scale = scale
+		case marginOption:
+			margin, err := strconv.Atoi(value)
+			if err != nil || margin < 0 || margin > maxWatermarkMargin {
+				return nil, ErrInvalidWatermarkMargin
+			}
+			warg.margin = margin
+		// Only tells derivatives apart, the current overlay is stamped anyway
+		case versionOption:
+			version, err := strconv.Atoi(value)
+			if err != nil || version < 1 {
+				return nil, ErrInvalidWatermarkVersion
+			}
+		default:
+			return nil, ErrUnknownWatermarkOption
+		}
+	}
+
+	return warg, nil
+}
@@ -0,0 +1,76 @@
+package blurhash
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncode(t *testing.T) {
+	t.Run("should encode uniform image", func(t *testing.T) {
+		t.Parallel()
+
+		img := image.NewRGBA(image.Rect(0, 0, 32, 24))
+		for i := range img.Pix {
+			img.Pix[i] = 0xFF
+		}
+
+		hash, err := Encode(img, 4, 3)
+		require.NoError(t, err)
+		require.Len(t, hash, 1+1+4+2*11)
+		// Size flag of 4x3 components
+		require.Equal(t, "L", hash[0:1])
+		// White DC
+		require.Equal(t, "TSUA", hash[2:6])
+	})
+
+	t.Run("should encode gradient", func(t *testing.T) {
+		t.Parallel()
+
+		img := image.NewGray(image.Rect(0, 0, 32, 32))
+		for x := 0; x < 32; x++ {
+			for y := 0; y < 32; y++ {
+				img.SetGray(x, y, color.Gray{Y: uint8(x * 8)})
+			}
+		}
+
+		hash, err := Encode(img, 4, 4)
+		require.NoError(t, err)
+		require.Len(t, hash, 1+1+4+2*15)
+		// Horizontal gradient has non-zero AC
+		require.NotEqual(t, "0", hash[1:2])
+		require.NotEqual(t, strings.Repeat("fQ", 15), hash[6:])
+	})
+
+	t.Run("should validate components", func(t *testing.T) {
+		t.Parallel()
+
+		img := image.NewGray(image.Rect(0, 0, 4, 4))
+
+		_, err := Encode(img, 0, 3)
+		require.ErrorIs(t, err, ErrInvalidComponents)
+
+		_, err = Encode(img, 4, 10)
+		require.ErrorIs(t, err, ErrInvalidComponents)
+
+		_, err = Encode(image.NewGray(image.Rect(0, 0, 0, 0)), 4, 3)
+		require.ErrorIs(t, err, ErrEmptyImage)
+	})
+}
+
+func TestComponents(t *testing.T) {
+	x, y := Components(1600, 900, 4)
+	require.Equal(t, 4, x)
+	require.Equal(t, 2, y)
+
+	x, y = Components(100, 1000, 4)
+	require.Equal(t, 1, x)
+	require.Equal(t, 4, y)
+
+	x, y = Components(0, 0, 4)
+	require.Equal(t, 4, x)
+	require.Equal(t, 4, y)
+}
@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+type entry struct {
+	uuid    string
+	expires time.Time
+}
+
+// AliasCache keeps UUIDs of files by bucket and alias for ttl, so files requested
+// by alias don't cost a database lookup every time. Holds up to size entries
+type AliasCache struct {
+	cache map[string]entry
+	size  int
+	ttl   time.Duration
+	mu    *sync.RWMutex
+}
+
+func NewAliasCache(size int, ttl time.Duration) *AliasCache {
+	return &AliasCache{
+		cache: make(map[string]entry),
+		size:  size,
+		ttl:   ttl,
+		mu:    new(sync.RWMutex),
+	}
+}
+
+// Get returns UUID of file aliased in bucket unless it's expired
+func (ac *AliasCache) Get(bucket string, alias string) (string, bool) {
+	ac.mu.RLock()
+	e, ok := ac.cache[key(bucket, alias)]
+	ac.mu.RUnlock()
+
+	if !ok || time.Now().After(e.expires) {
+		return "", false
+	}
+
+	return e.uuid, true
+}
+
+func (ac *AliasCache) Add(bucket string, alias string, uuid string) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	k := key(bucket, alias)
+	if _, ok := ac.cache[k]; !ok && len(ac.cache) >= ac.size {
+		ac.evict()
+	}
+
+	ac.cache[k] = entry{uuid: uuid, expires: time.Now().Add(ac.ttl)}
+}
+
+// Remove drops alias, e.g. once it's assigned to another file
+func (ac *AliasCache) Remove(bucket string, alias string) {
+	ac.mu.Lock()
+	delete(ac.cache, key(bucket, alias))
+	ac.mu.Unlock()
+}
+
+// evict drops expired entries or an arbitrary one if none is expired
+func (ac *AliasCache) evict() {
+	now := time.Now()
+	for k, e := range ac.cache {
+		if now.After(e.expires) {
+			delete(ac.cache, k)
+		}
+	}
+
+	if len(ac.cache) < ac.size {
+		return
+	}
+
+	for k := range ac.cache {
+		delete(ac.cache, k)
+		return
+	}
+}
+
+// Aliases are paths, so bucket is separated from them by a char they can't contain
+func key(bucket string, alias string) string {
+	return bucket + "\x00" + alias
+}
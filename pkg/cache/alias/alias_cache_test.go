@@ -0,0 +1,55 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAliasCache(t *testing.T) {
+	ac := NewAliasCache(2, time.Minute)
+
+	ac.Add("a", "x.jpg", "1")
+	ac.Add("b", "x.jpg", "2")
+
+	// Aliases are of bucket
+	id, ok := ac.Get("a", "x.jpg")
+	require.True(t, ok)
+	require.Equal(t, "1", id)
+
+	id, ok = ac.Get("b", "x.jpg")
+	require.True(t, ok)
+	require.Equal(t, "2", id)
+
+	ac.Remove("a", "x.jpg")
+	_, ok = ac.Get("a", "x.jpg")
+	require.False(t, ok)
+
+	// Never holds more than size
+	ac.Add("a", "y.jpg", "3")
+	ac.Add("a", "z.jpg", "4")
+	require.Len(t, ac.cache, 2)
+
+	id, ok = ac.Get("a", "z.jpg")
+	require.True(t, ok)
+	require.Equal(t, "4", id)
+}
+
+func TestAliasCacheExpiry(t *testing.T) {
+	ac := NewAliasCache(2, time.Millisecond)
+
+	ac.Add("a", "x.jpg", "1")
+	time.Sleep(5 * time.Millisecond)
+
+	_, ok := ac.Get("a", "x.jpg")
+	require.False(t, ok)
+
+	// Expired entries are evicted first
+	ac.Add("a", "y.jpg", "2")
+	ac.cache[key("a", "y.jpg")] = entry{uuid: "2", expires: time.Now().Add(time.Minute)}
+	ac.Add("a", "z.jpg", "3")
+
+	_, ok = ac.Get("a", "y.jpg")
+	require.True(t, ok)
+}
@@ -19,13 +19,29 @@ func NewBucketCache() *BucketCache {
 }
 
 func (bc *BucketCache) Get(bucketName string) (*entities.Bucket, error) {
+	// Buckets could be updated at runtime (e.g. presets)
+	bc.mu.RLock()
 	b, ok := bc.cache[bucketName]
+	bc.mu.RUnlock()
 	if ok == false {
 		return nil, entities.ErrBucketNotFound
 	}
 	return b, nil
 }
 
+// All returns every cached bucket
+func (bc *BucketCache) All() []*entities.Bucket {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	buckets := make([]*entities.Bucket, 0, len(bc.cache))
+	for _, b := range bc.cache {
+		buckets = append(buckets, b)
+	}
+
+	return buckets
+}
+
 func (bc *BucketCache) Add(b *entities.Bucket) {
 	bc.mu.Lock()
 	bc.cache[b.Name] = b
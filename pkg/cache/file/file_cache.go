@@ -2,6 +2,7 @@ package cache
 
 import (
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,6 +13,8 @@ import (
 type FileCache interface {
 	Increment(path string)
 	Lookup(path string) ([]byte, bool)
+	// Drops cached files under dir along with their hits
+	Invalidate(dir string)
 	Stop()
 }
 
@@ -123,6 +126,24 @@ func (fc *fileCache) Lookup(path string) ([]byte, bool) {
 	return fc.cache.GetItem(path)
 }
 
+func (fc *fileCache) Invalidate(dir string) {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+
+	for _, name := range fc.cache.StoredFiles() {
+		if strings.HasPrefix(name, prefix) {
+			fc.cache.Remove(name)
+		}
+	}
+
+	fc.mu.Lock()
+	for path := range fc.hits {
+		if strings.HasPrefix(path, prefix) {
+			delete(fc.hits, path)
+		}
+	}
+	fc.mu.Unlock()
+}
+
 func (fc *fileCache) Stop() {
 	// Clear hits map
 	fc.mu.Lock()
@@ -11,6 +11,10 @@ func (nc *NoOpFilecache) Stop() {
 	return
 }
 
+func (nc *NoOpFilecache) Invalidate(dir string) {
+	return
+}
+
 func (nc *NoOpFilecache) Lookup(path string) ([]byte, bool) {
 	return nil, false
 }
@@ -0,0 +1,226 @@
+// package ffmpeg runs ffmpeg binary against in-memory files.
+// Input and output go through a temporary directory removed right after the run,
+// so that formats requiring seekable output (mp4) work as well.
+// Input is demuxed by its sniffed container only and can't refer to other files or URLs
+// (e.g. playlists or concat scripts reading local files or fetching remote ones)
+
+package ffmpeg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+var (
+	ErrNotFound = errors.New("ffmpeg binary not found")
+	ErrFailed   = errors.New("ffmpeg failed")
+	// ffmpeg succeeded but had nothing to write (e.g. seek past the end)
+	ErrNoOutput = errors.New("ffmpeg produced no output")
+	// Input is not a known media container
+	ErrUnsupportedInput = errors.New("ffmpeg input container is not supported")
+)
+
+// Demuxers of containers ffmpeg reads, by sniffed mime type. Anything else,
+// text formats above all, is rejected rather than probed by ffmpeg
+var demuxers = map[string]string{
+	"video/mp4":        "mov",
+	"video/quicktime":  "mov",
+	"video/x-m4v":      "mov",
+	"video/3gpp":       "mov",
+	"video/3gpp2":      "mov",
+	"audio/mp4":        "mov",
+	"audio/x-m4a":      "mov",
+	"video/webm":       "matroska",
+	"video/x-matroska": "matroska",
+	"audio/webm":       "matroska",
+	"video/x-msvideo":  "avi",
+	"video/x-flv":      "flv",
+	"video/mpeg":       "mpeg",
+	"video/mp2t":       "mpegts",
+	"video/x-ms-asf":   "asf",
+	"application/ogg":  "ogg",
+	"audio/mpeg":       "mp3",
+	"audio/wav":        "wav",
+	"audio/flac":       "flac",
+	"audio/aac":        "aac",
+	"audio/aiff":       "aiff",
+	"audio/amr":        "amr",
+	"image/gif":        "gif",
+	"image/png":        "apng",
+	"image/jpeg":       "jpeg_pipe",
+	"image/webp":       "webp_pipe",
+}
+
+// Max bytes of ffmpeg stderr kept in error
+const maxStderr = 512
+
+// MPEG-TS is a stream of fixed size packets starting with sync byte
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+	// Packets checked to tell MPEG-TS from data starting with sync byte by chance
+	tsPackets = 3
+)
+
+// mimetype doesn't sniff MPEG-TS (e.g. segments of HLS or recordings of broadcasts)
+func init() {
+	mimetype.Extend(isMPEGTS, "video/mp2t", ".ts")
+}
+
+func isMPEGTS(raw []byte, _ uint32) bool {
+	if len(raw) < tsPacketSize*tsPackets {
+		return false
+	}
+
+	for i := 0; i < tsPackets; i++ {
+		if raw[i*tsPacketSize] != tsSyncByte {
+			return false
+		}
+	}
+
+	return true
+}
+
+type Runner struct {
+	path string
+}
+
+// New looks up ffmpeg binary by path or name in $PATH
+func New(path string) (*Runner, error) {
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrNotFound, path, err)
+	}
+
+	return &Runner{path: resolved}, nil
+}
+
+// demuxer tells demuxer of input by its sniffed container or its closest known parent
+// (e.g. ogg for audio/ogg)
+func demuxer(input []byte) (string, error) {
+	for mtype := mimetype.Detect(input); mtype != nil; mtype = mtype.Parent() {
+		for mime, name := range demuxers {
+			if mtype.Is(mime) {
+				return name, nil
+			}
+		}
+	}
+
+	return "", ErrUnsupportedInput
+}
+
+// Run writes input to a temporary file with inExt extension
+// and returns contents of the output written by ffmpeg with args applied.
+// Extensions include leading dot and let ffmpeg pick (de)muxers
+func (r *Runner) Run(ctx context.Context, input []byte, inExt, outExt string, args ...string) ([]byte, error) {
+	return r.RunInput(ctx, input, inExt, nil, outExt, args...)
+}
+
+// RunInput is Run with inArgs applied to input rather than output
+// (e.g. -ss seeking input without decoding everything before position)
+func (r *Runner) RunInput(ctx context.Context, input []byte, inExt string, inArgs []string, outExt string, args ...string) ([]byte, error) {
+	format, err := demuxer(input)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "ffmpeg-*")
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg.Run.os.MkdirTemp: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	in := filepath.Join(dir, "in"+inExt)
+	out := filepath.Join(dir, "out"+outExt)
+	if err := os.WriteFile(in, input, 0600); err != nil {
+		return nil, fmt.Errorf("ffmpeg.Run.os.WriteFile: %w", err)
+	}
+
+	if err := r.exec(ctx, dir, dir, format, in, inArgs, args, out); err != nil {
+		return nil, err
+	}
+
+	output, err := os.ReadFile(out)
+	if err != nil || len(output) == 0 {
+		return nil, ErrNoOutput
+	}
+
+	return output, nil
+}
+
+// RunTo is Run writing output named outName into outDir. Relative paths in args
+// (e.g. -hls_segment_filename) are resolved against outDir as well
+func (r *Runner) RunTo(ctx context.Context, input []byte, inExt string, outDir, outName string, args ...string) error {
+	format, err := demuxer(input)
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "ffmpeg-*")
+	if err != nil {
+		return fmt.Errorf("ffmpeg.RunTo.os.MkdirTemp: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	in := filepath.Join(dir, "in"+inExt)
+	if err := os.WriteFile(in, input, 0600); err != nil {
+		return fmt.Errorf("ffmpeg.RunTo.os.WriteFile: %w", err)
+	}
+
+	out := filepath.Join(outDir, outName)
+	if err := r.exec(ctx, dir, outDir, format, in, nil, args, out); err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(out); err != nil || info.Size() == 0 {
+		return ErrNoOutput
+	}
+
+	return nil
+}
+
+// exec runs ffmpeg in workDir reading in by format demuxer. Stderr is kept in tmpDir
+func (r *Runner) exec(ctx context.Context, tmpDir, workDir, format, in string, inArgs, args []string, out string) error {
+	cmdArgs := make([]string, 0, len(inArgs)+len(args)+12)
+	cmdArgs = append(cmdArgs, "-hide_banner", "-loglevel", "error", "-nostdin", "-y")
+	// Input can't open anything but local files, and is demuxed as sniffed container
+	// rather than probed, so that it can't be a playlist or concat script opening them
+	cmdArgs = append(cmdArgs, "-protocol_whitelist", "file", "-f", format)
+	cmdArgs = append(cmdArgs, inArgs...)
+	cmdArgs = append(cmdArgs, "-i", in)
+	cmdArgs = append(cmdArgs, args...)
+	cmdArgs = append(cmdArgs, out)
+
+	// Stderr goes to file rather than pipe: killed ffmpeg's children
+	// must not keep the run waiting for pipe to be closed
+	stderr, err := os.Create(filepath.Join(tmpDir, "stderr"))
+	if err != nil {
+		return fmt.Errorf("ffmpeg.Run.os.Create: %w", err)
+	}
+	defer stderr.Close()
+
+	cmd := exec.CommandContext(ctx, r.path, cmdArgs...)
+	cmd.Dir = workDir
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		logged, _ := os.ReadFile(stderr.Name())
+		msg := strings.TrimSpace(string(logged))
+		if len(msg) > maxStderr {
+			msg = msg[:maxStderr]
+		}
+		return fmt.Errorf("%w: %v: %s", ErrFailed, err, msg)
+	}
+
+	return nil
+}
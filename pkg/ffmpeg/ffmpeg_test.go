@@ -0,0 +1,138 @@
+package ffmpeg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeFFmpeg writes script that copies input into output prefixed by args
+func fakeFFmpeg(t *testing.T, body string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "ffmpeg")
+	script := "#!/bin/sh\n" + body + "\n"
+	require.NoError(t, os.WriteFile(path, []byte(script), 0755))
+
+	return path
+}
+
+const copyScript = `
+while [ $# -gt 1 ]; do
+	if [ "$1" = "-i" ]; then in="$2"; fi
+	args="$args $1"
+	shift
+done
+printf '%s|' "$args" > "$1"
+cat "$in" >> "$1"`
+
+// Minimal inputs sniffed as containers
+var (
+	gifInput = []byte("GIF89a input")
+	mp4Input = append([]byte("\x00\x00\x00\x18ftypmp42"), make([]byte, 16)...)
+	tsInput  = tsPacketsOf(tsPackets)
+)
+
+// tsPacketsOf returns n empty MPEG-TS packets
+func tsPacketsOf(n int) []byte {
+	input := make([]byte, tsPacketSize*n)
+	for i := 0; i < n; i++ {
+		input[i*tsPacketSize] = tsSyncByte
+	}
+
+	return input
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(filepath.Join(t.TempDir(), "nope"))
+	require.ErrorIs(t, err, ErrNotFound)
+
+	r, err := New(fakeFFmpeg(t, copyScript))
+	require.NoError(t, err)
+	require.NotNil(t, r)
+}
+
+func TestRun(t *testing.T) {
+	r, err := New(fakeFFmpeg(t, copyScript))
+	require.NoError(t, err)
+
+	out, err := r.Run(context.Background(), gifInput, ".gif", ".mp4", "-c:v", "libx264")
+	require.NoError(t, err)
+	require.Contains(t, string(out), " -y -protocol_whitelist file -f gif -i ")
+	require.Contains(t, string(out), ".gif -c:v libx264|GIF89a input")
+
+	out, err = r.RunInput(context.Background(), mp4Input, ".mp4", []string{"-ss", "10"}, ".jpg", "-frames:v", "1")
+	require.NoError(t, err)
+	require.Contains(t, string(out), " -y -protocol_whitelist file -f mov -ss 10 -i ")
+	require.Contains(t, string(out), ".mp4 -frames:v 1|")
+
+	out, err = r.Run(context.Background(), tsInput, ".ts", ".mp4")
+	require.NoError(t, err)
+	require.Contains(t, string(out), " -f mpegts -i ")
+}
+
+func TestRunUnsupportedInput(t *testing.T) {
+	r, err := New(fakeFFmpeg(t, copyScript))
+	require.NoError(t, err)
+
+	inputs := map[string]string{
+		"playlist": "#EXTM3U\n#EXTINF:10,\nfile:///etc/passwd\n",
+		"concat":   "ffconcat version 1.0\nfile /etc/passwd\n",
+		"text":     "input",
+		"ts":       string(tsPacketsOf(tsPackets - 1)),
+	}
+	for name, input := range inputs {
+		_, err = r.Run(context.Background(), []byte(input), ".mp4", ".mp4")
+		require.ErrorIs(t, err, ErrUnsupportedInput, name)
+
+		err = r.RunTo(context.Background(), []byte(input), ".mp4", t.TempDir(), "index.m3u8")
+		require.ErrorIs(t, err, ErrUnsupportedInput, name)
+	}
+}
+
+func TestRunTo(t *testing.T) {
+	r, err := New(fakeFFmpeg(t, copyScript+"\necho segment > seg_000.ts"))
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	err = r.RunTo(context.Background(), mp4Input, ".mp4", dir, "index.m3u8", "-f", "hls")
+	require.NoError(t, err)
+
+	playlist, err := os.ReadFile(filepath.Join(dir, "index.m3u8"))
+	require.NoError(t, err)
+	require.Contains(t, string(playlist), "-f hls|")
+
+	// Relative paths are written to output dir
+	require.FileExists(t, filepath.Join(dir, "seg_000.ts"))
+}
+
+func TestRunFailed(t *testing.T) {
+	r, err := New(fakeFFmpeg(t, `echo "Invalid data found" >&2; exit 1`))
+	require.NoError(t, err)
+
+	_, err = r.Run(context.Background(), gifInput, ".gif", ".mp4")
+	require.ErrorIs(t, err, ErrFailed)
+	require.Contains(t, err.Error(), "Invalid data found")
+
+	// Succeeded without writing output
+	r, err = New(fakeFFmpeg(t, `exit 0`))
+	require.NoError(t, err)
+
+	_, err = r.Run(context.Background(), gifInput, ".gif", ".mp4")
+	require.ErrorIs(t, err, ErrNoOutput)
+}
+
+func TestRunTimeout(t *testing.T) {
+	r, err := New(fakeFFmpeg(t, `sleep 5`))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	_, err = r.Run(ctx, gifInput, ".gif", ".mp4")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,281 @@
+// package hls packages videos into HTTP Live Streaming renditions.
+// Every rendition is a separate ffmpeg run writing {height}p/index.m3u8
+// and its segments. Master playlist referencing them is written afterwards,
+// with bandwidth measured on the segments actually produced
+
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"animakuro/cdn/pkg/ffmpeg"
+)
+
+const (
+	// MasterPlaylist is the entry point of packaged video
+	MasterPlaylist = "master.m3u8"
+	// Playlist of every rendition
+	RenditionPlaylist = "index.m3u8"
+
+	segmentPattern = "seg_%03d.ts"
+
+	DefaultSegmentDuration = 6
+)
+
+var (
+	ErrNoRenditions = errors.New("no renditions to package")
+	// Paths Serve accepts: master playlist, rendition playlists and segments
+	pathRegexp = regexp.MustCompile(`^(master\.m3u8|[0-9]+p/(index\.m3u8|seg_[0-9]+\.ts))$`)
+	uriRegexp  = regexp.MustCompile(`URI="([^"]*)"`)
+)
+
+type Packager struct {
+	runner          *ffmpeg.Runner
+	segmentDuration int
+}
+
+// New creates packager splitting video into segments of segmentDuration seconds
+func New(runner *ffmpeg.Runner, segmentDuration int) *Packager {
+	if segmentDuration <= 0 {
+		segmentDuration = DefaultSegmentDuration
+	}
+
+	return &Packager{
+		runner:          runner,
+		segmentDuration: segmentDuration,
+	}
+}
+
+// Package writes renditions of given heights and master playlist to dir.
+// Everything is written to a temporary sibling first, so that dir
+// is either complete or absent (or previous package is kept)
+func (p *Packager) Package(ctx context.Context, input []byte, inExt string, dir string, heights []int) error {
+	if len(heights) == 0 {
+		return ErrNoRenditions
+	}
+
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), "."+filepath.Base(dir)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("hls.Package.os.MkdirTemp: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	variants := make([]variant, 0, len(heights))
+	for _, height := range heights {
+		name := strconv.Itoa(height) + "p"
+		renditionDir := filepath.Join(tmp, name)
+		if err := os.Mkdir(renditionDir, 0777); err != nil {
+			return fmt.Errorf("hls.Package.os.Mkdir: %w", err)
+		}
+
+		if err := p.runner.RunTo(ctx, input, inExt, renditionDir, RenditionPlaylist, p.args(height)...); err != nil {
+			return fmt.Errorf("hls.Package.runner.RunTo: %s: %w", name, err)
+		}
+
+		v, err := measure(renditionDir)
+		if err != nil {
+			return err
+		}
+		v.uri = name + "/" + RenditionPlaylist
+		variants = append(variants, v)
+	}
+
+	if err := os.WriteFile(filepath.Join(tmp, MasterPlaylist), master(variants), 0777); err != nil {
+		return fmt.Errorf("hls.Package.os.WriteFile: %w", err)
+	}
+
+	// Replace previous package if any
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("hls.Package.os.RemoveAll: %w", err)
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return fmt.Errorf("hls.Package.os.Rename: %w", err)
+	}
+
+	return nil
+}
+
+// args of a single rendition. Keyframes are forced at segment boundaries,
+// so that segments of every rendition are aligned and players can switch between them
+func (p *Packager) args(height int) []string {
+	duration := strconv.Itoa(p.segmentDuration)
+
+	return []string{
+		"-map", "0:v:0", "-map", "0:a:0?",
+		// Never upscaled. Width must be even for yuv420p
+		"-vf", fmt.Sprintf("scale=-2:min(%d\\,trunc(ih/2)*2)", height),
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p",
+		"-force_key_frames", "expr:gte(t,n_forced*" + duration + ")",
+		"-c:a", "aac", "-ac", "2",
+		"-f", "hls", "-hls_time", duration, "-hls_playlist_type", "vod",
+		"-hls_segment_filename", segmentPattern,
+	}
+}
+
+// variant is a rendition referenced by master playlist
+type variant struct {
+	uri string
+	// Peak and average bits per second
+	bandwidth        int
+	averageBandwidth int
+}
+
+// measure computes bandwidth of rendition from its playlist and segment sizes
+func measure(dir string) (variant, error) {
+	var v variant
+
+	playlist, err := os.ReadFile(filepath.Join(dir, RenditionPlaylist))
+	if err != nil {
+		return v, fmt.Errorf("hls.measure.os.ReadFile: %w", err)
+	}
+
+	var (
+		duration      float64
+		totalDuration float64
+		totalBits     float64
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(playlist))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, "#EXTINF:") {
+			value := strings.SplitN(strings.TrimPrefix(line, "#EXTINF:"), ",", 2)[0]
+			duration, _ = strconv.ParseFloat(value, 64)
+			continue
+		}
+
+		if line == "" || strings.HasPrefix(line, "#") || duration <= 0 {
+			continue
+		}
+
+		info, err := os.Stat(filepath.Join(dir, line))
+		if err != nil {
+			return v, fmt.Errorf("hls.measure.os.Stat: %w", err)
+		}
+
+		bits := float64(info.Size() * 8)
+		if rate := int(bits / duration); rate > v.bandwidth {
+			v.bandwidth = rate
+		}
+		totalBits += bits
+		totalDuration += duration
+		duration = 0
+	}
+
+	if totalDuration > 0 {
+		v.averageBandwidth = int(totalBits / totalDuration)
+	}
+
+	return v, nil
+}
+
+func master(variants []variant) []byte {
+	buff := new(bytes.Buffer)
+	buff.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, v := range variants {
+		fmt.Fprintf(buff, "#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d\n%s\n", v.bandwidth, v.averageBandwidth, v.uri)
+	}
+
+	return buff.Bytes()
+}
+
+// IsPath tells whether path (relative to package dir) is a file Package writes.
+// Anything else (e.g. "../") must never be served
+func IsPath(path string) bool {
+	return pathRegexp.MatchString(path)
+}
+
+// IsPlaylist tells playlists from segments
+func IsPlaylist(path string) bool {
+	return strings.HasSuffix(path, ".m3u8")
+}
+
+// ContentType of packaged file
+func ContentType(path string) string {
+	if IsPlaylist(path) {
+		return "application/vnd.apple.mpegurl"
+	}
+
+	return "video/mp2t"
+}
+
+// Query keys of signed URIs, see SignURIs
+const (
+	ExpiresKey   = "expires"
+	SignatureKey = "signature"
+)
+
+// Sign returns signature of file at path of package pkg (e.g. "{bucket}/{uuid}") valid until expires (unix time)
+func Sign(key string, pkg string, path string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s/%s\n%d", pkg, path, expires)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify tells whether signature of file at path of package pkg is made by one of keys and is not expired
+func Verify(keys []string, pkg string, path string, expires int64, signature string, now time.Time) bool {
+	if now.Unix() > expires {
+		return false
+	}
+
+	for _, key := range keys {
+		if hmac.Equal([]byte(Sign(key, pkg, path, expires)), []byte(signature)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SignURIs appends expiry and signature to every URI of playlist at path of package pkg
+// (variant playlists, segments, keys), so that player requesting them relatively is authorized by the signature.
+// URIs are resolved relatively to the playlist, signature of one file isn't valid for another
+func SignURIs(playlist []byte, key string, pkg string, playlistPath string, expires int64) []byte {
+	dir := path.Dir(playlistPath)
+
+	sign := func(uri string) string {
+		target, _, _ := strings.Cut(uri, "?")
+		query := url.Values{
+			ExpiresKey:   {strconv.FormatInt(expires, 10)},
+			SignatureKey: {Sign(key, pkg, path.Join(dir, target), expires)},
+		}.Encode()
+
+		if strings.Contains(uri, "?") {
+			return uri + "&" + query
+		}
+		return uri + "?" + query
+	}
+
+	lines := strings.Split(string(playlist), "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+		case strings.HasPrefix(trimmed, "#"):
+			lines[i] = uriRegexp.ReplaceAllStringFunc(line, func(attr string) string {
+				uri := uriRegexp.FindStringSubmatch(attr)[1]
+				return `URI="` + sign(uri) + `"`
+			})
+		default:
+			lines[i] = sign(trimmed)
+		}
+	}
+
+	return []byte(strings.Join(lines, "\n"))
+}
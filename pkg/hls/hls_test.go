@@ -0,0 +1,119 @@
+package hls
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"animakuro/cdn/pkg/ffmpeg"
+
+	"github.com/stretchr/testify/require"
+)
+
+func fakeRunner(t *testing.T, body string) *ffmpeg.Runner {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "ffmpeg")
+	script := "#!/bin/sh\n" + body + "\n"
+	require.NoError(t, os.WriteFile(path, []byte(script), 0755))
+
+	r, err := ffmpeg.New(path)
+	require.NoError(t, err)
+
+	return r
+}
+
+// Minimal input sniffed as mp4
+var video = append([]byte("\x00\x00\x00\x18ftypmp42"), make([]byte, 16)...)
+
+// packageScript writes two segments of 750 and 1500 bytes 6 seconds each
+const packageScript = `
+for last; do :; done
+head -c 750 /dev/zero > seg_000.ts
+head -c 1500 /dev/zero > seg_001.ts
+printf '#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:6.000,\nseg_000.ts\n#EXTINF:6.000,\nseg_001.ts\n#EXT-X-ENDLIST\n' > "$last"`
+
+func TestPackage(t *testing.T) {
+	p := New(fakeRunner(t, packageScript), 0)
+	dir := filepath.Join(t.TempDir(), "hls")
+
+	err := p.Package(context.Background(), video, ".mp4", dir, []int{360, 720})
+	require.NoError(t, err)
+
+	master, err := os.ReadFile(filepath.Join(dir, MasterPlaylist))
+	require.NoError(t, err)
+	require.Equal(t, "#EXTM3U\n#EXT-X-VERSION:3\n"+
+		"#EXT-X-STREAM-INF:BANDWIDTH=2000,AVERAGE-BANDWIDTH=1500\n360p/index.m3u8\n"+
+		"#EXT-X-STREAM-INF:BANDWIDTH=2000,AVERAGE-BANDWIDTH=1500\n720p/index.m3u8\n", string(master))
+
+	require.FileExists(t, filepath.Join(dir, "720p", RenditionPlaylist))
+	require.FileExists(t, filepath.Join(dir, "720p", "seg_001.ts"))
+
+	// Temporary dirs are cleaned up
+	entries, err := os.ReadDir(filepath.Dir(dir))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestPackageFailed(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "hls")
+
+	p := New(fakeRunner(t, packageScript), 0)
+	require.NoError(t, p.Package(context.Background(), video, ".mp4", dir, []int{360}))
+
+	// Previous package is kept
+	p = New(fakeRunner(t, "exit 1"), 0)
+	err := p.Package(context.Background(), video, ".mp4", dir, []int{360})
+	require.ErrorIs(t, err, ffmpeg.ErrFailed)
+	require.FileExists(t, filepath.Join(dir, MasterPlaylist))
+
+	err = p.Package(context.Background(), video, ".mp4", dir, nil)
+	require.ErrorIs(t, err, ErrNoRenditions)
+}
+
+func TestIsPath(t *testing.T) {
+	for _, valid := range []string{"master.m3u8", "720p/index.m3u8", "360p/seg_012.ts"} {
+		require.True(t, IsPath(valid), valid)
+	}
+
+	for _, invalid := range []string{"", "../master.m3u8", "720p/../../orig.mp4", "720p/seg_1.mp4", "/master.m3u8", "720p"} {
+		require.False(t, IsPath(invalid), invalid)
+	}
+
+	require.Equal(t, "application/vnd.apple.mpegurl", ContentType("master.m3u8"))
+	require.Equal(t, "video/mp2t", ContentType("360p/seg_000.ts"))
+}
+
+func TestSignURIs(t *testing.T) {
+	playlist := "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:6.000,\nseg_000.ts\n\n#EXTINF:6.000,\nseg_001.ts?v=1\n#EXT-X-ENDLIST\n"
+	expires := time.Now().Add(time.Hour).Unix()
+
+	query := func(path string) string {
+		return url.Values{ExpiresKey: {strconv.FormatInt(expires, 10)}, SignatureKey: {Sign("key", "bucket/id", path, expires)}}.Encode()
+	}
+
+	signed := SignURIs([]byte(playlist), "key", "bucket/id", "720p/index.m3u8", expires)
+	require.Equal(t, "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4?"+query("720p/init.mp4")+"\"\n#EXTINF:6.000,\nseg_000.ts?"+query("720p/seg_000.ts")+"\n\n"+
+		"#EXTINF:6.000,\nseg_001.ts?v=1&"+query("720p/seg_001.ts")+"\n#EXT-X-ENDLIST\n", string(signed))
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(time.Hour).Unix()
+	signature := Sign("key", "bucket/id", "720p/seg_000.ts", expires)
+
+	require.True(t, Verify([]string{"old", "key"}, "bucket/id", "720p/seg_000.ts", expires, signature, now))
+
+	// Another file, package, expiry or key
+	require.False(t, Verify([]string{"key"}, "bucket/id", "720p/seg_001.ts", expires, signature, now))
+	require.False(t, Verify([]string{"key"}, "bucket/other", "720p/seg_000.ts", expires, signature, now))
+	require.False(t, Verify([]string{"key"}, "bucket/id", "720p/seg_000.ts", expires+1, signature, now))
+	require.False(t, Verify([]string{"other"}, "bucket/id", "720p/seg_000.ts", expires, signature, now))
+
+	// Expired
+	require.False(t, Verify([]string{"key"}, "bucket/id", "720p/seg_000.ts", expires, signature, now.Add(time.Hour*2)))
+}
@@ -2,9 +2,76 @@ package metrics
 
 import (
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+var (
+	// EagerRenders counts derivatives rendered right after upload by bucket and status (ok, failed)
+	EagerRenders = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cdn",
+		Name:      "eager_renders_total",
+		Help:      "Number of derivatives rendered right after upload",
+	}, []string{"bucket", "status"})
+
+	// HLSPackages counts videos packaged into HLS after upload by bucket and status (ok, failed)
+	HLSPackages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cdn",
+		Name:      "hls_packages_total",
+		Help:      "Number of videos packaged into HLS after upload",
+	}, []string{"bucket", "status"})
+
+	// RenderDuration observes time spent applying resolvers by bucket
+	RenderDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cdn",
+		Name:      "render_duration_seconds",
+		Help:      "Time spent applying resolvers to a file",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"bucket"})
+
+	// RendersRejected counts renders rejected by bucket due to full processing queue
+	RendersRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cdn",
+		Name:      "renders_rejected_total",
+		Help:      "Number of renders rejected due to full processing queue",
+	}, []string{"bucket"})
+
+	// BucketBytes is bytes stored by bucket and kind (originals, derivatives)
+	BucketBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "cdn",
+		Name:      "bucket_bytes",
+		Help:      "Bytes of files stored by bucket",
+	}, []string{"bucket", "kind"})
+
+	// BucketObjects is number of files stored by bucket and kind (originals, derivatives)
+	BucketObjects = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "cdn",
+		Name:      "bucket_objects",
+		Help:      "Number of files stored by bucket",
+	}, []string{"bucket", "kind"})
+
+	// LifecycleDeletions counts files deleted by lifecycle rules by bucket and rule
+	// (expire_originals, expire_derivatives, purge_deleted)
+	LifecycleDeletions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cdn",
+		Name:      "lifecycle_deletions_total",
+		Help:      "Number of files deleted by bucket lifecycle rules",
+	}, []string{"bucket", "rule"})
+)
+
+func init() {
+	prometheus.MustRegister(EagerRenders, HLSPackages, RenderDuration, RendersRejected, BucketBytes, BucketObjects, LifecycleDeletions)
+}
+
+// RegisterProcessingQueue exposes processing queue depth reported by depth
+func RegisterProcessingQueue(depth func() float64) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "cdn",
+		Name:      "processing_queue_depth",
+		Help:      "Number of renders waiting in processing queue",
+	}, depth))
+}
+
 func StartRecordingMetrics(h *mux.Router) {
 	h.Handle("/metrics", promhttp.Handler())
 	return
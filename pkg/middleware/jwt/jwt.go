@@ -2,12 +2,16 @@ package jwt
 
 import (
 	"net/http"
+	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	cdn_go "animakuro/cdn"
 	"animakuro/cdn/internal/auth"
 	cdn_errors "animakuro/cdn/internal/cdn/errors"
 	cache "animakuro/cdn/pkg/cache/bucket"
+	"animakuro/cdn/pkg/hls"
 
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
@@ -16,12 +20,15 @@ import (
 type Middleware struct {
 	logger *zap.SugaredLogger
 	bc     *cache.BucketCache
+	// Signs admin tokens. Empty if there's no admin
+	adminKey string
 }
 
-func NewMiddleware(logger *zap.SugaredLogger, bucketCache *cache.BucketCache) *Middleware {
+func NewMiddleware(logger *zap.SugaredLogger, bucketCache *cache.BucketCache, adminKey string) *Middleware {
 	return &Middleware{
-		logger: logger,
-		bc:     bucketCache,
+		logger:   logger,
+		bc:       bucketCache,
+		adminKey: adminKey,
 	}
 }
 
@@ -31,17 +38,51 @@ func (m *Middleware) Auth(h http.HandlerFunc) http.HandlerFunc {
 		vars := mux.Vars(r)
 
 		operation := strings.ToLower(r.Method)
+		// Updating a file is the same as uploading it
+		if r.Method == http.MethodPut {
+			operation = cdn_go.OperationPost
+		}
 		bucketName := vars[cdn_go.BucketKey]
 
 		// TODO: rename
-		var fileUUID string
+		// Empty for upload, every other route is of a single file
+		fileUUID := vars[cdn_go.FileUUIDKey]
+
+		m.logger.Debugf("auth: operation: %s on bucket: %s", operation, bucketName)
 
-		// For get, post operations FileUUIDKey is provided.
-		if operation != cdn_go.OperationPost {
-			fileUUID = vars[cdn_go.FileUUIDKey]
+		err := m.authorize(bucketName, operation, fileUUID, func() ([]byte, error) {
+			// Get token according to operation
+			return auth.ParseToken(operation, r.URL, r.Header.Get("Authorization"))
+		})
+		if err != nil {
+			cdn_errors.ToHttp(m.logger, w, err)
+			return
 		}
 
-		m.logger.Debugf("auth: operation: %s on bucket: %s", operation, bucketName)
+		//Jwt is valid
+		h.ServeHTTP(w, r)
+	}
+}
+
+// HLS authorizes getting files of HLS package. Request carrying signature (see hls.SignURIs)
+// is authorized by it, so that players fetch rendition playlists and segments without token.
+// Any other request is authorized like Auth does
+func (m *Middleware) HLS(h http.HandlerFunc) http.HandlerFunc {
+	authorized := m.Auth(h)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		q := r.URL.Query()
+		signature := q.Get(hls.SignatureKey)
+		if signature == "" {
+			authorized(w, r)
+			return
+		}
+
+		vars := mux.Vars(r)
+		bucketName := vars[cdn_go.BucketKey]
+
+		m.logger.Debugf("auth: signed hls on bucket: %s", bucketName)
 
 		b, err := m.bc.Get(bucketName)
 		if err != nil {
@@ -51,50 +92,188 @@ func (m *Middleware) Auth(h http.HandlerFunc) http.HandlerFunc {
 
 		var keys []string
 		for _, op := range b.Operations {
-			if op.Name == operation {
-				// No jwt verification if operation is public
-				if op.Type == cdn_go.OperationTypePublic {
-					h.ServeHTTP(w, r)
-					return
-				}
-
-				// If op.Keys is empty and operation type is private then access must be denied.
-				// Omit the check for private operation. (See jwt.go:56)
-				if op.Keys == nil {
-					cdn_errors.ToHttp(m.logger, w, auth.ErrAccessDenied)
-					return
-				}
-
-				keys = op.Keys
+			if op.Name != cdn_go.OperationGet {
+				continue
 			}
+
+			// Playlists of public bucket are not signed
+			if op.Type == cdn_go.OperationTypePublic {
+				authorized(w, r)
+				return
+			}
+
+			keys = op.Keys
 		}
 
-		// Get token according to operation
-		token, err := auth.ParseToken(operation, r.URL, r.Header.Get("Authorization"))
+		expires, err := strconv.ParseInt(q.Get(hls.ExpiresKey), 10, 64)
+		pkg := path.Join(bucketName, vars[cdn_go.FileUUIDKey])
+		if err != nil || !hls.Verify(keys, pkg, vars[cdn_go.HLSPathKey], expires, signature, time.Now()) {
+			cdn_errors.ToHttp(m.logger, w, auth.ErrAccessDenied)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	}
+}
+
+// Transfer authorizes copying or moving files to another bucket (see cdn_go.URLDestinationKey).
+// Source bucket must allow get (copy) or delete (move) of transferred file, token is passed
+// via Authorization header. Destination bucket must allow upload, its token is passed via
+// Destination-Authorization header. Batches are authorized by tokens of the whole bucket (no file_id)
+func (m *Middleware) Transfer(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		vars := mux.Vars(r)
+
+		operation := cdn_go.OperationGet
+		if vars[cdn_go.TransferKey] == cdn_go.TransferMove {
+			operation = cdn_go.OperationDelete
+		}
+
+		source := vars[cdn_go.BucketKey]
+		destination := r.URL.Query().Get(cdn_go.URLDestinationKey)
+
+		m.logger.Debugf("auth: %s from bucket: %s to bucket: %s", vars[cdn_go.TransferKey], source, destination)
+
+		err := m.authorize(source, operation, vars[cdn_go.FileUUIDKey], func() ([]byte, error) {
+			return auth.ParseHeader(r.Header.Get("Authorization"))
+		})
+		if err != nil {
+			cdn_errors.ToHttp(m.logger, w, err)
+			return
+		}
+
+		err = m.authorize(destination, cdn_go.OperationPost, "", func() ([]byte, error) {
+			return auth.ParseHeader(r.Header.Get(cdn_go.DestinationAuthKey))
+		})
 		if err != nil {
 			cdn_errors.ToHttp(m.logger, w, err)
 			return
 		}
 
-		wantedClaims := auth.Claims{
-			Bucket: bucketName,
-			FileID: fileUUID,
+		h.ServeHTTP(w, r)
+	}
+}
+
+// BatchDelete authorizes deleting many files of bucket at once. Token is passed via Authorization header
+// and is either issued for the whole bucket (no file_id) and signed with one of delete's keys, or signed with admin key
+func (m *Middleware) BatchDelete(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		bucketName := mux.Vars(r)[cdn_go.BucketKey]
+
+		m.logger.Debugf("auth: batch delete on bucket: %s", bucketName)
+
+		parse := func() ([]byte, error) {
+			return auth.ParseHeader(r.Header.Get("Authorization"))
 		}
 
-		// Validate token based on internals an wantedClaims
-		ok, err := auth.ValidateToken(token, keys, &wantedClaims)
+		err := m.authorize(bucketName, cdn_go.OperationDelete, "", parse)
+		if err != nil && m.isAdmin(bucketName, parse) {
+			err = nil
+		}
 		if err != nil {
 			cdn_errors.ToHttp(m.logger, w, err)
 			return
 		}
 
-		//Handle invalid jwt
-		if ok == false {
+		h.ServeHTTP(w, r)
+	}
+}
+
+// Admin authorizes managing bucket itself (e.g. its presets or usage). Token is passed via Authorization header
+// and is signed with admin key. Without admin key such routes are unreachable
+func (m *Middleware) Admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		bucketName := mux.Vars(r)[cdn_go.BucketKey]
+
+		m.logger.Debugf("auth: admin on bucket: %s", bucketName)
+
+		parse := func() ([]byte, error) {
+			return auth.ParseHeader(r.Header.Get("Authorization"))
+		}
+
+		if _, err := parse(); err != nil {
+			cdn_errors.ToHttp(m.logger, w, err)
+			return
+		}
+
+		if !m.isAdmin(bucketName, parse) {
 			cdn_errors.ToHttp(m.logger, w, auth.ErrAccessDenied)
 			return
 		}
 
-		//Jwt is valid
 		h.ServeHTTP(w, r)
 	}
 }
+
+// isAdmin checks that token got by parse is signed with admin key and is issued for the bucket
+func (m *Middleware) isAdmin(bucketName string, parse func() ([]byte, error)) bool {
+	if m.adminKey == "" {
+		return false
+	}
+
+	token, err := parse()
+	if err != nil {
+		return false
+	}
+
+	ok, err := auth.ValidateToken(token, []string{m.adminKey}, &auth.Claims{Bucket: bucketName})
+	if err != nil {
+		m.logger.Errorf("could not validate admin token. err: %s", err.Error())
+		return false
+	}
+
+	return ok
+}
+
+// authorize checks that operation on bucket is public or token got by parse is signed
+// with one of operation's keys and is issued for the bucket and file
+func (m *Middleware) authorize(bucketName string, operation string, fileUUID string, parse func() ([]byte, error)) error {
+	b, err := m.bc.Get(bucketName)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for _, op := range b.Operations {
+		if op.Name == operation {
+			// No jwt verification if operation is public
+			if op.Type == cdn_go.OperationTypePublic {
+				return nil
+			}
+
+			// If op.Keys is empty and operation type is private then access must be denied.
+			// Omit the check for private operation. (See public check above)
+			if op.Keys == nil {
+				return auth.ErrAccessDenied
+			}
+
+			keys = op.Keys
+		}
+	}
+
+	token, err := parse()
+	if err != nil {
+		return err
+	}
+
+	wantedClaims := auth.Claims{
+		Bucket: bucketName,
+		FileID: fileUUID,
+	}
+
+	// Validate token based on internals an wantedClaims
+	ok, err := auth.ValidateToken(token, keys, &wantedClaims)
+	if err != nil {
+		return err
+	}
+
+	//Handle invalid jwt
+	if ok == false {
+		return auth.ErrAccessDenied
+	}
+
+	return nil
+}
@@ -5,11 +5,14 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"testing"
+	"time"
 
 	"animakuro/cdn/internal/auth"
 	"animakuro/cdn/internal/entities"
 	cache "animakuro/cdn/pkg/cache/bucket"
+	"animakuro/cdn/pkg/hls"
 
 	"github.com/cristalhq/jwt/v4"
 	"github.com/gorilla/mux"
@@ -40,14 +43,14 @@ var bucket = &entities.Bucket{
 			Keys: nil,
 		},
 	},
-	Module: "images",
+	Modules: []string{"images"},
 }
 
 func TestAuth(t *testing.T) {
 	bc := cache.NewBucketCache()
 	bc.Add(bucket)
 
-	m := NewMiddleware(zap.NewNop().Sugar(), bc)
+	m := NewMiddleware(zap.NewNop().Sugar(), bc, "")
 
 	authfn := m.Auth(func(w http.ResponseWriter, r *http.Request) {
 		// mock
@@ -248,5 +251,270 @@ func TestAuth(t *testing.T) {
 		require.Equal(t, http.StatusForbidden, status)
 	})
 
+	t.Run("should authorize update as upload of the file", func(t *testing.T) {
+		t.Parallel()
+
+		fileID := "abcd-efgh-5678"
+
+		// Key of post operation
+		key := "abcd"
+		signer, _ := jwt.NewSignerHS(jwt.HS256, []byte(key))
+		builder := jwt.NewBuilder(signer)
+
+		updateURL := fmt.Sprintf("https://cdn.com/%s/%s", bucket.Name, fileID)
+
+		for claimed, expected := range map[string]int{
+			fileID:           http.StatusOK,
+			"another-file":   http.StatusForbidden,
+			"" /* upload */ : http.StatusForbidden,
+		} {
+			token, err := builder.Build(auth.Claims{
+				Bucket: bucket.Name,
+				FileID: claimed,
+			})
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			req, err := http.NewRequest(http.MethodPut, updateURL, nil)
+			require.NoError(t, err)
+
+			req.Header.Set("Authorization", "Bearer "+token.String())
+
+			router.ServeHTTP(w, req)
+
+			require.Equal(t, expected, w.Code, claimed)
+		}
+	})
+
 	// todo: missing tokens etc..
 }
+
+func TestTransfer(t *testing.T) {
+	destination := &entities.Bucket{
+		Name: "public-site",
+		Operations: []*entities.Operation{
+			{Name: "post", Type: "private", Keys: []string{"efgh"}},
+		},
+	}
+
+	bc := cache.NewBucketCache()
+	bc.Add(bucket)
+	bc.Add(destination)
+
+	m := NewMiddleware(zap.NewNop().Sugar(), bc, "")
+
+	router := mux.NewRouter()
+	router.Handle("/{bucket}/{fileUUID}/{transfer:copy|move}", m.Transfer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	token := func(key string, claims auth.Claims) string {
+		signer, _ := jwt.NewSignerHS(jwt.HS256, []byte(key))
+		token, err := jwt.NewBuilder(signer).Build(claims)
+		require.NoError(t, err)
+		return "Bearer " + token.String()
+	}
+
+	fileID := "abcd-efgh"
+	sourceToken := token("abcd", auth.Claims{Bucket: bucket.Name, FileID: fileID})
+	destinationToken := token("efgh", auth.Claims{Bucket: destination.Name})
+
+	cases := []struct {
+		name        string
+		transfer    string
+		source      string
+		destination string
+		code        int
+	}{
+		{"should allow copy", "copy", sourceToken, destinationToken, http.StatusOK},
+		{"should deny copy without destination's token", "copy", sourceToken, "", http.StatusUnauthorized},
+		{"should deny copy with source's token for destination", "copy", sourceToken, sourceToken, http.StatusForbidden},
+		{"should deny copy of another file", "copy", token("abcd", auth.Claims{Bucket: bucket.Name, FileID: "another"}), destinationToken, http.StatusForbidden},
+		// Delete of the source bucket is unreachable
+		{"should deny move", "move", sourceToken, destinationToken, http.StatusForbidden},
+	}
+
+	for _, tc := range cases {
+		url := fmt.Sprintf("https://cdn.com/%s/%s/%s?to=%s", bucket.Name, fileID, tc.transfer, destination.Name)
+		req, err := http.NewRequest(http.MethodPost, url, nil)
+		require.NoError(t, err)
+
+		req.Header.Set("Authorization", tc.source)
+		if tc.destination != "" {
+			req.Header.Set("Destination-Authorization", tc.destination)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		require.Equal(t, tc.code, w.Code, tc.name)
+	}
+}
+
+func TestBatchDelete(t *testing.T) {
+	uploads := &entities.Bucket{
+		Name: "uploads",
+		Operations: []*entities.Operation{
+			{Name: "delete", Type: "private", Keys: []string{"efgh"}},
+		},
+	}
+
+	bc := cache.NewBucketCache()
+	bc.Add(bucket)
+	bc.Add(uploads)
+
+	m := NewMiddleware(zap.NewNop().Sugar(), bc, "admin")
+
+	router := mux.NewRouter()
+	router.Handle("/{bucket}/delete", m.BatchDelete(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	token := func(key string, claims auth.Claims) string {
+		signer, _ := jwt.NewSignerHS(jwt.HS256, []byte(key))
+		token, err := jwt.NewBuilder(signer).Build(claims)
+		require.NoError(t, err)
+		return "Bearer " + token.String()
+	}
+
+	cases := []struct {
+		name   string
+		bucket string
+		token  string
+		code   int
+	}{
+		{"should allow bucket's token", uploads.Name, token("efgh", auth.Claims{Bucket: uploads.Name}), http.StatusOK},
+		{"should deny token of a single file", uploads.Name, token("efgh", auth.Claims{Bucket: uploads.Name, FileID: "abcd-efgh"}), http.StatusForbidden},
+		{"should deny token of another bucket", uploads.Name, token("efgh", auth.Claims{Bucket: bucket.Name}), http.StatusForbidden},
+		{"should deny without token", uploads.Name, "", http.StatusUnauthorized},
+		{"should allow admin's token", uploads.Name, token("admin", auth.Claims{Bucket: uploads.Name}), http.StatusOK},
+		// Delete of the bucket is unreachable by its own tokens only
+		{"should allow admin's token of unreachable delete", bucket.Name, token("admin", auth.Claims{Bucket: bucket.Name}), http.StatusOK},
+		{"should deny admin's token of another bucket", bucket.Name, token("admin", auth.Claims{Bucket: uploads.Name}), http.StatusForbidden},
+	}
+
+	for _, tc := range cases {
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("https://cdn.com/%s/delete", tc.bucket), nil)
+		require.NoError(t, err)
+
+		if tc.token != "" {
+			req.Header.Set("Authorization", tc.token)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		require.Equal(t, tc.code, w.Code, tc.name)
+	}
+
+	t.Run("should deny admin's token without admin", func(t *testing.T) {
+		m := NewMiddleware(zap.NewNop().Sugar(), bc, "")
+
+		req, err := http.NewRequest(http.MethodPost, "https://cdn.com/uploads/delete", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", token("admin", auth.Claims{Bucket: uploads.Name}))
+
+		w := httptest.NewRecorder()
+		m.BatchDelete(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})(w, mux.SetURLVars(req, map[string]string{"bucket": uploads.Name}))
+
+		require.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
+
+func TestAdmin(t *testing.T) {
+	bc := cache.NewBucketCache()
+	bc.Add(bucket)
+
+	token := func(key string, claims auth.Claims) string {
+		signer, _ := jwt.NewSignerHS(jwt.HS256, []byte(key))
+		token, err := jwt.NewBuilder(signer).Build(claims)
+		require.NoError(t, err)
+		return "Bearer " + token.String()
+	}
+
+	cases := []struct {
+		name     string
+		adminKey string
+		token    string
+		code     int
+	}{
+		{"should allow admin's token", "admin", token("admin", auth.Claims{Bucket: bucket.Name}), http.StatusOK},
+		{"should deny admin's token of another bucket", "admin", token("admin", auth.Claims{Bucket: "uploads"}), http.StatusForbidden},
+		{"should deny bucket's token", "admin", token("abcd", auth.Claims{Bucket: bucket.Name}), http.StatusForbidden},
+		{"should deny without token", "admin", "", http.StatusUnauthorized},
+		{"should deny admin's token without admin", "", token("admin", auth.Claims{Bucket: bucket.Name}), http.StatusForbidden},
+	}
+
+	for _, tc := range cases {
+		m := NewMiddleware(zap.NewNop().Sugar(), bc, tc.adminKey)
+
+		router := mux.NewRouter()
+		router.Handle("/api/bucket/{bucket}/usage", m.Admin(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://cdn.com/api/bucket/%s/usage", bucket.Name), nil)
+		require.NoError(t, err)
+
+		if tc.token != "" {
+			req.Header.Set("Authorization", tc.token)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		require.Equal(t, tc.code, w.Code, tc.name)
+	}
+}
+
+func TestHLS(t *testing.T) {
+	bc := cache.NewBucketCache()
+	bc.Add(bucket)
+
+	m := NewMiddleware(zap.NewNop().Sugar(), bc, "")
+
+	router := mux.NewRouter()
+	router.Handle("/{bucket}/{fileUUID}/hls/{hlsPath:.+}", m.HLS(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	signed := func(key, file, path string, expires time.Time) string {
+		return url.Values{
+			hls.ExpiresKey:   {strconv.FormatInt(expires.Unix(), 10)},
+			hls.SignatureKey: {hls.Sign(key, bucket.Name+"/"+file, path, expires.Unix())},
+		}.Encode()
+	}
+
+	signer, _ := jwt.NewSignerHS(jwt.HS256, []byte("abcd"))
+	token, err := jwt.NewBuilder(signer).Build(auth.Claims{Bucket: bucket.Name, FileID: "1234"})
+	require.NoError(t, err)
+
+	later := time.Now().Add(time.Hour)
+
+	cases := []struct {
+		name  string
+		path  string
+		query string
+		code  int
+	}{
+		{"should allow signed segment", "720p/seg_001.ts", signed("abcd", "1234", "720p/seg_001.ts", later), http.StatusOK},
+		{"should allow token", "master.m3u8", "auth=" + token.String(), http.StatusOK},
+		{"should deny signature of another segment", "720p/seg_002.ts", signed("abcd", "1234", "720p/seg_001.ts", later), http.StatusForbidden},
+		{"should deny signature of another file", "720p/seg_001.ts", signed("abcd", "5678", "720p/seg_001.ts", later), http.StatusForbidden},
+		{"should deny signature of another key", "720p/seg_001.ts", signed("efgh", "1234", "720p/seg_001.ts", later), http.StatusForbidden},
+		{"should deny expired signature", "720p/seg_001.ts", signed("abcd", "1234", "720p/seg_001.ts", time.Now().Add(-time.Minute)), http.StatusForbidden},
+		{"should deny without token", "master.m3u8", "", http.StatusUnauthorized},
+	}
+
+	for _, tc := range cases {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://cdn.com/%s/1234/hls/%s?%s", bucket.Name, tc.path, tc.query), nil)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		require.Equal(t, tc.code, w.Code, tc.name)
+	}
+}
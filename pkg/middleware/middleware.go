@@ -10,8 +10,8 @@ type Middlewares struct {
 	JwtMiddleware *jwt.Middleware
 }
 
-func NewMiddlewares(logger *zap.SugaredLogger, bucketCache *cache.BucketCache) *Middlewares {
-	jwtm := jwt.NewMiddleware(logger, bucketCache)
+func NewMiddlewares(logger *zap.SugaredLogger, bucketCache *cache.BucketCache, adminKey string) *Middlewares {
+	jwtm := jwt.NewMiddleware(logger, bucketCache, adminKey)
 
 	return &Middlewares{JwtMiddleware: jwtm}
 }
@@ -0,0 +1,335 @@
+// package plugin runs modules out of process. Plugin is an executable serving
+// newline-delimited JSON over a unix socket whose path is passed in SocketEnv.
+// Every connection carries a single Request and a single Response.
+// Plugin exiting for any reason is restarted, so its crash fails renders in flight only
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	ErrNotFound = errors.New("plugin binary not found")
+	// Plugin is not running (e.g. crashed and is being restarted)
+	ErrUnavailable = errors.New("plugin is unavailable")
+	// Plugin broke the protocol
+	ErrFailed = errors.New("plugin failed")
+
+	errClosed = errors.New("plugin is closed")
+)
+
+// SocketEnv is environment variable holding path of socket plugin must listen on
+const SocketEnv = "CDN_PLUGIN_SOCKET"
+
+// Methods of Request
+const (
+	MethodDescribe = "describe"
+	MethodRender   = "render"
+)
+
+var (
+	// Delay before plugin is restarted. Doubles while plugin keeps exiting
+	restartDelay    = time.Second
+	maxRestartDelay = time.Second * 30
+	// Plugin running that long is considered healthy, so delay is reset
+	healthyRun = time.Minute
+	// How often socket is polled while plugin is starting
+	dialInterval = time.Millisecond * 50
+)
+
+type Resolver struct {
+	Name string `json:"name"`
+	// Arguments resolver accepts. Empty accepts any argument matching Pattern
+	Arguments []string `json:"arguments,omitempty"`
+	// Regular expression argument must match as a whole
+	Pattern string `json:"pattern,omitempty"`
+	// Argument meaning the resolver does nothing
+	Default string `json:"default,omitempty"`
+}
+
+// Manifest is what plugin advertises in response to MethodDescribe
+type Manifest struct {
+	// Name of module plugin registers
+	Name string `json:"name"`
+	// Resolvers in order plugin applies them
+	Resolvers []Resolver `json:"resolvers"`
+	// Mime types of files module applies to (see modules.Module)
+	MimeTypes []string `json:"mime_types,omitempty"`
+}
+
+type Request struct {
+	Method string `json:"method"`
+	// Resolvers to apply with their arguments. Defaults are never passed
+	Resolvers map[string]string `json:"resolvers,omitempty"`
+	File      []byte            `json:"file,omitempty"`
+}
+
+type Response struct {
+	Manifest *Manifest `json:"manifest,omitempty"`
+	File     []byte    `json:"file,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	// Status of Error. Client sees Error only if it's 4xx
+	Status int `json:"status,omitempty"`
+}
+
+// Error is failure plugin reported itself
+type Error struct {
+	Msg    string
+	Status int
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("plugin error %d: %s", e.Status, e.Msg)
+}
+
+type Plugin struct {
+	path   string
+	args   []string
+	dir    string
+	socket string
+	logger *zap.SugaredLogger
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	closed bool
+	// Closed by Close to interrupt restart delay
+	quit chan struct{}
+	// Closed when supervisor is done after Close
+	done chan struct{}
+}
+
+// Start runs plugin binary found by path or name in $PATH and waits
+// for it to describe itself within startTimeout
+func Start(logger *zap.SugaredLogger, path string, args []string, startTimeout time.Duration) (*Plugin, *Manifest, error) {
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s: %v", ErrNotFound, path, err)
+	}
+
+	dir, err := os.MkdirTemp("", "plugin-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("plugin.Start.os.MkdirTemp: %w", err)
+	}
+
+	p := &Plugin{
+		path:   resolved,
+		args:   args,
+		dir:    dir,
+		socket: filepath.Join(dir, "plugin.sock"),
+		logger: logger,
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	if err := p.start(); err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	go p.supervise()
+
+	ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+	defer cancel()
+
+	manifest, err := p.describe(ctx)
+	if err != nil {
+		p.Close()
+		return nil, nil, err
+	}
+
+	return p, manifest, nil
+}
+
+// Render asks plugin to apply resolvers to file.
+// Deadline of ctx bounds the whole exchange
+func (p *Plugin) Render(ctx context.Context, resolvers map[string]string, file []byte) ([]byte, error) {
+	resp, err := p.call(ctx, &Request{Method: MethodRender, Resolvers: resolvers, File: file})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.File) == 0 {
+		return nil, fmt.Errorf("%w: no output", ErrFailed)
+	}
+
+	return resp.File, nil
+}
+
+// Close stops plugin. It's not restarted anymore
+func (p *Plugin) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.quit)
+	if p.cmd != nil {
+		p.cmd.Process.Kill()
+	}
+	p.mu.Unlock()
+
+	<-p.done
+	os.RemoveAll(p.dir)
+}
+
+// describe polls socket until plugin listens on it
+func (p *Plugin) describe(ctx context.Context) (*Manifest, error) {
+	for {
+		resp, err := p.call(ctx, &Request{Method: MethodDescribe})
+		if err == nil {
+			if resp.Manifest == nil {
+				return nil, fmt.Errorf("%w: no manifest", ErrFailed)
+			}
+			return resp.Manifest, nil
+		}
+
+		if !errors.Is(err, ErrUnavailable) {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %s didn't start: %v", ErrUnavailable, p.path, err)
+		case <-time.After(dialInterval):
+		}
+	}
+}
+
+func (p *Plugin) call(ctx context.Context, req *Request) (*Response, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", p.socket)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer conn.Close()
+
+	// Connection is closed on cancellation, so plugin could abandon the work
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, p.connErr(ctx, err)
+	}
+
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+			return nil, fmt.Errorf("%w: invalid response: %v", ErrFailed, err)
+		}
+		return nil, p.connErr(ctx, err)
+	}
+
+	if resp.Error != "" || resp.Status != 0 {
+		return nil, &Error{Msg: resp.Error, Status: resp.Status}
+	}
+
+	return &resp, nil
+}
+
+// connErr tells cancellation from plugin gone in the middle of request
+func (p *Plugin) connErr(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+
+	return fmt.Errorf("%w: %v", ErrUnavailable, err)
+}
+
+// start runs plugin unless it's closed. Lock is held,
+// so that Close never misses process to kill
+func (p *Plugin) start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return errClosed
+	}
+
+	// Socket of the previous run is left if plugin crashed
+	os.Remove(p.socket)
+
+	cmd := exec.Command(p.path, p.args...)
+	cmd.Env = append(os.Environ(), SocketEnv+"="+p.socket)
+	cmd.Dir = p.dir
+	// Plugin logs along with CDN
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("plugin.start.cmd.Start: %w", err)
+	}
+	p.cmd = cmd
+
+	return nil
+}
+
+// supervise restarts plugin whenever it exits until it's closed
+func (p *Plugin) supervise() {
+	defer close(p.done)
+
+	delay := restartDelay
+	for {
+		p.mu.Lock()
+		cmd := p.cmd
+		p.mu.Unlock()
+
+		started := time.Now()
+		err := cmd.Wait()
+
+		for {
+			if p.isClosed() {
+				return
+			}
+
+			if time.Since(started) > healthyRun {
+				delay = restartDelay
+			}
+
+			p.logger.Warnf("plugin %s exited: %v. restarting in %s", p.path, err, delay)
+			select {
+			case <-time.After(delay):
+			case <-p.quit:
+				return
+			}
+			if delay *= 2; delay > maxRestartDelay {
+				delay = maxRestartDelay
+			}
+
+			if err = p.start(); err == nil {
+				break
+			}
+			if errors.Is(err, errClosed) {
+				return
+			}
+			started = time.Now()
+		}
+	}
+}
+
+func (p *Plugin) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.closed
+}
@@ -0,0 +1,97 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+const helperEnv = "PLUGIN_TEST_HELPER"
+
+var manifest = &Manifest{
+	Name: "reverse",
+	Resolvers: []Resolver{
+		{Name: "reverse", Arguments: []string{"true", "false"}, Default: "false"},
+		{Name: "act", Arguments: []string{"fail", "crash", "hang"}},
+	},
+	MimeTypes: []string{"text/"},
+}
+
+// Test binary serves as plugin when it's run by Start
+func TestMain(m *testing.M) {
+	if os.Getenv(helperEnv) == "" {
+		os.Exit(m.Run())
+	}
+
+	err := Serve(manifest, func(resolvers map[string]string, file []byte) ([]byte, error) {
+		switch resolvers["act"] {
+		case "fail":
+			return nil, &Error{Msg: "bad file", Status: http.StatusBadRequest}
+		case "crash":
+			os.Exit(2)
+		case "hang":
+			time.Sleep(time.Minute)
+		}
+
+		out := make([]byte, len(file))
+		for i, b := range file {
+			out[len(file)-1-i] = b
+		}
+		return out, nil
+	})
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+func TestPlugin(t *testing.T) {
+	t.Setenv(helperEnv, "1")
+	restartDelay = time.Millisecond * 10
+
+	p, m, err := Start(zap.NewNop().Sugar(), os.Args[0], nil, time.Second*5)
+	require.NoError(t, err)
+	defer p.Close()
+	require.Equal(t, manifest, m)
+
+	out, err := p.Render(context.Background(), map[string]string{"reverse": "true"}, []byte("abc"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("cba"), out)
+
+	_, err = p.Render(context.Background(), map[string]string{"act": "fail"}, []byte("abc"))
+	var perr *Error
+	require.True(t, errors.As(err, &perr))
+	require.Equal(t, &Error{Msg: "bad file", Status: http.StatusBadRequest}, perr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	_, err = p.Render(ctx, map[string]string{"act": "hang"}, []byte("abc"))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Crash fails the render in flight only, plugin is restarted
+	_, err = p.Render(context.Background(), map[string]string{"act": "crash"}, []byte("abc"))
+	require.ErrorIs(t, err, ErrUnavailable)
+
+	require.Eventually(t, func() bool {
+		out, err := p.Render(context.Background(), map[string]string{"reverse": "true"}, []byte("ab"))
+		return err == nil && string(out) == "ba"
+	}, time.Second*5, time.Millisecond*20)
+}
+
+func TestStart(t *testing.T) {
+	_, _, err := Start(zap.NewNop().Sugar(), filepath.Join(t.TempDir(), "nope"), nil, time.Second)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// Plugin never listening on socket
+	path := filepath.Join(t.TempDir(), "plugin")
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\nexec sleep 5\n"), 0755))
+
+	_, _, err = Start(zap.NewNop().Sugar(), path, nil, time.Millisecond*200)
+	require.ErrorIs(t, err, ErrUnavailable)
+}
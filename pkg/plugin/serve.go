@@ -0,0 +1,69 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+)
+
+// RenderFunc applies resolvers to file. Returning *Error lets plugin
+// tell client what's wrong with the request
+type RenderFunc func(resolvers map[string]string, file []byte) ([]byte, error)
+
+// Serve implements plugin side of the protocol for plugins written in Go.
+// It listens on socket passed by CDN and never returns unless listening fails
+func Serve(manifest *Manifest, render RenderFunc) error {
+	socket := os.Getenv(SocketEnv)
+	if socket == "" {
+		return fmt.Errorf("missing %s env", SocketEnv)
+	}
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return fmt.Errorf("plugin.Serve.net.Listen: %w", err)
+	}
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return fmt.Errorf("plugin.Serve.l.Accept: %w", err)
+		}
+
+		go serveConn(conn, manifest, render)
+	}
+}
+
+func serveConn(conn net.Conn, manifest *Manifest, render RenderFunc) {
+	defer conn.Close()
+
+	var req Request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+
+	var resp Response
+	switch req.Method {
+	case MethodDescribe:
+		resp.Manifest = manifest
+	case MethodRender:
+		out, err := render(req.Resolvers, req.File)
+		if err != nil {
+			resp.Error, resp.Status = err.Error(), http.StatusInternalServerError
+
+			var perr *Error
+			if errors.As(err, &perr) {
+				resp.Error, resp.Status = perr.Msg, perr.Status
+			}
+			break
+		}
+		resp.File = out
+	default:
+		resp.Error, resp.Status = "unknown method "+req.Method, http.StatusInternalServerError
+	}
+
+	json.NewEncoder(conn).Encode(&resp)
+}
@@ -0,0 +1,195 @@
+// package pool provides bounded pool for CPU-bound work.
+// Unlike dealer it never blocks submitter on a full queue: Do fails fast with ErrQueueFull.
+// Queued work is grouped by key (e.g. bucket) and picked round-robin,
+// so a single hot key can't starve the others
+
+package pool
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrQueueFull = errors.New("processing queue is full, try again later")
+	ErrStopped   = errors.New("processing pool is stopped")
+)
+
+type Func func() (any, error)
+
+// Lingering is returned by Func replying before its work is done, e.g. abandoned on timeout.
+// Submitter gets Err right away, while worker waits for Done,
+// so that lingering work still counts against the workers
+type Lingering struct {
+	Err  error
+	Done <-chan struct{}
+}
+
+func (l *Lingering) Error() string {
+	return l.Err.Error()
+}
+
+func (l *Lingering) Unwrap() error {
+	return l.Err
+}
+
+type task struct {
+	f    Func
+	out  any
+	err  error
+	done chan struct{}
+}
+
+type Pool struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	wg   *sync.WaitGroup
+
+	// Pending tasks by key
+	queues map[string][]*task
+	// Keys with pending tasks in round-robin order
+	order []string
+	// Total amount of pending tasks
+	queued int
+
+	workers     int
+	maxQueued   int
+	maxQueuedBy int
+	stopped     bool
+}
+
+// New creates pool of workers. maxQueued limits pending tasks in total,
+// maxQueuedBy limits pending tasks of a single key
+func New(workers int, maxQueued int, maxQueuedBy int) *Pool {
+	p := &Pool{
+		wg:          new(sync.WaitGroup),
+		queues:      make(map[string][]*task),
+		workers:     workers,
+		maxQueued:   maxQueued,
+		maxQueuedBy: maxQueuedBy,
+	}
+	p.cond = sync.NewCond(&p.mu)
+
+	return p
+}
+
+func (p *Pool) Start() {
+	for i := 0; i < p.workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+}
+
+// Stop waits for pending tasks to complete and stops all workers
+func (p *Pool) Stop() {
+	p.mu.Lock()
+	p.stopped = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
+
+// Do queues f under key and waits for its result.
+// Returns ErrQueueFull immediately if either limit is exceeded
+func (p *Pool) Do(key string, f Func) (any, error) {
+	t := &task{
+		f:    f,
+		done: make(chan struct{}),
+	}
+
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return nil, ErrStopped
+	}
+
+	q := p.queues[key]
+	if p.queued >= p.maxQueued || len(q) >= p.maxQueuedBy {
+		p.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+
+	if len(q) == 0 {
+		p.order = append(p.order, key)
+	}
+	p.queues[key] = append(q, t)
+	p.queued++
+	p.cond.Signal()
+	p.mu.Unlock()
+
+	<-t.done
+	return t.out, t.err
+}
+
+// Queued returns amount of pending tasks
+func (p *Pool) Queued() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.queued
+}
+
+func (p *Pool) work() {
+	defer p.wg.Done()
+
+	for {
+		t, ok := p.next()
+		if !ok {
+			return
+		}
+
+		p.run(t)
+	}
+}
+
+// next pops a task of the next key in order. Returns false if pool is stopped and drained
+func (p *Pool) next() (*task, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.queued == 0 {
+		if p.stopped {
+			return nil, false
+		}
+		p.cond.Wait()
+	}
+
+	key := p.order[0]
+	p.order = p.order[1:]
+
+	q := p.queues[key]
+	t := q[0]
+	if len(q) == 1 {
+		delete(p.queues, key)
+	} else {
+		p.queues[key] = q[1:]
+		// Key goes to the end of the line
+		p.order = append(p.order, key)
+	}
+	p.queued--
+
+	return t, true
+}
+
+func (p *Pool) run(t *task) {
+	var lingering *Lingering
+
+	func() {
+		defer close(t.done)
+		defer func() {
+			if r := recover(); r != nil {
+				t.out, t.err = nil, fmt.Errorf("processing task panicked: %v", r)
+			}
+		}()
+
+		t.out, t.err = t.f()
+		if errors.As(t.err, &lingering) {
+			t.err = lingering.Err
+		}
+	}()
+
+	if lingering != nil {
+		<-lingering.Done
+	}
+}
@@ -0,0 +1,206 @@
+package pool
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanStartStop(t *testing.T) {
+	p := New(2, 10, 10)
+	p.Start()
+	p.Stop()
+
+	_, err := p.Do("key", func() (any, error) { return nil, nil })
+	require.ErrorIs(t, err, ErrStopped)
+}
+
+func TestDo(t *testing.T) {
+	t.Parallel()
+
+	p := New(2, 10, 10)
+	p.Start()
+	defer p.Stop()
+
+	out, err := p.Do("key", func() (any, error) {
+		return "bar", nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "bar", out)
+
+	someErr := errors.New("some error")
+	_, err = p.Do("key", func() (any, error) {
+		return nil, someErr
+	})
+	require.ErrorIs(t, err, someErr)
+
+	_, err = p.Do("key", func() (any, error) {
+		panic("boom")
+	})
+	require.Error(t, err)
+}
+
+func TestLingering(t *testing.T) {
+	t.Parallel()
+
+	p := New(1, 10, 10)
+	p.Start()
+	defer p.Stop()
+
+	timeout := errors.New("timeout")
+	release := make(chan struct{})
+
+	_, err := p.Do("key", func() (any, error) {
+		return nil, &Lingering{Err: timeout, Done: release}
+	})
+	require.ErrorIs(t, err, timeout)
+	require.Equal(t, timeout, err)
+
+	// The only worker is held by lingering work
+	next := make(chan struct{})
+	go func() {
+		_, _ = p.Do("key", func() (any, error) { return nil, nil })
+		close(next)
+	}()
+
+	select {
+	case <-next:
+		t.Fatal("worker is released before lingering work is done")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	close(release)
+	<-next
+}
+
+func TestQueueFull(t *testing.T) {
+	t.Parallel()
+
+	p := New(1, 2, 2)
+	p.Start()
+	defer p.Stop()
+
+	release := make(chan struct{})
+	block := func() (any, error) {
+		<-release
+		return nil, nil
+	}
+
+	wg := new(sync.WaitGroup)
+	wg.Add(3)
+	// One is running, two are queued
+	for i := 0; i < 3; i++ {
+		go func() {
+			defer wg.Done()
+			p.Do("key", block)
+		}()
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	require.Equal(t, 2, p.Queued())
+
+	_, err := p.Do("other", block)
+	require.ErrorIs(t, err, ErrQueueFull)
+
+	close(release)
+	wg.Wait()
+	require.Equal(t, 0, p.Queued())
+}
+
+func TestQueueFullByKey(t *testing.T) {
+	t.Parallel()
+
+	p := New(1, 10, 1)
+	p.Start()
+	defer p.Stop()
+
+	release := make(chan struct{})
+	block := func() (any, error) {
+		<-release
+		return nil, nil
+	}
+
+	wg := new(sync.WaitGroup)
+	wg.Add(2)
+	// One is running, one is queued
+	for i := 0; i < 2; i++ {
+		go func() {
+			defer wg.Done()
+			p.Do("hot", block)
+		}()
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	_, err := p.Do("hot", block)
+	require.ErrorIs(t, err, ErrQueueFull)
+
+	// Other keys are still accepted
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := p.Do("cold", block)
+		require.NoError(t, err)
+	}()
+	time.Sleep(time.Millisecond * 20)
+
+	close(release)
+	wg.Wait()
+}
+
+func TestRoundRobin(t *testing.T) {
+	t.Parallel()
+
+	p := New(1, 100, 100)
+	p.Start()
+	defer p.Stop()
+
+	release := make(chan struct{})
+	wg := new(sync.WaitGroup)
+
+	// Occupy the only worker
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.Do("block", func() (any, error) {
+			<-release
+			return nil, nil
+		})
+	}()
+	time.Sleep(time.Millisecond * 20)
+
+	var (
+		mu    sync.Mutex
+		order []string
+	)
+	record := func(key string) Func {
+		return func() (any, error) {
+			mu.Lock()
+			order = append(order, key)
+			mu.Unlock()
+			return nil, nil
+		}
+	}
+
+	// Hot key queues a lot before cold one
+	submit := func(key string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Do(key, record(key))
+		}()
+		time.Sleep(time.Millisecond * 5)
+	}
+	for i := 0; i < 3; i++ {
+		submit("hot")
+	}
+	submit("cold")
+
+	close(release)
+	wg.Wait()
+
+	// Cold key doesn't wait for all hot ones
+	require.Equal(t, []string{"hot", "cold", "hot", "hot"}, order)
+}
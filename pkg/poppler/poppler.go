@@ -0,0 +1,226 @@
+// package poppler renders PDF pages with poppler utilities (pdftoppm, pdfinfo).
+// Like ffmpeg, documents are passed through a temporary directory removed right after the run
+
+package poppler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNotFound = errors.New("poppler binary not found")
+	ErrFailed   = errors.New("poppler failed")
+)
+
+// Max bytes of stderr kept in error
+const maxStderr = 512
+
+type Poppler struct {
+	pdftoppm string
+	pdfinfo  string
+}
+
+// New looks up pdftoppm and pdfinfo binaries by path or name in $PATH
+func New(pdftoppm, pdfinfo string) (*Poppler, error) {
+	p := &Poppler{}
+	for _, bin := range []struct {
+		path     string
+		resolved *string
+	}{{pdftoppm, &p.pdftoppm}, {pdfinfo, &p.pdfinfo}} {
+		resolved, err := exec.LookPath(bin.path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrNotFound, bin.path, err)
+		}
+		*bin.resolved = resolved
+	}
+
+	return p, nil
+}
+
+// Render renders page (starting from 1) to PNG at dpi
+func (p *Poppler) Render(ctx context.Context, pdf []byte, page, dpi int) ([]byte, error) {
+	return p.render(ctx, pdf, page, "-r", strconv.Itoa(dpi))
+}
+
+// RenderWidth renders page (starting from 1) to PNG of width keeping aspect ratio
+func (p *Poppler) RenderWidth(ctx context.Context, pdf []byte, page, width int) ([]byte, error) {
+	return p.render(ctx, pdf, page, "-scale-to-x", strconv.Itoa(width), "-scale-to-y", "-1")
+}
+
+func (p *Poppler) render(ctx context.Context, pdf []byte, page int, args ...string) ([]byte, error) {
+	dir, in, err := prepare(pdf)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	n := strconv.Itoa(page)
+	args = append([]string{"-f", n, "-l", n, "-png", "-singlefile"}, args...)
+	// pdftoppm adds extension to output prefix itself
+	args = append(args, in, filepath.Join(dir, "out"))
+
+	if _, err := run(ctx, dir, p.pdftoppm, args...); err != nil {
+		return nil, err
+	}
+
+	out, err := os.ReadFile(filepath.Join(dir, "out.png"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: no output: %v", ErrFailed, err)
+	}
+
+	return out, nil
+}
+
+// Info is what pdfinfo reports of document and one of its pages
+type Info struct {
+	Pages int
+	// Size of page in points (1/72 inch). Zero if page is out of range
+	Width  float64
+	Height float64
+}
+
+// Pages returns number of pages of document
+func (p *Poppler) Pages(ctx context.Context, pdf []byte) (int, error) {
+	info, err := p.Info(ctx, pdf, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Pages, nil
+}
+
+// Info returns number of pages of document and size of page (starting from 1).
+// Zero page is not examined
+func (p *Poppler) Info(ctx context.Context, pdf []byte, page int) (*Info, error) {
+	dir, in, err := prepare(pdf)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{in}
+	if page > 0 {
+		n := strconv.Itoa(page)
+		args = []string{"-f", n, "-l", n, in}
+	}
+
+	out, err := run(ctx, dir, p.pdfinfo, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &Info{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+
+		// Page size is reported as "Page    3 size: 595.276 x 841.89 pts (A4)"
+		if fields := strings.Fields(key); len(fields) == 3 && fields[0] == "Page" && fields[2] == "size" {
+			if info.Width, info.Height, err = parseSize(value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if key != "Pages" {
+			continue
+		}
+
+		info.Pages, err = strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid pages: %s", ErrFailed, value)
+		}
+	}
+
+	if info.Pages == 0 {
+		return nil, fmt.Errorf("%w: pdfinfo reported no pages", ErrFailed)
+	}
+
+	return info, nil
+}
+
+func parseSize(value string) (float64, float64, error) {
+	fields := strings.Fields(value)
+	if len(fields) < 3 || fields[1] != "x" {
+		return 0, 0, fmt.Errorf("%w: invalid page size: %s", ErrFailed, value)
+	}
+
+	width, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: invalid page size: %s", ErrFailed, value)
+	}
+	height, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: invalid page size: %s", ErrFailed, value)
+	}
+
+	return width, height, nil
+}
+
+// prepare writes document to a temporary dir
+func prepare(pdf []byte) (string, string, error) {
+	dir, err := os.MkdirTemp("", "poppler-*")
+	if err != nil {
+		return "", "", fmt.Errorf("poppler.os.MkdirTemp: %w", err)
+	}
+
+	in := filepath.Join(dir, "in.pdf")
+	if err := os.WriteFile(in, pdf, 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", "", fmt.Errorf("poppler.os.WriteFile: %w", err)
+	}
+
+	return dir, in, nil
+}
+
+// run returns stdout of binary. Output goes to files rather than pipes
+// for the same reason as in ffmpeg package
+func run(ctx context.Context, dir, bin string, args ...string) ([]byte, error) {
+	stdout, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		return nil, fmt.Errorf("poppler.os.Create: %w", err)
+	}
+	defer stdout.Close()
+
+	stderr, err := os.Create(filepath.Join(dir, "stderr"))
+	if err != nil {
+		return nil, fmt.Errorf("poppler.os.Create: %w", err)
+	}
+	defer stderr.Close()
+
+	cmd := exec.CommandContext(ctx, bin, args...)
+	cmd.Dir = dir
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		logged, _ := os.ReadFile(stderr.Name())
+		msg := strings.TrimSpace(string(logged))
+		if len(msg) > maxStderr {
+			msg = msg[:maxStderr]
+		}
+		return nil, fmt.Errorf("%w: %s: %v: %s", ErrFailed, filepath.Base(bin), err, msg)
+	}
+
+	out, err := os.ReadFile(stdout.Name())
+	if err != nil {
+		return nil, fmt.Errorf("poppler.os.ReadFile: %w", err)
+	}
+
+	return out, nil
+}
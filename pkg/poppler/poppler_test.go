@@ -0,0 +1,95 @@
+package poppler
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func fakeBinary(t *testing.T, name, body string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	script := "#!/bin/sh\n" + body + "\n"
+	require.NoError(t, os.WriteFile(path, []byte(script), 0755))
+
+	return path
+}
+
+// pdftoppmScript writes its arguments to {prefix}.png
+const pdftoppmScript = `for last; do :; done
+echo "$@" > "$last.png"`
+
+const pdfinfoScript = `printf 'Title:          chapter\nPages:          12\nEncrypted:      no\n'
+if [ "$1" = -f ]; then printf 'Page %4d size: 595.276 x 841.89 pts (A4)\nPage %4d rot:  0\n' "$2" "$2"; fi`
+
+func TestNew(t *testing.T) {
+	_, err := New(filepath.Join(t.TempDir(), "nope"), fakeBinary(t, "pdfinfo", pdfinfoScript))
+	require.ErrorIs(t, err, ErrNotFound)
+
+	_, err = New(fakeBinary(t, "pdftoppm", pdftoppmScript), filepath.Join(t.TempDir(), "nope"))
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestRender(t *testing.T) {
+	p, err := New(fakeBinary(t, "pdftoppm", pdftoppmScript), fakeBinary(t, "pdfinfo", pdfinfoScript))
+	require.NoError(t, err)
+
+	out, err := p.Render(context.Background(), []byte("%PDF-1.7"), 3, 150)
+	require.NoError(t, err)
+	require.Contains(t, string(out), "-f 3 -l 3 -png -singlefile -r 150 ")
+
+	out, err = p.RenderWidth(context.Background(), []byte("%PDF-1.7"), 1, 256)
+	require.NoError(t, err)
+	require.Contains(t, string(out), "-f 1 -l 1 -png -singlefile -scale-to-x 256 -scale-to-y -1 ")
+}
+
+func TestPages(t *testing.T) {
+	p, err := New(fakeBinary(t, "pdftoppm", pdftoppmScript), fakeBinary(t, "pdfinfo", pdfinfoScript))
+	require.NoError(t, err)
+
+	pages, err := p.Pages(context.Background(), []byte("%PDF-1.7"))
+	require.NoError(t, err)
+	require.Equal(t, 12, pages)
+
+	p, err = New(fakeBinary(t, "pdftoppm", pdftoppmScript), fakeBinary(t, "pdfinfo", `echo "Syntax Error" >&2; exit 1`))
+	require.NoError(t, err)
+
+	_, err = p.Pages(context.Background(), []byte("garbage"))
+	require.ErrorIs(t, err, ErrFailed)
+	require.Contains(t, err.Error(), "Syntax Error")
+}
+
+func TestInfo(t *testing.T) {
+	p, err := New(fakeBinary(t, "pdftoppm", pdftoppmScript), fakeBinary(t, "pdfinfo", pdfinfoScript))
+	require.NoError(t, err)
+
+	info, err := p.Info(context.Background(), []byte("%PDF-1.7"), 3)
+	require.NoError(t, err)
+	require.Equal(t, &Info{Pages: 12, Width: 595.276, Height: 841.89}, info)
+
+	info, err = p.Info(context.Background(), []byte("%PDF-1.7"), 0)
+	require.NoError(t, err)
+	require.Equal(t, &Info{Pages: 12}, info)
+
+	p, err = New(fakeBinary(t, "pdftoppm", pdftoppmScript), fakeBinary(t, "pdfinfo", `printf 'Pages: 1\nPage    1 size: wide x 10 pts\n'`))
+	require.NoError(t, err)
+
+	_, err = p.Info(context.Background(), []byte("%PDF-1.7"), 1)
+	require.ErrorIs(t, err, ErrFailed)
+}
+
+func TestTimeout(t *testing.T) {
+	p, err := New(fakeBinary(t, "pdftoppm", "sleep 5"), fakeBinary(t, "pdfinfo", pdfinfoScript))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	_, err = p.Render(ctx, []byte("%PDF-1.7"), 1, 72)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,216 @@
+// package precompress compresses files ahead of time, so that they're served
+// with Content-Encoding without compressing them on every request.
+// Gzip is done in process, brotli by its binary (like ffmpeg, input is passed
+// through a temporary directory removed right after the run)
+
+package precompress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Encodings as they appear in Accept-Encoding and Content-Encoding
+const (
+	Gzip   = "gzip"
+	Brotli = "br"
+)
+
+var ErrFailed = errors.New("brotli failed")
+
+// Max bytes of stderr kept in error
+const maxStderr = 512
+
+type Compressor struct {
+	// Empty if brotli binary is not found
+	brotli string
+}
+
+// New looks up brotli binary by path or name in $PATH.
+// If it's not found files are compressed with gzip only (see Encodings)
+func New(brotliPath string) *Compressor {
+	c := &Compressor{}
+	if brotliPath == "" {
+		return c
+	}
+
+	if resolved, err := exec.LookPath(brotliPath); err == nil {
+		c.brotli = resolved
+	}
+
+	return c
+}
+
+// Encodings compressor produces in order of preference
+func (c *Compressor) Encodings() []string {
+	if c.brotli == "" {
+		return []string{Gzip}
+	}
+
+	return []string{Brotli, Gzip}
+}
+
+// Compress returns variants of bits by encoding.
+// Variants which are not smaller than bits are useless, so they're missing
+func (c *Compressor) Compress(ctx context.Context, bits []byte) (map[string][]byte, error) {
+	variants := make(map[string][]byte, 2)
+
+	gzipped, err := c.gzip(bits)
+	if err != nil {
+		return nil, err
+	}
+	if len(gzipped) < len(bits) {
+		variants[Gzip] = gzipped
+	}
+
+	if c.brotli == "" {
+		return variants, nil
+	}
+
+	brotlied, err := c.runBrotli(ctx, bits)
+	if err != nil {
+		return nil, err
+	}
+	if len(brotlied) < len(bits) {
+		variants[Brotli] = brotlied
+	}
+
+	return variants, nil
+}
+
+func (c *Compressor) gzip(bits []byte) ([]byte, error) {
+	var buff bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buff, gzip.BestCompression)
+	if err != nil {
+		return nil, fmt.Errorf("precompress.gzip.NewWriterLevel: %w", err)
+	}
+
+	if _, err := zw.Write(bits); err != nil {
+		return nil, fmt.Errorf("precompress.gzip.Write: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("precompress.gzip.Close: %w", err)
+	}
+
+	return buff.Bytes(), nil
+}
+
+func (c *Compressor) runBrotli(ctx context.Context, bits []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "brotli-*")
+	if err != nil {
+		return nil, fmt.Errorf("precompress.os.MkdirTemp: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	in, out := filepath.Join(dir, "in"), filepath.Join(dir, "out.br")
+	if err := os.WriteFile(in, bits, 0600); err != nil {
+		return nil, fmt.Errorf("precompress.os.WriteFile: %w", err)
+	}
+
+	// Stderr goes to file rather than pipe for the same reason as in ffmpeg package
+	stderr, err := os.Create(filepath.Join(dir, "stderr"))
+	if err != nil {
+		return nil, fmt.Errorf("precompress.os.Create: %w", err)
+	}
+	defer stderr.Close()
+
+	cmd := exec.CommandContext(ctx, c.brotli, "-f", "-q", "11", "-o", out, in)
+	cmd.Dir = dir
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		logged, _ := os.ReadFile(stderr.Name())
+		msg := strings.TrimSpace(string(logged))
+		if len(msg) > maxStderr {
+			msg = msg[:maxStderr]
+		}
+		return nil, fmt.Errorf("%w: %v: %s", ErrFailed, err, msg)
+	}
+
+	compressed, err := os.ReadFile(out)
+	if err != nil || len(compressed) == 0 {
+		return nil, fmt.Errorf("%w: no output", ErrFailed)
+	}
+
+	return compressed, nil
+}
+
+// Ext is appended to path of file to get path of its variant
+func Ext(encoding string) string {
+	switch encoding {
+	case Gzip:
+		return ".gz"
+	case Brotli:
+		return ".br"
+	}
+
+	return ""
+}
+
+// Negotiate returns encodings (subset of available) client accepts
+// according to Accept-Encoding header. Encodings are ordered by client's
+// preference, ties are broken by order of available
+func Negotiate(acceptEncoding string, available []string) []string {
+	if acceptEncoding == "" {
+		return nil
+	}
+
+	qualities := make(map[string]float64, len(available))
+	wildcard := -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(param, "=")
+			if !ok || strings.TrimSpace(key) != "q" {
+				continue
+			}
+
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				q = 0
+				break
+			}
+			q = parsed
+		}
+
+		if coding == "*" {
+			wildcard = q
+			continue
+		}
+		qualities[coding] = q
+	}
+
+	accepted := make([]string, 0, len(available))
+	for _, encoding := range available {
+		q, ok := qualities[encoding]
+		if !ok {
+			q = wildcard
+		}
+
+		if q > 0 {
+			accepted = append(accepted, encoding)
+			qualities[encoding] = q
+		}
+	}
+
+	sort.SliceStable(accepted, func(i, j int) bool {
+		return qualities[accepted[i]] > qualities[accepted[j]]
+	})
+
+	return accepted
+}
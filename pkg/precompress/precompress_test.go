@@ -0,0 +1,102 @@
+package precompress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func fakeBinary(t *testing.T, name, body string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	script := "#!/bin/sh\n" + body + "\n"
+	require.NoError(t, os.WriteFile(path, []byte(script), 0755))
+
+	return path
+}
+
+// brotliScript "compresses" input to its first byte, so the variant is always smaller.
+// Arguments are: -f -q 11 -o out in
+const brotliScript = `head -c 1 "$6" > "$5"`
+
+var css = []byte(strings.Repeat("body { margin: 0; padding: 0; }\n", 64))
+
+func TestCompress(t *testing.T) {
+	c := New(filepath.Join(t.TempDir(), "nope"))
+	require.Equal(t, []string{Gzip}, c.Encodings())
+
+	variants, err := c.Compress(context.Background(), css)
+	require.NoError(t, err)
+	require.Len(t, variants, 1)
+
+	zr, err := gzip.NewReader(bytes.NewReader(variants[Gzip]))
+	require.NoError(t, err)
+	plain, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	require.Equal(t, css, plain)
+
+	// Variants bigger than the file are useless
+	variants, err = c.Compress(context.Background(), []byte("a"))
+	require.NoError(t, err)
+	require.Empty(t, variants)
+
+	c = New(fakeBinary(t, "brotli", brotliScript))
+	require.Equal(t, []string{Brotli, Gzip}, c.Encodings())
+
+	variants, err = c.Compress(context.Background(), css)
+	require.NoError(t, err)
+	require.Len(t, variants, 2)
+	require.Equal(t, css[:1], variants[Brotli])
+
+	c = New(fakeBinary(t, "brotli", `echo "corrupt input" >&2; exit 1`))
+	_, err = c.Compress(context.Background(), css)
+	require.ErrorIs(t, err, ErrFailed)
+	require.Contains(t, err.Error(), "corrupt input")
+
+	c = New(fakeBinary(t, "brotli", "sleep 5"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	_, err = c.Compress(ctx, css)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestNegotiate(t *testing.T) {
+	available := []string{Brotli, Gzip}
+
+	cases := []struct {
+		accept   string
+		expected []string
+	}{
+		{"", nil},
+		{"identity", []string{}},
+		{"gzip", []string{Gzip}},
+		{"gzip, deflate, br", []string{Brotli, Gzip}},
+		{"br;q=0.5, gzip", []string{Gzip, Brotli}},
+		{"GZIP;q=1.0, br;q=0", []string{Gzip}},
+		{"*", []string{Brotli, Gzip}},
+		{"gzip;q=0.2, *;q=0.8", []string{Brotli, Gzip}},
+		{"*;q=0", []string{}},
+		{"br;q=oops, gzip", []string{Gzip}},
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.expected, Negotiate(c.accept, available), c.accept)
+	}
+
+	require.Equal(t, []string{Gzip}, Negotiate("br, gzip", []string{Gzip}))
+}
+
+func TestExt(t *testing.T) {
+	require.Equal(t, ".gz", Ext(Gzip))
+	require.Equal(t, ".br", Ext(Brotli))
+	require.Equal(t, "", Ext("deflate"))
+}
@@ -0,0 +1,63 @@
+// package singleflight deduplicates concurrent calls with the same key.
+// While a call is in flight, callers with the same key wait for it and share its result
+
+package singleflight
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrPanicked = errors.New("singleflight: function panicked")
+
+type Func func() (any, error)
+
+type call struct {
+	wg  sync.WaitGroup
+	out any
+	err error
+	// Number of callers waiting for the result (leader excluded)
+	dups int
+}
+
+type Group struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+func New() *Group {
+	return &Group{
+		calls: make(map[string]*call),
+	}
+}
+
+// Do executes f once per key at a time. Callers arriving while f is running
+// get the same out and err. shared reports whether result was given to more than one caller
+func (g *Group) Do(key string, f Func) (out any, err error, shared bool) {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		c.dups++
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.out, c.err, true
+	}
+
+	c := new(call)
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	// Release waiters even if f panics
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		shared = c.dups > 0
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+
+	// Waiters get ErrPanicked if f never returns
+	c.err = ErrPanicked
+	c.out, c.err = f()
+	return c.out, c.err, shared
+}
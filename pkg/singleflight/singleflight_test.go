@@ -0,0 +1,144 @@
+package singleflight
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDo(t *testing.T) {
+	t.Parallel()
+
+	g := New()
+
+	out, err, shared := g.Do("key", func() (any, error) {
+		return "bar", nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "bar", out)
+	require.False(t, shared)
+}
+
+func TestDoErr(t *testing.T) {
+	t.Parallel()
+
+	g := New()
+	someErr := errors.New("some error")
+
+	out, err, _ := g.Do("key", func() (any, error) {
+		return nil, someErr
+	})
+	require.ErrorIs(t, err, someErr)
+	require.Nil(t, out)
+}
+
+func TestDoDeduplicates(t *testing.T) {
+	t.Parallel()
+
+	g := New()
+
+	var calls int32
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	f := func() (any, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return "bar", nil
+	}
+
+	const n = 50
+	var (
+		wg        sync.WaitGroup
+		sharedCnt int32
+	)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		out, err, shared := g.Do("key", f)
+		require.NoError(t, err)
+		require.Equal(t, "bar", out)
+		if shared {
+			atomic.AddInt32(&sharedCnt, 1)
+		}
+	}()
+	<-started
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out, err, shared := g.Do("key", f)
+			require.NoError(t, err)
+			require.Equal(t, "bar", out)
+			if shared {
+				atomic.AddInt32(&sharedCnt, 1)
+			}
+		}()
+	}
+
+	// Let waiters join the call
+	time.Sleep(time.Millisecond * 100)
+	close(release)
+	wg.Wait()
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	require.Equal(t, int32(n+1), atomic.LoadInt32(&sharedCnt))
+}
+
+func TestDoDifferentKeys(t *testing.T) {
+	t.Parallel()
+
+	g := New()
+
+	var calls int32
+	f := func() (any, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, nil
+	}
+
+	g.Do("a", f)
+	g.Do("b", f)
+	g.Do("a", f)
+
+	require.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestDoPanic(t *testing.T) {
+	t.Parallel()
+
+	g := New()
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan error)
+
+	go func() {
+		defer func() { recover() }()
+		g.Do("key", func() (any, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+
+	go func() {
+		_, err, _ := g.Do("key", func() (any, error) {
+			return nil, nil
+		})
+		done <- err
+	}()
+
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+
+	require.ErrorIs(t, <-done, ErrPanicked)
+}
@@ -0,0 +1,208 @@
+// package usage keeps bytes and objects stored by buckets in memory.
+// Originals (uploaded files) and derivatives (rendered files, compressed variants, HLS packages)
+// are accounted separately. Tracker is filled by Scan at startup and kept up to date by writes and deletes
+
+package usage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var ErrQuotaExceeded = errors.New("bucket quota exceeded")
+
+// Kinds of stored files
+const (
+	Originals   = "originals"
+	Derivatives = "derivatives"
+)
+
+// Counter of stored files
+type Counter struct {
+	Bytes   int64 `json:"bytes"`
+	Objects int64 `json:"objects"`
+}
+
+// Usage of a single bucket
+type Usage struct {
+	Originals   Counter `json:"originals"`
+	Derivatives Counter `json:"derivatives"`
+}
+
+// Total sums originals and derivatives
+func (u Usage) Total() Counter {
+	return Counter{
+		Bytes:   u.Originals.Bytes + u.Derivatives.Bytes,
+		Objects: u.Originals.Objects + u.Derivatives.Objects,
+	}
+}
+
+func (u *Usage) counter(kind string) *Counter {
+	if kind == Originals {
+		return &u.Originals
+	}
+
+	return &u.Derivatives
+}
+
+// Limits of a bucket. Zero means no limit
+type Limits struct {
+	// Max bytes of originals and derivatives together
+	MaxBytes int64
+	// Max originals
+	MaxObjects int64
+}
+
+// ObserveFunc is called with bucket's usage after every change
+type ObserveFunc func(bucket string, u Usage)
+
+type Tracker struct {
+	mu      sync.Mutex
+	buckets map[string]*Usage
+	observe ObserveFunc
+}
+
+// New makes empty tracker. observe could be nil
+func New(observe ObserveFunc) *Tracker {
+	return &Tracker{
+		buckets: make(map[string]*Usage),
+		observe: observe,
+	}
+}
+
+// Get returns usage of bucket. Unknown buckets use nothing
+func (t *Tracker) Get(bucket string) Usage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if u, ok := t.buckets[bucket]; ok {
+		return *u
+	}
+
+	return Usage{}
+}
+
+// Set replaces usage of bucket, e.g. with the one found by Scan
+func (t *Tracker) Set(bucket string, u Usage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.buckets[bucket] = &u
+	t.notify(bucket, u)
+}
+
+// Add adds c to kind of bucket's usage. Negative c is subtracted
+func (t *Tracker) Add(bucket string, kind string, c Counter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	u := t.get(bucket)
+	counter := u.counter(kind)
+	counter.Bytes += c.Bytes
+	counter.Objects += c.Objects
+
+	// Files deleted before Scan has seen them
+	if counter.Bytes < 0 {
+		counter.Bytes = 0
+	}
+	if counter.Objects < 0 {
+		counter.Objects = 0
+	}
+
+	t.notify(bucket, *u)
+}
+
+// Reserve adds c to kind of bucket's usage if it fits limits. Reservation
+// of files never written should be given back with negative Add.
+// Derivatives count towards MaxBytes only
+func (t *Tracker) Reserve(bucket string, kind string, c Counter, limits Limits) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	u := t.get(bucket)
+	total := u.Total()
+
+	if limits.MaxBytes > 0 && total.Bytes+c.Bytes > limits.MaxBytes {
+		return fmt.Errorf("%w: %d of %d bytes are used, %d more requested", ErrQuotaExceeded, total.Bytes, limits.MaxBytes, c.Bytes)
+	}
+
+	if kind == Originals && limits.MaxObjects > 0 && u.Originals.Objects+c.Objects > limits.MaxObjects {
+		return fmt.Errorf("%w: %d of %d files are stored, %d more requested", ErrQuotaExceeded, u.Originals.Objects, limits.MaxObjects, c.Objects)
+	}
+
+	counter := u.counter(kind)
+	counter.Bytes += c.Bytes
+	counter.Objects += c.Objects
+
+	t.notify(bucket, *u)
+	return nil
+}
+
+func (t *Tracker) get(bucket string) *Usage {
+	u, ok := t.buckets[bucket]
+	if !ok {
+		u = &Usage{}
+		t.buckets[bucket] = u
+	}
+
+	return u
+}
+
+func (t *Tracker) notify(bucket string, u Usage) {
+	if t.observe != nil {
+		t.observe(bucket, u)
+	}
+}
+
+// Scan walks dir and counts files in it. classify is given path of file relative to dir
+// and returns its kind or empty string if file isn't counted.
+// Hidden files (e.g. ones being written) are skipped. Missing dir uses nothing
+func Scan(dir string, classify func(rel string) string) (Usage, error) {
+	var u Usage
+
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			// Removed while walking
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		kind := classify(filepath.ToSlash(rel))
+		if kind == "" {
+			return nil
+		}
+
+		counter := u.counter(kind)
+		counter.Bytes += info.Size()
+		counter.Objects++
+		return nil
+	})
+	if err != nil {
+		return Usage{}, fmt.Errorf("usage.Scan.filepath.WalkDir: %w", err)
+	}
+
+	return u, nil
+}
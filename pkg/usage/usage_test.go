@@ -0,0 +1,88 @@
+package usage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReserve(t *testing.T) {
+	observed := make(map[string]Usage)
+	tr := New(func(bucket string, u Usage) {
+		observed[bucket] = u
+	})
+
+	limits := Limits{MaxBytes: 100, MaxObjects: 2}
+
+	require.NoError(t, tr.Reserve("b", Originals, Counter{Bytes: 60, Objects: 1}, limits))
+	require.NoError(t, tr.Reserve("b", Derivatives, Counter{Bytes: 30, Objects: 1}, limits))
+
+	// Derivatives count towards bytes
+	err := tr.Reserve("b", Originals, Counter{Bytes: 20, Objects: 1}, limits)
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+
+	// But not towards objects
+	require.NoError(t, tr.Reserve("b", Derivatives, Counter{Bytes: 5, Objects: 1}, limits))
+	require.NoError(t, tr.Reserve("b", Originals, Counter{Bytes: 5, Objects: 1}, limits))
+
+	err = tr.Reserve("b", Originals, Counter{Bytes: 0, Objects: 1}, limits)
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+
+	want := Usage{
+		Originals:   Counter{Bytes: 65, Objects: 2},
+		Derivatives: Counter{Bytes: 35, Objects: 2},
+	}
+	require.Equal(t, want, tr.Get("b"))
+	require.Equal(t, want, observed["b"])
+	require.Equal(t, Counter{Bytes: 100, Objects: 4}, want.Total())
+
+	tr.Add("b", Originals, Counter{Bytes: -100, Objects: -1})
+	require.Equal(t, Counter{Bytes: 0, Objects: 1}, tr.Get("b").Originals)
+
+	// No limits
+	require.NoError(t, tr.Reserve("c", Originals, Counter{Bytes: 1 << 40, Objects: 1000}, Limits{}))
+	require.Equal(t, Usage{}, tr.Get("unknown"))
+}
+
+func TestScan(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"uuid1/data.png":        "12345",
+		"uuid1/abcdef":          "123",
+		"uuid1/.data.png.tmp-":  "1234567",
+		"uuid2/data.css":        "1234",
+		"uuid2/data.css.gz":     "12",
+		"uuid2/hls/master.m3u8": "1",
+		"meta":                  "123456",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0777))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0666))
+	}
+
+	u, err := Scan(dir, func(rel string) string {
+		parts := strings.Split(rel, "/")
+		switch {
+		case len(parts) == 1:
+			return ""
+		case len(parts) == 2 && strings.HasPrefix(parts[1], "data") && strings.Count(parts[1], ".") == 1:
+			return Originals
+		default:
+			return Derivatives
+		}
+	})
+	require.NoError(t, err)
+	require.Equal(t, Usage{
+		Originals:   Counter{Bytes: 9, Objects: 2},
+		Derivatives: Counter{Bytes: 6, Objects: 3},
+	}, u)
+
+	u, err = Scan(filepath.Join(dir, "nope"), func(string) string { return Originals })
+	require.NoError(t, err)
+	require.Equal(t, Usage{}, u)
+}
@@ -0,0 +1,31 @@
+;; Writes argument, "|" and stdin to stdout.
+;; 0: argc, 4: argv buffer size, 16: argv, 64: argv buffer, 2048: iovec, 2056: counts, 4096: stdin chunk
+(module
+  (import "wasi_snapshot_preview1" "fd_read" (func $fd_read (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "fd_write" (func $fd_write (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "args_sizes_get" (func $args_sizes_get (param i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "args_get" (func $args_get (param i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "proc_exit" (func $proc_exit (param i32)))
+  (memory (export "memory") 1)
+  (data (i32.const 3000) "|")
+  (func (export "_start")
+    (drop (call $args_sizes_get (i32.const 0) (i32.const 4)))
+    (drop (call $args_get (i32.const 16) (i32.const 64)))
+    ;; argv[1] up to the end of argv buffer without trailing NUL
+    (i32.store (i32.const 2048) (i32.load (i32.const 20)))
+    (i32.store (i32.const 2052)
+      (i32.sub (i32.sub (i32.add (i32.const 64) (i32.load (i32.const 4))) (i32.load (i32.const 20))) (i32.const 1)))
+    (drop (call $fd_write (i32.const 1) (i32.const 2048) (i32.const 1) (i32.const 2056)))
+    (i32.store (i32.const 2048) (i32.const 3000))
+    (i32.store (i32.const 2052) (i32.const 1))
+    (drop (call $fd_write (i32.const 1) (i32.const 2048) (i32.const 1) (i32.const 2056)))
+    (block
+      (loop
+        (i32.store (i32.const 2048) (i32.const 4096))
+        (i32.store (i32.const 2052) (i32.const 4096))
+        (drop (call $fd_read (i32.const 0) (i32.const 2048) (i32.const 1) (i32.const 2056)))
+        (br_if 1 (i32.eqz (i32.load (i32.const 2056))))
+        (i32.store (i32.const 2052) (i32.load (i32.const 2056)))
+        (drop (call $fd_write (i32.const 1) (i32.const 2048) (i32.const 1) (i32.const 2060)))
+        (br 0))))
+)
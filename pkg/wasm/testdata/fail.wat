@@ -0,0 +1,15 @@
+;; Writes "invalid argument" to stderr and exits with 1
+(module
+  (import "wasi_snapshot_preview1" "fd_read" (func $fd_read (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "fd_write" (func $fd_write (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "args_sizes_get" (func $args_sizes_get (param i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "args_get" (func $args_get (param i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "proc_exit" (func $proc_exit (param i32)))
+  (memory (export "memory") 1)
+  (data (i32.const 3000) "invalid argument")
+  (func (export "_start")
+    (i32.store (i32.const 2048) (i32.const 3000))
+    (i32.store (i32.const 2052) (i32.const 16))
+    (drop (call $fd_write (i32.const 2) (i32.const 2048) (i32.const 1) (i32.const 2056)))
+    (call $proc_exit (i32.const 1)))
+)
@@ -0,0 +1,167 @@
+// package wasm runs WebAssembly (WASI) transforms in process with wazero.
+// Transform reads file from stdin and writes result to stdout, its argument is passed
+// as the only command-line argument. It's granted neither filesystem nor network nor environment.
+// Memory of every run is limited by runtime, time is limited by context of the run
+
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+var (
+	ErrInvalid = errors.New("invalid wasm transform")
+	ErrFailed  = errors.New("wasm transform failed")
+	// Transform ran out of memory
+	ErrLimit    = errors.New("wasm transform exceeded limits")
+	ErrNoOutput = errors.New("wasm transform produced no output")
+)
+
+// Max bytes of stderr kept in error
+const maxStderr = 512
+
+// Size of WebAssembly memory page and max pages of 32-bit memory
+const (
+	pageSize = 65536
+	maxPages = 65536
+)
+
+// Function WASI command starts with
+const startFunction = "_start"
+
+// Limits of a single run. Zero means no limit
+type Limits struct {
+	// Max bytes of linear memory, rounded down to pages
+	MaxMemory int64
+}
+
+type Runtime struct {
+	runtime wazero.Runtime
+	// Max pages of linear memory of every run
+	pages uint32
+}
+
+// New starts runtime of transforms. Runs of its transforms are stopped as soon as their context is done
+func New(ctx context.Context, limits Limits) (*Runtime, error) {
+	pages := uint32(maxPages)
+	if limits.MaxMemory > 0 && limits.MaxMemory/pageSize < maxPages {
+		pages = uint32(limits.MaxMemory / pageSize)
+		if pages == 0 {
+			pages = 1
+		}
+	}
+
+	cfg := wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(pages).
+		WithCloseOnContextDone(true)
+
+	r := wazero.NewRuntimeWithConfig(ctx, cfg)
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+		_ = r.Close(ctx)
+		return nil, fmt.Errorf("wasm.New.wasi_snapshot_preview1.Instantiate: %w", err)
+	}
+
+	return &Runtime{runtime: r, pages: pages}, nil
+}
+
+// Transform is a compiled WASI command run against files
+type Transform struct {
+	runtime  *Runtime
+	name     string
+	compiled wazero.CompiledModule
+}
+
+// Compile compiles transform at module path (.wasm), so that runs don't compile it again
+func (r *Runtime) Compile(ctx context.Context, module string) (*Transform, error) {
+	binary, err := os.ReadFile(module)
+	if err != nil {
+		return nil, fmt.Errorf("wasm.Compile.os.ReadFile: %w", err)
+	}
+
+	compiled, err := r.runtime.CompileModule(ctx, binary)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalid, module, err)
+	}
+
+	if _, ok := compiled.ExportedFunctions()[startFunction]; !ok {
+		_ = compiled.Close(ctx)
+		return nil, fmt.Errorf("%w: %s: no %s function", ErrInvalid, module, startFunction)
+	}
+
+	name := strings.TrimSuffix(filepath.Base(module), filepath.Ext(module))
+
+	return &Transform{runtime: r, name: name, compiled: compiled}, nil
+}
+
+// Run applies transform to input with arg as its command-line argument
+func (t *Transform) Run(ctx context.Context, input []byte, arg string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	// Started explicitly rather than on instantiation, so that memory is examined on failure.
+	// Runs are anonymous, so that they don't conflict by name
+	cfg := wazero.NewModuleConfig().
+		WithName("").
+		WithArgs(t.name, arg).
+		WithStdin(bytes.NewReader(input)).
+		WithStdout(&stdout).
+		WithStderr(&stderr).
+		WithStartFunctions()
+
+	mod, err := t.runtime.runtime.InstantiateModule(ctx, t.compiled, cfg)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, fmt.Errorf("%w: %v", ErrFailed, err)
+	}
+	defer mod.Close(ctx)
+
+	_, err = mod.ExportedFunction(startFunction).Call(ctx)
+
+	// proc_exit(0) is a success as well
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 0 {
+		err = nil
+	}
+
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if t.outOfMemory(mod) {
+			return nil, fmt.Errorf("%w: out of memory", ErrLimit)
+		}
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > maxStderr {
+			msg = msg[:maxStderr]
+		}
+		return nil, fmt.Errorf("%w: %v: %s", ErrFailed, err, msg)
+	}
+
+	if stdout.Len() == 0 {
+		return nil, ErrNoOutput
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// outOfMemory tells whether memory of failed run can't grow anymore
+func (t *Transform) outOfMemory(mod api.Module) bool {
+	mem := mod.Memory()
+	if mem == nil {
+		return false
+	}
+
+	return uint64(mem.Size())+pageSize > uint64(t.runtime.pages)*pageSize
+}
@@ -0,0 +1,84 @@
+package wasm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Transforms of testdata are described by .wat files next to them
+
+func compile(t *testing.T, r *Runtime, name string) *Transform {
+	t.Helper()
+
+	transform, err := r.Compile(context.Background(), filepath.Join("testdata", name+".wasm"))
+	require.NoError(t, err)
+
+	return transform
+}
+
+func TestCompile(t *testing.T) {
+	r, err := New(context.Background(), Limits{})
+	require.NoError(t, err)
+
+	_, err = r.Compile(context.Background(), filepath.Join(t.TempDir(), "nope.wasm"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	invalid := filepath.Join(t.TempDir(), "invalid.wasm")
+	require.NoError(t, os.WriteFile(invalid, []byte("\x00asm"), 0644))
+	_, err = r.Compile(context.Background(), invalid)
+	require.ErrorIs(t, err, ErrInvalid)
+}
+
+func TestRun(t *testing.T) {
+	r, err := New(context.Background(), Limits{MaxMemory: 1 << 20})
+	require.NoError(t, err)
+
+	echo := compile(t, r, "echo")
+
+	out, err := echo.Run(context.Background(), []byte("input"), "16")
+	require.NoError(t, err)
+	require.Equal(t, "16|input", string(out))
+
+	out, err = echo.Run(context.Background(), []byte("input"), "")
+	require.NoError(t, err)
+	require.Equal(t, "|input", string(out))
+
+	_, err = compile(t, r, "grow").Run(context.Background(), []byte("input"), "16")
+	require.ErrorIs(t, err, ErrLimit)
+
+	_, err = compile(t, r, "fail").Run(context.Background(), []byte("input"), "0")
+	require.ErrorIs(t, err, ErrFailed)
+	require.Contains(t, err.Error(), "invalid argument")
+
+	_, err = compile(t, r, "empty").Run(context.Background(), []byte("input"), "16")
+	require.ErrorIs(t, err, ErrNoOutput)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	_, err = compile(t, r, "spin").Run(ctx, []byte("input"), "16")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestRunConcurrently(t *testing.T) {
+	r, err := New(context.Background(), Limits{MaxMemory: 1 << 20})
+	require.NoError(t, err)
+
+	echo := compile(t, r, "echo")
+
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := echo.Run(context.Background(), []byte("input"), "16")
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < cap(errs); i++ {
+		require.NoError(t, <-errs)
+	}
+}